@@ -1,4 +1,4 @@
-module parser
+module github.com/newrelic/go-easy-instrumentation/parser
 
 go 1.22.1
 
@@ -7,6 +7,7 @@ require (
 	github.com/sourcegraph/go-diff-patch v0.0.0-20240223163233-798fd1e94a8e
 	github.com/stretchr/testify v1.8.0
 	golang.org/x/tools v0.24.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -14,5 +15,4 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/mod v0.20.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
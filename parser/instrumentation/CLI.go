@@ -0,0 +1,229 @@
+package instrumentation
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Commands
+const (
+	// CommandInstrument adds New Relic instrumentation to an application.
+	CommandInstrument = "instrument"
+	// CommandRemove removes the New Relic instrumentation this tool adds from an application.
+	CommandRemove = "remove"
+	// CommandExplain describes why a function was or was not instrumented.
+	CommandExplain = "explain"
+	// CommandRollback restores the files of an application that were changed in place with the apply flag.
+	CommandRollback = "rollback"
+)
+
+// Default Values
+const (
+	defaultCommand           = CommandInstrument
+	defaultAgentVariableName = "NewRelicAgent"
+	defaultTarget            = TargetNewRelic
+	defaultPackageName       = "./..."
+	defaultPackagePath       = ""
+	defaultAppName           = ""
+	defaultDiffFileName      = "new-relic-instrumentation.diff"
+	defaultPropagation       = PropagateTxnArgument
+	defaultVerify            = true
+	defaultDropFailed        = false
+	defaultRulesFile         = ""
+	defaultReportFile        = ""
+	defaultReportFormat      = ReportFormatJSON
+	defaultProvenance        = ""
+	defaultApply             = false
+	defaultJournalDir        = ""
+	defaultReview            = false
+	defaultGit               = false
+	defaultBranch            = "new-relic-instrumentation"
+	defaultSince             = ""
+)
+
+type CLIConfig struct {
+	Command           string
+	PackagePath       string
+	PackageName       string
+	AppName           string
+	AgentVariableName string
+	DiffFile          string
+	Propagation       string
+	Target            string
+	Verify            bool
+	DropFailed        bool
+	RulesFile         string
+	Plugins           []string
+	ReportFile        string
+	ReportFormat      string
+	Provenance        string
+	ExplainFunction   string // function the explain command describes, by ID, name or file:line
+	Apply             bool
+	JournalDir        string
+	Review            bool
+	Git               bool
+	Branch            string
+	Since             string   // git ref the packages that changed since are instrumented
+	Packages          []string // patterns of the packages loaded, PackageName unless Since limits them
+}
+
+// stringList is a flag that can be set more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, strings.TrimSpace(value))
+	return nil
+}
+
+func setConfigValue(input *string, defaultValue string) string {
+	if input != nil && *input != "" {
+		return strings.TrimSpace(*input)
+	}
+	return defaultValue
+}
+
+func NewCLIConfig() *CLIConfig {
+	wd, _ := os.Getwd()
+	diffFile := filepath.Join(wd, defaultDiffFileName)
+	relativePath, _ := filepath.Rel(wd, diffFile)
+
+	cfg := &CLIConfig{
+		Command:     defaultCommand,
+		PackageName: defaultPackageName, // dont touch this
+	}
+
+	// the command is an optional first argument, followed by the flags
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cfg.Command = args[0]
+		args = args[1:]
+	}
+
+	var pathFlag = flag.String("path", defaultPackagePath, "path to package to instrument")
+	var appNameFlag = flag.String("name", defaultAppName, "configure the New Relic application name")
+	var diffFlag = flag.String("diff", relativePath, "output diff file path name")
+	var agentFlag = flag.String("agent", "", fmt.Sprintf("application variable for the New Relic agent, or the OpenTelemetry tracer provider (default %q, or %q with the otel target)", defaultAgentVariableName, defaultTracerProviderName))
+	var propagationFlag = flag.String("propagation", defaultPropagation, "how transactions are passed to traced functions: \"argument\" adds a transaction argument, \"context\" uses an existing context.Context argument when possible")
+	var targetFlag = flag.String("target", defaultTarget, "telemetry library to instrument the application with: \"newrelic\" for the New Relic Go agent, \"otel\" for OpenTelemetry")
+	var verifyFlag = flag.Bool("verify", defaultVerify, "type check the instrumented application before writing the diff, and report the changes that do not compile")
+	var dropFailedFlag = flag.Bool("drop-failed", defaultDropFailed, "leave out changes that do not compile, and instrument the application again without them")
+	var rulesFlag = flag.String("rules", defaultRulesFile, "YAML file of declarative instrumentation rules to apply in addition to the built in rules")
+	var pluginsFlag stringList
+	flag.Var(&pluginsFlag, "plugin", "executable that instruments the application in addition to the built in rules, over the JSON plugin protocol; can be repeated")
+	var reportFlag = flag.String("report", defaultReportFile, "write a report of the changes made, and of the code that could not be instrumented, to this file")
+	var reportFormatFlag = flag.String("report-format", defaultReportFormat, "format of the report: \"json\", or \"sarif\" for code scanning tools")
+	var provenanceFlag = flag.String("provenance", defaultProvenance, "show the rule each change was made by: \"map\" writes a map from each hunk of the diff to its rules next to the diff, \"comments\" adds \"// nr:\" review comments above the changes")
+	var applyFlag = flag.Bool("apply", defaultApply, "also write the changes to the files of the application in place, after backing the files up to the journal")
+	var journalFlag = flag.String("journal", defaultJournalDir, fmt.Sprintf("directory the files changed with -apply are backed up to, and the rollback command restores them from (default %q in the application)", defaultJournalDirName))
+	var reviewFlag = flag.Bool("review", defaultReview, "review each change in the terminal, and only write the changes that are accepted")
+	var gitFlag = flag.Bool("git", defaultGit, "write the changes in place on a new branch, and commit them; tracked files must not have uncommitted changes")
+	var branchFlag = flag.String("branch", defaultBranch, "branch the git flag commits the changes to")
+	var sinceFlag = flag.String("since", defaultSince, "only instrument the packages with files that changed since this git ref, and the packages that import them")
+	flag.CommandLine.Parse(args)
+
+	cfg.PackagePath = setConfigValue(pathFlag, defaultPackagePath)
+	cfg.AppName = setConfigValue(appNameFlag, defaultAppName)
+	cfg.DiffFile = setConfigValue(diffFlag, diffFile)
+	cfg.Propagation = setConfigValue(propagationFlag, defaultPropagation)
+	cfg.Target = setConfigValue(targetFlag, defaultTarget)
+	if backend := NewInstrumentationBackend(cfg.Target); backend != nil {
+		cfg.AgentVariableName = setConfigValue(agentFlag, backend.AgentVariableName())
+	}
+	cfg.Verify = *verifyFlag
+	cfg.DropFailed = *dropFailedFlag
+	cfg.RulesFile = setConfigValue(rulesFlag, defaultRulesFile)
+	cfg.Plugins = pluginsFlag
+	cfg.ReportFile = setConfigValue(reportFlag, defaultReportFile)
+	cfg.ReportFormat = setConfigValue(reportFormatFlag, defaultReportFormat)
+	cfg.Provenance = setConfigValue(provenanceFlag, defaultProvenance)
+	if cfg.Command == CommandExplain {
+		cfg.ExplainFunction = strings.TrimSpace(flag.Arg(0))
+	}
+	cfg.Apply = *applyFlag
+	cfg.Review = *reviewFlag
+	cfg.JournalDir = setConfigValue(journalFlag, filepath.Join(cfg.PackagePath, defaultJournalDirName))
+	cfg.Git = *gitFlag
+	cfg.Branch = setConfigValue(branchFlag, defaultBranch)
+	cfg.Since = setConfigValue(sinceFlag, defaultSince)
+	cfg.Packages = []string{cfg.PackageName}
+
+	cfg.Validate()
+	return cfg
+}
+
+func (cfg *CLIConfig) Validate() {
+	switch cfg.Command {
+	case CommandInstrument, CommandRemove, CommandExplain, CommandRollback:
+	default:
+		log.Fatalf("unknown command %q, the command must be %q, %q, %q or %q", cfg.Command, CommandInstrument, CommandRemove, CommandExplain, CommandRollback)
+	}
+	if cfg.Command == CommandExplain && cfg.ExplainFunction == "" {
+		log.Fatalf("the %s command takes a function, or a file:line in one, after its flags", CommandExplain)
+	}
+	if cfg.PackagePath == "" {
+		log.Fatal("path flag is required")
+	}
+	_, err := os.Stat(cfg.PackagePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Propagation != PropagateTxnArgument && cfg.Propagation != PropagateTxnContext {
+		log.Fatalf("propagation flag must be %q or %q", PropagateTxnArgument, PropagateTxnContext)
+	}
+	if NewInstrumentationBackend(cfg.Target) == nil {
+		log.Fatalf("target flag must be %q or %q", TargetNewRelic, TargetOpenTelemetry)
+	}
+	if cfg.Command == CommandRemove && cfg.Target != TargetNewRelic {
+		log.Fatalf("the %s command only removes %q instrumentation", CommandRemove, TargetNewRelic)
+	}
+	if cfg.Command == CommandRemove && len(cfg.Plugins) > 0 {
+		log.Fatalf("the %s command does not run plugins", CommandRemove)
+	}
+	if cfg.ReportFormat != ReportFormatJSON && cfg.ReportFormat != ReportFormatSARIF {
+		log.Fatalf("report-format flag must be %q or %q", ReportFormatJSON, ReportFormatSARIF)
+	}
+	if cfg.Provenance != "" && cfg.Provenance != ProvenanceMap && cfg.Provenance != ProvenanceComments {
+		log.Fatalf("provenance flag must be %q or %q", ProvenanceMap, ProvenanceComments)
+	}
+	if cfg.Command == CommandRemove && cfg.Provenance != "" {
+		log.Fatalf("the %s command does not show provenance", CommandRemove)
+	}
+	if cfg.Command == CommandRemove && cfg.ReportFile != "" {
+		log.Fatalf("the %s command does not write a report", CommandRemove)
+	}
+	if cfg.Command == CommandExplain && len(cfg.Plugins) > 0 {
+		log.Fatalf("the %s command does not run plugins", CommandExplain)
+	}
+	if cfg.Command == CommandExplain && (cfg.Provenance != "" || cfg.ReportFile != "") {
+		log.Fatalf("the %s command does not write a diff, its provenance or a report", CommandExplain)
+	}
+	if cfg.Apply && cfg.Command != CommandInstrument && cfg.Command != CommandRemove {
+		log.Fatalf("the apply flag can only be used with the %s and %s commands", CommandInstrument, CommandRemove)
+	}
+	if cfg.Command == CommandRollback && (len(cfg.Plugins) > 0 || cfg.Provenance != "" || cfg.ReportFile != "") {
+		log.Fatalf("the %s command only restores files from the journal", CommandRollback)
+	}
+	if cfg.Review && cfg.Command != CommandInstrument {
+		log.Fatalf("the review flag can only be used with the %s command", CommandInstrument)
+	}
+	if cfg.Git && cfg.Command != CommandInstrument {
+		log.Fatalf("the git flag can only be used with the %s command", CommandInstrument)
+	}
+	if cfg.Git && cfg.Apply {
+		log.Fatal("the git and apply flags both write the changes in place, use only one of them")
+	}
+	if cfg.Since != "" && cfg.Command == CommandRollback {
+		log.Fatalf("the %s command restores every file in the journal, it does not take the since flag", CommandRollback)
+	}
+	if cfg.DropFailed && !cfg.Verify {
+		log.Fatal("drop-failed flag requires verify")
+	}
+}
@@ -0,0 +1,719 @@
+package instrumentation
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+func panicOnError(errVariableName string) *dst.IfStmt {
+	return &dst.IfStmt{
+		Cond: &dst.BinaryExpr{
+			X: &dst.Ident{
+				Name: errVariableName,
+			},
+			Op: token.NEQ,
+			Y: &dst.Ident{
+				Name: "nil",
+			},
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{
+				&dst.ExprStmt{
+					X: &dst.CallExpr{
+						Fun: &dst.Ident{
+							Name: "panic",
+						},
+						Args: []dst.Expr{
+							&dst.Ident{
+								Name: errVariableName,
+							},
+						},
+					},
+				},
+			},
+		},
+		Decs: dst.IfStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+}
+
+func createAgentAST(AppName, AgentVariableName, errVariableName string) []dst.Stmt {
+	newappArgs := []dst.Expr{
+		&dst.CallExpr{
+			Fun: &dst.Ident{
+				Path: newrelicAgentImport,
+				Name: "ConfigFromEnvironment",
+			},
+		},
+	}
+	if AppName != "" {
+		AppName = "\"" + AppName + "\""
+		newappArgs = append([]dst.Expr{&dst.CallExpr{
+			Fun: &dst.Ident{
+				Path: newrelicAgentImport,
+				Name: "ConfigAppName",
+			},
+			Args: []dst.Expr{
+				&dst.BasicLit{
+					Kind:  token.STRING,
+					Value: AppName,
+				},
+			},
+		}}, newappArgs...)
+	}
+
+	agentInit := &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			&dst.Ident{
+				Name: AgentVariableName,
+			},
+			&dst.Ident{
+				Name: errVariableName,
+			},
+		},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: "NewApplication",
+					Path: newrelicAgentImport,
+				},
+				Args: newappArgs,
+			},
+		},
+	}
+
+	return []dst.Stmt{agentInit, panicOnError(errVariableName)}
+}
+
+func shutdownAgent(AgentVariableName string) *dst.ExprStmt {
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X: &dst.Ident{
+					Name: AgentVariableName,
+				},
+				Sel: &dst.Ident{
+					Name: "Shutdown",
+				},
+			},
+			Args: []dst.Expr{
+				&dst.BinaryExpr{
+					X: &dst.BasicLit{
+						Kind:  token.INT,
+						Value: "5",
+					},
+					Op: token.MUL,
+					Y: &dst.Ident{
+						Name: "Second",
+						Path: "time",
+					},
+				},
+			},
+		},
+		Decs: dst.ExprStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				Before: dst.EmptyLine,
+			},
+		},
+	}
+}
+
+func startTransaction(appVariableName, transactionVariableName, transactionName string, overwriteVariable bool) *dst.AssignStmt {
+	tok := token.DEFINE
+	if overwriteVariable {
+		tok = token.ASSIGN
+	}
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(transactionVariableName)},
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf(`"%s"`, transactionName),
+					},
+				},
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(appVariableName),
+					Sel: dst.NewIdent("StartTransaction"),
+				},
+			},
+		},
+		Tok: tok,
+	}
+}
+
+func endTransaction(transactionVariableName string) *dst.ExprStmt {
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(transactionVariableName),
+				Sel: dst.NewIdent("End"),
+			},
+		},
+	}
+}
+
+// InstrumentMain looks for the main method of a program, and uses this as an instrumentation initialization and injection point
+func InstrumentMain(mainFunctionNode dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	txnStarted := false
+	if decl, ok := mainFunctionNode.(*dst.FuncDecl); ok {
+		// only inject go agent into the main.main function
+		if decl.Name.Name == "main" && decl.Recv == nil {
+			if manager.ChangeDropped(ruleAgent, decl) {
+				return
+			}
+			mainEntryPoint := &entryPoint{function: manager.functionID(decl)}
+			manager.entryPoint = mainEntryPoint
+			defer func() { manager.entryPoint = nil }()
+
+			txnVarName := manager.FunctionVariableName(decl, manager.Backend().TransactionVariableName())
+			spanVarName := manager.SpanVariableName(decl)
+			if agent := manager.existing.agentVariable; agent != "" {
+				// the application already creates an agent
+				manager.agentVariableName = agent
+			} else {
+				// the agent variable is only referred to in main, so it can be renamed if its name is taken there
+				manager.agentVariableName = manager.FunctionVariableName(decl, manager.agentVariableName)
+				agentDecl := manager.Backend().CreateAgent(manager.appName, manager.agentVariableName, func(name string) string {
+					return manager.FunctionVariableName(decl, name)
+				})
+				shutdown := manager.Backend().ShutdownAgent(manager.agentVariableName)
+				decl.Body.List = append(agentDecl, decl.Body.List...)
+				decl.Body.List = append(decl.Body.List, shutdown)
+
+				nodes := []dst.Node{shutdown}
+				for _, stmt := range agentDecl {
+					nodes = append(nodes, stmt)
+				}
+				manager.RecordChange(ruleAgent, decl, nodes...)
+				manager.AddImports(nodes...)
+			}
+
+			newMain := dstutil.Apply(decl, func(c *dstutil.Cursor) bool {
+				node := c.Node()
+				switch v := node.(type) {
+				case *dst.ExprStmt:
+					if !manager.ChangeDropped(ruleTransaction, v) {
+						rootPkg := manager.currentPackage
+						// a call through an interface or function value may invoke more than one function
+						invocations := manager.GetOutermostInvocations(v)
+						// roots start a transaction even if the function they call is not passed one
+						txnName, isRoot := manager.transactionRoots[v]
+						if !isRoot && len(invocations) > 0 {
+							txnName = invocations[0].functionName
+						}
+						txnName = manager.changeName(ruleTransaction, v, txnName)
+						manager.entryPoint = &entryPoint{function: mainEntryPoint.function, transaction: txnName}
+						passed := false
+						for _, invInfo := range invocations {
+							// check if the called function has been instrumented already, if not, instrument it.
+							if manager.ShouldInstrumentFunction(invInfo) {
+								manager.SetPackage(invInfo.packageName)
+								decl := manager.GetDeclaration(invInfo.functionID)
+								calleeTxnName := manager.TransactionName(decl)
+								_, wasModified := TraceFunction(manager, decl, calleeTxnName)
+								if wasModified && manager.ExistingTransactionName(decl) == "" {
+									// pass the transaction to the declaration
+									manager.AddTxnToFunctionDecl(decl, calleeTxnName)
+									manager.AddImports(manager.Backend().TransactionType())
+									manager.RecordChange(ruleTraceFunction, decl, decl.Type)
+								}
+								manager.SetPackage(rootPkg)
+							}
+							// pass the called function a transaction if needed
+							if c.Index() >= 0 && !manager.IsInstrumented(v) && passTransaction(manager, invInfo, txnVarName, "", false) {
+								passed = true
+							}
+						}
+						// always check c.Index >= 0 to avoid panics when using c.Insert methods
+						if c.Index() >= 0 && !manager.IsInstrumented(v) && (passed || isRoot) {
+							start := manager.Backend().StartTransaction(manager.agentVariableName, txnVarName, spanVarName, txnName, manager.GetPackageName(), txnStarted)
+							end := manager.Backend().EndTransaction(txnVarName, spanVarName)
+							c.InsertBefore(start)
+							c.InsertAfter(end)
+							manager.recordNamedChange(ruleTransaction, txnName, v, start, end)
+							manager.AddImports(start, end)
+							txnStarted = true
+						}
+						manager.entryPoint = mainEntryPoint
+					}
+					WrapHandleFunc(v.X, manager, c)
+				}
+
+				return true
+			}, nil)
+			// this will skip the tracing of this function in the outer tree walking algorithm
+			c.Replace(newMain)
+		}
+	}
+}
+
+// AddTransactionRoot makes stmt, a call statement in main, the root of a background transaction named name. InstrumentMain
+// starts the transaction before the statement and ends it after, whether the called function is traced or not. Rules
+// that add roots must be applied to main before InstrumentMain.
+func (m *InstrumentationManager) AddTransactionRoot(stmt *dst.ExprStmt, name string) {
+	if m.transactionRoots == nil {
+		m.transactionRoots = map[dst.Stmt]string{}
+	}
+	m.transactionRoots[stmt] = name
+}
+
+func txnAsParameter(txnName string, txnType dst.Expr) *dst.Field {
+	return &dst.Field{
+		Names: []*dst.Ident{
+			{
+				Name: txnName,
+			},
+		},
+		Type: txnType,
+	}
+}
+
+func deferSegment(segmentName, txnVarName string) *dst.DeferStmt {
+	return &dst.DeferStmt{
+		Call: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X: &dst.CallExpr{
+					Fun: &dst.SelectorExpr{
+						X: dst.NewIdent(txnVarName),
+						Sel: &dst.Ident{
+							Name: "StartSegment",
+						},
+					},
+					Args: []dst.Expr{
+						&dst.BasicLit{
+							Kind:  token.STRING,
+							Value: fmt.Sprintf(`"%s"`, segmentName),
+						},
+					},
+				},
+				Sel: &dst.Ident{
+					Name: "End",
+				},
+			},
+		},
+	}
+}
+
+// takeBeforeDecorations returns the decorations before a statement, and removes them from it, so that they can be moved
+// to a statement inserted before it.
+func takeBeforeDecorations(nodeDecs *dst.NodeDecs) dst.NodeDecs {
+	if nodeDecs == nil {
+		return dst.NodeDecs{}
+	}
+	decs := dst.NodeDecs{
+		Before: nodeDecs.Before,
+		Start:  nodeDecs.Start,
+	}
+	nodeDecs.Before = dst.None
+	nodeDecs.Start.Clear()
+	return decs
+}
+
+// startSegment creates a statement that starts a segment named segmentName, and assigns it to segmentVarName:
+// segmentVarName := txnVarName.StartSegment("segmentName")
+func startSegment(txnVarName, segmentVarName, segmentName string, nodeDecs *dst.NodeDecs) *dst.AssignStmt {
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(segmentVarName)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(txnVarName),
+					Sel: dst.NewIdent("StartSegment"),
+				},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf("%q", segmentName),
+					},
+				},
+			},
+		},
+		Decs: dst.AssignStmtDecorations{NodeDecs: takeBeforeDecorations(nodeDecs)},
+	}
+}
+
+// startDatastoreSegment creates a statement that starts a datastore segment, and assigns it to segmentVarName. The
+// name of the segment is its operation, and fields that are not set are left out:
+//
+//	segmentVarName := newrelic.DatastoreSegment{
+//		StartTime:  txnVarName.StartSegmentNow(),
+//		Product:    "Product",
+//		Collection: "Collection",
+//		Operation:  "Name",
+//	}
+func startDatastoreSegment(txnVarName, segmentVarName string, segment CallSegment, nodeDecs *dst.NodeDecs) *dst.AssignStmt {
+	field := func(name string, value dst.Expr) *dst.KeyValueExpr {
+		return &dst.KeyValueExpr{
+			Key:   dst.NewIdent(name),
+			Value: value,
+			Decs: dst.KeyValueExprDecorations{
+				NodeDecs: dst.NodeDecs{Before: dst.NewLine, After: dst.NewLine},
+			},
+		}
+	}
+	fields := []dst.Expr{
+		field("StartTime", &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(txnVarName),
+				Sel: dst.NewIdent("StartSegmentNow"),
+			},
+		}),
+	}
+	for _, f := range []struct{ name, value string }{
+		{"Product", segment.Product},
+		{"Collection", segment.Collection},
+		{"Operation", segment.Name},
+	} {
+		if f.value != "" {
+			fields = append(fields, field(f.name, &dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", f.value)}))
+		}
+	}
+
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(segmentVarName)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CompositeLit{
+				Type: &dst.Ident{
+					Name: "DatastoreSegment",
+					Path: newrelicAgentImport,
+				},
+				Elts: fields,
+			},
+		},
+		Decs: dst.AssignStmtDecorations{NodeDecs: takeBeforeDecorations(nodeDecs)},
+	}
+}
+
+// contextWithTxn wraps a context expression so that it carries the transaction txn.
+func contextWithTxn(ctx, txn dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: "NewContext",
+			Path: newrelicAgentImport,
+		},
+		Args: []dst.Expr{
+			ctx,
+			txn,
+		},
+	}
+}
+
+// passTransaction passes the transaction txnVarName to the function invoked by invInfo if it requires one, either as a new
+// argument or in its context argument. Async invocations are passed a transaction for a new goroutine. Invocations that are
+// passed txnContextName, the context the calling function got its transaction from, already carry it, unless they are async
+// and the backend needs a new transaction for the goroutine.
+//
+// Returns true if the invoked function requires a transaction from the caller.
+func passTransaction(manager *InstrumentationManager, invInfo *invocationInfo, txnVarName, txnContextName string, async bool) bool {
+	if invInfo != nil && manager.IsInstrumented(invInfo.call) {
+		manager.explainInvocation(invInfo, "the call is passed a transaction already")
+		return true
+	}
+	if invInfo != nil && manager.explaining(invInfo.functionID) {
+		_, requiresContext := manager.RequiresTransactionContext(invInfo)
+		requiresArgument := manager.RequiresTransactionArgument(invInfo, txnVarName)
+		manager.explainInvocation(invInfo, "RequiresTransactionContext is %t, RequiresTransactionArgument is %t", requiresContext, requiresArgument)
+	}
+
+	var txn dst.Expr = dst.NewIdent(txnVarName)
+	if async {
+		txn = manager.Backend().NewGoroutine(txnVarName)
+	}
+
+	if index, ok := manager.RequiresTransactionContext(invInfo); ok {
+		ctx := invInfo.call.Args[index]
+		if ident, ok := ctx.(*dst.Ident); ok && (!async || manager.Backend().ContextIsTransaction()) && ident.Path == "" && ident.Name == txnContextName {
+			return true
+		}
+		invInfo.call.Args[index] = manager.Backend().ContextWithTransaction(ctx, txn)
+		manager.AddImports(invInfo.call.Args[index])
+		manager.RecordChange(ruleTraceFunction, manager.invokedDeclaration(invInfo), invInfo.call)
+		return true
+	}
+
+	if manager.RequiresTransactionArgument(invInfo, txnVarName) {
+		if name := manager.TracedFunctionName(invInfo); name != "" {
+			renameCall(invInfo.call, name)
+		}
+		invInfo.call.Args = append(invInfo.call.Args, txn)
+		manager.RecordChange(ruleTraceFunction, manager.invokedDeclaration(invInfo), invInfo.call)
+		return true
+	}
+	return false
+}
+
+// renameCall changes the name of the function or method invoked by call.
+func renameCall(call *dst.CallExpr, name string) {
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		fun.Name = name
+	case *dst.SelectorExpr:
+		fun.Sel.Name = name
+	}
+}
+
+func txnNewGoroutine(txnVarName string) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X: &dst.Ident{
+				Name: txnVarName,
+			},
+			Sel: &dst.Ident{
+				Name: "NewGoroutine",
+			},
+		},
+	}
+}
+
+func isNamedError(n *types.Named) bool {
+	o := n.Obj()
+	return o != nil && o.Pkg() == nil && o.Name() == "error"
+}
+
+func errorReturns(v *dst.CallExpr, pkg *decorator.Package) (int, bool) {
+	if pkg == nil {
+		return 0, false
+	}
+
+	astCall, ok := pkg.Decorator.Ast.Nodes[v]
+	if ok {
+		ty := pkg.TypesInfo.TypeOf(astCall.(*ast.CallExpr))
+		switch n := ty.(type) {
+		case *types.Named:
+			if isNamedError(n) {
+				return 0, true
+			}
+		case *types.Tuple:
+			for i := 0; i < n.Len(); i++ {
+				t := n.At(i).Type()
+				switch e := t.(type) {
+				case *types.Named:
+					if isNamedError(e) {
+						return i, true
+					}
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func isNewRelicMethod(call *dst.CallExpr) bool {
+	if sel, ok := call.Fun.(*dst.SelectorExpr); ok {
+		if pkg, ok := sel.X.(*dst.Ident); ok {
+			return pkg.Name == "newrelic"
+		}
+	}
+	return false
+}
+
+func txnNoticeError(errVariableName, txnName string, nodeDecs *dst.NodeDecs) *dst.ExprStmt {
+	// copy all decs below the current statement into this statement
+	decs := dst.ExprStmtDecorations{
+		NodeDecs: dst.NodeDecs{
+			After: nodeDecs.After,
+			End:   nodeDecs.End,
+		},
+	}
+
+	// remove coppied decs from above node
+	nodeDecs.After = dst.None
+	nodeDecs.End.Clear()
+
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X: &dst.Ident{
+					Name: txnName,
+				},
+				Sel: &dst.Ident{
+					Name: "NoticeError",
+				},
+			},
+			Args: []dst.Expr{
+				&dst.Ident{
+					Name: errVariableName,
+				},
+			},
+		},
+		Decs: decs,
+	}
+}
+
+func findErrorVariable(stmt *dst.AssignStmt, pkg *decorator.Package) string {
+	if len(stmt.Rhs) == 1 {
+		if call, ok := stmt.Rhs[0].(*dst.CallExpr); ok {
+			if !isNewRelicMethod(call) {
+				if errIndex, ok := errorReturns(call, pkg); ok {
+					expr := stmt.Lhs[errIndex]
+					if ident, ok := expr.(*dst.Ident); ok && ident.Name != "_" {
+						return ident.Name
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// StatefulTracingFunction is a function that instruments a statement of a function traced with the transaction
+// tracingName. It returns true if the statement was instrumented.
+type StatefulTracingFunction func(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, tracingName string) bool
+
+// NoticeError will check for the presence of an error.Error variable in the body at the index in bodyIndex.
+// If it finds that an error is returned, it will add a line after the assignment statement to capture an error
+// with a newrelic transaction. All transactions are assumed to be named "txn"
+func NoticeError(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+	switch nodeVal := stmt.(type) {
+	case *dst.AssignStmt:
+		errVar := findErrorVariable(nodeVal, manager.GetDecoratorPackage())
+		if errVar != "" && c.Index() >= 0 && !manager.IsInstrumented(nodeVal) && !manager.ChangeDropped(ruleNoticeError, nodeVal) {
+			noticeError := manager.Backend().NoticeError(errVar, txnName, nodeVal.Decorations())
+			c.InsertAfter(noticeError)
+			manager.RecordChange(ruleNoticeError, nodeVal, noticeError)
+			manager.AddImports(noticeError)
+			return true
+		}
+	}
+	return false
+}
+
+// traceCallee starts a segment named segmentName in decl, a function that was traced with the transaction txnVarName,
+// and passes it that transaction. Functions that were already passed a transaction, or already start a segment, are
+// not changed again.
+func traceCallee(manager *InstrumentationManager, decl *dst.FuncDecl, segmentName, txnVarName string) {
+	nodes := []dst.Node{}
+	imports := []dst.Node{}
+	name := ""
+	if !manager.HasSegment(decl) {
+		name = manager.changeName(ruleTraceFunction, decl, segmentName)
+		segment := manager.Backend().StartSegment(txnVarName, manager.SpanVariableName(decl), name, manager.GetPackageName())
+		decl.Body.List = append(segment, decl.Body.List...)
+		for _, stmt := range segment {
+			nodes = append(nodes, stmt)
+			imports = append(imports, stmt)
+		}
+	}
+	if manager.ExistingTransactionName(decl) == "" {
+		manager.AddTxnToFunctionDecl(decl, txnVarName)
+		nodes = append(nodes, decl.Type)
+		imports = append(imports, manager.Backend().TransactionType())
+	}
+	if len(nodes) > 0 {
+		manager.AddImports(imports...)
+		manager.recordNamedChange(ruleTraceFunction, name, decl, nodes...)
+	}
+}
+
+// TraceFunction adds tracing to a function. This includes error capture, and passing agent metadata to relevant functions and services.
+// Traces all called functions inside the current package as well.
+// This function returns a FuncDecl object pointer that contains the potentially modified version of the FuncDecl object, fn, passed. If
+// the bool field is true, then the function was modified, and requires a transaction most likely.
+func TraceFunction(manager *InstrumentationManager, fn *dst.FuncDecl, txnVarName string) (*dst.FuncDecl, bool) {
+	TopLevelFunctionChanged := false
+	// mark the function before walking its body so that recursive calls do not trace it again
+	manager.StartTracingFunction(fn)
+	manager.callChain = append(manager.callChain, manager.functionID(fn))
+	defer func() { manager.callChain = manager.callChain[:len(manager.callChain)-1] }()
+	txnContextName := manager.TransactionContextName(fn)
+	statefulRules := manager.Rules().statefulRules(manager.importsPackage)
+	outputNode := dstutil.Apply(fn, nil, func(c *dstutil.Cursor) bool {
+		n := c.Node()
+		switch v := n.(type) {
+		case *dst.GoStmt:
+			switch fun := v.Call.Fun.(type) {
+			case *dst.FuncLit:
+				if manager.IsInstrumented(v) || manager.ChangeDropped(ruleAsyncLiteral, v) {
+					return true
+				}
+				// Add threaded txn to function arguments and parameters
+				fun.Type.Params.List = append(fun.Type.Params.List, txnAsParameter(txnVarName, manager.Backend().TransactionType()))
+				v.Call.Args = append(v.Call.Args, manager.Backend().NewGoroutine(txnVarName))
+
+				// create async segment
+				name := manager.changeName(ruleAsyncLiteral, v, "async literal")
+				segment := manager.Backend().StartSegment(txnVarName, manager.SpanVariableName(fn), name, manager.GetPackageName())
+				fun.Body.List = append(segment, fun.Body.List...)
+				manager.recordNamedChange(ruleAsyncLiteral, name, v, v.Call)
+				manager.AddImports(manager.Backend().TransactionType())
+				for _, stmt := range segment {
+					manager.AddImports(stmt)
+				}
+				c.Replace(v)
+				TopLevelFunctionChanged = true
+			default:
+				rootPkg := manager.currentPackage
+				for _, invInfo := range manager.GetOutermostInvocations(v.Call) {
+					if manager.ShouldInstrumentFunction(invInfo) {
+						manager.SetPackage(invInfo.packageName)
+						decl := manager.GetDeclaration(invInfo.functionID)
+						calleeTxnName := manager.TransactionName(decl)
+						TraceFunction(manager, decl, calleeTxnName)
+						traceCallee(manager, decl, fmt.Sprintf("async %s", invInfo.functionName), calleeTxnName)
+					}
+					if passTransaction(manager, invInfo, txnVarName, txnContextName, true) {
+						c.Replace(v)
+						TopLevelFunctionChanged = true
+					}
+					manager.SetPackage(rootPkg)
+				}
+
+			}
+		case dst.Stmt:
+			downstreamFunctionTraced := false
+			rootPkg := manager.currentPackage
+			for _, invInfo := range manager.GetPackageFunctionInvocations(v) {
+				if manager.ShouldInstrumentFunction(invInfo) {
+					manager.SetPackage(invInfo.packageName)
+					decl := manager.GetDeclaration(invInfo.functionID)
+					calleeTxnName := manager.TransactionName(decl)
+					_, traced := TraceFunction(manager, decl, calleeTxnName)
+					if traced {
+						traceCallee(manager, decl, invInfo.functionName, calleeTxnName)
+						downstreamFunctionTraced = true
+					}
+				}
+				if passTransaction(manager, invInfo, txnVarName, txnContextName, false) {
+					TopLevelFunctionChanged = true
+				}
+				if invInfo != nil && manager.IsInstrumented(invInfo.call) {
+					// the function was traced when the application was instrumented before
+					downstreamFunctionTraced = true
+				}
+				manager.SetPackage(rootPkg)
+			}
+			if !downstreamFunctionTraced {
+				ok := NoticeError(manager, v, c, txnVarName)
+				if ok {
+					TopLevelFunctionChanged = true
+				}
+			}
+			for _, stmtFunc := range statefulRules {
+				ok := stmtFunc(manager, v, c, txnVarName)
+				if ok {
+					TopLevelFunctionChanged = true
+				}
+			}
+		}
+		return true
+	})
+
+	// update the stored declaration, marking it as traced
+	decl := outputNode.(*dst.FuncDecl)
+	manager.UpdateFunctionDeclaration(decl)
+	return decl, TopLevelFunctionChanged
+}
@@ -0,0 +1,266 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+// countSegments returns the number of deferred segments started at the top of a function body.
+func countSegments(decl *dst.FuncDecl) int {
+	count := 0
+	for _, stmt := range decl.Body.List {
+		deferStmt, ok := stmt.(*dst.DeferStmt)
+		if !ok {
+			continue
+		}
+		dst.Inspect(deferStmt, func(n dst.Node) bool {
+			sel, ok := n.(*dst.SelectorExpr)
+			if ok && sel.Sel.Name == "StartSegment" {
+				count++
+			}
+			return true
+		})
+	}
+	return count
+}
+
+// countTxnArguments returns the number of calls to the named function in decl, and how many of them are passed txnName.
+func countTxnArguments(decl *dst.FuncDecl, funcName, txnName string) (int, int) {
+	calls, withTxn := 0, 0
+	dst.Inspect(decl.Body, func(n dst.Node) bool {
+		call, ok := n.(*dst.CallExpr)
+		if !ok {
+			return true
+		}
+		ident, ok := call.Fun.(*dst.Ident)
+		if ok && ident.Name == funcName {
+			calls++
+			if containsTransactionArgument(call, txnName) {
+				withTxn++
+			}
+		}
+		return true
+	})
+	return calls, withTxn
+}
+
+func Test_TraceFunction_recursion(t *testing.T) {
+	code := `
+package main
+
+import "errors"
+
+func fib(n int) (int, error) {
+	if n < 0 {
+		return 0, errors.New("negative")
+	}
+	if n < 2 {
+		return n, nil
+	}
+	a, err := fib(n - 1)
+	if err != nil {
+		return 0, err
+	}
+	b, err := fib(n - 2)
+	return a + b, err
+}
+
+func ping(n int) error {
+	if n == 0 {
+		return errors.New("done")
+	}
+	return pong(n - 1)
+}
+
+func pong(n int) error {
+	return ping(n)
+}
+
+func walk(n int) {
+	if n > 0 {
+		walk(n - 1)
+	}
+}
+
+func run() {
+	fib(10)
+	ping(3)
+	walk(2)
+}
+
+func main() {
+	run()
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+
+	decl := manager.GetDeclaration(testAppPackage + ".run")
+	_, modified := TraceFunction(manager, decl, "nrTxn")
+	assert.True(t, modified)
+
+	tests := []struct {
+		name    string
+		callees []string
+	}{
+		{name: "fib", callees: []string{"fib"}},
+		{name: "ping", callees: []string{"pong"}},
+		{name: "pong", callees: []string{"ping"}},
+		{name: "walk", callees: []string{"walk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decl := manager.GetDeclaration(testAppPackage + "." + tt.name)
+			assert.Equal(t, 1, countSegments(decl), "function must contain exactly one segment")
+			assert.True(t, manager.ShouldInstrumentFunction(&invocationInfo{packageName: testAppPackage, functionID: testAppPackage + "." + tt.name}) == false)
+
+			params := decl.Type.Params.List
+			assert.Equal(t, "nrTxn", params[len(params)-1].Names[0].Name, "function must have a transaction parameter")
+
+			for _, callee := range tt.callees {
+				calls, withTxn := countTxnArguments(decl, callee, "nrTxn")
+				assert.NotZero(t, calls)
+				assert.Equal(t, calls, withTxn, "every call to %s must be passed a transaction", callee)
+			}
+		})
+	}
+}
+
+func Test_TraceFunction_contextPropagation(t *testing.T) {
+	code := `
+package main
+
+import (
+	"context"
+	"strconv"
+)
+
+func parse(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	return n, err
+}
+
+func load(ctx context.Context, key string) (int, error) {
+	return parse(key)
+}
+
+func process(ctx context.Context, key string) error {
+	_, err := load(ctx, key)
+	go load(ctx, key)
+	return err
+}
+
+func run() {
+	process(context.Background(), "1")
+}
+
+func main() {
+	run()
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	manager.propagation = PropagateTxnContext
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+
+	_, modified := TraceFunction(manager, manager.GetDeclaration(testAppPackage+".run"), "nrTxn")
+	assert.True(t, modified)
+
+	// functions that accept a context get their transaction from it
+	for _, name := range []string{"process", "load"} {
+		decl := manager.GetDeclaration(testAppPackage + "." + name)
+		assert.Len(t, decl.Type.Params.List, 2, "%s must not be passed a transaction argument", name)
+		assert.Equal(t, defineTxnFromContext("nrTxn", dst.NewIdent("ctx")), decl.Body.List[0], "%s must define a transaction from its context", name)
+		assert.Equal(t, 1, countSegments(decl))
+	}
+
+	// functions without a context fall back to a transaction argument
+	parse := manager.GetDeclaration(testAppPackage + ".parse")
+	assert.Len(t, parse.Type.Params.List, 2)
+	assert.Equal(t, "nrTxn", parse.Type.Params.List[1].Names[0].Name)
+
+	// the context passed by a traced function already carries its transaction, unless it starts a goroutine
+	process := manager.GetDeclaration(testAppPackage + ".process")
+	load := process.Body.List[2].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr)
+	assert.Equal(t, "ctx", load.Args[0].(*dst.Ident).Name)
+	goLoad := process.Body.List[3].(*dst.GoStmt).Call
+	assert.True(t, containsTransactionContext(goLoad.Args[0]))
+	assert.Equal(t, txnNewGoroutine("nrTxn"), goLoad.Args[0].(*dst.CallExpr).Args[1])
+
+	// the context passed by the transaction root must carry the transaction
+	run := manager.GetDeclaration(testAppPackage + ".run")
+	call := run.Body.List[0].(*dst.ExprStmt).X.(*dst.CallExpr)
+	assert.Len(t, call.Args, 2)
+	assert.True(t, containsTransactionContext(call.Args[0]))
+}
+
+func Test_TraceFunction_signatureBound(t *testing.T) {
+	code := `
+package main
+
+import "strconv"
+
+type loader interface {
+	Load(key string) (int, error)
+}
+
+type store struct{}
+
+func (s *store) Load(key string) (int, error) {
+	n, err := strconv.Atoi(key)
+	return n, err
+}
+
+func run() {
+	s := &store{}
+	s.Load("1")
+	var l loader = s
+	l.Load("2")
+}
+
+func main() {
+	run()
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+
+	_, modified := TraceFunction(manager, manager.GetDeclaration(testAppPackage+".run"), "nrTxn")
+	assert.True(t, modified)
+
+	// the traced method is renamed and passed a transaction
+	traced := manager.GetDeclaration("(*" + testAppPackage + ".store).Load")
+	assert.Equal(t, "LoadWithTxn", traced.Name.Name)
+	assert.Len(t, traced.Type.Params.List, 2)
+
+	// a wrapper with the original signature still satisfies the interface
+	var wrapper *dst.FuncDecl
+	for _, decl := range manager.GetDecoratorPackage().Syntax[0].Decls {
+		if fn, ok := decl.(*dst.FuncDecl); ok && fn.Name.Name == "Load" {
+			wrapper = fn
+		}
+	}
+	if wrapper == nil {
+		t.Fatal("no wrapper was declared for Load")
+	}
+	assert.Len(t, wrapper.Type.Params.List, 1)
+
+	// direct calls invoke the traced method, and calls through the interface are unchanged
+	run := manager.GetDeclaration(testAppPackage + ".run")
+	direct := run.Body.List[1].(*dst.ExprStmt).X.(*dst.CallExpr)
+	assert.Equal(t, "LoadWithTxn", direct.Fun.(*dst.SelectorExpr).Sel.Name)
+	assert.True(t, containsTransactionArgument(direct, "nrTxn"))
+	dynamic := run.Body.List[3].(*dst.ExprStmt).X.(*dst.CallExpr)
+	assert.Equal(t, "Load", dynamic.Fun.(*dst.SelectorExpr).Sel.Name)
+	assert.Len(t, dynamic.Args, 1)
+}
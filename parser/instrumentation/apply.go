@@ -0,0 +1,285 @@
+package instrumentation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// defaultJournalDirName is the directory in the application that the files changed in place are backed up to.
+	// The go command ignores directories whose name starts with a dot, so the backups are not built.
+	defaultJournalDirName = ".new-relic-instrumentation"
+	// journalFileName is the name of the journal in its directory.
+	journalFileName = "journal.json"
+	// journalBackupDir is the directory in the journal directory that the original files are backed up to.
+	journalBackupDir = "files"
+	// journalModuleDir is the directory in the journal directory that the original go.mod and go.sum are backed up to.
+	journalModuleDir = "modules"
+)
+
+// Journal records the files of an application that were changed in place, so that the changes can be rolled back.
+type Journal struct {
+	Files []JournalFile `json:"files"`
+}
+
+// JournalFile is a file of the application that was changed in place. Its original contents are backed up in the
+// journal directory, under the same path. The go.mod and go.sum of the module can be outside of the application, in
+// the root of the module, so they are backed up by name instead.
+type JournalFile struct {
+	Path     string `json:"path"`              // path of the file, relative to the application
+	Original string `json:"original"`          // SHA-256 of the contents of the file before it was changed
+	Changed  string `json:"changed"`           // SHA-256 of the contents the file was changed to
+	Module   bool   `json:"module,omitempty"`  // the file is the go.mod or go.sum of the module of the application
+	Created  bool   `json:"created,omitempty"` // the file did not exist, so it is removed rather than restored
+}
+
+// backupPath returns the path the original contents of a file are backed up to in journalDir.
+func backupPath(journalDir string, file JournalFile) string {
+	if file.Module {
+		return filepath.Join(journalDir, journalModuleDir, path.Base(file.Path))
+	}
+	return filepath.Join(journalDir, journalBackupDir, filepath.FromSlash(file.Path))
+}
+
+// moduleFile is the go.mod or go.sum of the module of the application, as it was before the modules the changes import
+// were added to it.
+type moduleFile struct {
+	path     string
+	original []byte // nil if the file did not exist
+	exists   bool
+}
+
+// readModuleFiles reads the go.mod and go.sum of the module dir is in. A go.sum that does not exist is read too, since
+// go get creates it.
+func readModuleFiles(dir string) ([]moduleFile, error) {
+	paths, err := modulePaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []moduleFile{}
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			files = append(files, moduleFile{path: path, original: contents, exists: true})
+		case os.IsNotExist(err):
+			files = append(files, moduleFile{path: path})
+		default:
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// hashContents returns the hex encoded SHA-256 of the contents of a file.
+func hashContents(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFileAtomic replaces the contents of a file by writing them to a temporary file in the same directory, and
+// renaming it, so that the file is never left partially written. A file that exists keeps its permissions.
+func writeFileAtomic(path string, contents []byte) error {
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ApplyChanges writes the changed files of the application in place, adds the modules the changes import to go.mod,
+// and returns the paths of the changed files, relative to the application. The original files, go.mod and go.sum
+// included, are backed up to a journal in journalDir first, that RollbackChanges restores them from. No journal is
+// written if journalDir is empty, for changes that are undone another way, such as with git.
+//
+// Nothing is written if a file changed since the application was loaded, since the changes were made to its old
+// contents, or if journalDir holds changes that were not rolled back.
+func (m *InstrumentationManager) ApplyChanges(journalDir string) ([]string, error) {
+	if journalDir != "" {
+		if _, err := os.Stat(filepath.Join(journalDir, journalFileName)); err == nil {
+			return nil, fmt.Errorf("%s holds changes that were not rolled back, roll them back or remove it first", journalDir)
+		}
+	}
+
+	changed := []filePatch{}
+	drifted := []string{}
+	for _, patch := range m.filePatches() {
+		if patch.original == patch.modified {
+			continue
+		}
+		if hashContents([]byte(patch.original)) != m.sources[patch.path] {
+			drifted = append(drifted, m.appRelativePath(patch.path))
+		}
+		changed = append(changed, patch)
+	}
+	modules, err := readModuleFiles(m.userAppPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range modules {
+		if hash, ok := m.sources[file.path]; ok && hash != hashContents(file.original) {
+			drifted = append(drifted, m.appRelativePath(file.path))
+		}
+	}
+	if len(drifted) > 0 {
+		sort.Strings(drifted)
+		return nil, fmt.Errorf("files changed since the application was loaded, instrument it again: %s", strings.Join(drifted, ", "))
+	}
+	if len(changed) == 0 {
+		return []string{}, nil
+	}
+	if journalDir != "" {
+		if err := m.writeJournal(journalDir, changed, modules); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := []string{}
+	for _, patch := range changed {
+		if err := writeFileAtomic(patch.path, []byte(patch.modified)); err != nil {
+			return nil, err
+		}
+		paths = append(paths, m.appRelativePath(patch.path))
+	}
+	if err := m.AddRequiredModules(); err != nil {
+		return nil, err
+	}
+	// the journal is written again, so that it records what the modules changed go.mod and go.sum to
+	if journalDir != "" {
+		if err := m.writeJournal(journalDir, changed, modules); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// writeJournal backs up the original contents of the changed files, and of the go.mod and go.sum of the module, to
+// journalDir, and records them in its journal. The go.mod and go.sum are recorded with their current contents.
+func (m *InstrumentationManager) writeJournal(journalDir string, changed []filePatch, modules []moduleFile) error {
+	journal := &Journal{Files: []JournalFile{}}
+	for _, patch := range changed {
+		file := JournalFile{
+			Path:     m.appRelativePath(patch.path),
+			Original: hashContents([]byte(patch.original)),
+			Changed:  hashContents([]byte(patch.modified)),
+		}
+		if err := writeFileAtomic(backupPath(journalDir, file), []byte(patch.original)); err != nil {
+			return err
+		}
+		journal.Files = append(journal.Files, file)
+	}
+	for _, module := range modules {
+		current, err := os.ReadFile(module.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		file := JournalFile{
+			Path:     m.appRelativePath(module.path),
+			Original: hashContents(module.original),
+			Changed:  hashContents(current),
+			Module:   true,
+			Created:  !module.exists,
+		}
+		if module.exists {
+			if err := writeFileAtomic(backupPath(journalDir, file), module.original); err != nil {
+				return err
+			}
+		}
+		journal.Files = append(journal.Files, file)
+	}
+	sort.Slice(journal.Files, func(i, j int) bool {
+		return journal.Files[i].Path < journal.Files[j].Path
+	})
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("journal: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(journalDir, journalFileName), append(data, '\n'))
+}
+
+// RollbackChanges restores the files of the application in appPath that ApplyChanges changed from the journal in
+// journalDir, removes the journal, and returns how many files were restored. Files that still have their original
+// contents are left as they are, and files that ApplyChanges created, such as a go.sum, are removed.
+//
+// Nothing is restored if a file changed since the changes were applied, since restoring it would lose those changes.
+func RollbackChanges(appPath, journalDir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(journalDir, journalFileName))
+	if err != nil {
+		return 0, fmt.Errorf("no changes to roll back: %w", err)
+	}
+	journal := &Journal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return 0, fmt.Errorf("journal %s: %w", filepath.Join(journalDir, journalFileName), err)
+	}
+
+	restore := []JournalFile{}
+	drifted := []string{}
+	for _, file := range journal.Files {
+		contents, err := os.ReadFile(filepath.Join(appPath, filepath.FromSlash(file.Path)))
+		if err != nil && !(file.Created && os.IsNotExist(err)) {
+			return 0, err
+		}
+		switch hashContents(contents) {
+		case file.Original:
+			// the file was not written, or was restored already
+		case file.Changed:
+			restore = append(restore, file)
+		default:
+			drifted = append(drifted, file.Path)
+		}
+	}
+	if len(drifted) > 0 {
+		return 0, fmt.Errorf("files changed since the changes were applied, restore them from %s by hand: %s", journalDir, strings.Join(drifted, ", "))
+	}
+
+	for _, file := range restore {
+		if file.Created {
+			if err := os.Remove(filepath.Join(appPath, filepath.FromSlash(file.Path))); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		backup, err := os.ReadFile(backupPath(journalDir, file))
+		if err != nil {
+			return 0, err
+		}
+		if hashContents(backup) != file.Original {
+			return 0, fmt.Errorf("the backup of %s in %s does not match the journal", file.Path, journalDir)
+		}
+		if err := writeFileAtomic(filepath.Join(appPath, filepath.FromSlash(file.Path)), backup); err != nil {
+			return 0, err
+		}
+	}
+	return len(restore), os.RemoveAll(journalDir)
+}
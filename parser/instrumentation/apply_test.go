@@ -0,0 +1,144 @@
+package instrumentation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/go/packages"
+)
+
+func Test_ApplyChanges_RollbackChanges(t *testing.T) {
+	code := `package main
+
+func main() {
+	println("hello")
+}
+`
+	changed := `package main
+
+func main() {
+	println("hello")
+	println()
+}
+`
+	tests := []struct {
+		name          string
+		applyDrift    bool // the file changes after it is loaded
+		rollbackDrift bool // the file changes after the changes are applied
+	}{
+		{name: "apply_and_rollback"},
+		{name: "changed_before_apply", applyDrift: true},
+		{name: "changed_before_rollback", rollbackDrift: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer panicRecovery(t)
+			stubGetModules(t)
+			testAppDir := "tmp"
+			pkgs, err := createTestAppPackage(testAppDir, "app.go", code)
+			defer cleanupTestApp(t, testAppDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(testAppDir, "app.go")
+			journalDir := filepath.Join(testAppDir, defaultJournalDirName)
+
+			manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+			manager.SetPackage(testAppPackage)
+			main := manager.GetDecoratorPackage().Syntax[0].Decls[0].(*dst.FuncDecl)
+			println := &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("println")}}
+			main.Body.List = append(main.Body.List, println)
+			manager.RecordChange("log", main, println)
+
+			if tt.applyDrift {
+				assert.NoError(t, os.WriteFile(path, []byte(code+"\n"), 0644))
+				_, err := manager.ApplyChanges(journalDir)
+				assert.Error(t, err)
+				assert.NoDirExists(t, journalDir, "nothing must be written when a file changed since it was loaded")
+				return
+			}
+
+			applied, err := manager.ApplyChanges(journalDir)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"app.go"}, applied)
+			assertFileContents(t, path, changed)
+			assertFileContents(t, filepath.Join(journalDir, journalBackupDir, "app.go"), code)
+			_, err = manager.ApplyChanges(journalDir)
+			assert.Error(t, err, "changes must not be applied again before they are rolled back")
+
+			if tt.rollbackDrift {
+				assert.NoError(t, os.WriteFile(path, []byte(changed+"\n"), 0644))
+				_, err := RollbackChanges(testAppDir, journalDir)
+				assert.Error(t, err)
+				assertFileContents(t, path, changed+"\n")
+				assert.DirExists(t, journalDir)
+				return
+			}
+
+			restored, err := RollbackChanges(testAppDir, journalDir)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, restored)
+			assertFileContents(t, path, code)
+			assert.NoDirExists(t, journalDir)
+		})
+	}
+}
+
+func assertFileContents(t *testing.T, path, want string) {
+	contents, err := os.ReadFile(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, want, string(contents))
+	}
+}
+
+func Test_ApplyChanges_RollbackChanges_modules(t *testing.T) {
+	defer panicRecovery(t)
+	// the test application is a module of its own, which the go flags of this module must not apply to
+	t.Setenv("GOFLAGS", "")
+	goMod := "module example.com/app\n\ngo 1.22\n"
+	testAppDir := "tmp"
+	if _, err := createTestAppPackage(testAppDir, "app.go", "package main\n\nfunc main() {\n}\n"); err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupTestApp(t, testAppDir)
+	assert.NoError(t, os.WriteFile(filepath.Join(testAppDir, "go.mod"), []byte(goMod), 0644))
+	pkgs, err := decorator.Load(&packages.Config{Dir: testAppDir, Mode: loadMode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	journalDir := filepath.Join(testAppDir, defaultJournalDirName)
+
+	// go get adds the module to go.mod, and creates go.sum
+	original := getModules
+	getModules = func(dir, modFile string, imports []string) error {
+		if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte(goMod+"\nrequire github.com/newrelic/go-agent/v3 v3.0.0\n"), 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, "go.sum"), []byte("github.com/newrelic/go-agent/v3 v3.0.0 h1:\n"), 0644)
+	}
+	t.Cleanup(func() { getModules = original })
+
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+	manager.SetPackage("example.com/app")
+	main := manager.GetDecoratorPackage().Syntax[0].Decls[0].(*dst.FuncDecl)
+	println := &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("println")}}
+	main.Body.List = append(main.Body.List, println)
+	manager.RecordChange("log", main, println)
+	manager.AddImport(newrelicAgentImport)
+
+	applied, err := manager.ApplyChanges(journalDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app.go"}, applied)
+	assertFileContents(t, filepath.Join(journalDir, journalModuleDir, "go.mod"), goMod)
+	assert.FileExists(t, filepath.Join(testAppDir, "go.sum"))
+
+	restored, err := RollbackChanges(testAppDir, journalDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, restored, "app.go and go.mod should be restored, and go.sum removed")
+	assertFileContents(t, filepath.Join(testAppDir, "go.mod"), goMod)
+	assert.NoFileExists(t, filepath.Join(testAppDir, "go.sum"), "go.sum did not exist before the changes were applied")
+}
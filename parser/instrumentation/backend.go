@@ -0,0 +1,421 @@
+package instrumentation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// Instrumentation targets are the telemetry libraries an application can be instrumented with.
+const (
+	// TargetNewRelic instruments an application with the New Relic Go agent.
+	TargetNewRelic = "newrelic"
+	// TargetOpenTelemetry instruments an application with the OpenTelemetry Go SDK, exporting traces over OTLP.
+	TargetOpenTelemetry = "otel"
+)
+
+// Kinds of the segments that time calls.
+const (
+	// SegmentKindCustom times a call in a segment named after what it does.
+	SegmentKindCustom = "custom"
+	// SegmentKindDatastore times a call to a datastore, such as a cache or a database.
+	SegmentKindDatastore = "datastore"
+)
+
+// CallSegment describes a segment that times a call.
+type CallSegment struct {
+	Name       string // name of the segment, and the operation of a datastore segment
+	Kind       string // SegmentKindCustom or SegmentKindDatastore
+	Product    string // datastore product, e.g. "Redis"
+	Collection string // datastore collection, e.g. the name of a table
+}
+
+// InstrumentationBackend generates the code that instruments an application with the telemetry library of a target.
+// Instrumentation rules decide where an application is instrumented, and call into the backend for the code they inject.
+//
+// Traced functions are passed a transaction, which is a *newrelic.Transaction for the New Relic agent, and a
+// context.Context carrying the active span for OpenTelemetry. The agent is the object main creates to report telemetry.
+type InstrumentationBackend interface {
+	// AgentVariableName is the default name of the agent variable.
+	AgentVariableName() string
+	// TransactionVariableName is the default name of the transaction variables passed to traced functions.
+	TransactionVariableName() string
+	// SpanVariableName is the default name of the variables that hold the spans started in a function, or an empty
+	// string if the backend does not declare any.
+	SpanVariableName() string
+	// ContextIsTransaction returns true if transactions are contexts, so that a function can use its context argument
+	// as its transaction.
+	ContextIsTransaction() bool
+	// TransactionType returns the type of a transaction parameter.
+	TransactionType() dst.Expr
+	// TransactionDescription describes a transaction in generated comments.
+	TransactionDescription() string
+	// NoTransaction creates the expression passed as the transaction by callers that do not have one.
+	NoTransaction() dst.Expr
+
+	// CreateAgent creates the statements that create the agent at the top of main. Other variables the statements
+	// declare are named by newVariable.
+	CreateAgent(appName, agentVariableName string, newVariable func(name string) string) []dst.Stmt
+	// ShutdownAgent creates the statement that shuts down the agent at the end of main.
+	ShutdownAgent(agentVariableName string) dst.Stmt
+	// StartTransaction creates the statement that starts a transaction in main. The scope is the import path of the
+	// package the statement is injected into. If overwriteVariable is true, the transaction and span variables are
+	// assigned instead of declared.
+	StartTransaction(agentVariableName, txnVariableName, spanVariableName, transactionName, scope string, overwriteVariable bool) dst.Stmt
+	// EndTransaction creates the statement that ends a transaction started by StartTransaction.
+	EndTransaction(txnVariableName, spanVariableName string) dst.Stmt
+	// StartSegment creates the statements that time the rest of a traced function in a segment. The scope is the
+	// import path of the package the function is declared in.
+	StartSegment(txnVariableName, spanVariableName, segmentName, scope string) []dst.Stmt
+	// StartCallSegment creates the statement that starts segment before the statement that makes the call it times.
+	// The scope is the import path of the package the statement is injected into. The decorations before the statement
+	// that makes the call, nodeDecs, are moved to it.
+	StartCallSegment(txnVariableName, segmentVariableName string, segment CallSegment, scope string, nodeDecs *dst.NodeDecs) dst.Stmt
+	// EndCallSegment creates the statement that ends a segment started by StartCallSegment after the statement that
+	// makes the call. The decorations after that statement, nodeDecs, are moved to it.
+	EndCallSegment(segmentVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt
+	// NewGoroutine creates the expression a goroutine is passed the transaction txnVariableName in.
+	NewGoroutine(txnVariableName string) dst.Expr
+	// NoticeError creates the statement that records the error errVariableName. The decorations after the statement
+	// it follows, nodeDecs, are moved to it.
+	NoticeError(errVariableName, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt
+	// TransactionFromContext creates the statement that defines a transaction from the context ctx.
+	TransactionFromContext(txnVariableName string, ctx dst.Expr) dst.Stmt
+	// ContextWithTransaction creates the expression that adds the transaction txn to the context ctx.
+	ContextWithTransaction(ctx, txn dst.Expr) dst.Expr
+	// IsContextWithTransaction returns true if expr is a context created by ContextWithTransaction.
+	IsContextWithTransaction(expr dst.Expr) bool
+
+	// WrapHandler wraps the handler registered by call, an invocation of a net/http HandleFunc or Handle method,
+	// with a transaction. The agent expression is the agent that reports it. Returns false if the handler is already
+	// wrapped.
+	WrapHandler(call *dst.CallExpr, method string, agent dst.Expr) bool
+	// TransactionAgent creates the expression of the agent that reports the transaction txnVariableName.
+	TransactionAgent(txnVariableName string) dst.Expr
+	// AgentType returns the type of the agent parameter that functions creating routers are passed, or nil if the
+	// routers are instrumented without the agent.
+	AgentType() dst.Expr
+	// InstrumentClient creates the statement that instruments the transport of an http client.
+	InstrumentClient(client dst.Expr, spacingAfter dst.SpaceType) dst.Stmt
+	// RequestWithTransaction creates the statement that adds a transaction to an http request, so that the
+	// instrumented client that sends it traces it. The decorations before the statement it precedes, nodeDecs, are
+	// moved to it.
+	RequestWithTransaction(request dst.Expr, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt
+	// ExternalSegment traces call, a request sent with the default http client, returning the statements inserted
+	// before and after the statement that makes it. The response expression is the response the call is assigned
+	// to, or nil if it is not assigned. The decorations of that statement, nodeDecs, are moved to the statements
+	// around it.
+	ExternalSegment(call *dst.CallExpr, request, response dst.Expr, txnVariableName, segmentVariableName string, nodeDecs *dst.NodeDecs) (before, after []dst.Stmt)
+	// RouterMiddleware creates the expression of the middleware that starts a transaction for each request handled by a
+	// router of a web framework, such as FrameworkGin or FrameworkEcho, or nil if the framework is not supported. The
+	// agent expression is the agent that reports the transactions, and the service is the name of the application,
+	// which may be empty.
+	RouterMiddleware(framework string, agent dst.Expr, service string) dst.Expr
+	// InstrumentedRouter creates the expression that creates a router of a web framework that starts a transaction for
+	// each request, which replaces the expression that creates a router of the application, or nil if the routers of
+	// the framework get middleware instead. The agent expression is the agent that reports the transactions.
+	InstrumentedRouter(framework string, agent dst.Expr) dst.Expr
+	// RouterHandler wraps router, a router of a web framework used as a net/http handler, in a handler that starts a
+	// transaction for each request, or returns nil if the routers of the framework get middleware or are created by an
+	// integration instead. The service is the name of the application, which may be empty.
+	RouterHandler(framework string, router dst.Expr, service string) dst.Expr
+	// RouteMiddleware creates the declaration of the middleware RouterMiddleware adds to the routers of a web framework
+	// without an integration, such as FrameworkChi, or nil if the framework has one. It names the transactions after the
+	// route of the request once it is routed. The import path is the path of the package of the framework the router is
+	// created with, and the scope is the import path of the package the middleware is declared in. It returns an error if
+	// the source of the middleware can not be parsed.
+	RouteMiddleware(framework, importPath, scope string) (*dst.FuncDecl, error)
+	// HandlerTransaction creates the statement that defines a transaction from the context a handler of a web framework
+	// is passed, handlerContext, or nil if the handlers of the framework are net/http handlers.
+	HandlerTransaction(framework, txnVariableName string, handlerContext dst.Expr) dst.Stmt
+	// HttpClientDocumentation is a link to the documentation of the http requests that can be traced.
+	HttpClientDocumentation() string
+	// ImportAliases returns the aliases packages of the injected code are imported under by their path.
+	ImportAliases() map[string]string
+}
+
+// NewInstrumentationBackend returns the backend of an instrumentation target, or nil if the target is not supported.
+func NewInstrumentationBackend(target string) InstrumentationBackend {
+	switch target {
+	case TargetNewRelic:
+		return newRelicBackend{}
+	case TargetOpenTelemetry:
+		return otelBackend{}
+	}
+	return nil
+}
+
+// Backend returns the backend the application is instrumented with. Without a target, the New Relic agent is used.
+func (m *InstrumentationManager) Backend() InstrumentationBackend {
+	if m.backend == nil {
+		return newRelicBackend{}
+	}
+	return m.backend
+}
+
+// AddImports adds the packages that qualified identifiers in nodes refer to to the imports of the current package, so
+// that their modules are required by the application. Packages of the standard library, and packages the current
+// package already imports, are left out.
+func (m *InstrumentationManager) AddImports(nodes ...dst.Node) {
+	pkg := m.GetDecoratorPackage()
+	for _, node := range nodes {
+		dst.Inspect(node, func(n dst.Node) bool {
+			ident, ok := n.(*dst.Ident)
+			if !ok || ident.Path == "" || isStandardLibraryPath(ident.Path) {
+				return true
+			}
+			if pkg != nil && pkg.Package != nil && pkg.Imports[ident.Path] != nil {
+				return true
+			}
+			m.AddImport(ident.Path)
+			return true
+		})
+	}
+}
+
+// fileRestorer returns a restorer for file that imports the packages of the injected code under the aliases of the
+// backend, unless the file already imports them.
+func (m *InstrumentationManager) fileRestorer(r *decorator.Restorer, file *dst.File) *decorator.FileRestorer {
+	fr := r.FileRestorer()
+	for path, alias := range m.Backend().ImportAliases() {
+		if !importsPath(file, path) {
+			fr.Alias[path] = alias
+		}
+	}
+	return fr
+}
+
+// importsPath returns true if file imports the package path.
+func importsPath(file *dst.File, path string) bool {
+	for _, spec := range file.Imports {
+		if p, err := strconv.Unquote(spec.Path.Value); err == nil && p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// isStandardLibraryPath returns true if path is the import path of a package of the standard library, whose first
+// element is not a domain name.
+func isStandardLibraryPath(path string) bool {
+	first, _, _ := strings.Cut(path, "/")
+	return !strings.Contains(first, ".")
+}
+
+// newRelicBackend instruments an application with the New Relic Go agent.
+type newRelicBackend struct{}
+
+func (newRelicBackend) AgentVariableName() string       { return defaultAgentVariableName }
+func (newRelicBackend) TransactionVariableName() string { return defaultTxnName }
+func (newRelicBackend) SpanVariableName() string        { return "" }
+func (newRelicBackend) ContextIsTransaction() bool      { return false }
+
+func (newRelicBackend) TransactionType() dst.Expr {
+	return &dst.StarExpr{
+		X: &dst.Ident{
+			Name: "Transaction",
+			Path: newrelicAgentImport,
+		},
+	}
+}
+
+func (newRelicBackend) TransactionDescription() string {
+	return "a New Relic transaction"
+}
+
+func (newRelicBackend) NoTransaction() dst.Expr {
+	return dst.NewIdent("nil")
+}
+
+func (newRelicBackend) CreateAgent(appName, agentVariableName string, newVariable func(name string) string) []dst.Stmt {
+	return createAgentAST(appName, agentVariableName, newVariable(defaultErrName))
+}
+
+func (newRelicBackend) ShutdownAgent(agentVariableName string) dst.Stmt {
+	return shutdownAgent(agentVariableName)
+}
+
+func (newRelicBackend) StartTransaction(agentVariableName, txnVariableName, _, transactionName, _ string, overwriteVariable bool) dst.Stmt {
+	return startTransaction(agentVariableName, txnVariableName, transactionName, overwriteVariable)
+}
+
+func (newRelicBackend) EndTransaction(txnVariableName, _ string) dst.Stmt {
+	return endTransaction(txnVariableName)
+}
+
+func (newRelicBackend) StartSegment(txnVariableName, _, segmentName, _ string) []dst.Stmt {
+	return []dst.Stmt{deferSegment(segmentName, txnVariableName)}
+}
+
+func (newRelicBackend) StartCallSegment(txnVariableName, segmentVariableName string, segment CallSegment, _ string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	if segment.Kind == SegmentKindDatastore {
+		return startDatastoreSegment(txnVariableName, segmentVariableName, segment, nodeDecs)
+	}
+	return startSegment(txnVariableName, segmentVariableName, segment.Name, nodeDecs)
+}
+
+func (newRelicBackend) EndCallSegment(segmentVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	return endExternalSegment(segmentVariableName, nodeDecs)
+}
+
+func (newRelicBackend) NewGoroutine(txnVariableName string) dst.Expr {
+	return txnNewGoroutine(txnVariableName)
+}
+
+func (newRelicBackend) NoticeError(errVariableName, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	return txnNoticeError(errVariableName, txnVariableName, nodeDecs)
+}
+
+func (newRelicBackend) TransactionFromContext(txnVariableName string, ctx dst.Expr) dst.Stmt {
+	return defineTxnFromContext(txnVariableName, ctx)
+}
+
+func (newRelicBackend) ContextWithTransaction(ctx, txn dst.Expr) dst.Expr {
+	return contextWithTxn(ctx, txn)
+}
+
+func (newRelicBackend) IsContextWithTransaction(expr dst.Expr) bool {
+	return containsTransactionContext(expr)
+}
+
+func (newRelicBackend) WrapHandler(call *dst.CallExpr, method string, agent dst.Expr) bool {
+	// the handler is wrapped by replacing the arguments of the call with a newrelic.WrapHandle or WrapHandleFunc call
+	// that returns them
+	if len(call.Args) != 2 {
+		return false
+	}
+	call.Args = []dst.Expr{
+		&dst.CallExpr{
+			Fun: &dst.Ident{
+				Name: wrapHandlerFunction(method),
+				Path: newrelicAgentImport,
+			},
+			Args: []dst.Expr{
+				agent,
+				call.Args[0],
+				call.Args[1],
+			},
+		},
+	}
+	return true
+}
+
+func (newRelicBackend) AgentType() dst.Expr {
+	return &dst.StarExpr{
+		X: &dst.Ident{
+			Name: "Application",
+			Path: newrelicAgentImport,
+		},
+	}
+}
+
+func (newRelicBackend) TransactionAgent(txnVariableName string) dst.Expr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.NewIdent(txnVariableName),
+			Sel: dst.NewIdent("Application"),
+		},
+	}
+}
+
+func (newRelicBackend) InstrumentClient(client dst.Expr, spacingAfter dst.SpaceType) dst.Stmt {
+	return injectRoundTripper(client, spacingAfter)
+}
+
+func (newRelicBackend) RequestWithTransaction(request dst.Expr, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	return addTxnToRequestContext(request, txnVariableName, nodeDecs)
+}
+
+func (newRelicBackend) ExternalSegment(_ *dst.CallExpr, request, response dst.Expr, txnVariableName, segmentVariableName string, nodeDecs *dst.NodeDecs) ([]dst.Stmt, []dst.Stmt) {
+	before := []dst.Stmt{startExternalSegment(request, txnVariableName, segmentVariableName, nodeDecs)}
+	// statements inserted after a statement are listed in the order they appear in
+	after := []dst.Stmt{}
+	if response != nil {
+		after = append(after, captureHttpResponse(segmentVariableName, response))
+	}
+	after = append(after, endExternalSegment(segmentVariableName, nodeDecs))
+	return before, after
+}
+
+func (newRelicBackend) RouterMiddleware(framework string, agent dst.Expr, _ string) dst.Expr {
+	f, ok := webFrameworks[framework]
+	if !ok || f.instrumentedRouter != "" {
+		return nil
+	}
+	if f.routePattern != "" {
+		return &dst.CallExpr{
+			Fun:  dst.NewIdent(routeMiddlewareName(newRelicMiddlewarePrefix, framework)),
+			Args: []dst.Expr{agent},
+		}
+	}
+	return frameworkMiddleware(framework, agent)
+}
+
+func (newRelicBackend) InstrumentedRouter(framework string, agent dst.Expr) dst.Expr {
+	if f, ok := webFrameworks[framework]; !ok || f.instrumentedRouter == "" {
+		return nil
+	}
+	return newInstrumentedRouter(framework, agent)
+}
+
+// RouterHandler returns nil, since the routers of the frameworks New Relic instruments get middleware or are created by
+// an integration.
+func (newRelicBackend) RouterHandler(string, dst.Expr, string) dst.Expr {
+	return nil
+}
+
+// newRelicMiddlewarePrefix is the prefix of the names of the middleware New Relic declares for web frameworks without an
+// integration.
+const newRelicMiddlewarePrefix = "newRelic"
+
+// newRelicRouteMiddleware is the source of the middleware New Relic declares for the routers of a web framework without
+// an integration, formatted with its name and the expression of the pattern of the route of the request r. The
+// transaction is started before the request is routed, so that it times the middleware of the router.
+const newRelicRouteMiddleware = `// %[1]s starts a transaction for each request the router routes, and names it
+// after the pattern of the route of the request once it is routed.
+func %[1]s(app *newrelic.Application) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			txn := app.StartTransaction(r.Method + " " + r.URL.Path)
+			defer txn.End()
+
+			txn.SetWebRequestHTTP(r)
+			w = txn.SetWebResponse(w)
+			next.ServeHTTP(w, newrelic.RequestWithTransactionContext(r, txn))
+			txn.SetName(r.Method + " " + %[2]s)
+		})
+	}
+}
+`
+
+func (newRelicBackend) RouteMiddleware(framework, importPath, _ string) (*dst.FuncDecl, error) {
+	f, ok := webFrameworks[framework]
+	if !ok || f.routePattern == "" {
+		return nil, nil
+	}
+	src := fmt.Sprintf(newRelicRouteMiddleware, routeMiddlewareName(newRelicMiddlewarePrefix, framework), f.routePattern)
+	return parseRouteMiddleware(src, map[string]string{
+		"net/http":          "http",
+		newrelicAgentImport: "newrelic",
+		importPath:          framework,
+	})
+}
+
+func (newRelicBackend) HandlerTransaction(framework, txnVariableName string, handlerContext dst.Expr) dst.Stmt {
+	if f, ok := webFrameworks[framework]; !ok || f.transaction == "" {
+		return nil
+	}
+	return defineHandlerTransaction(framework, txnVariableName, handlerContext)
+}
+
+// ImportAliases imports the echo integration as nrecho, since its import path does not end in its name.
+func (newRelicBackend) ImportAliases() map[string]string {
+	return map[string]string{nrechoImport: "nrecho"}
+}
+
+func (newRelicBackend) HttpClientDocumentation() string {
+	return "https://docs.newrelic.com/docs/apm/agents/go-agent/configuration/distributed-tracing-go-agent/#make-http-requests"
+}
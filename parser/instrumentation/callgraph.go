@@ -0,0 +1,227 @@
+package instrumentation
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"golang.org/x/tools/go/callgraph"
+	"golang.org/x/tools/go/callgraph/cha"
+	"golang.org/x/tools/go/callgraph/vta"
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+)
+
+// callSite contains the functions declared in the packages being instrumented that a call may invoke.
+type callSite struct {
+	static  bool     // true if the call always invokes the same function
+	callees []string // IDs of the functions that may be invoked
+}
+
+// CallGraph is the result of a whole program analysis of the packages being instrumented. It contains the set of
+// functions declared in those packages that are reachable from a transaction entry point, such as main or an http
+// handler, along with the functions each call site in them can invoke.
+//
+// Please access this object's data through methods rather than directly manipulating it.
+type CallGraph struct {
+	reachable map[string]bool
+	dynamic   map[string]bool // IDs of the functions invoked by a call that dispatches through an interface or function value
+	sites     map[token.Pos]*callSite
+}
+
+// NewCallGraph builds an SSA representation of the packages being instrumented, and computes their call graph using
+// variable type analysis seeded with a class hierarchy analysis. This resolves calls made through interfaces, function
+// values and closures. Nil is returned if the program can not be analyzed, for example because it does not type check.
+func NewCallGraph(pkgs []*decorator.Package) *CallGraph {
+	if len(pkgs) == 0 {
+		return nil
+	}
+
+	initial := make([]*packages.Package, len(pkgs))
+	inModule := map[string]bool{}
+	for i, pkg := range pkgs {
+		initial[i] = pkg.Package
+		inModule[pkg.PkgPath] = true
+	}
+
+	prog, ssaPkgs := ssautil.Packages(initial, ssa.InstantiateGenerics)
+	for _, pkg := range ssaPkgs {
+		if pkg == nil {
+			return nil
+		}
+	}
+	prog.Build()
+
+	graph := vta.CallGraph(ssautil.AllFunctions(prog), cha.CallGraph(prog))
+	graph.DeleteSyntheticNodes()
+
+	cg := &CallGraph{
+		reachable: map[string]bool{},
+		dynamic:   map[string]bool{},
+		sites:     map[token.Pos]*callSite{},
+	}
+
+	// discover transaction entry points
+	queue := []*ssa.Function{}
+	for fn := range graph.Nodes {
+		if fn == nil || !isModuleFunction(fn, inModule) {
+			continue
+		}
+		if isMainFunction(fn) || isHttpHandlerSignature(fn.Signature) || isGinHandlerSignature(fn.Signature) ||
+			isEchoHandlerSignature(fn.Signature) {
+			queue = append(queue, fn)
+		}
+	}
+
+	// walk all functions in the module that can be reached from an entry point
+	visited := map[*ssa.Function]bool{}
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+		if visited[fn] {
+			continue
+		}
+		visited[fn] = true
+		if id := ssaFunctionID(fn); id != "" {
+			cg.reachable[id] = true
+		}
+
+		// closures can be invoked by code outside of the module, such as sync.Once.Do, but run on behalf of the function that declares them
+		queue = append(queue, fn.AnonFuncs...)
+
+		node := graph.Nodes[fn]
+		if node == nil {
+			continue
+		}
+		for _, edge := range node.Out {
+			cg.addEdge(edge, inModule)
+			if isModuleFunction(edge.Callee.Func, inModule) {
+				queue = append(queue, edge.Callee.Func)
+			}
+		}
+	}
+
+	return cg
+}
+
+func (cg *CallGraph) addEdge(edge *callgraph.Edge, inModule map[string]bool) {
+	if edge.Site == nil || !isModuleFunction(edge.Callee.Func, inModule) {
+		return
+	}
+	id := ssaFunctionID(edge.Callee.Func)
+	if id == "" {
+		return
+	}
+
+	pos := edge.Site.Common().Pos()
+	site, ok := cg.sites[pos]
+	if !ok {
+		site = &callSite{static: edge.Site.Common().StaticCallee() != nil}
+		cg.sites[pos] = site
+	}
+	for _, callee := range site.callees {
+		if callee == id {
+			return
+		}
+	}
+	site.callees = append(site.callees, id)
+	if !site.static {
+		cg.dynamic[id] = true
+	}
+}
+
+// IsReachable returns true if the function with the given ID can be invoked from a transaction entry point.
+func (cg *CallGraph) IsReachable(functionID string) bool {
+	if cg == nil {
+		return false
+	}
+	return cg.reachable[functionID]
+}
+
+// IsDynamicCallee returns true if the function with the given ID may be invoked by a call that dispatches through an
+// interface or function value. The signature of such a function is bound to the one of the call, so it can only be passed
+// a transaction in a context argument.
+func (cg *CallGraph) IsDynamicCallee(functionID string) bool {
+	if cg == nil {
+		return false
+	}
+	return cg.dynamic[functionID]
+}
+
+// StaticCallee returns the ID of the function declared in the instrumented packages that is always invoked by call.
+// Calls that dispatch dynamically through an interface or function value have no static callee.
+func (cg *CallGraph) StaticCallee(call *ast.CallExpr) (string, bool) {
+	if cg == nil || call == nil {
+		return "", false
+	}
+	site, ok := cg.sites[call.Lparen]
+	if !ok || !site.static || len(site.callees) != 1 {
+		return "", false
+	}
+	return site.callees[0], true
+}
+
+// DynamicCallees returns the IDs of the functions declared in the instrumented packages that may be invoked by a call
+// that dispatches through an interface or function value.
+func (cg *CallGraph) DynamicCallees(call *ast.CallExpr) []string {
+	if cg == nil || call == nil {
+		return nil
+	}
+	site, ok := cg.sites[call.Lparen]
+	if !ok || site.static {
+		return nil
+	}
+	return site.callees
+}
+
+// ssaFunctionID returns the ID of the declared function fn, the same way that InstrumentationManager.functionID does.
+// Anonymous functions and synthetic wrappers have no ID.
+func ssaFunctionID(fn *ssa.Function) string {
+	if origin := fn.Origin(); origin != nil {
+		fn = origin
+	}
+	obj, ok := fn.Object().(*types.Func)
+	if !ok || fn.Synthetic != "" {
+		return ""
+	}
+	return obj.Origin().FullName()
+}
+
+func isModuleFunction(fn *ssa.Function, inModule map[string]bool) bool {
+	if fn == nil {
+		return false
+	}
+	if origin := fn.Origin(); origin != nil {
+		fn = origin
+	}
+	return fn.Pkg != nil && inModule[fn.Pkg.Pkg.Path()]
+}
+
+func isMainFunction(fn *ssa.Function) bool {
+	return fn.Pkg != nil && fn.Pkg.Pkg.Name() == "main" && fn.Name() == "main" && fn.Parent() == nil && fn.Signature.Recv() == nil
+}
+
+// isHttpHandlerSignature returns true for functions with the signature func(http.ResponseWriter, *http.Request).
+func isHttpHandlerSignature(sig *types.Signature) bool {
+	params := sig.Params()
+	switch {
+	case params.Len() == 2:
+	case params.Len() == 3 && params.At(2).Type().String() == HttpRouter+".Params":
+		// httprouter handlers are also passed the parameters of their route
+	default:
+		return false
+	}
+	return params.At(0).Type().String() == "net/http.ResponseWriter" && params.At(1).Type().String() == "*net/http.Request"
+}
+
+// astCallExpr returns the go/ast node a dst call expression was decorated from.
+func astCallExpr(call *dst.CallExpr, pkg *decorator.Package) *ast.CallExpr {
+	if call == nil || pkg == nil || pkg.Decorator == nil {
+		return nil
+	}
+	astCall, _ := pkg.Decorator.Ast.Nodes[call].(*ast.CallExpr)
+	return astCall
+}
@@ -0,0 +1,296 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+const callGraphTestCode = `
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+type Loader interface {
+	Load() error
+}
+
+type Repo struct{}
+
+func (r *Repo) Load() error { return nil }
+
+type Set[T comparable] struct{}
+
+func (s *Set[T]) Add(v T) {}
+
+func helper() {}
+
+func viaValue() {}
+
+func run(fn func()) {
+	fn()
+}
+
+func viaOnce() {}
+
+func background() {}
+
+func unused() {}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	var l Loader = &Repo{}
+	l.Load()
+}
+
+func main() {
+	helper()
+	run(viaValue)
+	once := sync.Once{}
+	once.Do(func() {
+		viaOnce()
+	})
+	s := &Set[int]{}
+	s.Add(1)
+	go background()
+	http.HandleFunc("/", index)
+}
+`
+
+// findCall returns the first call expression in the body of the named function that satisfies match.
+func findCall(t *testing.T, manager *InstrumentationManager, funcName string, match func(*dst.CallExpr) bool) *dst.CallExpr {
+	var found *dst.CallExpr
+	for _, decl := range manager.GetDecoratorPackage().Syntax[0].Decls {
+		fn, ok := decl.(*dst.FuncDecl)
+		if !ok || fn.Name.Name != funcName {
+			continue
+		}
+		dst.Inspect(fn, func(n dst.Node) bool {
+			if call, ok := n.(*dst.CallExpr); ok && found == nil && match(call) {
+				found = call
+			}
+			return found == nil
+		})
+	}
+	if found == nil {
+		t.Fatalf("no matching call found in %s", funcName)
+	}
+	return found
+}
+
+func calls(name string) func(*dst.CallExpr) bool {
+	return func(call *dst.CallExpr) bool {
+		switch fun := call.Fun.(type) {
+		case *dst.Ident:
+			return fun.Name == name
+		case *dst.SelectorExpr:
+			return fun.Sel.Name == name
+		}
+		return false
+	}
+}
+
+func Test_NewCallGraph(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, callGraphTestCode)
+	defer panicRecovery(t)
+
+	cg := NewCallGraph(manager.decoratorPackages())
+	if cg == nil {
+		t.Fatal("expected a call graph to be built for a well typed program")
+	}
+
+	t.Run("reachability", func(t *testing.T) {
+		for _, id := range []string{
+			testAppPackage + ".helper",
+			testAppPackage + ".viaValue",
+			testAppPackage + ".run",
+			testAppPackage + ".viaOnce",
+			testAppPackage + ".background",
+			"(*" + testAppPackage + ".Repo).Load",
+			"(*" + testAppPackage + ".Set[T]).Add",
+		} {
+			assert.True(t, cg.IsReachable(id), id)
+		}
+		assert.False(t, cg.IsReachable(testAppPackage+".unused"))
+	})
+
+	pkg := manager.GetDecoratorPackage()
+	t.Run("static_calls", func(t *testing.T) {
+		for name, want := range map[string]string{
+			"helper":     testAppPackage + ".helper",
+			"Add":        "(*" + testAppPackage + ".Set[T]).Add",
+			"background": testAppPackage + ".background",
+		} {
+			got, ok := cg.StaticCallee(astCallExpr(findCall(t, manager, "main", calls(name)), pkg))
+			assert.True(t, ok, name)
+			assert.Equal(t, want, got)
+		}
+	})
+
+	t.Run("dynamic_calls", func(t *testing.T) {
+		call := astCallExpr(findCall(t, manager, "index", calls("Load")), pkg)
+		_, ok := cg.StaticCallee(call)
+		assert.False(t, ok)
+		assert.Equal(t, []string{"(*" + testAppPackage + ".Repo).Load"}, cg.DynamicCallees(call))
+
+		call = astCallExpr(findCall(t, manager, "run", calls("fn")), pkg)
+		assert.Equal(t, []string{testAppPackage + ".viaValue"}, cg.DynamicCallees(call))
+
+		assert.True(t, cg.IsDynamicCallee("(*"+testAppPackage+".Repo).Load"))
+		assert.True(t, cg.IsDynamicCallee(testAppPackage+".viaValue"))
+		assert.False(t, cg.IsDynamicCallee(testAppPackage+".helper"))
+	})
+}
+
+func Test_GetPackageFunctionInvocations_callGraph(t *testing.T) {
+	code := `
+package main
+
+func inner() int { return 1 }
+
+func outer(i int) int { return i }
+
+func main() {
+	x := outer(inner())
+	_ = x
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+	manager.callGraph = NewCallGraph(manager.decoratorPackages())
+
+	file := manager.GetDecoratorPackage().Syntax[0]
+	mainDecl := file.Decls[len(file.Decls)-1].(*dst.FuncDecl)
+	invocations := manager.GetPackageFunctionInvocations(mainDecl.Body.List[0])
+	if assert.Len(t, invocations, 2) {
+		assert.Equal(t, testAppPackage+".outer", invocations[0].functionID)
+		assert.Equal(t, "outer", invocations[0].functionName)
+		assert.Equal(t, testAppPackage+".inner", invocations[1].functionID)
+	}
+}
+
+const dynamicCallsApp = `package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+type Store interface {
+	Load(ctx context.Context, id string) error
+}
+
+type database struct{}
+
+func (d database) Load(ctx context.Context, id string) error {
+	_, err := strconv.Atoi(id)
+	return err
+}
+
+type cache struct{}
+
+func (c cache) Load(ctx context.Context, id string) error {
+	_, err := strconv.ParseBool(id)
+	return err
+}
+
+func store(cached bool) Store {
+	if cached {
+		return cache{}
+	}
+	return database{}
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	err := store(r.URL.Query().Has("cached")).Load(r.Context(), r.URL.Path)
+	if err != nil {
+		w.WriteHeader(404)
+	}
+}
+
+func main() {
+	http.HandleFunc("/item", item)
+	http.ListenAndServe(":8000", nil)
+}
+`
+
+const dynamicCallsAppNewRelic = `package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+type Store interface {
+	Load(ctx context.Context, id string) error
+}
+
+type database struct{}
+
+func (d database) Load(ctx context.Context, id string) error {
+	nrTxn := newrelic.FromContext(ctx)
+
+	defer nrTxn.StartSegment("database.Load").End()
+	_, err := strconv.Atoi(id)
+	nrTxn.NoticeError(err)
+	return err
+}
+
+type cache struct{}
+
+func (c cache) Load(ctx context.Context, id string) error {
+	nrTxn := newrelic.FromContext(ctx)
+
+	defer nrTxn.StartSegment("cache.Load").End()
+	_, err := strconv.ParseBool(id)
+	nrTxn.NoticeError(err)
+	return err
+}
+
+func store(cached bool) Store {
+	if cached {
+		return cache{}
+	}
+	return database{}
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	nrTxn := newrelic.FromContext(r.Context())
+
+	err := store(r.URL.Query().Has("cached")).Load(newrelic.NewContext(r.Context(), nrTxn), r.URL.Path)
+	if err != nil {
+		w.WriteHeader(404)
+	}
+}
+
+func main() {
+	NewRelicAgent, err := newrelic.NewApplication(newrelic.ConfigFromEnvironment())
+	if err != nil {
+		panic(err)
+	}
+
+	http.HandleFunc(newrelic.WrapHandleFunc(NewRelicAgent, "/item", item))
+	http.ListenAndServe(":8000", nil)
+
+	NewRelicAgent.Shutdown(5 * time.Second)
+}
+`
+
+func Test_InstrumentPackages_dynamicCalls(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, dynamicCallsApp)
+	defer panicRecovery(t)
+
+	assert.NoError(t, manager.InstrumentPackages())
+	assert.Equal(t, dynamicCallsAppNewRelic, printTestApp(t, manager))
+}
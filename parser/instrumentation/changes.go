@@ -0,0 +1,137 @@
+package instrumentation
+
+import (
+	"go/token"
+
+	"github.com/dave/dst"
+)
+
+// Names of the instrumentation rules that make changes to the application.
+const (
+	ruleAgent              = "agent"
+	ruleTransaction        = "transaction"
+	ruleTraceFunction      = "trace-function"
+	ruleAsyncLiteral       = "async-literal"
+	ruleNoticeError        = "notice-error"
+	ruleExternalSegment    = "external-segment"
+	ruleRequestContext     = "request-context"
+	ruleWrapHandler        = "wrap-handler"
+	ruleHandlerTransaction = "handler-transaction"
+	ruleRoundTripper       = "round-tripper"
+	ruleMiddleware         = "middleware"
+	ruleRouterAgent        = "router-agent"
+	ruleReturnedError      = "returned-error"
+	ruleRouter             = "router"
+	ruleRouterHandler      = "router-handler"
+)
+
+// change is a modification made to the application by an instrumentation rule. Changes are identified by their rule,
+// and the position of the source code they were made to, so that the same change can be recognized when an application
+// is instrumented again.
+type change struct {
+	rule       string
+	pos        token.Position // position of the node in the original source code the change was made to
+	nodes      []dst.Node     // nodes that were added or modified by the change
+	anchor     dst.Node       // node of the original source code the change was made to
+	pkg        string         // ID of the package the change was made in
+	entryPoint *entryPoint    // entry point of the transaction the change traces, nil if it is not traced for one
+	callChain  []string       // IDs of the functions being traced when the change was made
+	name       string         // name of the transaction or segment the change starts, if it starts one
+}
+
+// entryPoint is a function a transaction starts in, such as main or an http handler.
+type entryPoint struct {
+	function    string // ID of the function
+	transaction string // name of the transaction, empty if it is named where the function is registered
+}
+
+// skippedChange is an opportunity to instrument the application that a rule found, but could not take.
+type skippedChange struct {
+	rule   string
+	pos    token.Position
+	reason string
+}
+
+// key identifies a change across instrumentations of the same application.
+func (c *change) key() string {
+	return changeKey(c.rule, c.pos)
+}
+
+func changeKey(rule string, pos token.Position) string {
+	return rule + "@" + pos.String()
+}
+
+// sourcePosition returns the position of a node in the original source code of the instrumented packages. Nodes that
+// were created by instrumentation have no position.
+func (m *InstrumentationManager) sourcePosition(node dst.Node) token.Position {
+	for _, state := range m.packages {
+		pkg := state.pkg
+		if pkg == nil || pkg.Decorator == nil {
+			continue
+		}
+		astNode, ok := pkg.Decorator.Ast.Nodes[node]
+		if ok && pkg.Fset != nil {
+			return pkg.Fset.Position(astNode.Pos())
+		}
+	}
+	return token.Position{}
+}
+
+// RecordChange records that a rule changed the application at anchor, a node of the original source code, by adding or
+// modifying nodes.
+func (m *InstrumentationManager) RecordChange(rule string, anchor dst.Node, nodes ...dst.Node) {
+	m.changes = append(m.changes, &change{
+		rule:       rule,
+		pos:        m.sourcePosition(anchor),
+		nodes:      nodes,
+		anchor:     anchor,
+		pkg:        m.currentPackage,
+		entryPoint: m.entryPoint,
+		callChain:  append([]string(nil), m.callChain...),
+	})
+}
+
+// recordNamedChange records a change that starts a transaction or segment with the given name.
+func (m *InstrumentationManager) recordNamedChange(rule, name string, anchor dst.Node, nodes ...dst.Node) {
+	m.RecordChange(rule, anchor, nodes...)
+	m.changes[len(m.changes)-1].name = name
+}
+
+// RecordSkipped records that a rule could not instrument the application at node, a node of the original source code,
+// and why.
+func (m *InstrumentationManager) RecordSkipped(rule string, node dst.Node, reason string) {
+	m.skipped = append(m.skipped, &skippedChange{
+		rule:   rule,
+		pos:    m.sourcePosition(node),
+		reason: reason,
+	})
+}
+
+// ChangeDropped returns true if the change a rule would make at anchor was dropped because it did not compile.
+// Rules must not make changes that were dropped.
+func (m *InstrumentationManager) ChangeDropped(rule string, anchor dst.Node) bool {
+	if len(m.droppedChanges) == 0 {
+		return false
+	}
+	return m.droppedChanges[changeKey(rule, m.sourcePosition(anchor))]
+}
+
+// DropChanges prevents the changes with the given keys from being made when the application is instrumented.
+func (m *InstrumentationManager) DropChanges(keys map[string]bool) {
+	m.droppedChanges = keys
+}
+
+// changeName returns the name the change a rule would make at anchor gives the transaction or segment it starts. This
+// is name, unless the change was given another one with RenameChanges.
+func (m *InstrumentationManager) changeName(rule string, anchor dst.Node, name string) string {
+	if renamed, ok := m.renamedChanges[changeKey(rule, m.sourcePosition(anchor))]; ok {
+		return renamed
+	}
+	return name
+}
+
+// RenameChanges gives the transactions and segments started by the changes with the given keys new names when the
+// application is instrumented.
+func (m *InstrumentationManager) RenameChanges(names map[string]string) {
+	m.renamedChanges = names
+}
@@ -0,0 +1,39 @@
+package instrumentation
+
+import (
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	// Chi is the path of the module of chi without its major version. The routers of each of its major versions, such
+	// as github.com/go-chi/chi/v5, are instrumented.
+	Chi = "github.com/go-chi/chi"
+
+	// functions that create a chi router
+	ChiNewRouter = "NewRouter"
+	ChiNewMux    = "NewMux"
+
+	// FrameworkChi is the chi router, which routers are instrumented for. It has no integration, so its routers get
+	// middleware declared in the package that creates them. Its handlers are net/http handlers, which
+	// InstrumentHandleFunction traces.
+	FrameworkChi = "chi"
+)
+
+// InstrumentChiRouter adds middleware to the chi routers created in main, so that each request they route starts a
+// transaction named after the pattern of its route. The middleware is declared after main, and is reported by the agent
+// main creates. Subrouters, mounted routers and groups run the middleware of the router they are routed from, so they
+// do not get middleware of their own.
+func InstrumentChiRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentMainRouters(n, manager, FrameworkChi)
+}
+
+// InstrumentNestedChiRouter adds middleware to the chi routers created in functions other than main. The middleware is
+// declared after the function, and is reported by the agent main creates, which the function is passed.
+func InstrumentNestedChiRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentNestedRouters(n, manager, FrameworkChi)
+}
+
+// chiRoutePattern is the source of the expression of the pattern of the route chi routed the request r to, such as
+// /items/{id}. Subrouters share the route context of the request, so it is the pattern of the whole route.
+const chiRoutePattern = "chi.RouteContext(r.Context()).RoutePattern()"
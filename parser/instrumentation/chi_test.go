@@ -0,0 +1,240 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+// chi has no integration, so the middleware is declared after the first function that creates a router
+var chiTest = frameworkTest{
+	importPath: Chi + "/v5",
+	stub: `package chi
+
+import (
+	"context"
+	"net/http"
+)
+
+type Router interface {
+	http.Handler
+	Use(middlewares ...func(http.Handler) http.Handler)
+	Get(pattern string, h http.HandlerFunc)
+	Route(pattern string, fn func(r Router)) Router
+}
+
+type Mux struct{}
+
+func NewRouter() *Mux { return &Mux{} }
+func NewMux() *Mux    { return &Mux{} }
+
+func (mx *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request)   {}
+func (mx *Mux) Use(middlewares ...func(http.Handler) http.Handler) {}
+func (mx *Mux) Get(pattern string, h http.HandlerFunc)             {}
+func (mx *Mux) Route(pattern string, fn func(r Router)) Router     { return mx }
+
+type Context struct{}
+
+func RouteContext(ctx context.Context) *Context { return nil }
+
+func (x *Context) RoutePattern() string { return "" }
+
+func URLParam(r *http.Request, key string) string { return "" }
+`,
+	app: frameworkTestApp{
+		imports: []string{"net/http", Chi + "/v5"},
+		handlers: `func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	n, err := load(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+
+func admin() http.Handler {
+	router := chi.NewRouter()
+	router.Get("/health", health)
+	return router
+}
+`,
+		main: `	router := chi.NewRouter()
+	router.Get("/health", health)
+	router.Route("/api", func(api chi.Router) {
+		api.Get("/items/{id}", item)
+	})
+
+	go http.ListenAndServe(":8001", admin())
+	http.ListenAndServe(":8000", router)
+`,
+	},
+	newRelic: frameworkTestApp{
+		imports: []string{"net/http", Chi + "/v5"},
+		handlers: `func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	nrTxn := newrelic.FromContext(r.Context())
+
+	n, err := load(chi.URLParam(r, "id"), nrTxn)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+
+func admin(NewRelicAgent *newrelic.Application) http.Handler {
+	router := chi.NewRouter()
+	router.Use(newRelicChiMiddleware(NewRelicAgent))
+	router.Get("/health", health)
+	return router
+}
+
+// newRelicChiMiddleware starts a transaction for each request the router routes, and names it
+// after the pattern of the route of the request once it is routed.
+func newRelicChiMiddleware(app *newrelic.Application) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			txn := app.StartTransaction(r.Method + " " + r.URL.Path)
+			defer txn.End()
+
+			txn.SetWebRequestHTTP(r)
+			w = txn.SetWebResponse(w)
+			next.ServeHTTP(w, newrelic.RequestWithTransactionContext(r, txn))
+			txn.SetName(r.Method + " " + chi.RouteContext(r.Context()).RoutePattern())
+		})
+	}
+}
+`,
+		main: `	router := chi.NewRouter()
+	router.Use(newRelicChiMiddleware(NewRelicAgent))
+	router.Get("/health", health)
+	router.Route("/api", func(api chi.Router) {
+		api.Get("/items/{id}", item)
+	})
+
+	go http.ListenAndServe(":8001", admin(NewRelicAgent))
+	http.ListenAndServe(":8000", router)
+`,
+	},
+	openTelemetry: frameworkTestApp{
+		imports: []string{"net/http", Chi + "/v5"},
+		handlers: `func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	n, err := load(chi.URLParam(r, "id"), ctx)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+
+func admin() http.Handler {
+	router := chi.NewRouter()
+	router.Use(otelChiMiddleware)
+	router.Get("/health", health)
+	return router
+}
+
+// otelChiMiddleware starts a server span for each request the router routes, and names it
+// after the pattern of the route of the request once it is routed.
+func otelChiMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := otel.Tracer("github.com/newrelic/go-easy-instrumentation/parser/instrumentation/tmp").Start(r.Context(), r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+		span.SetName(r.Method + " " + chi.RouteContext(r.Context()).RoutePattern())
+	})
+}
+`,
+		main: `	router := chi.NewRouter()
+	router.Use(otelChiMiddleware)
+	router.Get("/health", health)
+	router.Route("/api", func(api chi.Router) {
+		api.Get("/items/{id}", item)
+	})
+
+	go http.ListenAndServe(":8001", admin())
+	http.ListenAndServe(":8000", router)
+`,
+	},
+}
+
+func Test_InstrumentPackages_chi(t *testing.T) {
+	chiTest.run(t)
+}
+
+// failingRouteMiddlewareBackend is a backend whose route middleware can not be parsed.
+type failingRouteMiddlewareBackend struct {
+	newRelicBackend
+}
+
+func (failingRouteMiddlewareBackend) RouteMiddleware(string, string, string) (*dst.FuncDecl, error) {
+	return parseRouteMiddleware("func newRelicChiMiddleware(", nil)
+}
+
+func Test_InstrumentPackages_chiMiddlewareNotDeclared(t *testing.T) {
+	app := chiTest.app.source("")
+	manager := newTestingInstrumentationManager(t, app)
+	manager.backend = failingRouteMiddlewareBackend{}
+	defer panicRecovery(t)
+
+	assert.NoError(t, manager.InstrumentPackages())
+	assert.NotContains(t, printTestApp(t, manager), "router.Use(", "routers must not use middleware that is not declared")
+	if assert.Len(t, manager.skipped, 2) {
+		for _, skipped := range manager.skipped {
+			assert.Equal(t, ruleMiddleware, skipped.rule)
+			assert.Contains(t, skipped.reason, "the middleware of the router can not be declared: ")
+		}
+	}
+}
+
+func Test_routerImportPath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{name: "module", path: Chi, want: Chi},
+		{name: "major_version", path: Chi + "/v5", want: Chi + "/v5"},
+		{name: "other_module", path: "github.com/go-chi/chi-extra/v5"},
+		{name: "subpackage", path: Chi + "/v5/middleware"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			call := &dst.CallExpr{Fun: &dst.Ident{Name: ChiNewRouter, Path: tt.path}}
+			assert.Equal(t, tt.want, routerImportPath(call, webFrameworks[FrameworkChi]))
+		})
+	}
+}
+
+func Test_isRouterMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		call *dst.CallExpr
+		want bool
+	}{
+		{name: "integration", call: &dst.CallExpr{Fun: &dst.Ident{Name: "Middleware", Path: nrginImport}}, want: true},
+		{name: "declared", call: &dst.CallExpr{Fun: dst.NewIdent("newRelicChiMiddleware")}, want: true},
+		{name: "declared_in_other_package", call: &dst.CallExpr{Fun: &dst.Ident{Name: "newRelicChiMiddleware", Path: "example.com/app"}}},
+		{name: "other_function", call: &dst.CallExpr{Fun: dst.NewIdent("Middleware")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRouterMiddleware(tt.call))
+		})
+	}
+}
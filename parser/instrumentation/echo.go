@@ -0,0 +1,198 @@
+package instrumentation
+
+import (
+	"go/ast"
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	Echo = "github.com/labstack/echo/v4"
+
+	// function that creates an echo instance
+	EchoNew = "New"
+
+	// FrameworkEcho is the echo web framework, which routers and handlers are instrumented for.
+	FrameworkEcho = "echo"
+
+	nrechoImport   = "github.com/newrelic/go-agent/v3/integrations/nrecho-v4"
+	otelechoImport = "go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+
+	// echoGroup is the method of echo instances and groups that creates a group of routes
+	echoGroup = "Group"
+)
+
+// echoRouteMethods are the methods of echo instances and groups that register the handler of a route, and the index of
+// the handler in their arguments.
+var echoRouteMethods = map[string]int{
+	"GET":     1,
+	"POST":    1,
+	"PUT":     1,
+	"DELETE":  1,
+	"PATCH":   1,
+	"HEAD":    1,
+	"OPTIONS": 1,
+	"CONNECT": 1,
+	"TRACE":   1,
+	"Any":     1,
+	"Match":   2,
+	"Add":     2,
+}
+
+// InstrumentEchoRouter adds the echo middleware of the instrumentation target to the echo instances created in main, so
+// that each request they handle starts a transaction. The middleware is reported by the agent main creates.
+func InstrumentEchoRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentMainRouters(n, manager, FrameworkEcho)
+}
+
+// InstrumentNestedEchoRouter adds the echo middleware of the instrumentation target to the echo instances created in
+// functions other than main. The middleware is reported by the agent main creates, which the function is passed.
+func InstrumentNestedEchoRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentNestedRouters(n, manager, FrameworkEcho)
+}
+
+// isEchoHandler returns true if decl is an echo handler, a function that takes an echo.Context and returns an error.
+func isEchoHandler(decl *dst.FuncDecl) bool {
+	params := decl.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return false
+	}
+	ident, ok := params[0].Type.(*dst.Ident)
+	if !ok || ident.Name != "Context" || ident.Path != Echo {
+		return false
+	}
+	results := decl.Type.Results
+	if results == nil || len(results.List) != 1 || len(results.List[0].Names) > 1 {
+		return false
+	}
+	result, ok := results.List[0].Type.(*dst.Ident)
+	return ok && result.Name == "error" && result.Path == ""
+}
+
+// isEchoHandlerSignature returns true for functions with the signature func(echo.Context) error.
+func isEchoHandlerSignature(sig *types.Signature) bool {
+	params, results := sig.Params(), sig.Results()
+	return params.Len() == 1 && params.At(0).Type().String() == Echo+".Context" &&
+		results.Len() == 1 && results.At(0).Type().String() == "error"
+}
+
+// echoHandlers returns the IDs of the functions of the current package that are registered as the handlers of echo
+// routes, such as item in e.GET("/items/:id", item).
+func (m *InstrumentationManager) echoHandlers() map[string]bool {
+	state := m.packages[m.currentPackage]
+	if state.echoHandlers != nil {
+		return state.echoHandlers
+	}
+	state.echoHandlers = map[string]bool{}
+	routers := echoRouterVariables(state.pkg)
+	for _, file := range state.pkg.Syntax {
+		dst.Inspect(file, func(n dst.Node) bool {
+			call, ok := n.(*dst.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*dst.SelectorExpr)
+			if !ok {
+				return true
+			}
+			i, ok := echoRouteMethods[sel.Sel.Name]
+			if !ok || i >= len(call.Args) || !isEchoRouter(sel.X, state.pkg, routers) {
+				return true
+			}
+			if id := m.functionValueID(call.Args[i]); id != "" {
+				state.echoHandlers[id] = true
+			}
+			return true
+		})
+	}
+	return state.echoHandlers
+}
+
+// isEchoRouter returns true if expr is an echo instance or group. Without type information, it is one if it is a
+// variable an echo instance or group is assigned to in the package, one of routers.
+func isEchoRouter(expr dst.Expr, pkg *decorator.Package, routers map[string]bool) bool {
+	if pkg != nil && pkg.TypesInfo != nil {
+		if astExpr, ok := pkg.Decorator.Ast.Nodes[expr].(ast.Expr); ok {
+			if t := pkg.TypesInfo.TypeOf(astExpr); t != nil && t != types.Typ[types.Invalid] {
+				return t.String() == "*"+Echo+".Echo" || t.String() == "*"+Echo+".Group"
+			}
+		}
+	}
+	ident, ok := expr.(*dst.Ident)
+	return ok && ident.Path == "" && routers[ident.Name]
+}
+
+// echoRouterVariables returns the names of the variables of the package that echo instances are assigned, such as
+// e := echo.New(), and the groups of routes created from them, such as api := e.Group("/api").
+func echoRouterVariables(pkg *decorator.Package) map[string]bool {
+	routers := map[string]bool{}
+	for found := true; found; {
+		found = false
+		for _, file := range pkg.Syntax {
+			dst.Inspect(file, func(n dst.Node) bool {
+				assign, ok := n.(*dst.AssignStmt)
+				if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+					return true
+				}
+				ident, ok := assign.Lhs[0].(*dst.Ident)
+				call, isCall := assign.Rhs[0].(*dst.CallExpr)
+				if !ok || !isCall || routers[ident.Name] {
+					return true
+				}
+				router := false
+				switch fun := call.Fun.(type) {
+				case *dst.Ident:
+					router = fun.Path == Echo && fun.Name == EchoNew
+				case *dst.SelectorExpr:
+					x, ok := fun.X.(*dst.Ident)
+					router = ok && fun.Sel.Name == echoGroup && routers[x.Name]
+				}
+				if router {
+					routers[ident.Name] = true
+					found = true
+				}
+				return true
+			})
+		}
+	}
+	return routers
+}
+
+// InstrumentEchoHandler traces echo handlers as the entry points of the transactions the echo middleware starts. The
+// handlers are the functions registered for routes of echo instances and groups. The transaction is taken from the
+// context of the handler, and passed down its call chain the way InstrumentHandleFunction passes the transaction of an
+// http handler. The errors the handler returns are noticed before it returns them.
+func InstrumentEchoHandler(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	fn, isFn := n.(*dst.FuncDecl)
+	if !isFn {
+		return
+	}
+	id := manager.functionID(fn)
+	if !isEchoHandler(fn) {
+		manager.explain(id, "%s: isEchoHandler is false, it does not take an echo.Context and return an error", RuleEchoHandler)
+		return
+	}
+	if !manager.echoHandlers()[id] {
+		manager.explain(id, "%s: isEchoHandler is true, but it is not registered as the handler of a route", RuleEchoHandler)
+		return
+	}
+	traceFrameworkHandler(manager, fn, c, FrameworkEcho, RuleEchoHandler, "isEchoHandler")
+}
+
+// echoRequestContext creates the expression of the context of the request of an echo context: ctx.Request().Context()
+func echoRequestContext(ctx dst.Expr) dst.Expr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   ctx,
+					Sel: dst.NewIdent("Request"),
+				},
+			},
+			Sel: dst.NewIdent("Context"),
+		},
+	}
+}
@@ -0,0 +1,231 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+var echoTest = frameworkTest{
+	importPath: Echo,
+	stub: `package echo
+
+import "net/http"
+
+type Context interface {
+	Request() *http.Request
+	Param(name string) string
+	QueryParam(name string) string
+	NoContent(code int) error
+	JSON(code int, i interface{}) error
+}
+
+type HandlerFunc func(c Context) error
+
+type MiddlewareFunc func(next HandlerFunc) HandlerFunc
+
+type Route struct{}
+
+type Echo struct{}
+
+type Group struct{}
+
+func New() *Echo { return &Echo{} }
+
+func (e *Echo) Use(middleware ...MiddlewareFunc)                            {}
+func (e *Echo) GET(path string, h HandlerFunc, m ...MiddlewareFunc) *Route  { return nil }
+func (e *Echo) Group(prefix string, m ...MiddlewareFunc) *Group             { return nil }
+func (e *Echo) Start(address string) error                                  { return nil }
+func (g *Group) GET(path string, h HandlerFunc, m ...MiddlewareFunc) *Route { return nil }
+`,
+	app: frameworkTestApp{
+		imports: []string{Echo},
+		handlers: `func setup() {
+	admin := echo.New()
+	api := admin.Group("/api")
+	api.GET("/health", health)
+}
+
+func health(c echo.Context) error {
+	return c.NoContent(200)
+}
+
+func notFound(c echo.Context) error {
+	return c.NoContent(404)
+}
+
+func item(c echo.Context) error {
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	if err != nil {
+		return err
+	}
+	n, err := load(c.Param("id"))
+	if err != nil {
+		return notFound(c)
+	}
+	return c.JSON(200, n*page)
+}
+`,
+		main: `	e := echo.New()
+
+	e.GET("/items/:id", item)
+	setup()
+	e.Start(":8000")
+`,
+	},
+	newRelic: frameworkTestApp{
+		imports: []string{Echo, nrechoImport},
+		handlers: `func setup(NewRelicAgent *newrelic.Application) {
+	admin := echo.New()
+	admin.Use(nrecho.Middleware(NewRelicAgent))
+	api := admin.Group("/api")
+	api.GET("/health", health)
+}
+
+func health(c echo.Context) error {
+	nrTxn := nrecho.FromContext(c)
+
+	err := c.NoContent(200)
+	nrTxn.NoticeError(err)
+	return err
+}
+
+func notFound(c echo.Context) error {
+	return c.NoContent(404)
+}
+
+func item(c echo.Context) error {
+	nrTxn := nrecho.FromContext(c)
+
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	nrTxn.NoticeError(err)
+	if err != nil {
+		return err
+	}
+	n, err := load(c.Param("id"), nrTxn)
+	if err != nil {
+		err2 := notFound(c)
+		nrTxn.NoticeError(err2)
+		return err2
+	}
+	err3 := c.JSON(200, n*page)
+	nrTxn.NoticeError(err3)
+	return err3
+}
+`,
+		main: `	e := echo.New()
+	e.Use(nrecho.Middleware(NewRelicAgent))
+
+	e.GET("/items/:id", item)
+	setup(NewRelicAgent)
+	e.Start(":8000")
+`,
+	},
+	openTelemetry: frameworkTestApp{
+		imports: []string{"os", Echo, otelechoImport},
+		handlers: `func setup() {
+	admin := echo.New()
+	admin.Use(otelecho.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+	api := admin.Group("/api")
+	api.GET("/health", health)
+}
+
+func health(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	err := c.NoContent(200)
+	trace.SpanFromContext(ctx).RecordError(err)
+	return err
+}
+
+func notFound(c echo.Context) error {
+	return c.NoContent(404)
+}
+
+func item(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	page, err := strconv.Atoi(c.QueryParam("page"))
+	trace.SpanFromContext(ctx).RecordError(err)
+	if err != nil {
+		return err
+	}
+	n, err := load(c.Param("id"), ctx)
+	if err != nil {
+		err2 := notFound(c)
+		trace.SpanFromContext(ctx).RecordError(err2)
+		return err2
+	}
+	err3 := c.JSON(200, n*page)
+	trace.SpanFromContext(ctx).RecordError(err3)
+	return err3
+}
+`,
+		main: `	e := echo.New()
+	e.Use(otelecho.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+
+	e.GET("/items/:id", item)
+	setup()
+	e.Start(":8000")
+`,
+	},
+}
+
+func Test_InstrumentPackages_echo(t *testing.T) {
+	echoTest.run(t)
+}
+
+func Test_isEchoHandler(t *testing.T) {
+	echoContext := &dst.Ident{Name: "Context", Path: Echo}
+	errorResult := &dst.FieldList{List: []*dst.Field{{Type: dst.NewIdent("error")}}}
+	tests := []struct {
+		name    string
+		params  []*dst.Field
+		results *dst.FieldList
+		want    bool
+	}{
+		{name: "handler", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("c")}, Type: echoContext}}, results: errorResult, want: true},
+		{name: "unnamed", params: []*dst.Field{{Type: echoContext}}, results: errorResult, want: true},
+		{name: "no_error", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("c")}, Type: echoContext}}},
+		{
+			name:    "other_result",
+			params:  []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("c")}, Type: echoContext}},
+			results: &dst.FieldList{List: []*dst.Field{{Type: dst.NewIdent("int")}}},
+		},
+		{name: "other_context", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("ctx")}, Type: &dst.Ident{Name: "Context", Path: "context"}}}, results: errorResult},
+		{name: "two_params", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("a"), dst.NewIdent("b")}, Type: echoContext}}, results: errorResult},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decl := &dst.FuncDecl{Name: dst.NewIdent("handler"), Type: &dst.FuncType{Params: &dst.FieldList{List: tt.params}, Results: tt.results}}
+			assert.Equal(t, tt.want, isEchoHandler(decl))
+		})
+	}
+}
+
+func Test_echoHandlers(t *testing.T) {
+	want := map[string]bool{
+		testAppPackage + ".health": true,
+		testAppPackage + ".item":   true,
+	}
+	for _, typed := range []bool{false, true} {
+		name := "untyped"
+		if typed {
+			name = "typed"
+		}
+		t.Run(name, func(t *testing.T) {
+			var manager *InstrumentationManager
+			if typed {
+				manager = newTypedTestingInstrumentationManager(t, echoTest.app.source(""), echoTest.importPath, echoTest.stub)
+			} else {
+				manager = newTestingInstrumentationManager(t, echoTest.app.source(""))
+			}
+			defer panicRecovery(t)
+
+			assert.NoError(t, tracePackageFunctionCalls(manager))
+			manager.SetPackage(testAppPackage)
+			assert.Equal(t, want, manager.echoHandlers(), "notFound is not registered as the handler of a route")
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package instrumentation
+
+import (
+	"go/ast"
+	"go/types"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// existingInstrumentation is the New Relic instrumentation an application contained before it was instrumented. Rules skip
+// what is already instrumented, so that the tool can be run again after the application changes.
+type existingInstrumentation struct {
+	agentVariable string                   // variable the application created in main.main is assigned to
+	transactions  map[*dst.FuncDecl]string // names of the transactions functions are passed or get from their context
+	segments      map[*dst.FuncDecl]bool   // functions that start a segment
+	nodes         map[dst.Node]bool        // statements and calls that are already instrumented
+}
+
+func newExistingInstrumentation() *existingInstrumentation {
+	return &existingInstrumentation{
+		transactions: map[*dst.FuncDecl]string{},
+		segments:     map[*dst.FuncDecl]bool{},
+		nodes:        map[dst.Node]bool{},
+	}
+}
+
+// findExistingInstrumentation finds the New Relic instrumentation in all functions declared in the instrumented packages.
+// Wrappers added for functions that are traced under a new name are not traced again.
+func findExistingInstrumentation(manager *InstrumentationManager) {
+	rootPkg := manager.currentPackage
+	defer manager.SetPackage(rootPkg)
+
+	for pkgName, state := range manager.packages {
+		manager.SetPackage(pkgName)
+		for _, file := range state.pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok || fn.Body == nil {
+					continue
+				}
+				findFunctionInstrumentation(manager.existing, fn, state.pkg)
+				if isSignaturePreservingWrapper(fn) {
+					if traced, ok := state.tracedFuncs[manager.functionID(fn)]; ok {
+						traced.untraceable = true
+					}
+				}
+			}
+		}
+	}
+}
+
+// findFunctionInstrumentation records the instrumentation found in the function declaration fn.
+func findFunctionInstrumentation(existing *existingInstrumentation, fn *dst.FuncDecl, pkg *decorator.Package) {
+	// transactions that are available in fn
+	txnNames := map[string]bool{}
+	if name := transactionParameterName(fn); name != "" {
+		existing.transactions[fn] = name
+		txnNames[name] = true
+	}
+
+	for _, stmt := range fn.Body.List {
+		if isSegmentStart(stmt, pkg) {
+			existing.segments[fn] = true
+		}
+	}
+
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		if _, ok := n.(*dst.FuncLit); ok {
+			return false
+		}
+		name, call := assignedCall(n)
+		if call == nil {
+			return true
+		}
+		switch {
+		case newrelicFunctionName(call) == "FromContext" || isHandlerTransaction(call):
+			if _, ok := existing.transactions[fn]; !ok {
+				existing.transactions[fn] = name
+			}
+			txnNames[name] = true
+		case newrelicFunctionName(call) == "NewApplication" && fn.Name.Name == "main" && fn.Recv == nil && pkg.Name == "main":
+			existing.agentVariable = name
+		case newrelicMethodName(call, pkg) == "StartTransaction":
+			txnNames[name] = true
+		}
+		return true
+	})
+
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.BlockStmt:
+			findStatementInstrumentation(existing, v.List, pkg)
+		case *dst.CaseClause:
+			findStatementInstrumentation(existing, v.Body, pkg)
+		case *dst.CommClause:
+			findStatementInstrumentation(existing, v.Body, pkg)
+		case *dst.GoStmt:
+			if passesTransaction(v.Call, txnNames, pkg) {
+				existing.nodes[v] = true
+			}
+		case *dst.CallExpr:
+			if passesTransaction(v, txnNames, pkg) || wrapsHandler(v) {
+				existing.nodes[v] = true
+			}
+		}
+		return true
+	})
+}
+
+// findStatementInstrumentation records the statements in a list that are instrumented by the statements around them.
+func findStatementInstrumentation(existing *existingInstrumentation, stmts []dst.Stmt, pkg *decorator.Package) {
+	for i, stmt := range stmts {
+		// middleware instruments the router created before
+		if usesRouterMiddleware(stmt) && i > 0 {
+			existing.nodes[stmts[i-1]] = true
+		}
+		for _, call := range statementCalls(stmt) {
+			switch newrelicFunctionName(call) {
+			case "StartExternalSegment", "RequestWithTransactionContext":
+				// instruments the external call that follows
+				if i+1 < len(stmts) {
+					existing.nodes[stmts[i+1]] = true
+				}
+			case "NewRoundTripper":
+				// instruments the client defined before
+				if i > 0 {
+					existing.nodes[stmts[i-1]] = true
+				}
+			}
+			switch newrelicMethodName(call, pkg) {
+			case "NoticeError":
+				// notices the error assigned before
+				if i > 0 {
+					existing.nodes[stmts[i-1]] = true
+				}
+			case "StartTransaction":
+				// is passed to the call that follows
+				if i+1 < len(stmts) {
+					existing.nodes[stmts[i+1]] = true
+				}
+			case "StartSegment", "StartSegmentNow":
+				// a segment assigned to a variable times the call that follows, unlike a deferred one
+				if _, ok := stmt.(*dst.AssignStmt); ok && i+1 < len(stmts) {
+					existing.nodes[stmts[i+1]] = true
+				}
+			}
+		}
+	}
+}
+
+// assignedCall returns the call in an assignment of a single call, and the name of the first variable it is assigned to.
+func assignedCall(n dst.Node) (string, *dst.CallExpr) {
+	assign, ok := n.(*dst.AssignStmt)
+	if !ok || len(assign.Lhs) == 0 || len(assign.Rhs) != 1 {
+		return "", nil
+	}
+	call, ok := assign.Rhs[0].(*dst.CallExpr)
+	if !ok {
+		return "", nil
+	}
+	ident, ok := assign.Lhs[0].(*dst.Ident)
+	if !ok || ident.Name == "_" {
+		return "", nil
+	}
+	return ident.Name, call
+}
+
+// statementCalls returns the calls made by a statement, leaving out calls made in function literals.
+func statementCalls(stmt dst.Stmt) []*dst.CallExpr {
+	calls := []*dst.CallExpr{}
+	dst.Inspect(stmt, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.FuncLit, *dst.BlockStmt:
+			return false
+		case *dst.CallExpr:
+			calls = append(calls, v)
+		}
+		return true
+	})
+	return calls
+}
+
+// newrelicFunctionName returns the name of the New Relic agent function invoked by call, or an empty string if it invokes
+// anything else.
+func newrelicFunctionName(call *dst.CallExpr) string {
+	if ident, ok := call.Fun.(*dst.Ident); ok && ident.Path == newrelicAgentImport {
+		return ident.Name
+	}
+	return ""
+}
+
+// newrelicMethodName returns the name of the method invoked by call if its receiver is a New Relic agent type, or an
+// empty string if it is not. Methods with receivers of unknown type are assumed to belong to the agent.
+func newrelicMethodName(call *dst.CallExpr, pkg *decorator.Package) string {
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok {
+		return ""
+	}
+	if pkg != nil && pkg.TypesInfo != nil {
+		if astSel, ok := pkg.Decorator.Ast.Nodes[sel].(*ast.SelectorExpr); ok {
+			if selection, ok := pkg.TypesInfo.Selections[astSel]; ok && !isNewRelicType(selection.Recv()) {
+				return ""
+			}
+		}
+	}
+	return sel.Sel.Name
+}
+
+// isNewRelicType returns true if t, or the type it points to, is declared in the New Relic agent package.
+func isNewRelicType(t types.Type) bool {
+	if ptr, ok := t.(*types.Pointer); ok {
+		t = ptr.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj != nil && obj.Pkg() != nil && obj.Pkg().Path() == newrelicAgentImport
+}
+
+// transactionParameterName returns the name of the *newrelic.Transaction parameter of a function, or an empty string
+// if it has none.
+func transactionParameterName(fn *dst.FuncDecl) string {
+	if fn.Type.Params == nil {
+		return ""
+	}
+	for _, field := range fn.Type.Params.List {
+		star, ok := field.Type.(*dst.StarExpr)
+		if !ok {
+			continue
+		}
+		ident, ok := star.X.(*dst.Ident)
+		if ok && ident.Name == "Transaction" && ident.Path == newrelicAgentImport && len(field.Names) == 1 {
+			return field.Names[0].Name
+		}
+	}
+	return ""
+}
+
+// isSegmentStart returns true if a statement starts a segment.
+func isSegmentStart(stmt dst.Stmt, pkg *decorator.Package) bool {
+	for _, call := range statementCalls(stmt) {
+		if newrelicFunctionName(call) == "StartSegment" || newrelicMethodName(call, pkg) == "StartSegment" {
+			return true
+		}
+	}
+	return false
+}
+
+// passesTransaction returns true if call is passed one of the transactions txnNames, a goroutine of it, or a context
+// carrying a transaction.
+func passesTransaction(call *dst.CallExpr, txnNames map[string]bool, pkg *decorator.Package) bool {
+	for _, arg := range call.Args {
+		switch v := arg.(type) {
+		case *dst.Ident:
+			if v.Path == "" && txnNames[v.Name] {
+				return true
+			}
+		case *dst.CallExpr:
+			if newrelicFunctionName(v) == "NewContext" {
+				return true
+			}
+			if sel, ok := v.Fun.(*dst.SelectorExpr); ok && sel.Sel.Name == "NewGoroutine" {
+				if ident, ok := sel.X.(*dst.Ident); ok && txnNames[ident.Name] {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// wrapsHandler returns true if one of the arguments of call wraps an http handler with a transaction.
+func wrapsHandler(call *dst.CallExpr) bool {
+	for _, arg := range call.Args {
+		if argCall, ok := arg.(*dst.CallExpr); ok {
+			switch newrelicFunctionName(argCall) {
+			case "WrapHandleFunc", "WrapHandle":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isSignaturePreservingWrapper returns true if fn only calls the function it is traced under without a transaction.
+func isSignaturePreservingWrapper(fn *dst.FuncDecl) bool {
+	if len(fn.Body.List) != 1 {
+		return false
+	}
+	var call *dst.CallExpr
+	switch stmt := fn.Body.List[0].(type) {
+	case *dst.ExprStmt:
+		call, _ = stmt.X.(*dst.CallExpr)
+	case *dst.ReturnStmt:
+		if len(stmt.Results) == 1 {
+			call, _ = stmt.Results[0].(*dst.CallExpr)
+		}
+	}
+	if call == nil || len(call.Args) == 0 {
+		return false
+	}
+
+	var name string
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		name = fun.Name
+	case *dst.SelectorExpr:
+		name = fun.Sel.Name
+	}
+	last, ok := call.Args[len(call.Args)-1].(*dst.Ident)
+	return ok && last.Name == "nil" && strings.TrimSuffix(name, tracedFunctionSuffix) == fn.Name.Name && name != fn.Name.Name
+}
+
+// IsInstrumented returns true if a statement or call of the application was instrumented before it was loaded.
+func (m *InstrumentationManager) IsInstrumented(node dst.Node) bool {
+	return m.existing.nodes[node]
+}
+
+// ExistingTransactionName returns the name of the transaction a function was passed before the application was
+// loaded, or an empty string if it was not passed one.
+func (m *InstrumentationManager) ExistingTransactionName(decl *dst.FuncDecl) string {
+	return m.existing.transactions[decl]
+}
+
+// HasSegment returns true if a function started a segment before the application was loaded.
+func (m *InstrumentationManager) HasSegment(decl *dst.FuncDecl) bool {
+	return m.existing.segments[decl]
+}
+
+// TransactionName returns the name of the transaction a function is passed: the transaction it was already passed, the
+// context argument it gets its transaction from if transactions are contexts, or a new name that is free in it.
+func (m *InstrumentationManager) TransactionName(decl *dst.FuncDecl) string {
+	if name := m.ExistingTransactionName(decl); name != "" {
+		return name
+	}
+	if ctx := m.TransactionContextName(decl); ctx != "" && m.Backend().ContextIsTransaction() {
+		return ctx
+	}
+	return m.FunctionVariableName(decl, m.Backend().TransactionVariableName())
+}
@@ -0,0 +1,180 @@
+package instrumentation
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+// instrumentedApp is an application as the tool instruments it.
+const instrumentedApp = `package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+func work(nrTxn *newrelic.Transaction) error {
+	defer nrTxn.StartSegment("work").End()
+	err := errors.New("failed")
+	nrTxn.NoticeError(err)
+	return err
+}
+
+func Exported() {
+	ExportedWithTxn(nil)
+}
+
+// ExportedWithTxn is Exported, traced with a New Relic transaction.
+// Exported preserves its original signature for callers that are not passed a transaction.
+func ExportedWithTxn(nrTxn *newrelic.Transaction) {
+	defer nrTxn.StartSegment("Exported").End()
+	work(nrTxn)
+}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	nrTxn := newrelic.FromContext(r.Context())
+
+	client := &http.Client{}
+	client.Transport = newrelic.NewRoundTripper(client.Transport)
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	req = newrelic.RequestWithTransactionContext(req, nrTxn)
+	client.Do(req)
+	go func(nrTxn *newrelic.Transaction) {
+		defer nrTxn.StartSegment("async literal").End()
+		work(nrTxn)
+	}(nrTxn.NewGoroutine())
+}
+
+func main() {
+	NewRelicAgent, err := newrelic.NewApplication(newrelic.ConfigAppName("app"), newrelic.ConfigFromEnvironment())
+	if err != nil {
+		panic(err)
+	}
+
+	http.HandleFunc(newrelic.WrapHandleFunc(NewRelicAgent, "/", index))
+	nrTxn := NewRelicAgent.StartTransaction("work")
+	work(nrTxn)
+	nrTxn.End()
+	nrTxn = NewRelicAgent.StartTransaction("ExportedWithTxn")
+	ExportedWithTxn(nrTxn)
+	nrTxn.End()
+
+	NewRelicAgent.Shutdown(5 * time.Second)
+}
+`
+
+func Test_findExistingInstrumentation(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, instrumentedApp)
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "NewRelicAgent", manager.existing.agentVariable)
+
+	tests := []struct {
+		name             string
+		wantTxn          string
+		wantSegment      bool
+		wantInstrumented []int // indexes of the statements of the function body that are already instrumented
+	}{
+		{name: "work", wantTxn: "nrTxn", wantSegment: true, wantInstrumented: []int{1}},
+		{name: "Exported"},
+		{name: "ExportedWithTxn", wantTxn: "nrTxn", wantSegment: true},
+		{name: "index", wantTxn: "nrTxn", wantInstrumented: []int{1, 5, 6}},
+		{name: "main", wantInstrumented: []int{4, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decl := manager.GetDeclaration(testAppPackage + "." + tt.name)
+			if decl == nil {
+				t.Fatalf("function %s is not declared", tt.name)
+			}
+			assert.Equal(t, tt.wantTxn, manager.ExistingTransactionName(decl))
+			assert.Equal(t, tt.wantSegment, manager.HasSegment(decl))
+
+			instrumented := []int{}
+			for i, stmt := range decl.Body.List {
+				if manager.IsInstrumented(stmt) {
+					instrumented = append(instrumented, i)
+				}
+			}
+			if tt.wantInstrumented == nil {
+				tt.wantInstrumented = []int{}
+			}
+			assert.Equal(t, tt.wantInstrumented, instrumented)
+		})
+	}
+
+	t.Run("wrapper is not traced", func(t *testing.T) {
+		assert.False(t, manager.ShouldInstrumentFunction(&invocationInfo{packageName: testAppPackage, functionID: testAppPackage + ".Exported"}))
+	})
+}
+
+func Test_InstrumentPackages_idempotent(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, instrumentedApp)
+	defer panicRecovery(t)
+	err := manager.InstrumentPackages()
+	assert.NoError(t, err)
+	assert.Empty(t, manager.changes, "an instrumented application must not be changed again")
+
+	got := bytes.NewBuffer([]byte{})
+	r := decorator.NewRestorerWithImports(testAppPackage, guess.New())
+	if err := r.Fprint(got, manager.GetDecoratorPackage().Syntax[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, instrumentedApp, got.String())
+}
+
+func Test_isSignaturePreservingWrapper(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{
+			name: "wrapper",
+			code: "func Run(n int) error {\n\treturn RunWithTxn(n, nil)\n}",
+			want: true,
+		},
+		{
+			name: "method wrapper",
+			code: "func (s *S) Run() {\n\ts.RunWithTxn(nil)\n}",
+			want: true,
+		},
+		{
+			name: "calls another function",
+			code: "func Run(n int) error {\n\treturn Other(n, nil)\n}",
+			want: false,
+		},
+		{
+			name: "passes a transaction",
+			code: "func Run(n int) error {\n\treturn RunWithTxn(n, txn)\n}",
+			want: false,
+		},
+		{
+			name: "more than one statement",
+			code: "func Run(n int) error {\n\tprintln(n)\n\treturn RunWithTxn(n, nil)\n}",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := "package main\n\ntype S struct{}\n\n" + tt.code + "\n"
+			file, err := decorator.Parse(code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decl := file.Decls[len(file.Decls)-1].(*dst.FuncDecl)
+			assert.Equal(t, tt.want, isSignaturePreservingWrapper(decl))
+		})
+	}
+}
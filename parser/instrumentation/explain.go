@@ -0,0 +1,217 @@
+package instrumentation
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// explanation is the trail of the decisions the rules made about a function while the application was instrumented.
+type explanation struct {
+	function  string   // ID of the function
+	name      string   // human readable name of the function
+	pkg       string   // ID of the package the function is declared in
+	file      string   // path of the file the function is declared in
+	startLine int      // first line of the declaration
+	endLine   int      // last line of the declaration
+	steps     []string // decisions made about the function, in the order they were made
+	called    bool     // a call to the function was found
+}
+
+// ExplainFunction makes the manager record the decisions the rules make about a function while the application is
+// instrumented, so that Explain can describe them. The function is named by its ID, e.g. "(*example.com/app.Server).Close",
+// its name, e.g. "Server.Close", or a file:line position in its declaration, relative to the application.
+func (m *InstrumentationManager) ExplainFunction(target string) error {
+	currentPackage := m.currentPackage
+	defer m.SetPackage(currentPackage)
+
+	path, line, isPosition := parsePosition(target)
+	matches := []*explanation{}
+	for pkgName, state := range m.packages {
+		m.SetPackage(pkgName)
+		for _, file := range state.pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok {
+					continue
+				}
+				astDecl, ok := state.pkg.Decorator.Ast.Nodes[fn]
+				if !ok {
+					continue
+				}
+				start, end := state.pkg.Fset.Position(astDecl.Pos()), state.pkg.Fset.Position(astDecl.End())
+				id := m.functionID(fn)
+				if isPosition {
+					if !m.isApplicationFile(start.Filename, path) || line < start.Line || line > end.Line {
+						continue
+					}
+				} else if target != id && target != functionDeclName(fn) {
+					continue
+				}
+				matches = append(matches, &explanation{
+					function:  id,
+					name:      functionDeclName(fn),
+					pkg:       pkgName,
+					file:      start.Filename,
+					startLine: start.Line,
+					endLine:   end.Line,
+				})
+			}
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no function declared in the application matches %q", target)
+	case 1:
+		m.explanation = matches[0]
+		return nil
+	}
+	ids := []string{}
+	for _, match := range matches {
+		ids = append(ids, match.function)
+	}
+	sort.Strings(ids)
+	return fmt.Errorf("%q matches more than one function, use the ID of one of them: %s", target, strings.Join(ids, ", "))
+}
+
+// isApplicationFile returns true if path, an absolute path, names the same file as name, a path relative to the
+// application or an absolute path.
+func (m *InstrumentationManager) isApplicationFile(path, name string) bool {
+	if filepath.IsAbs(name) {
+		return filepath.Clean(name) == path
+	}
+	return m.appRelativePath(path) == filepath.ToSlash(filepath.Clean(name))
+}
+
+// explaining returns true if the decisions made about the function with the given ID are being recorded.
+func (m *InstrumentationManager) explaining(functionID string) bool {
+	return m.explanation != nil && m.explanation.function == functionID
+}
+
+// explain records a decision made about the function with the given ID, if it is the function being explained.
+func (m *InstrumentationManager) explain(functionID, format string, args ...any) {
+	if m.explaining(functionID) {
+		m.explanation.steps = append(m.explanation.steps, fmt.Sprintf(format, args...))
+	}
+}
+
+// explainInvocation records the decisions made about a call to the function being explained, if inv invokes it.
+func (m *InstrumentationManager) explainInvocation(inv *invocationInfo, format string, args ...any) {
+	if inv == nil || !m.explaining(inv.functionID) {
+		return
+	}
+	caller := "main"
+	if len(m.callChain) > 0 {
+		caller = m.callChain[len(m.callChain)-1]
+	} else if m.entryPoint != nil {
+		caller = m.entryPoint.function
+	}
+	pos := m.sourcePosition(inv.call)
+	m.explanation.called = true
+	m.explain(inv.functionID, "call by %s at %s:%d: %s", caller, m.appRelativePath(pos.Filename), pos.Line, fmt.Sprintf(format, args...))
+}
+
+// Explain describes the decisions the rules made about the function given to ExplainFunction while the application
+// was instrumented, and the changes that were made to it or skipped.
+func (m *InstrumentationManager) Explain() string {
+	e := m.explanation
+	if e == nil {
+		return ""
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s (%s) is declared at %s:%d\n", e.name, e.function, m.appRelativePath(e.file), e.startLine)
+
+	routes := m.handlerRoutes()
+	if route, ok := routes[e.function]; ok {
+		fmt.Fprintf(b, "- %s: it is registered as the handler of the route %q, which starts its transaction\n", ruleWrapHandler, route)
+	}
+	entryPoints := map[string]bool{}
+	for _, c := range m.changes {
+		if c.entryPoint != nil {
+			entryPoints[c.entryPoint.function] = true
+		}
+	}
+	for _, step := range e.steps {
+		fmt.Fprintf(b, "- %s\n", step)
+	}
+	if _, isRoute := routes[e.function]; !e.called && !isRoute && !entryPoints[e.function] {
+		b.WriteString("- GetPackageFunctionInvocation found no call to it in main, or in the functions traced from main and the http handlers\n")
+	}
+	if m.callGraph != nil {
+		fmt.Fprintf(b, "- the call graph reaches it from a transaction entry point: %t\n", m.callGraph.IsReachable(e.function))
+	}
+	if state, ok := m.packages[e.pkg]; ok {
+		if fn, ok := state.tracedFuncs[e.function]; ok {
+			switch {
+			case fn.untraceable:
+				b.WriteString("- it is not traced: its signature can not be changed, and it can not be wrapped\n")
+			case fn.traced && fn.tracedName != "":
+				fmt.Fprintf(b, "- it is traced as %s, and %s calls it without a transaction\n", fn.tracedName, fn.name)
+			case fn.traced:
+				b.WriteString("- it is traced\n")
+			default:
+				b.WriteString("- it is not traced\n")
+			}
+		}
+	}
+
+	changes := []*change{}
+	for _, c := range m.changes {
+		if e.contains(c.pos.Filename, c.pos.Line) {
+			changes = append(changes, c)
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].pos.Line < changes[j].pos.Line
+	})
+	skipped := []string{}
+	for _, s := range m.skipped {
+		if e.contains(s.pos.Filename, s.pos.Line) {
+			skipped = append(skipped, fmt.Sprintf("%s at line %d: %s", s.rule, s.pos.Line, s.reason))
+		}
+	}
+	for key := range m.droppedChanges {
+		rule, pos, _ := strings.Cut(key, "@")
+		path, line, ok := parsePosition(pos)
+		if ok && e.contains(path, line) {
+			skipped = append(skipped, fmt.Sprintf("%s at line %d: the change does not compile, and was dropped", rule, line))
+		}
+	}
+	for _, s := range m.unreachedHandlers(routes, entryPoints) {
+		if s.File == m.appRelativePath(e.file) && s.Line == e.startLine {
+			skipped = append(skipped, fmt.Sprintf("%s at line %d: %s", s.Rule, s.Line, s.Reason))
+		}
+	}
+	sort.Strings(skipped)
+
+	if len(changes) == 0 {
+		b.WriteString("no changes were made to it\n")
+	} else {
+		b.WriteString("changes made to it:\n")
+	}
+	described := map[string]bool{}
+	for _, c := range changes {
+		// a rule can make more than one change to the same node, such as the declaration of a traced function
+		line := fmt.Sprintf("- %s at line %d: %s\n", c.rule, c.pos.Line, changeReason(c.rule))
+		if !described[line] {
+			described[line] = true
+			b.WriteString(line)
+		}
+	}
+	if len(skipped) > 0 {
+		b.WriteString("rules that declined to instrument it:\n")
+	}
+	for _, s := range skipped {
+		fmt.Fprintf(b, "- %s\n", s)
+	}
+	return b.String()
+}
+
+// contains returns true if a position is in the declaration of the function.
+func (e *explanation) contains(path string, line int) bool {
+	return path == e.file && line >= e.startLine && line <= e.endLine
+}
@@ -0,0 +1,122 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const explainTestApp = `package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type store struct{}
+
+func (s *store) load(key string) (int, error) {
+	n, err := strconv.Atoi(key)
+	return n, err
+}
+
+func (s *store) index(w http.ResponseWriter, r *http.Request) {
+	_, err := s.load(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func unused(w http.ResponseWriter, r *http.Request) {}
+
+func main() {
+	s := &store{}
+	http.HandleFunc("/", s.index)
+	http.ListenAndServe(":8000", nil)
+}
+`
+
+func TestInstrumentationManager_ExplainFunction(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{name: "id", target: "(*" + testAppPackage + ".store).load", want: "(*" + testAppPackage + ".store).load"},
+		{name: "name", target: "store.index", want: "(*" + testAppPackage + ".store).index"},
+		{name: "position", target: "app.go:15", want: "(*" + testAppPackage + ".store).index"},
+		{name: "position_of_declaration", target: "app.go:22", want: testAppPackage + ".unused"},
+		{name: "position_outside_function", target: "app.go:8", wantErr: true},
+		{name: "other_file", target: "main.go:15", wantErr: true},
+		{name: "unknown_function", target: "load", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, explainTestApp)
+			defer panicRecovery(t)
+
+			err := manager.ExplainFunction(tt.target)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Nil(t, manager.explanation)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, manager.explanation.function)
+		})
+	}
+}
+
+func TestInstrumentationManager_Explain(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   []string
+	}{
+		{
+			name:   "traced_function",
+			target: "store.load",
+			want: []string{
+				"store.load ((*" + testAppPackage + ".store).load) is declared at app.go:10",
+				"- net/http-handler: isHttpHandler is false, it does not take an http.ResponseWriter and an *http.Request",
+				"- call by (*" + testAppPackage + ".store).index at app.go:16: ShouldInstrumentFunction is true, it is not traced yet",
+				"- call by (*" + testAppPackage + ".store).index at app.go:16: RequiresTransactionContext is false, RequiresTransactionArgument is true",
+				"- trace-function at line 10: passes a transaction to a function that calls traced code",
+				"- notice-error at line 11: reports the error to the transaction",
+			},
+		},
+		{
+			name:   "handler",
+			target: "store.index",
+			want: []string{
+				`- wrap-handler: it is registered as the handler of the route "/", which starts its transaction`,
+				"- net/http-handler: isHttpHandler is true, so it is traced as the entry point of a transaction",
+				"- handler-transaction at line 15: gets the transaction of an http handler from its request",
+			},
+		},
+		{
+			name:   "unregistered_handler",
+			target: "unused",
+			want: []string{
+				"- net/http-handler: isHttpHandler is true, so it is traced as the entry point of a transaction",
+				"- net/http-handler: nothing in its body needs the transaction, so it does not get it from the request",
+				"- GetPackageFunctionInvocation found no call to it in main, or in the functions traced from main and the http handlers",
+				"no changes were made to it",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, explainTestApp)
+			defer panicRecovery(t)
+
+			assert.NoError(t, manager.ExplainFunction(tt.target))
+			assert.NoError(t, manager.InstrumentPackages())
+			got := manager.Explain()
+			for _, line := range tt.want {
+				assert.Contains(t, got, line+"\n")
+			}
+		})
+	}
+}
@@ -0,0 +1,832 @@
+package instrumentation
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/goast"
+	"github.com/dave/dst/dstutil"
+)
+
+// webFramework is a web framework whose routers get middleware that starts a transaction for each request, and whose
+// handlers get that transaction from the context they are passed.
+type webFramework struct {
+	importPath string   // import path of the framework
+	routers    []string // functions of the framework that create a router
+	// majorVersions is true if the routers of every major version of the framework are instrumented, in which case
+	// importPath is the path of its module without a major version suffix
+	majorVersions bool
+	// routerMethods are the methods that return a router when they are called on a router, or on a route of one
+	routerMethods []string
+	// integration is the import path of the New Relic integration with the framework, which provides the middleware or
+	// the instrumented router
+	integration string
+	// instrumentedRouter is the function of the integration that creates a router that starts a transaction for each
+	// request, which routers are created with instead of getting middleware. It is passed the agent.
+	instrumentedRouter string
+	// transaction is the function of the integration that gets the transaction from the context of a handler, or an
+	// empty string if the handlers of the framework are net/http handlers
+	transaction string
+	// otelIntegration is the import path of the OpenTelemetry instrumentation of the framework, which provides the
+	// middleware
+	otelIntegration string
+	// requestContext creates the expression of the context of the request from the context of a handler, or is nil if
+	// the handlers of the framework are net/http handlers
+	requestContext func(ctx dst.Expr) dst.Expr
+	// returnsErrors is true if the handlers of the framework return errors, which the framework handles
+	returnsErrors bool
+	// routePattern is the source of the expression of the pattern of the route of the request r, which the middleware
+	// declared for the routers of a framework without an integration names transactions after, or an empty string if
+	// the framework has an integration. It refers to the framework by its name.
+	routePattern string
+}
+
+// webFrameworks are the web frameworks whose routers and handlers are instrumented, by name.
+var webFrameworks = map[string]webFramework{
+	FrameworkGin: {
+		importPath:      Gin,
+		routers:         []string{GinDefault, GinNew},
+		integration:     nrginImport,
+		transaction:     "Transaction",
+		otelIntegration: otelginImport,
+		requestContext:  ginRequestContext,
+	},
+	FrameworkEcho: {
+		importPath:      Echo,
+		routers:         []string{EchoNew},
+		integration:     nrechoImport,
+		transaction:     "FromContext",
+		otelIntegration: otelechoImport,
+		requestContext:  echoRequestContext,
+		returnsErrors:   true,
+	},
+	FrameworkGorillaMux: {
+		importPath:      GorillaMux,
+		routers:         []string{GorillaNewRouter},
+		routerMethods:   []string{"Subrouter", "StrictSlash", "SkipClean", "UseEncodedPath"},
+		integration:     nrgorillaImport,
+		otelIntegration: otelmuxImport,
+	},
+	FrameworkHttpRouter: {
+		importPath:         HttpRouter,
+		routers:            []string{HttpRouterNew},
+		integration:        nrhttprouterImport,
+		instrumentedRouter: HttpRouterNew,
+	},
+	FrameworkChi: {
+		importPath:    Chi,
+		routers:       []string{ChiNewRouter, ChiNewMux},
+		majorVersions: true,
+		routePattern:  chiRoutePattern,
+	},
+}
+
+// routerVariable returns the name of the variable a router of the framework is assigned to by stmt, such as
+// router := gin.Default(), or an empty string if stmt does not create one.
+func routerVariable(stmt dst.Stmt, framework string) string {
+	assign, ok := stmt.(*dst.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return ""
+	}
+	call, ok := assign.Rhs[0].(*dst.CallExpr)
+	if !ok || !createsRouter(call, webFrameworks[framework]) {
+		return ""
+	}
+	ident, ok := assign.Lhs[0].(*dst.Ident)
+	if !ok || ident.Name == "_" {
+		return ""
+	}
+	return ident.Name
+}
+
+// createsRouter returns true if call creates a router of the framework. Routers are created by the router functions of
+// the framework, and by router methods called on a router created in the same expression, such as
+// mux.NewRouter().PathPrefix("/api").Subrouter(). The routers returned by router methods called on a router in a
+// variable are not created by call, since they run the middleware of that router.
+func createsRouter(call *dst.CallExpr, framework webFramework) bool {
+	return routerImportPath(call, framework) != ""
+}
+
+// routerImportPath returns the import path of the package of the framework that call creates a router with, or an
+// empty string if call does not create a router of the framework.
+func routerImportPath(call *dst.CallExpr, framework webFramework) string {
+	if fun, ok := call.Fun.(*dst.Ident); ok {
+		return framework.routerFunction(fun)
+	}
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok || !containsString(framework.routerMethods, sel.Sel.Name) {
+		return ""
+	}
+	// the methods in between may return routes, such as PathPrefix
+	for expr := sel.X; ; {
+		inner, ok := expr.(*dst.CallExpr)
+		if !ok {
+			return ""
+		}
+		switch fun := inner.Fun.(type) {
+		case *dst.Ident:
+			return framework.routerFunction(fun)
+		case *dst.SelectorExpr:
+			expr = fun.X
+		default:
+			return ""
+		}
+	}
+}
+
+// routerFunction returns the import path of the package of the framework fun is declared in, if it is a function that
+// creates a router, or an empty string if it is not.
+func (f webFramework) routerFunction(fun *dst.Ident) string {
+	if !containsString(f.routers, fun.Name) || !f.isImportPath(fun.Path) {
+		return ""
+	}
+	return fun.Path
+}
+
+// isImportPath returns true if path is the import path of the framework, or of one of its major versions if they are
+// all instrumented, such as github.com/go-chi/chi/v5.
+func (f webFramework) isImportPath(path string) bool {
+	return path == f.importPath || (f.majorVersions && withoutMajorVersion(path) == f.importPath)
+}
+
+// withoutMajorVersion returns path without its major version suffix, such as github.com/go-chi/chi for
+// github.com/go-chi/chi/v5, or path if it has none.
+func withoutMajorVersion(path string) string {
+	i := strings.LastIndex(path, "/v")
+	if i < 0 {
+		return path
+	}
+	if major, err := strconv.Atoi(path[i+2:]); err != nil || major < 2 || path[i+2] == '0' {
+		return path
+	}
+	return path[:i]
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// useMiddleware creates a statement that adds middleware to the router routerVariable.
+func useMiddleware(routerVariable string, middleware dst.Expr, spacingAfter dst.SpaceType) *dst.ExprStmt {
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(routerVariable),
+				Sel: dst.NewIdent("Use"),
+			},
+			Args: []dst.Expr{middleware},
+		},
+		Decs: dst.ExprStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: spacingAfter,
+			},
+		},
+	}
+}
+
+// isRouterMiddleware returns true if call creates the middleware of a web framework integration of the New Relic agent,
+// or the middleware New Relic declares for a web framework without one.
+func isRouterMiddleware(call *dst.CallExpr) bool {
+	ident, ok := call.Fun.(*dst.Ident)
+	if !ok {
+		return false
+	}
+	for name, framework := range webFrameworks {
+		if ident.Name == "Middleware" && framework.integration != "" && ident.Path == framework.integration {
+			return true
+		}
+		if ident.Path == "" && framework.routePattern != "" && ident.Name == routeMiddlewareName(newRelicMiddlewarePrefix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRouteMiddlewareDeclaration returns true if decl declares the middleware New Relic declares for a web framework
+// without an integration.
+func isRouteMiddlewareDeclaration(decl *dst.FuncDecl) bool {
+	if decl.Recv != nil {
+		return false
+	}
+	for name, framework := range webFrameworks {
+		if framework.routePattern != "" && decl.Name.Name == routeMiddlewareName(newRelicMiddlewarePrefix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMiddlewareName returns the name of the middleware a backend declares for the routers of a web framework without
+// an integration, which starts with the prefix of the backend, such as newRelicChiMiddleware.
+func routeMiddlewareName(prefix, framework string) string {
+	return prefix + strings.ToUpper(framework[:1]) + framework[1:] + "Middleware"
+}
+
+// parseRouteMiddleware parses src, the source of the middleware a backend declares for the routers of a web framework
+// without an integration. Qualified identifiers in it are resolved to imports, the paths of the packages it refers to
+// by the name they are imported under, so that the restorer imports them.
+func parseRouteMiddleware(src string, imports map[string]string) (*dst.FuncDecl, error) {
+	file := &strings.Builder{}
+	file.WriteString("package middleware\n\n")
+	for path, name := range imports {
+		fmt.Fprintf(file, "import %s %q\n", name, path)
+	}
+	fmt.Fprintf(file, "\n%s", src)
+
+	parsed, err := decorator.NewDecoratorWithImports(token.NewFileSet(), "middleware", goast.New()).Parse(file.String())
+	if err != nil {
+		return nil, err
+	}
+	decl, ok := parsed.Decls[len(parsed.Decls)-1].(*dst.FuncDecl)
+	if !ok {
+		return nil, fmt.Errorf("the source of the middleware does not end in a function declaration")
+	}
+	decl.Decs.Before = dst.EmptyLine
+	decl.Decs.After = dst.EmptyLine
+	return decl, nil
+}
+
+// isHandlerTransaction returns true if call gets the transaction of a handler from the context of a web framework
+// integration of the New Relic agent.
+func isHandlerTransaction(call *dst.CallExpr) bool {
+	return handlerTransactionFramework(call) != ""
+}
+
+// handlerTransactionFramework returns the name of the web framework whose handler call gets the transaction of, from
+// the context of the handler, or an empty string if call does not get one.
+func handlerTransactionFramework(call *dst.CallExpr) string {
+	ident, ok := call.Fun.(*dst.Ident)
+	if !ok {
+		return ""
+	}
+	for name, framework := range webFrameworks {
+		if framework.transaction != "" && ident.Path == framework.integration && ident.Name == framework.transaction {
+			return name
+		}
+	}
+	return ""
+}
+
+// usesRouterMiddleware returns true if stmt adds the middleware of a web framework integration to a router.
+func usesRouterMiddleware(stmt dst.Stmt) bool {
+	expr, ok := stmt.(*dst.ExprStmt)
+	if !ok {
+		return false
+	}
+	call, ok := expr.X.(*dst.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return false
+	}
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok || sel.Sel.Name != "Use" {
+		return false
+	}
+	middleware, ok := call.Args[0].(*dst.CallExpr)
+	return ok && isRouterMiddleware(middleware)
+}
+
+// instrumentRouter makes the router of the framework created by the statement at the cursor start a transaction for each
+// request, and returns true if it did. The router is created by the integration with the framework instead, or gets
+// its middleware. The agent expression is the agent that reports the transactions.
+func instrumentRouter(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, agent dst.Expr, framework string) bool {
+	router := routerVariable(stmt, framework)
+	if router == "" || c.Index() < 0 || manager.IsInstrumented(stmt) {
+		return false
+	}
+	if instrumented := manager.Backend().InstrumentedRouter(framework, agent); instrumented != nil {
+		if manager.ChangeDropped(ruleRouter, stmt) {
+			return false
+		}
+		stmt.(*dst.AssignStmt).Rhs[0] = instrumented
+		manager.RecordChange(ruleRouter, stmt, instrumented)
+		manager.AddImports(instrumented)
+		return true
+	}
+	middleware := manager.Backend().RouterMiddleware(framework, agent, manager.appName)
+	if middleware == nil {
+		return wrapRouterHandlers(manager, stmt, c, framework)
+	}
+	if manager.ChangeDropped(ruleMiddleware, stmt) {
+		return false
+	}
+	path := routerImportPath(stmt.(*dst.AssignStmt).Rhs[0].(*dst.CallExpr), webFrameworks[framework])
+	decl, err := manager.Backend().RouteMiddleware(framework, path, manager.GetPackageName())
+	if err != nil {
+		manager.RecordSkipped(ruleMiddleware, stmt, fmt.Sprintf("the middleware of the router can not be declared: %v", err))
+		return false
+	}
+	decs := stmt.Decorations()
+	use := useMiddleware(router, middleware, decs.After)
+	decs.After = dst.None
+	c.InsertAfter(use)
+	nodes := []dst.Node{use}
+	if decl != nil && manager.declareAfter(stmt, decl) {
+		nodes = append(nodes, decl)
+	}
+	manager.RecordChange(ruleMiddleware, stmt, nodes...)
+	manager.AddImports(nodes...)
+	return true
+}
+
+// wrapRouterHandlers wraps the router of the framework created by the statement at the cursor where the statements after
+// it in its block use it as a net/http handler, such as http.ListenAndServe(addr, router), in a handler that starts a
+// transaction for each request. It returns true if it wrapped any.
+func wrapRouterHandlers(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, framework string) bool {
+	block, ok := c.Parent().(*dst.BlockStmt)
+	pkg := manager.GetDecoratorPackage()
+	if !ok || pkg == nil || pkg.TypesInfo == nil {
+		return false
+	}
+	astRouter, ok := pkg.Decorator.Ast.Nodes[stmt.(*dst.AssignStmt).Lhs[0]].(*ast.Ident)
+	if !ok {
+		return false
+	}
+	router := pkg.TypesInfo.ObjectOf(astRouter)
+
+	// isRouter returns true if expr is the router variable, and is used where a net/http handler is expected
+	isRouter := func(expr dst.Expr, expected types.Type) bool {
+		ident, ok := expr.(*dst.Ident)
+		if !ok || router == nil || !isHttpHandlerType(expected) {
+			return false
+		}
+		astIdent, ok := pkg.Decorator.Ast.Nodes[ident].(*ast.Ident)
+		return ok && pkg.TypesInfo.Uses[astIdent] == router
+	}
+	// wrap wraps the router used at anchor, unless that change was dropped
+	wrapped := false
+	wrap := func(anchor dst.Node, expr *dst.Expr) {
+		if manager.ChangeDropped(ruleRouterHandler, anchor) {
+			return
+		}
+		handler := manager.Backend().RouterHandler(framework, *expr, manager.appName)
+		if handler == nil {
+			return
+		}
+		*expr = handler
+		manager.RecordChange(ruleRouterHandler, anchor, handler)
+		manager.AddImports(handler)
+		wrapped = true
+	}
+
+	for _, next := range block.List[c.Index()+1:] {
+		dst.Inspect(next, func(n dst.Node) bool {
+			switch v := n.(type) {
+			case *dst.CallExpr:
+				astCall, ok := pkg.Decorator.Ast.Nodes[v].(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				sig, ok := pkg.TypesInfo.TypeOf(astCall.Fun).(*types.Signature)
+				if !ok {
+					return true
+				}
+				for i := range v.Args {
+					if isRouter(v.Args[i], parameterType(sig, i)) {
+						wrap(v, &v.Args[i])
+					}
+				}
+			case *dst.CompositeLit:
+				astLit, ok := pkg.Decorator.Ast.Nodes[v].(*ast.CompositeLit)
+				if !ok {
+					return true
+				}
+				litType := pkg.TypesInfo.TypeOf(astLit)
+				if litType == nil {
+					return true
+				}
+				fields, ok := litType.Underlying().(*types.Struct)
+				if !ok {
+					return true
+				}
+				for _, elt := range v.Elts {
+					kv, ok := elt.(*dst.KeyValueExpr)
+					if !ok {
+						continue
+					}
+					key, ok := kv.Key.(*dst.Ident)
+					if !ok {
+						continue
+					}
+					for i := 0; i < fields.NumFields(); i++ {
+						if fields.Field(i).Name() == key.Name && isRouter(kv.Value, fields.Field(i).Type()) {
+							wrap(kv, &kv.Value)
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+	return wrapped
+}
+
+// parameterType returns the type of the parameter of a function of type sig that is passed its argument i, or nil if
+// it is passed none.
+func parameterType(sig *types.Signature, i int) types.Type {
+	params := sig.Params()
+	if sig.Variadic() && i >= params.Len()-1 {
+		if slice, ok := params.At(params.Len() - 1).Type().(*types.Slice); ok {
+			return slice.Elem()
+		}
+		return nil
+	}
+	if i >= params.Len() {
+		return nil
+	}
+	return params.At(i).Type()
+}
+
+// isHttpHandlerType returns true if t is the net/http.Handler interface.
+func isHttpHandlerType(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Name() == "Handler" && obj.Pkg() != nil && obj.Pkg().Path() == NetHttp
+}
+
+// instrumentMainRouters adds middleware to the routers of the framework created in main, if n is main. The middleware is
+// reported by the agent main creates.
+func instrumentMainRouters(n dst.Node, manager *InstrumentationManager, framework string) {
+	decl, ok := n.(*dst.FuncDecl)
+	if !ok || decl.Name.Name != "main" || decl.Recv != nil {
+		return
+	}
+	// the agent is not created if the change that creates it was dropped
+	if manager.ChangeDropped(ruleAgent, decl) {
+		return
+	}
+	dstutil.Apply(decl.Body, nil, func(c *dstutil.Cursor) bool {
+		if stmt, ok := c.Node().(dst.Stmt); ok {
+			instrumentRouter(manager, stmt, c, dst.NewIdent(manager.agentVariableName), framework)
+		}
+		return true
+	})
+}
+
+// instrumentNestedRouters instruments the routers of the framework created in n, if it is a function other than main.
+// When the routers are reported by the agent, the function is passed the agent by the functions that call it.
+func instrumentNestedRouters(n dst.Node, manager *InstrumentationManager, framework string) {
+	decl, ok := n.(*dst.FuncDecl)
+	if !ok || decl.Body == nil || isMainDeclaration(decl, manager.GetDecoratorPackage()) || !createsRouters(manager, decl, framework) {
+		return
+	}
+	var agent dst.Expr
+	if manager.Backend().AgentType() != nil {
+		name, ok := passAgent(manager, decl)
+		if !ok {
+			return
+		}
+		agent = dst.NewIdent(name)
+	}
+	dstutil.Apply(decl.Body, nil, func(c *dstutil.Cursor) bool {
+		if stmt, ok := c.Node().(dst.Stmt); ok {
+			instrumentRouter(manager, stmt, c, agent, framework)
+		}
+		return true
+	})
+}
+
+// isMainDeclaration returns true if decl declares the main function of a program.
+func isMainDeclaration(decl *dst.FuncDecl, pkg *decorator.Package) bool {
+	return decl.Name.Name == "main" && decl.Recv == nil && pkg != nil && pkg.Name == "main"
+}
+
+// createsRouters returns true if decl creates a router of the framework that is not instrumented yet.
+func createsRouters(manager *InstrumentationManager, decl *dst.FuncDecl, framework string) bool {
+	found := false
+	dst.Inspect(decl.Body, func(n dst.Node) bool {
+		if stmt, ok := n.(dst.Stmt); ok && routerVariable(stmt, framework) != "" && !manager.IsInstrumented(stmt) {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// agentCall is a call to a function that is passed the agent.
+type agentCall struct {
+	pkg    string        // ID of the package the call is made in
+	caller *dst.FuncDecl // function the call is made in
+	call   *dst.CallExpr
+}
+
+// agentFunction is a function that gets an agent parameter, and the calls that pass it the agent.
+type agentFunction struct {
+	pkg   string // ID of the package the function is declared in
+	decl  *dst.FuncDecl
+	calls []agentCall
+}
+
+// passAgent passes the agent main creates to decl, a function in the current package that creates routers, and returns
+// the name of the parameter decl gets it in. The agent is passed down from main: decl, and each function that calls a
+// function that gets the agent, gets it as a new last parameter. Nothing is changed, and false is returned, if one of
+// these functions can not be passed the agent.
+func passAgent(manager *InstrumentationManager, decl *dst.FuncDecl) (string, bool) {
+	id := manager.functionID(decl)
+	if name, ok := manager.agentParameters[id]; ok {
+		return name, true
+	}
+	rootPkg := manager.currentPackage
+	defer manager.SetPackage(rootPkg)
+
+	plan := []*agentFunction{}
+	if reason := planAgent(manager, rootPkg, decl, &plan); reason != "" {
+		manager.SetPackage(rootPkg)
+		manager.explain(id, "%s: it creates a router, but it can not be passed the agent: %s", ruleRouterAgent, reason)
+		manager.RecordSkipped(ruleRouterAgent, decl, fmt.Sprintf("the router can not be passed the agent: %s", reason))
+		return "", false
+	}
+	name := manager.agentVariableName
+	for _, fn := range plan {
+		manager.SetPackage(fn.pkg)
+		param := &dst.Field{Names: []*dst.Ident{dst.NewIdent(name)}, Type: manager.Backend().AgentType()}
+		fn.decl.Type.Params.List = append(fn.decl.Type.Params.List, param)
+		nodes := []dst.Node{param}
+		for _, call := range fn.calls {
+			arg := dst.NewIdent(name)
+			call.call.Args = append(call.call.Args, arg)
+			nodes = append(nodes, arg)
+		}
+		manager.agentParameters[manager.functionID(fn.decl)] = name
+		manager.RecordChange(ruleRouterAgent, fn.decl, nodes...)
+		manager.AddImports(param)
+	}
+	return name, true
+}
+
+// planAgent adds decl, a function declared in the package pkg, and the functions that call it to the functions that get
+// an agent parameter, unless they have one already or are main. It returns why the agent can not be passed to decl, or
+// an empty string if it can be.
+func planAgent(manager *InstrumentationManager, pkg string, decl *dst.FuncDecl, plan *[]*agentFunction) string {
+	manager.SetPackage(pkg)
+	if isMainDeclaration(decl, manager.GetDecoratorPackage()) {
+		if manager.ChangeDropped(ruleAgent, decl) {
+			return "main does not create the agent"
+		}
+		return ""
+	}
+	id := manager.functionID(decl)
+	if _, ok := manager.agentParameters[id]; ok {
+		return ""
+	}
+	for _, fn := range *plan {
+		if fn.decl == decl {
+			// the function calls itself
+			return ""
+		}
+	}
+	name := functionDeclName(decl)
+	if fn, ok := manager.packages[pkg].tracedFuncs[id]; ok && (fn.tracedName != "" || fn.untraceable) {
+		return fmt.Sprintf("the signature of %s can not be changed", name)
+	}
+	if manager.ChangeDropped(ruleRouterAgent, decl) {
+		return fmt.Sprintf("passing the agent to %s does not compile, and was dropped", name)
+	}
+	calls := manager.callsTo(id)
+	if len(calls) == 0 {
+		return fmt.Sprintf("%s is not called from main", name)
+	}
+	*plan = append(*plan, &agentFunction{pkg: pkg, decl: decl, calls: calls})
+	for _, call := range calls {
+		if reason := planAgent(manager, call.pkg, call.caller, plan); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// callsTo returns the calls made in the application to the function with the given ID.
+func (m *InstrumentationManager) callsTo(functionID string) []agentCall {
+	rootPkg := m.currentPackage
+	defer m.SetPackage(rootPkg)
+
+	pkgNames := []string{}
+	for pkgName := range m.packages {
+		pkgNames = append(pkgNames, pkgName)
+	}
+	sort.Strings(pkgNames)
+	calls := []agentCall{}
+	for _, pkgName := range pkgNames {
+		m.SetPackage(pkgName)
+		for _, file := range m.packages[pkgName].pkg.Syntax {
+			for _, decl := range file.Decls {
+				fn, ok := decl.(*dst.FuncDecl)
+				if !ok || fn.Body == nil {
+					continue
+				}
+				dst.Inspect(fn.Body, func(n dst.Node) bool {
+					call, ok := n.(*dst.CallExpr)
+					if !ok {
+						return true
+					}
+					if inv := m.GetPackageFunctionInvocation(call); inv != nil && inv.call == call && inv.functionID == functionID {
+						calls = append(calls, agentCall{pkg: pkgName, caller: fn, call: call})
+					}
+					return true
+				})
+			}
+		}
+	}
+	return calls
+}
+
+// handlerContextName returns the name of the context parameter of a handler of a web framework, its first parameter, or
+// an empty string if it can not be referred to.
+func handlerContextName(decl *dst.FuncDecl) string {
+	names := decl.Type.Params.List[0].Names
+	if len(names) == 0 || names[0].Name == "_" {
+		return ""
+	}
+	return names[0].Name
+}
+
+// traceFrameworkHandler traces fn, a handler of the framework, as the entry point of the transaction the middleware of
+// the framework starts. The transaction is taken from the context of the handler, and passed down its call chain the way
+// InstrumentHandleFunction passes the transaction of an http handler. The rule and the name of the function that
+// recognized the handler, predicate, explain the decisions made.
+func traceFrameworkHandler(manager *InstrumentationManager, fn *dst.FuncDecl, c *dstutil.Cursor, framework, rule, predicate string) {
+	id := manager.functionID(fn)
+	if manager.IsTracingStarted(fn) {
+		manager.explain(id, "%s: %s is true, but it is traced already, so it does not start a transaction of its own", rule, predicate)
+		return
+	}
+	if manager.ChangeDropped(ruleHandlerTransaction, fn) {
+		manager.explain(id, "%s: %s is true, but getting its transaction does not compile, and was dropped", rule, predicate)
+		return
+	}
+	ctxName := handlerContextName(fn)
+	if ctxName == "" {
+		manager.explain(id, "%s: %s is true, but its context parameter has no name to get the transaction from", rule, predicate)
+		return
+	}
+	manager.explain(id, "%s: %s is true, so it is traced as the entry point of a transaction", rule, predicate)
+	manager.entryPoint = &entryPoint{function: id}
+	defer func() { manager.entryPoint = nil }()
+	txnName := manager.TransactionName(fn)
+	newFn, ok := TraceFunction(manager, fn, txnName)
+	if webFrameworks[framework].returnsErrors && noticeReturnedErrors(manager, newFn, txnName) {
+		ok = true
+	}
+	if !ok {
+		manager.explain(id, "%s: nothing in its body needs the transaction, so it does not get it from the context", rule)
+		return
+	}
+	if manager.ExistingTransactionName(fn) == "" {
+		txn := manager.Backend().HandlerTransaction(framework, txnName, dst.NewIdent(ctxName))
+		newFn.Body.List = append([]dst.Stmt{txn}, newFn.Body.List...)
+		manager.setTransactionVariable(fn, txnName)
+		manager.RecordChange(ruleHandlerTransaction, fn, txn)
+		manager.AddImports(txn)
+	}
+	c.Replace(newFn)
+	manager.UpdateFunctionDeclaration(newFn)
+}
+
+// noticeReturnedErrors notices the errors that decl, a handler of a framework that handles the errors its handlers
+// return, returns from the calls it makes, and returns true if it noticed any. The error is assigned to a variable,
+// noticed, and returned:
+//
+//	err := c.JSON(200, n)
+//	nrTxn.NoticeError(err)
+//	return err
+//
+// Errors returned in variables are noticed where they are assigned, and the calls that are passed the transaction
+// notice their own errors.
+func noticeReturnedErrors(manager *InstrumentationManager, decl *dst.FuncDecl, txnName string) bool {
+	pkg := manager.GetDecoratorPackage()
+	noticed := false
+	dstutil.Apply(decl.Body, func(c *dstutil.Cursor) bool {
+		switch v := c.Node().(type) {
+		case *dst.FuncLit:
+			// the returns of function literals are not returns of the handler
+			return false
+		case *dst.ReturnStmt:
+			if c.Index() < 0 || len(v.Results) != 1 || manager.ChangeDropped(ruleReturnedError, v) {
+				return true
+			}
+			call, ok := v.Results[0].(*dst.CallExpr)
+			if !ok || passesTransaction(call, map[string]bool{txnName: true}, pkg) {
+				return true
+			}
+			errName := manager.StatementVariableName(v, defaultErrName)
+			assign := &dst.AssignStmt{
+				Lhs: []dst.Expr{dst.NewIdent(errName)},
+				Tok: token.DEFINE,
+				Rhs: []dst.Expr{call},
+			}
+			assign.Decs.Before = v.Decs.Before
+			assign.Decs.Start = v.Decs.Start
+			v.Decs.Before = dst.NewLine
+			v.Decs.Start = nil
+			notice := manager.Backend().NoticeError(errName, txnName, &assign.Decs.NodeDecs)
+			v.Results[0] = dst.NewIdent(errName)
+			c.InsertBefore(assign)
+			c.InsertBefore(notice)
+			manager.RecordChange(ruleReturnedError, v, assign, notice, v.Results[0])
+			manager.AddImports(notice)
+			noticed = true
+		}
+		return true
+	}, nil)
+	return noticed
+}
+
+// newInstrumentedRouter creates a call to the function of the New Relic integration with the framework that creates a
+// router that starts a transaction reported by agent for each request.
+func newInstrumentedRouter(framework string, agent dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: webFrameworks[framework].instrumentedRouter,
+			Path: webFrameworks[framework].integration,
+		},
+		Args: []dst.Expr{agent},
+	}
+}
+
+// uninstrumentRouter replaces call, if it creates a router with the New Relic integration with a framework, with the
+// call to the framework that creates the router it instruments. It returns true if it did.
+func uninstrumentRouter(call *dst.CallExpr) bool {
+	ident, ok := call.Fun.(*dst.Ident)
+	if !ok {
+		return false
+	}
+	for _, framework := range webFrameworks {
+		if framework.instrumentedRouter != "" && ident.Path == framework.integration && ident.Name == framework.instrumentedRouter {
+			call.Fun = &dst.Ident{Name: framework.routers[0], Path: framework.importPath}
+			call.Args = nil
+			return true
+		}
+	}
+	return false
+}
+
+// frameworkMiddleware creates a call to the middleware of the New Relic integration with the framework, which starts a
+// transaction reported by agent for each request.
+func frameworkMiddleware(framework string, agent dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{
+			Name: "Middleware",
+			Path: webFrameworks[framework].integration,
+		},
+		Args: []dst.Expr{agent},
+	}
+}
+
+// defineHandlerTransaction creates a statement that defines a transaction variable from the context of a handler of the
+// framework, such as: txnVariable := nrgin.Transaction(ctx)
+func defineHandlerTransaction(framework, txnVariable string, ctx dst.Expr) *dst.AssignStmt {
+	return &dst.AssignStmt{
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+		Lhs: []dst.Expr{
+			dst.NewIdent(txnVariable),
+		},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{
+					Name: webFrameworks[framework].transaction,
+					Path: webFrameworks[framework].integration,
+				},
+				Args: []dst.Expr{ctx},
+			},
+		},
+	}
+}
+
+// otelFrameworkMiddleware creates a call to the middleware of the OpenTelemetry instrumentation of the framework, which
+// starts a span for each request. The spans record the service as the name of the server.
+func otelFrameworkMiddleware(framework, service string) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "Middleware", Path: webFrameworks[framework].otelIntegration},
+		Args: []dst.Expr{otelServiceName(service)},
+	}
+}
+
+// otelServiceName creates the expression of the name of the service, which is read from the environment if it is empty.
+func otelServiceName(service string) dst.Expr {
+	if service == "" {
+		return &dst.CallExpr{
+			Fun:  &dst.Ident{Name: "Getenv", Path: "os"},
+			Args: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote("OTEL_SERVICE_NAME")}},
+		}
+	}
+	return &dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(service)}
+}
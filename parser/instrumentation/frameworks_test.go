@@ -0,0 +1,247 @@
+package instrumentation
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+// frameworkTestApp is a test application of a web framework, or the application a backend instruments it into. The
+// applications share a load function the handlers call, and the setup and shutdown of the agent in main, which source
+// adds for the instrumentation target.
+type frameworkTestApp struct {
+	imports  []string // import paths besides those of the shared code
+	handlers string   // declarations between load and main
+	main     string   // statements of main between the setup and the shutdown of the agent
+	after    string   // declarations after main
+}
+
+// source returns the source of the application instrumented for target, or of the application before it is
+// instrumented if target is empty.
+func (app frameworkTestApp) source(target string) string {
+	imports := append([]string{"strconv"}, app.imports...)
+	load := `func load(id string) (int, error) {
+	n, err := strconv.Atoi(id)
+	return n, err
+}`
+	setup, shutdown := "", ""
+	switch target {
+	case TargetNewRelic:
+		imports = append(imports, "time", newrelicAgentImport)
+		load = `func load(id string, nrTxn *newrelic.Transaction) (int, error) {
+	defer nrTxn.StartSegment("load").End()
+	n, err := strconv.Atoi(id)
+	nrTxn.NoticeError(err)
+	return n, err
+}`
+		setup = `	NewRelicAgent, err := newrelic.NewApplication(newrelic.ConfigFromEnvironment())
+	if err != nil {
+		panic(err)
+	}
+
+`
+		shutdown = `
+	NewRelicAgent.Shutdown(5 * time.Second)
+`
+	case TargetOpenTelemetry:
+		imports = append(imports, "context", otelImport, otelExporterImport, otelSdkTraceImport, otelTraceImport)
+		load = `func load(id string, ctx context.Context) (int, error) {
+	ctx, span := otel.Tracer("` + testAppPackage + `").Start(ctx, "load")
+	defer span.End()
+	n, err := strconv.Atoi(id)
+	trace.SpanFromContext(ctx).RecordError(err)
+	return n, err
+}`
+		setup = `	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+
+`
+		shutdown = `
+	tracerProvider.Shutdown(context.Background())
+`
+	}
+	src := "package main\n\n" + importBlock(imports) + "\n" + load + "\n\n" + app.handlers + "\nfunc main() {\n" + setup + app.main + shutdown + "}\n"
+	if app.after != "" {
+		src += "\n" + app.after
+	}
+	return src
+}
+
+// testAppImportNames are the names the test applications import packages under, when they are not the last element of
+// their import path. The test applications can not load the web frameworks, so their packages are imported under their
+// name for their identifiers to be resolved.
+var testAppImportNames = map[string]string{
+	Chi + "/v5":        "chi",
+	Echo:               "echo",
+	nrechoImport:       "nrecho",
+	otelSdkTraceImport: "sdktrace",
+}
+
+// importBlock returns the import declaration of the import paths, with the standard library in a group of its own and
+// each group sorted, the way the restorer prints it.
+func importBlock(paths []string) string {
+	std, other := []string{}, []string{}
+	for _, path := range paths {
+		if strings.Contains(strings.Split(path, "/")[0], ".") {
+			other = append(other, path)
+		} else {
+			std = append(std, path)
+		}
+	}
+	sort.Strings(std)
+	sort.Strings(other)
+	block := &strings.Builder{}
+	block.WriteString("import (\n")
+	for i, group := range [][]string{std, other} {
+		if i > 0 && len(std) > 0 && len(other) > 0 {
+			block.WriteString("\n")
+		}
+		for _, path := range group {
+			block.WriteString("\t")
+			if name, ok := testAppImportNames[path]; ok {
+				block.WriteString(name + " ")
+			}
+			block.WriteString(strconv.Quote(path) + "\n")
+		}
+	}
+	block.WriteString(")\n")
+	return block.String()
+}
+
+// frameworkTest is the test application of a web framework, and the applications the backends instrument it into. The
+// application is also type checked against stub, the source of a package with the import path of the framework that
+// declares what the application uses of it.
+type frameworkTest struct {
+	importPath    string
+	stub          string
+	app           frameworkTestApp
+	newRelic      frameworkTestApp
+	openTelemetry frameworkTestApp
+}
+
+// run instruments the application of the framework for each backend, with and without type information, instruments
+// the application instrumented for New Relic again, and removes its instrumentation.
+func (tt frameworkTest) run(t *testing.T) {
+	backends := []struct {
+		name    string
+		backend InstrumentationBackend
+		want    string
+	}{
+		{name: "new_relic", backend: newRelicBackend{}, want: tt.newRelic.source(TargetNewRelic)},
+		{name: "open_telemetry", backend: otelBackend{}, want: tt.openTelemetry.source(TargetOpenTelemetry)},
+	}
+	for _, b := range backends {
+		for _, typed := range []bool{false, true} {
+			name := b.name
+			if typed {
+				name += "_typed"
+			}
+			t.Run(name, func(t *testing.T) {
+				var manager *InstrumentationManager
+				if typed {
+					manager = newTypedTestingInstrumentationManager(t, tt.app.source(""), tt.importPath, tt.stub)
+				} else {
+					manager = newTestingInstrumentationManager(t, tt.app.source(""))
+				}
+				manager.backend = b.backend
+				manager.agentVariableName = b.backend.AgentVariableName()
+				defer panicRecovery(t)
+
+				assert.NoError(t, manager.InstrumentPackages())
+				assert.Equal(t, b.want, printTestApp(t, manager))
+			})
+		}
+	}
+
+	t.Run("instrumented", func(t *testing.T) {
+		want := tt.newRelic.source(TargetNewRelic)
+		manager := newTestingInstrumentationManager(t, want)
+		defer panicRecovery(t)
+
+		assert.NoError(t, manager.InstrumentPackages())
+		assert.Empty(t, manager.changes, "an instrumented application must not be instrumented again")
+		assert.Equal(t, want, printTestApp(t, manager))
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		manager := newTestingInstrumentationManager(t, tt.newRelic.source(TargetNewRelic))
+		defer panicRecovery(t)
+
+		manager.RemoveInstrumentation()
+		assert.Equal(t, tt.app.source(""), printTestApp(t, manager))
+	})
+}
+
+// printTestApp prints the file of the test application the manager instrumented. The names of the packages whose
+// import paths do not end in their name are given, since the test applications can not load them.
+func printTestApp(t *testing.T, manager *InstrumentationManager) string {
+	got := bytes.NewBuffer([]byte{})
+	file := manager.GetDecoratorPackage().Syntax[0]
+	resolver := guess.WithMap(map[string]string{Echo: "echo", Chi + "/v5": "chi"})
+	r := manager.fileRestorer(decorator.NewRestorerWithImports(testAppPackage, resolver), file)
+	if err := r.Fprint(got, file); err != nil {
+		t.Fatal(err)
+	}
+	return got.String()
+}
+
+func Test_RouteMiddleware(t *testing.T) {
+	backends := []struct {
+		name    string
+		backend InstrumentationBackend
+		prefix  string
+	}{
+		{name: "new_relic", backend: newRelicBackend{}, prefix: newRelicMiddlewarePrefix},
+		{name: "open_telemetry", backend: otelBackend{}, prefix: otelMiddlewarePrefix},
+	}
+	frameworks := []string{}
+	for name := range webFrameworks {
+		frameworks = append(frameworks, name)
+	}
+	sort.Strings(frameworks)
+	for _, framework := range frameworks {
+		for _, b := range backends {
+			t.Run(framework+"/"+b.name, func(t *testing.T) {
+				decl, err := b.backend.RouteMiddleware(framework, webFrameworks[framework].importPath, testAppPackage)
+				assert.NoError(t, err)
+				if webFrameworks[framework].routePattern == "" {
+					assert.Nil(t, decl, "frameworks with an integration do not get middleware declared")
+					return
+				}
+				if assert.NotNil(t, decl) {
+					assert.Equal(t, routeMiddlewareName(b.prefix, framework), decl.Name.Name)
+					assert.NotNil(t, decl.Body)
+				}
+			})
+		}
+	}
+}
+
+func Test_withoutMajorVersion(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "github.com/go-chi/chi/v5", want: "github.com/go-chi/chi"},
+		{path: "github.com/go-chi/chi", want: "github.com/go-chi/chi"},
+		{path: "github.com/go-chi/chi/v1", want: "github.com/go-chi/chi/v1"},
+		{path: "github.com/go-chi/chi/v05", want: "github.com/go-chi/chi/v05"},
+		{path: "github.com/go-chi/chi/view", want: "github.com/go-chi/chi/view"},
+		{path: "github.com/go-chi/chi/v", want: "github.com/go-chi/chi/v"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.want, withoutMajorVersion(tt.path))
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package instrumentation
+
+import (
+	"go/types"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	Gin = "github.com/gin-gonic/gin"
+
+	// functions that create a gin engine
+	GinDefault = "Default"
+	GinNew     = "New"
+
+	// FrameworkGin is the gin web framework, which routers and handlers are instrumented for.
+	FrameworkGin = "gin"
+
+	nrginImport   = "github.com/newrelic/go-agent/v3/integrations/nrgin"
+	otelginImport = "go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+)
+
+// InstrumentGinRouter adds the gin middleware of the instrumentation target to the gin engines created in main, so that
+// each request they handle starts a transaction. The middleware is reported by the agent main creates.
+func InstrumentGinRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentMainRouters(n, manager, FrameworkGin)
+}
+
+// InstrumentNestedGinRouter adds the gin middleware of the instrumentation target to the gin engines created in functions
+// other than main. The middleware is reported by the agent main creates, which the function is passed.
+func InstrumentNestedGinRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentNestedRouters(n, manager, FrameworkGin)
+}
+
+// isGinHandler returns true if decl is a gin handler, a function that only takes a *gin.Context.
+func isGinHandler(decl *dst.FuncDecl) bool {
+	params := decl.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return false
+	}
+	star, ok := params[0].Type.(*dst.StarExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := star.X.(*dst.Ident)
+	return ok && ident.Name == "Context" && ident.Path == Gin
+}
+
+// isGinHandlerSignature returns true for functions with the signature func(*gin.Context).
+func isGinHandlerSignature(sig *types.Signature) bool {
+	params := sig.Params()
+	return params.Len() == 1 && params.At(0).Type().String() == "*"+Gin+".Context"
+}
+
+// InstrumentGinHandler traces gin handlers as the entry points of the transactions the gin middleware starts. The
+// transaction is taken from the context of the handler, and passed down its call chain the way InstrumentHandleFunction
+// passes the transaction of an http handler.
+func InstrumentGinHandler(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	fn, isFn := n.(*dst.FuncDecl)
+	if !isFn {
+		return
+	}
+	if !isGinHandler(fn) {
+		manager.explain(manager.functionID(fn), "%s: isGinHandler is false, it does not only take a *gin.Context", RuleGinHandler)
+		return
+	}
+	traceFrameworkHandler(manager, fn, c, FrameworkGin, RuleGinHandler, "isGinHandler")
+}
+
+// ginRequestContext creates the expression of the context of the request of a gin context: ctx.Request.Context()
+func ginRequestContext(ctx dst.Expr) dst.Expr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X: &dst.SelectorExpr{
+				X:   ctx,
+				Sel: dst.NewIdent("Request"),
+			},
+			Sel: dst.NewIdent("Context"),
+		},
+	}
+}
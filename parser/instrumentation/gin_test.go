@@ -0,0 +1,176 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+var ginTest = frameworkTest{
+	importPath: Gin,
+	stub: `package gin
+
+import "net/http"
+
+type Context struct {
+	Request *http.Request
+}
+
+func (c *Context) Status(code int)         {}
+func (c *Context) Param(key string) string { return "" }
+func (c *Context) JSON(code int, obj any)  {}
+
+type HandlerFunc func(*Context)
+
+type Engine struct{}
+
+func Default() *Engine { return &Engine{} }
+func New() *Engine     { return &Engine{} }
+
+func (e *Engine) Use(middleware ...HandlerFunc)            {}
+func (e *Engine) GET(path string, handlers ...HandlerFunc) {}
+func (e *Engine) Run(addr ...string) error                 { return nil }
+`,
+	app: frameworkTestApp{
+		imports: []string{Gin},
+		handlers: `func setup() {
+	admin := gin.New()
+	admin.GET("/health", health)
+}
+
+func health(c *gin.Context) {
+	c.Status(200)
+}
+
+func item(c *gin.Context) {
+	n, err := load(c.Param("id"))
+	if err != nil {
+		c.Status(404)
+		return
+	}
+	c.JSON(200, n)
+}
+`,
+		main: `	router := gin.Default()
+
+	router.GET("/items/:id", item)
+	setup()
+	router.Run()
+`,
+	},
+	newRelic: frameworkTestApp{
+		imports: []string{Gin, nrginImport},
+		handlers: `func setup(NewRelicAgent *newrelic.Application) {
+	admin := gin.New()
+	admin.Use(nrgin.Middleware(NewRelicAgent))
+	admin.GET("/health", health)
+}
+
+func health(c *gin.Context) {
+	c.Status(200)
+}
+
+func item(c *gin.Context) {
+	nrTxn := nrgin.Transaction(c)
+
+	n, err := load(c.Param("id"), nrTxn)
+	if err != nil {
+		c.Status(404)
+		return
+	}
+	c.JSON(200, n)
+}
+`,
+		main: `	router := gin.Default()
+	router.Use(nrgin.Middleware(NewRelicAgent))
+
+	router.GET("/items/:id", item)
+	setup(NewRelicAgent)
+	router.Run()
+`,
+	},
+	openTelemetry: frameworkTestApp{
+		imports: []string{"os", Gin, otelginImport},
+		handlers: `func setup() {
+	admin := gin.New()
+	admin.Use(otelgin.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+	admin.GET("/health", health)
+}
+
+func health(c *gin.Context) {
+	c.Status(200)
+}
+
+func item(c *gin.Context) {
+	ctx := c.Request.Context()
+
+	n, err := load(c.Param("id"), ctx)
+	if err != nil {
+		c.Status(404)
+		return
+	}
+	c.JSON(200, n)
+}
+`,
+		main: `	router := gin.Default()
+	router.Use(otelgin.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+
+	router.GET("/items/:id", item)
+	setup()
+	router.Run()
+`,
+	},
+}
+
+func Test_InstrumentPackages_gin(t *testing.T) {
+	ginTest.run(t)
+}
+
+func Test_InstrumentPackages_ginRouterNotCalledFromMain(t *testing.T) {
+	code := `package main
+
+import "github.com/gin-gonic/gin"
+
+func setup() {
+	admin := gin.New()
+	admin.Run()
+}
+
+func main() {
+	router := gin.Default()
+	router.Run()
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	assert.NoError(t, manager.InstrumentPackages())
+	if assert.Len(t, manager.skipped, 1) {
+		assert.Equal(t, ruleRouterAgent, manager.skipped[0].rule)
+		assert.Equal(t, "the router can not be passed the agent: setup is not called from main", manager.skipped[0].reason)
+	}
+	assert.NotContains(t, printTestApp(t, manager), "func setup(NewRelicAgent")
+}
+
+func Test_isGinHandler(t *testing.T) {
+	ginContext := &dst.StarExpr{X: &dst.Ident{Name: "Context", Path: Gin}}
+	tests := []struct {
+		name   string
+		params []*dst.Field
+		want   bool
+	}{
+		{name: "handler", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("c")}, Type: ginContext}}, want: true},
+		{name: "unnamed", params: []*dst.Field{{Type: ginContext}}, want: true},
+		{name: "not_pointer", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("c")}, Type: &dst.Ident{Name: "Context", Path: Gin}}}},
+		{name: "other_context", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("ctx")}, Type: &dst.StarExpr{X: &dst.Ident{Name: "Context", Path: "context"}}}}},
+		{name: "two_params", params: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("a"), dst.NewIdent("b")}, Type: ginContext}}},
+		{name: "no_params"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decl := &dst.FuncDecl{Name: dst.NewIdent("handler"), Type: &dst.FuncType{Params: &dst.FieldList{List: tt.params}}}
+			assert.Equal(t, tt.want, isGinHandler(decl))
+		})
+	}
+}
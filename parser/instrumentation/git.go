@@ -0,0 +1,183 @@
+package instrumentation
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+)
+
+// runGit runs git in dir, and returns its output without the spaces around it.
+func runGit(dir string, stdin io.Reader, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// CheckCleanWorkingTree returns an error listing the files with uncommitted changes in the git repository dir is in.
+// Untracked files are not committed, so they are allowed.
+func CheckCleanWorkingTree(dir string) error {
+	status, err := runGit(dir, nil, "status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		return fmt.Errorf("the working tree has uncommitted changes, commit or stash them first:\n%s", status)
+	}
+	return nil
+}
+
+// CreateBranch creates a branch at the current commit of the git repository dir is in, and checks it out. Uncommitted
+// changes are carried over to the branch.
+func CreateBranch(dir, branch string) error {
+	_, err := runGit(dir, nil, "checkout", "-b", branch)
+	return err
+}
+
+// CommitFiles commits the files, which are relative to dir, to the current branch of the git repository dir is in.
+// Other changes are left uncommitted.
+func CommitFiles(dir string, files []string, message string) error {
+	if _, err := runGit(dir, nil, append([]string{"add", "--"}, files...)...); err != nil {
+		return err
+	}
+	_, err := runGit(dir, strings.NewReader(message), append([]string{"commit", "--quiet", "--file", "-", "--"}, files...)...)
+	return err
+}
+
+// modulePaths returns the paths of the go.mod and go.sum files of the module dir is in, which the modules needed by the
+// instrumentation are added to, whether they exist or not. No paths are returned if dir is not in a module.
+func modulePaths(dir string) ([]string, error) {
+	cmd := exec.Command("go", "env", "GOMOD")
+	cmd.Dir = dir
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go env GOMOD: %w", err)
+	}
+	goMod := strings.TrimSpace(string(output))
+	if goMod == "" || goMod == os.DevNull {
+		return []string{}, nil
+	}
+	return []string{goMod, filepath.Join(filepath.Dir(goMod), "go.sum")}, nil
+}
+
+// moduleFiles returns the go.mod and go.sum files of the module dir is in that exist.
+func moduleFiles(dir string) ([]string, error) {
+	paths, err := modulePaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files, nil
+}
+
+// ChangedPackages returns the import paths of the packages matching pattern in dir with Go files that changed since
+// ref, including uncommitted and untracked files. The packages that import them, directly or not, are returned too,
+// since the functions of a changed package are traced from the packages that call them.
+func ChangedPackages(dir, pattern, ref string) ([]string, error) {
+	diff, err := runGit(dir, nil, "diff", "--name-only", "--relative", ref, "--")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := runGit(dir, nil, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// files that were deleted are not in their package anymore, so packages are matched by directory
+	changedDirs := map[string]bool{}
+	for _, path := range strings.Split(diff+"\n"+untracked, "\n") {
+		if strings.HasSuffix(path, ".go") {
+			changedDirs[filepath.Join(absDir, filepath.Dir(filepath.FromSlash(path)))] = true
+		}
+	}
+
+	pkgs, err := packages.Load(&packages.Config{Dir: dir, Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports}, pattern)
+	if err != nil {
+		return nil, err
+	}
+	changed := map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.GoFiles {
+			if changedDirs[filepath.Dir(file)] {
+				changed[pkg.ID] = true
+			}
+		}
+	}
+	for added := true; added; {
+		added = false
+		for _, pkg := range pkgs {
+			if changed[pkg.ID] {
+				continue
+			}
+			for _, imported := range pkg.Imports {
+				if changed[imported.ID] {
+					changed[pkg.ID] = true
+					added = true
+					break
+				}
+			}
+		}
+	}
+
+	paths := []string{}
+	for _, pkg := range pkgs {
+		if changed[pkg.ID] {
+			paths = append(paths, pkg.PkgPath)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// CommitMessage summarizes the changes made to the application for the commit of the files they were made to.
+func (m *InstrumentationManager) CommitMessage(files []string) string {
+	library := "New Relic"
+	if m.target == TargetOpenTelemetry {
+		library = "OpenTelemetry"
+	}
+	counts := map[string]int{}
+	rules := []string{}
+	for _, c := range m.changes {
+		if counts[c.rule] == 0 {
+			rules = append(rules, c.rule)
+		}
+		counts[c.rule]++
+	}
+	sort.Strings(rules)
+
+	message := &strings.Builder{}
+	fmt.Fprintf(message, "Add %s instrumentation\n\n", library)
+	fmt.Fprintf(message, "Generated by go-easy-instrumentation, which made %d changes to %d files.\n\n", len(m.changes), len(files))
+	for _, rule := range rules {
+		fmt.Fprintf(message, "- %d %s: %s\n", counts[rule], rule, changeReason(rule))
+	}
+	fmt.Fprintf(message, "\nFiles:\n")
+	for _, file := range files {
+		fmt.Fprintf(message, "- %s\n", file)
+	}
+	return message.String()
+}
@@ -0,0 +1,124 @@
+package instrumentation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createTestGitRepo writes the files to a new git repository in dir, and commits them.
+func createTestGitRepo(t *testing.T, dir string, files map[string]string) {
+	for path, contents := range files {
+		writeTestFile(t, filepath.Join(dir, path), contents)
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@example.com"},
+		{"add", "."},
+		{"commit", "--quiet", "--message", "initial"},
+	} {
+		if _, err := runGit(dir, nil, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ChangedPackages(t *testing.T) {
+	files := map[string]string{
+		"main.go":   "package main\n\nimport \"" + testAppPackage + "/b\"\n\nfunc main() {\n\tb.B()\n}\n",
+		"a/a.go":    "package a\n\nfunc A() {}\n",
+		"b/b.go":    "package b\n\nimport \"" + testAppPackage + "/b/c\"\n\nfunc B() {\n\tc.C()\n}\n",
+		"b/c/c.go":  "package c\n\nfunc C() {}\n",
+		"README.md": "app\n",
+	}
+	tests := []struct {
+		name    string
+		changes map[string]string // files written after the initial commit
+		want    []string
+	}{
+		{name: "no_changes", want: []string{}},
+		{name: "not_go_file", changes: map[string]string{"README.md": "changed\n"}, want: []string{}},
+		{name: "not_imported", changes: map[string]string{"a/a.go": "package a\n\nfunc A() { println() }\n"}, want: []string{testAppPackage + "/a"}},
+		{
+			name:    "imported",
+			changes: map[string]string{"b/c/c.go": "package c\n\nfunc C() { println() }\n"},
+			want:    []string{testAppPackage, testAppPackage + "/b", testAppPackage + "/b/c"},
+		},
+		{name: "untracked_file", changes: map[string]string{"a/new.go": "package a\n"}, want: []string{testAppPackage + "/a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAppDir := "tmp"
+			defer cleanupTestApp(t, testAppDir)
+			createTestGitRepo(t, testAppDir, files)
+			for path, contents := range tt.changes {
+				writeTestFile(t, filepath.Join(testAppDir, path), contents)
+			}
+
+			got, err := ChangedPackages(testAppDir, defaultPackageName, "HEAD")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("unknown_ref", func(t *testing.T) {
+		testAppDir := "tmp"
+		defer cleanupTestApp(t, testAppDir)
+		createTestGitRepo(t, testAppDir, files)
+		_, err := ChangedPackages(testAppDir, defaultPackageName, "unknown")
+		assert.Error(t, err)
+	})
+}
+
+func Test_CommitFiles(t *testing.T) {
+	testAppDir := "tmp"
+	defer cleanupTestApp(t, testAppDir)
+	createTestGitRepo(t, testAppDir, map[string]string{"app.go": "package main\n\nfunc main() {}\n"})
+
+	assert.NoError(t, CheckCleanWorkingTree(testAppDir))
+	writeTestFile(t, filepath.Join(testAppDir, "untracked.go"), "package main\n")
+	assert.NoError(t, CheckCleanWorkingTree(testAppDir), "untracked files are not committed, so they must be allowed")
+	writeTestFile(t, filepath.Join(testAppDir, "app.go"), "package main\n\nfunc main() {\n\tprintln()\n}\n")
+	assert.Error(t, CheckCleanWorkingTree(testAppDir))
+
+	assert.NoError(t, CreateBranch(testAppDir, defaultBranch))
+	assert.NoError(t, CommitFiles(testAppDir, []string{"app.go"}, "Add instrumentation\n\nbody\n"))
+
+	branch, err := runGit(testAppDir, nil, "branch", "--show-current")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultBranch, branch)
+	message, err := runGit(testAppDir, nil, "log", "-1", "--format=%B")
+	assert.NoError(t, err)
+	assert.Equal(t, "Add instrumentation\n\nbody", message)
+	committed, err := runGit(testAppDir, nil, "show", "--name-only", "--format=", "HEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, "app.go", committed, "only the given files must be committed")
+	assert.NoError(t, CheckCleanWorkingTree(testAppDir))
+	assert.Error(t, CreateBranch(testAppDir, defaultBranch), "a branch that exists must not be reused")
+}
+
+func TestInstrumentationManager_CommitMessage(t *testing.T) {
+	manager := &InstrumentationManager{target: TargetNewRelic, changes: []*change{
+		{rule: ruleTraceFunction},
+		{rule: ruleWrapHandler},
+		{rule: ruleTraceFunction},
+	}}
+	want := "Add New Relic instrumentation\n\n" +
+		"Generated by go-easy-instrumentation, which made 3 changes to 2 files.\n\n" +
+		"- 2 " + ruleTraceFunction + ": " + changeReason(ruleTraceFunction) + "\n" +
+		"- 1 " + ruleWrapHandler + ": " + changeReason(ruleWrapHandler) + "\n" +
+		"\nFiles:\n- main.go\n- pkg/service.go\n"
+	assert.Equal(t, want, manager.CommitMessage([]string{"main.go", "pkg/service.go"}))
+}
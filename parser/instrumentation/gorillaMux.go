@@ -0,0 +1,34 @@
+package instrumentation
+
+import (
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	GorillaMux = "github.com/gorilla/mux"
+
+	// function that creates a gorilla/mux router
+	GorillaNewRouter = "NewRouter"
+
+	// FrameworkGorillaMux is the gorilla/mux router, which routers are instrumented for. Its handlers are net/http
+	// handlers, which InstrumentHandleFunction traces.
+	FrameworkGorillaMux = "gorilla/mux"
+
+	nrgorillaImport = "github.com/newrelic/go-agent/v3/integrations/nrgorilla"
+	otelmuxImport   = "go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+)
+
+// InstrumentGorillaMuxRouter adds the gorilla/mux middleware of the instrumentation target to the routers created in
+// main, so that each request they route starts a transaction named after the template of its route. The middleware is
+// reported by the agent main creates. Subrouters run the middleware of the router they are created from, so only the
+// subrouters of routers that are not assigned to a variable get middleware of their own.
+func InstrumentGorillaMuxRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentMainRouters(n, manager, FrameworkGorillaMux)
+}
+
+// InstrumentNestedGorillaMuxRouter adds the gorilla/mux middleware of the instrumentation target to the routers created
+// in functions other than main. The middleware is reported by the agent main creates, which the function is passed.
+func InstrumentNestedGorillaMuxRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentNestedRouters(n, manager, FrameworkGorillaMux)
+}
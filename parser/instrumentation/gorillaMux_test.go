@@ -0,0 +1,165 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+var gorillaMuxTest = frameworkTest{
+	importPath: GorillaMux,
+	stub: `package mux
+
+import "net/http"
+
+type MiddlewareFunc func(http.Handler) http.Handler
+
+type Router struct{}
+
+type Route struct{}
+
+func NewRouter() *Router { return &Router{} }
+
+func Vars(r *http.Request) map[string]string { return nil }
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {}
+func (r *Router) Use(mwf ...MiddlewareFunc)                          {}
+func (r *Router) HandleFunc(path string, f func(http.ResponseWriter, *http.Request)) *Route {
+	return nil
+}
+func (r *Router) PathPrefix(tpl string) *Route { return nil }
+func (r *Route) Subrouter() *Router            { return nil }
+`,
+	app: frameworkTestApp{
+		imports: []string{"net/http", GorillaMux},
+		handlers: `func setup() {
+	admin := mux.NewRouter().PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/health", health)
+	go http.ListenAndServe(":8001", admin)
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	n, err := load(mux.Vars(r)["id"])
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := mux.NewRouter()
+	router.HandleFunc("/health", health)
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/items/{id}", item)
+
+	setup()
+	http.ListenAndServe(":8000", router)
+`,
+	},
+	newRelic: frameworkTestApp{
+		imports: []string{"net/http", GorillaMux, nrgorillaImport},
+		handlers: `func setup(NewRelicAgent *newrelic.Application) {
+	admin := mux.NewRouter().PathPrefix("/admin").Subrouter()
+	admin.Use(nrgorilla.Middleware(NewRelicAgent))
+	admin.HandleFunc("/health", health)
+	go http.ListenAndServe(":8001", admin)
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	nrTxn := newrelic.FromContext(r.Context())
+
+	n, err := load(mux.Vars(r)["id"], nrTxn)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := mux.NewRouter()
+	router.Use(nrgorilla.Middleware(NewRelicAgent))
+	router.HandleFunc("/health", health)
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/items/{id}", item)
+
+	setup(NewRelicAgent)
+	http.ListenAndServe(":8000", router)
+`,
+	},
+	openTelemetry: frameworkTestApp{
+		imports: []string{"net/http", "os", GorillaMux, otelmuxImport},
+		handlers: `func setup() {
+	admin := mux.NewRouter().PathPrefix("/admin").Subrouter()
+	admin.Use(otelmux.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+	admin.HandleFunc("/health", health)
+	go http.ListenAndServe(":8001", admin)
+}
+
+func health(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	n, err := load(mux.Vars(r)["id"], ctx)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := mux.NewRouter()
+	router.Use(otelmux.Middleware(os.Getenv("OTEL_SERVICE_NAME")))
+	router.HandleFunc("/health", health)
+
+	api := router.PathPrefix("/api").Subrouter()
+	api.HandleFunc("/items/{id}", item)
+
+	setup()
+	http.ListenAndServe(":8000", router)
+`,
+	},
+}
+
+func Test_InstrumentPackages_gorillaMux(t *testing.T) {
+	gorillaMuxTest.run(t)
+}
+
+func Test_createsRouter(t *testing.T) {
+	newRouter := func() *dst.CallExpr {
+		return &dst.CallExpr{Fun: &dst.Ident{Name: GorillaNewRouter, Path: GorillaMux}}
+	}
+	method := func(x dst.Expr, name string) *dst.CallExpr {
+		return &dst.CallExpr{Fun: &dst.SelectorExpr{X: x, Sel: dst.NewIdent(name)}}
+	}
+	tests := []struct {
+		name string
+		call *dst.CallExpr
+		want bool
+	}{
+		{name: "router", call: newRouter(), want: true},
+		{name: "other_package", call: &dst.CallExpr{Fun: &dst.Ident{Name: GorillaNewRouter, Path: "example.com/mux"}}},
+		{name: "router_method", call: method(newRouter(), "StrictSlash"), want: true},
+		{name: "subrouter", call: method(method(newRouter(), "PathPrefix"), "Subrouter"), want: true},
+		{name: "subrouter_of_variable", call: method(method(dst.NewIdent("router"), "PathPrefix"), "Subrouter")},
+		{name: "route", call: method(newRouter(), "PathPrefix")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, createsRouter(tt.call, webFrameworks[FrameworkGorillaMux]))
+		})
+	}
+}
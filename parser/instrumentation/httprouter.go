@@ -0,0 +1,41 @@
+package instrumentation
+
+import (
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+)
+
+const (
+	HttpRouter = "github.com/julienschmidt/httprouter"
+
+	// function that creates an httprouter router
+	HttpRouterNew = "New"
+
+	// FrameworkHttpRouter is the httprouter router, which routers are instrumented for. Its handlers are net/http
+	// handlers that are also passed the parameters of their route, which InstrumentHandleFunction traces.
+	FrameworkHttpRouter = "httprouter"
+
+	nrhttprouterImport = "github.com/newrelic/go-agent/v3/integrations/nrhttprouter"
+)
+
+// InstrumentHttpRouter creates the httprouter routers created in main with the New Relic integration instead, so that
+// each request they route starts a transaction. The transactions are reported by the agent main creates.
+func InstrumentHttpRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentMainRouters(n, manager, FrameworkHttpRouter)
+}
+
+// InstrumentNestedHttpRouter creates the httprouter routers created in functions other than main with the New Relic
+// integration instead. The transactions are reported by the agent main creates, which the function is passed.
+func InstrumentNestedHttpRouter(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+	instrumentNestedRouters(n, manager, FrameworkHttpRouter)
+}
+
+// isHttpRouterParams returns true if field is a single httprouter.Params parameter, which httprouter handlers are passed
+// after the request.
+func isHttpRouterParams(field *dst.Field) bool {
+	if len(field.Names) > 1 {
+		return false
+	}
+	ident, ok := field.Type.(*dst.Ident)
+	return ok && ident.Name == "Params" && ident.Path == HttpRouter
+}
@@ -0,0 +1,189 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+// OpenTelemetry does not instrument httprouter routers, so they are wrapped where they are used as http handlers, and
+// the handlers still pass the context of their request
+var httpRouterTest = frameworkTest{
+	importPath: HttpRouter,
+	stub: `package httprouter
+
+import "net/http"
+
+type Param struct {
+	Key   string
+	Value string
+}
+
+type Params []Param
+
+func (ps Params) ByName(name string) string { return "" }
+
+type Handle func(http.ResponseWriter, *http.Request, Params)
+
+type Router struct{}
+
+func New() *Router { return &Router{} }
+
+func (r *Router) GET(path string, handle Handle)                     {}
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {}
+`,
+	app: frameworkTestApp{
+		imports: []string{"net/http", HttpRouter},
+		handlers: `func listen(addr string) {
+	router := httprouter.New()
+	router.GET("/health", health)
+	http.ListenAndServe(addr, router)
+}
+
+func health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	n, err := load(ps.ByName("id"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := httprouter.New()
+	router.GET("/items/:id", item)
+
+	go http.ListenAndServe(":8000", router)
+	listen(":8001")
+`,
+	},
+	newRelic: frameworkTestApp{
+		imports: []string{"net/http", HttpRouter, nrhttprouterImport},
+		handlers: `func listen(addr string, NewRelicAgent *newrelic.Application) {
+	router := nrhttprouter.New(NewRelicAgent)
+	router.GET("/health", health)
+	http.ListenAndServe(addr, router)
+}
+
+func health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	nrTxn := newrelic.FromContext(r.Context())
+
+	n, err := load(ps.ByName("id"), nrTxn)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := nrhttprouter.New(NewRelicAgent)
+	router.GET("/items/:id", item)
+
+	go http.ListenAndServe(":8000", router)
+	listen(":8001", NewRelicAgent)
+`,
+	},
+	openTelemetry: frameworkTestApp{
+		imports: []string{"net/http", "os", HttpRouter, otelHttpImport},
+		handlers: `func listen(addr string) {
+	router := httprouter.New()
+	router.GET("/health", health)
+	http.ListenAndServe(addr, otelhttp.NewHandler(router, os.Getenv("OTEL_SERVICE_NAME")))
+}
+
+func health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.WriteHeader(200)
+}
+
+func item(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	n, err := load(ps.ByName("id"), ctx)
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	w.Write([]byte(strconv.Itoa(n)))
+}
+`,
+		main: `	router := httprouter.New()
+	router.GET("/items/:id", item)
+
+	go http.ListenAndServe(":8000", otelhttp.NewHandler(router, os.Getenv("OTEL_SERVICE_NAME")))
+	listen(":8001")
+`,
+	},
+}
+
+func Test_InstrumentPackages_httpRouter(t *testing.T) {
+	httpRouterTest.run(t)
+}
+
+func Test_requestParameterName(t *testing.T) {
+	writer := &dst.Field{Names: []*dst.Ident{dst.NewIdent("w")}, Type: &dst.Ident{Name: "ResponseWriter", Path: NetHttp}}
+	request := func(name string) *dst.Field {
+		return &dst.Field{Names: []*dst.Ident{dst.NewIdent(name)}, Type: &dst.StarExpr{X: &dst.Ident{Name: "Request", Path: NetHttp}}}
+	}
+	params := &dst.Field{Names: []*dst.Ident{dst.NewIdent("ps")}, Type: &dst.Ident{Name: "Params", Path: HttpRouter}}
+	tests := []struct {
+		name   string
+		params []*dst.Field
+		want   string
+	}{
+		{name: "handler", params: []*dst.Field{writer, request("r")}, want: "r"},
+		{name: "httprouter_handler", params: []*dst.Field{writer, request("req"), params}, want: "req"},
+		{name: "unnamed_request", params: []*dst.Field{writer, request("_"), params}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decl := &dst.FuncDecl{Name: dst.NewIdent("handler"), Type: &dst.FuncType{Params: &dst.FieldList{List: tt.params}}}
+			assert.Equal(t, tt.want, requestParameterName(decl))
+		})
+	}
+}
+
+func Test_wrapRouterHandlers(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "server_handler",
+			code: "srv := &http.Server{Addr: \":8000\", Handler: router}\n\tsrv.ListenAndServe()",
+			want: "srv := &http.Server{Addr: \":8000\", Handler: otelhttp.NewHandler(router, \"app\")}\n\tsrv.ListenAndServe()",
+		},
+		{
+			name: "mux_handler_wrapped_once",
+			code: "mux := http.NewServeMux()\n\tmux.Handle(\"/\", router)\n\thttp.ListenAndServe(\":8000\", mux)",
+			want: "mux := http.NewServeMux()\n\tmux.Handle(\"/\", otelhttp.NewHandler(router, \"/\"))\n\thttp.ListenAndServe(\":8000\", mux)",
+		},
+		{
+			name: "not_a_handler",
+			code: "fmt.Println(router)",
+			want: "fmt.Println(router)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := "package main\n\nimport (\n\t\"fmt\"\n\t\"net/http\"\n\n\t\"github.com/julienschmidt/httprouter\"\n)\n\n" +
+				"var _ = fmt.Sprint\n\nfunc main() {\n\trouter := httprouter.New()\n\t" + tt.code + "\n}\n"
+			manager := newTestingInstrumentationManager(t, app)
+			manager.backend = otelBackend{}
+			manager.agentVariableName = manager.backend.AgentVariableName()
+			manager.appName = "app"
+			defer panicRecovery(t)
+
+			assert.NoError(t, manager.InstrumentPackages())
+			assert.Contains(t, printTestApp(t, manager), "\trouter := httprouter.New()\n\t"+tt.want+"\n")
+		})
+	}
+}
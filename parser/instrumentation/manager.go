@@ -0,0 +1,1160 @@
+package instrumentation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/gopackages"
+	"github.com/dave/dst/dstutil"
+	godiffpatch "github.com/sourcegraph/go-diff-patch"
+)
+
+const (
+	defaultTxnName = "nrTxn"
+)
+
+// Transaction propagation modes control how traced functions are passed a transaction.
+const (
+	// PropagateTxnArgument passes a transaction to traced functions as a new *newrelic.Transaction argument.
+	PropagateTxnArgument = "argument"
+	// PropagateTxnContext passes a transaction to traced functions through their existing context.Context argument,
+	// and only falls back to a new argument for functions that do not accept a context.
+	PropagateTxnContext = "context"
+)
+
+// tracedFunction contains relevant information about a function within the current package, and
+// its tracing status. Traced functions are tracked by the full name of the types.Func they declare, which
+// includes the package path and receiver, e.g. "(*example.com/app.Server).Close".
+//
+// Please access this object's data through methods rather than directly manipulating it.
+type tracedFunction struct {
+	name        string // human readable name of the function
+	traced      bool
+	inProgress  bool // the body of the function is being traced, and it may be invoked again before tracing completes
+	requiresTxn bool
+	txnContext  *contextParameter // the context the function gets its transaction from, nil if it is passed as an argument
+	tracedName  string            // if set, the function is traced under this name, and a wrapper preserves its original signature
+	untraceable bool              // the signature of the function can not be changed, and it can not be wrapped
+	txnVariable string            // the variable the body of the traced function has its transaction in
+	body        *dst.FuncDecl
+}
+
+// contextParameter is a context.Context parameter of a function declaration.
+type contextParameter struct {
+	name  string
+	index int // index of the argument in calls to the function
+}
+
+// InstrumentationManager maintains state relevant to tracing across all files, packages and functions.
+type InstrumentationManager struct {
+	userAppPath       string // path to the user's application as provided by the user
+	diffFile          string
+	appName           string
+	agentVariableName string
+	propagation       string                 // how transactions are passed to traced functions
+	target            string                 // the telemetry library the application is instrumented with
+	backend           InstrumentationBackend // generates the code of the instrumentation target
+	rules             *RuleRegistry          // rules the application is instrumented with
+	transactionRoots  map[dst.Stmt]string    // names of the transactions started around statements in main
+	currentPackage    string
+	packages          map[string]*PackageState         // stores stateful information on packages by ID
+	callGraph         *CallGraph                       // whole program call graph, nil if the program could not be analyzed
+	allocatedNames    map[*types.Scope]map[string]bool // names of injected variables by the function scope they are declared in
+	changes           []*change                        // changes made to the application, in the order they were made
+	droppedChanges    map[string]bool                  // keys of the changes that must not be made, because they did not compile
+	renamedChanges    map[string]string                // names of the transactions and segments started by changes, by the keys of the changes
+	skipped           []*skippedChange                 // opportunities to instrument the application that were not taken
+	entryPoint        *entryPoint                      // entry point of the transaction being traced, nil outside of one
+	callChain         []string                         // IDs of the functions being traced, in the order they were called from the entry point
+	existing          *existingInstrumentation         // instrumentation the application contained before it was loaded
+	agentParameters   map[string]string                // names of the agent parameters of the functions passed the agent, by function ID
+	explanation       *explanation                     // decisions made about the function being explained, nil if none is
+	sources           map[string]string                // SHA-256 of the files of the packages, go.mod and go.sum when they were loaded, by path
+}
+
+// PackageManager contains state relevant to tracing within a single package.
+type PackageState struct {
+	pkg          *decorator.Package         // the package being instrumented
+	tracedFuncs  map[string]*tracedFunction // maintains state of tracing for functions within the package by function ID
+	importsAdded map[string]bool            // tracks imports added to the package
+	echoHandlers map[string]bool            // IDs of the functions registered as echo handlers, nil until they are found
+}
+
+const (
+	newrelicAgentImport string = "github.com/newrelic/go-agent/v3/newrelic"
+)
+
+// NewInstrumentationManager initializes an InstrumentationManager cache for a given package.
+func NewInstrumentationManager(pkgs []*decorator.Package, appName, agentVariableName, diffFile, userAppPath, propagation, target string) *InstrumentationManager {
+	manager := &InstrumentationManager{
+		userAppPath:       userAppPath,
+		diffFile:          diffFile,
+		appName:           appName,
+		agentVariableName: agentVariableName,
+		propagation:       propagation,
+		target:            target,
+		backend:           NewInstrumentationBackend(target),
+		packages:          map[string]*PackageState{},
+		existing:          newExistingInstrumentation(),
+		agentParameters:   map[string]string{},
+		sources:           map[string]string{},
+	}
+
+	for _, pkg := range pkgs {
+		manager.packages[pkg.ID] = &PackageState{
+			pkg:          pkg,
+			tracedFuncs:  map[string]*tracedFunction{},
+			importsAdded: map[string]bool{},
+		}
+		for _, file := range pkg.Syntax {
+			path := pkg.Decorator.Filenames[file]
+			if contents, err := os.ReadFile(path); err == nil {
+				manager.sources[path] = hashContents(contents)
+			}
+		}
+	}
+	// the modules the changes import are added to go.mod and go.sum, so they are checked for changes too
+	if modules, err := readModuleFiles(userAppPath); err == nil {
+		for _, file := range modules {
+			manager.sources[file.path] = hashContents(file.original)
+		}
+	}
+
+	return manager
+}
+
+func (m *InstrumentationManager) SetPackage(pkgName string) {
+	m.currentPackage = pkgName
+}
+
+func (m *InstrumentationManager) AddImport(path string) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		state.importsAdded[path] = true
+	}
+}
+
+func (m *InstrumentationManager) GetImports(fileName string) []string {
+	i := 0
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return []string{}
+	}
+
+	importsAdded := state.importsAdded
+	ret := make([]string, len(importsAdded))
+	for k := range importsAdded {
+		ret[i] = string(k)
+		i++
+	}
+	return ret
+}
+
+// Returns Decorator Package for the current package being instrumented
+func (m *InstrumentationManager) GetDecoratorPackage() *decorator.Package {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return nil
+	}
+
+	return state.pkg
+}
+
+// decoratorPackages returns all packages being instrumented.
+func (m *InstrumentationManager) decoratorPackages() []*decorator.Package {
+	pkgs := make([]*decorator.Package, 0, len(m.packages))
+	for _, state := range m.packages {
+		pkgs = append(pkgs, state.pkg)
+	}
+	return pkgs
+}
+
+// Returns the string name of the current package
+func (m *InstrumentationManager) GetPackageName() string {
+	return m.currentPackage
+}
+
+// functionID returns the ID a function declared in the current package is tracked by. This is the full name of the
+// types.Func object it declares. When no type information is available, the same name is built from the syntax of
+// the declaration.
+func (m *InstrumentationManager) functionID(decl *dst.FuncDecl) string {
+	if fn := m.declaredFunction(decl); fn != nil {
+		return fn.FullName()
+	}
+
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return m.currentPackage + "." + decl.Name.Name
+	}
+	recv := m.currentPackage + "." + receiverTypeName(decl.Recv.List[0].Type)
+	if _, ok := decl.Recv.List[0].Type.(*dst.StarExpr); ok {
+		recv = "*" + recv
+	}
+	return "(" + recv + ")." + decl.Name.Name
+}
+
+// functionValueID returns the ID of the function declared in the current package that expr refers to, such as a
+// handler passed to a router, or an empty string if it refers to none. Without type information, only functions
+// referred to by their name are found.
+func (m *InstrumentationManager) functionValueID(expr dst.Expr) string {
+	var ident *dst.Ident
+	switch v := expr.(type) {
+	case *dst.Ident:
+		ident = v
+	case *dst.SelectorExpr:
+		ident = v.Sel
+	default:
+		return ""
+	}
+	pkg := m.GetDecoratorPackage()
+	if pkg != nil && pkg.TypesInfo != nil {
+		if astIdent, ok := pkg.Decorator.Ast.Nodes[ident].(*ast.Ident); ok && pkg.TypesInfo.Uses[astIdent] != nil {
+			fn, ok := pkg.TypesInfo.Uses[astIdent].(*types.Func)
+			if !ok || fn.Pkg() == nil || fn.Pkg().Path() != pkg.PkgPath {
+				return ""
+			}
+			return fn.Origin().FullName()
+		}
+	}
+	if ident != expr || ident.Path != "" {
+		return ""
+	}
+	id := m.currentPackage + "." + ident.Name
+	if _, ok := m.packages[m.currentPackage].tracedFuncs[id]; !ok {
+		return ""
+	}
+	return id
+}
+
+// declaredFunction returns the types.Func declared by a function declaration in the current package, or nil if there is no
+// type information for it.
+func (m *InstrumentationManager) declaredFunction(decl *dst.FuncDecl) *types.Func {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	astDecl, ok := pkg.Decorator.Ast.Nodes[decl].(*ast.FuncDecl)
+	if !ok {
+		return nil
+	}
+	fn, _ := pkg.TypesInfo.Defs[astDecl.Name].(*types.Func)
+	return fn
+}
+
+// functionDisplayName returns the human readable name of a function, used to name transactions and segments.
+// Methods are qualified by the name of their receiver type, e.g. "Server.Close".
+func functionDisplayName(fn *types.Func) string {
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return fn.Name()
+	}
+
+	recvType := recv.Type()
+	if ptr, ok := recvType.(*types.Pointer); ok {
+		recvType = ptr.Elem()
+	}
+	if named, ok := recvType.(*types.Named); ok {
+		return named.Obj().Name() + "." + fn.Name()
+	}
+	return fn.Name()
+}
+
+// functionDeclName returns the human readable name of a declared function, the same way functionDisplayName does.
+func functionDeclName(decl *dst.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	return receiverTypeName(decl.Recv.List[0].Type) + "." + decl.Name.Name
+}
+
+// receiverTypeName returns the name of the type of a method receiver, without any pointer or type parameters.
+func receiverTypeName(expr dst.Expr) string {
+	switch v := expr.(type) {
+	case *dst.Ident:
+		return v.Name
+	case *dst.StarExpr:
+		return receiverTypeName(v.X)
+	case *dst.IndexExpr:
+		return receiverTypeName(v.X)
+	case *dst.IndexListExpr:
+		return receiverTypeName(v.X)
+	}
+	return ""
+}
+
+// CreateFunctionDeclaration creates a tracking object for a function declaration that can be used
+// to find tracing locations. This is for initializing and set up only.
+func (m *InstrumentationManager) CreateFunctionDeclaration(decl *dst.FuncDecl) {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return
+	}
+
+	id := m.functionID(decl)
+	_, ok = state.tracedFuncs[id]
+	if !ok {
+		fn := &tracedFunction{
+			name: functionDeclName(decl),
+			body: decl,
+		}
+		if m.propagation == PropagateTxnContext {
+			fn.txnContext = m.contextParameter(decl)
+		}
+		state.tracedFuncs[id] = fn
+	}
+}
+
+// UpdateFunctionDeclaration replaces the declaration stored for the given function, and marks it as traced.
+func (m *InstrumentationManager) UpdateFunctionDeclaration(decl *dst.FuncDecl) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		t, ok := state.tracedFuncs[m.functionID(decl)]
+		if ok {
+			t.body = decl
+			t.traced = true
+			t.inProgress = false
+		}
+	}
+}
+
+// StartTracingFunction marks a function declared in the current package as being traced. Until UpdateFunctionDeclaration
+// is called for it, recursive invocations of the function will not trace it again, but will pass it a transaction.
+func (m *InstrumentationManager) StartTracingFunction(decl *dst.FuncDecl) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		t, ok := state.tracedFuncs[m.functionID(decl)]
+		if ok && !t.traced {
+			t.inProgress = true
+		}
+	}
+}
+
+// TransactionContextName returns the name of the context argument a function declared in the current package gets its
+// transaction from, or an empty string if it does not get its transaction from a context.
+func (m *InstrumentationManager) TransactionContextName(decl *dst.FuncDecl) string {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		t, ok := state.tracedFuncs[m.functionID(decl)]
+		if ok && t.txnContext != nil {
+			return t.txnContext.name
+		}
+	}
+	return ""
+}
+
+// contextParameter returns the first named context.Context parameter of a function declared in the current package,
+// or nil if it has none.
+func (m *InstrumentationManager) contextParameter(decl *dst.FuncDecl) *contextParameter {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil || decl.Type.Params == nil {
+		return nil
+	}
+
+	index := 0
+	for _, field := range decl.Type.Params.List {
+		astField, ok := pkg.Decorator.Ast.Nodes[field].(*ast.Field)
+		if !ok {
+			return nil
+		}
+
+		if len(field.Names) == 0 {
+			index++
+			continue
+		}
+		if isContextType(pkg.TypesInfo.TypeOf(astField.Type)) {
+			for _, name := range field.Names {
+				if name.Name != "_" {
+					return &contextParameter{name: name.Name, index: index}
+				}
+				index++
+			}
+			continue
+		}
+		index += len(field.Names)
+	}
+	return nil
+}
+
+// isContextType returns true if t is context.Context.
+func isContextType(t types.Type) bool {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	obj := named.Obj()
+	return obj.Pkg() != nil && obj.Pkg().Path() == "context" && obj.Name() == "Context"
+}
+
+// IsTracingStarted returns true if a function declared in the current package is being traced, or has been traced already.
+func (m *InstrumentationManager) IsTracingStarted(decl *dst.FuncDecl) bool {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		t, ok := state.tracedFuncs[m.functionID(decl)]
+		if ok {
+			return t.traced || t.inProgress
+		}
+	}
+	return false
+}
+
+type invocationInfo struct {
+	functionName string // human readable name of the function, used to name transactions and segments
+	functionID   string // ID the function is tracked by in its package
+	packageName  string
+	call         *dst.CallExpr
+}
+
+// GetPackageFunctionInvocation returns the name of the function being invoked, and the expression containing the call
+// where that invocation occurs if a function is declared in this package. Methods invoked on a concrete receiver are
+// resolved with type information, and are named after their receiver type. If more than one function is invoked in
+// node, the outermost invocation is returned.
+func (m *InstrumentationManager) GetPackageFunctionInvocation(node dst.Node) *invocationInfo {
+	invocations := m.GetPackageFunctionInvocations(node)
+	if len(invocations) == 0 {
+		return nil
+	}
+	return invocations[0]
+}
+
+// GetOutermostInvocations returns the invocations made by the outermost call in node to functions declared in the
+// instrumented packages. A call that dispatches through an interface or function value may invoke more than one of
+// them.
+func (m *InstrumentationManager) GetOutermostInvocations(node dst.Node) []*invocationInfo {
+	invocations := m.GetPackageFunctionInvocations(node)
+	for i, inv := range invocations {
+		if inv.call != invocations[0].call {
+			return invocations[:i]
+		}
+	}
+	return invocations
+}
+
+// GetPackageFunctionInvocations returns every invocation of a function declared in the instrumented packages made in node,
+// including calls nested in other expressions, in the order they appear. Calls in nested blocks are not included.
+//
+// When a call graph is available, calls are resolved with it. Otherwise, they are resolved from the syntax and type
+// information of the current package.
+func (m *InstrumentationManager) GetPackageFunctionInvocations(node dst.Node) []*invocationInfo {
+	invocations := []*invocationInfo{}
+
+	dst.Inspect(node, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.BlockStmt:
+			return false
+		case *dst.CallExpr:
+			if m.callGraph != nil {
+				invocations = append(invocations, m.getCallGraphInvocations(v)...)
+			} else if invInfo := m.getSyntaxInvocation(v); invInfo != nil {
+				invocations = append(invocations, invInfo)
+			}
+		}
+		return true
+	})
+
+	return invocations
+}
+
+// getCallGraphInvocations returns the invocations made by call of the functions declared in the instrumented packages
+// the call graph resolves it to. A call that always invokes the same function invokes it. A call that dispatches through
+// an interface or function value invokes each of the functions it may call that get their transaction from the context
+// it passes them, since their signature can not be changed.
+func (m *InstrumentationManager) getCallGraphInvocations(call *dst.CallExpr) []*invocationInfo {
+	astCall := astCallExpr(call, m.GetDecoratorPackage())
+	if id, ok := m.callGraph.StaticCallee(astCall); ok {
+		if inv := m.callGraphInvocation(call, id); inv != nil {
+			return []*invocationInfo{inv}
+		}
+		return nil
+	}
+
+	invocations := []*invocationInfo{}
+	for _, id := range m.callGraph.DynamicCallees(astCall) {
+		inv := m.callGraphInvocation(call, id)
+		if inv == nil {
+			continue
+		}
+		if fn := m.packages[inv.packageName].tracedFuncs[id]; fn.txnContext == nil {
+			m.explainInvocation(inv, "the call dispatches dynamically, and it has no context argument to be passed a transaction in")
+			continue
+		}
+		invocations = append(invocations, inv)
+	}
+	return invocations
+}
+
+// callGraphInvocation returns the invocation made by call of the function with the given ID, or nil if it is not
+// declared in the instrumented packages.
+func (m *InstrumentationManager) callGraphInvocation(call *dst.CallExpr, id string) *invocationInfo {
+	for path, state := range m.packages {
+		fn, ok := state.tracedFuncs[id]
+		if ok {
+			return &invocationInfo{
+				functionName: fn.name,
+				functionID:   id,
+				packageName:  path,
+				call:         call,
+			}
+		}
+	}
+	return nil
+}
+
+// getSyntaxInvocation returns the invocation made by call if it names a function, or a method of a concrete type,
+// declared in the instrumented packages.
+func (m *InstrumentationManager) getSyntaxInvocation(call *dst.CallExpr) *invocationInfo {
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		path := fun.Path
+		if path == "" {
+			path = m.GetPackageName()
+		}
+		_, ok := m.packages[path]
+		if ok {
+			id, ok := m.getFunctionInvocationID(fun, path)
+			if ok {
+				return &invocationInfo{
+					functionName: fun.Name,
+					functionID:   id,
+					packageName:  path,
+					call:         call,
+				}
+			}
+		}
+	case *dst.SelectorExpr:
+		inv, ok := m.getMethodInvocation(fun)
+		if ok {
+			inv.call = call
+			return inv
+		}
+	}
+	return nil
+}
+
+// getFunctionInvocationID returns the ID of the function named by ident in a function call. If type information is
+// available, identifiers that do not refer to a function, such as variables of a function type and type conversions, are
+// rejected.
+func (m *InstrumentationManager) getFunctionInvocationID(ident *dst.Ident, path string) (string, bool) {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return path + "." + ident.Name, true
+	}
+
+	var astIdent *ast.Ident
+	switch v := pkg.Decorator.Ast.Nodes[ident].(type) {
+	case *ast.Ident:
+		astIdent = v
+	case *ast.SelectorExpr:
+		astIdent = v.Sel
+	default:
+		return "", false
+	}
+
+	fn, ok := pkg.TypesInfo.Uses[astIdent].(*types.Func)
+	if !ok {
+		return "", false
+	}
+	return fn.Origin().FullName(), true
+}
+
+// getMethodInvocation resolves the method selected by sel in a method call. If the method is declared on a concrete type in
+// one of the packages being instrumented, an invocationInfo without a call is returned for it.
+func (m *InstrumentationManager) getMethodInvocation(sel *dst.SelectorExpr) (*invocationInfo, bool) {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil, false
+	}
+
+	astSel, ok := pkg.Decorator.Ast.Nodes[sel].(*ast.SelectorExpr)
+	if !ok {
+		return nil, false
+	}
+
+	selection, ok := pkg.TypesInfo.Selections[astSel]
+	if !ok || selection.Kind() != types.MethodVal {
+		return nil, false
+	}
+
+	method, ok := selection.Obj().(*types.Func)
+	if !ok || method.Pkg() == nil {
+		return nil, false
+	}
+	method = method.Origin()
+
+	recv := method.Type().(*types.Signature).Recv()
+	if recv == nil || types.IsInterface(recv.Type()) {
+		return nil, false
+	}
+
+	path := method.Pkg().Path()
+	if _, ok := m.packages[path]; !ok {
+		return nil, false
+	}
+
+	return &invocationInfo{
+		functionName: functionDisplayName(method),
+		functionID:   method.FullName(),
+		packageName:  path,
+	}, true
+}
+
+// AddTxnArgumentToFuncDecl adds a transaction argument to the declaration of a function. This marks that function as needing a transaction,
+// and can be looked up by name to know that the last argument is a transaction.
+//
+// If callers the tool can not see depend on the signature of the function, it is renamed, and a wrapper with its original
+// name and signature is declared after it.
+func (m *InstrumentationManager) AddTxnArgumentToFunctionDecl(decl *dst.FuncDecl, txnVarName string) {
+	if decl == nil {
+		return
+	}
+
+	state, ok := m.packages[m.currentPackage]
+	var fn *tracedFunction
+	if ok {
+		fn = state.tracedFuncs[m.functionID(decl)]
+	}
+	if fn != nil && fn.tracedName != "" && decl.Name.Name != fn.tracedName {
+		wrapper := signaturePreservingWrapper(decl, fn.tracedName, m.Backend())
+		m.insertFunctionDeclaration(decl, wrapper)
+		m.RecordChange(ruleTraceFunction, decl, wrapper)
+		decl.Name.Name = fn.tracedName
+	}
+
+	if decl.Type.Params == nil {
+		decl.Type.Params = &dst.FieldList{
+			List: []*dst.Field{{
+				Names: []*dst.Ident{dst.NewIdent(txnVarName)},
+				Type:  m.Backend().TransactionType(),
+			}},
+		}
+	} else {
+		decl.Type.Params.List = append(decl.Type.Params.List, &dst.Field{
+			Names: []*dst.Ident{dst.NewIdent(txnVarName)},
+			Type:  m.Backend().TransactionType(),
+		})
+	}
+	if fn != nil {
+		fn.requiresTxn = true
+		fn.txnVariable = txnVarName
+	}
+}
+
+// insertFunctionDeclaration declares newDecl right after decl, in the same file of the current package.
+func (m *InstrumentationManager) insertFunctionDeclaration(decl, newDecl *dst.FuncDecl) {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return
+	}
+
+	for _, file := range state.pkg.Syntax {
+		for i, d := range file.Decls {
+			if d == decl {
+				// always build a new list, since the declarations of files may be iterated over while they are instrumented
+				decls := make([]dst.Decl, 0, len(file.Decls)+1)
+				decls = append(decls, file.Decls[:i+1]...)
+				decls = append(decls, newDecl)
+				file.Decls = append(decls, file.Decls[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// declareAfter inserts newDecl after the function declaration of the current package that contains stmt, unless the
+// package declares a function of the same name already. It returns true if it inserted newDecl.
+func (m *InstrumentationManager) declareAfter(stmt dst.Stmt, newDecl *dst.FuncDecl) bool {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return false
+	}
+
+	var decl *dst.FuncDecl
+	for _, file := range state.pkg.Syntax {
+		for _, d := range file.Decls {
+			fn, ok := d.(*dst.FuncDecl)
+			if !ok {
+				continue
+			}
+			if fn.Recv == nil && fn.Name.Name == newDecl.Name.Name {
+				return false
+			}
+			if decl == nil && fn.Body != nil && containsNode(fn.Body, stmt) {
+				decl = fn
+			}
+		}
+	}
+	if decl == nil {
+		return false
+	}
+	m.insertFunctionDeclaration(decl, newDecl)
+	return true
+}
+
+// containsNode returns true if node is root, or one of its descendants.
+func containsNode(root, node dst.Node) bool {
+	found := false
+	dst.Inspect(root, func(n dst.Node) bool {
+		if n == node {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// TracedFunctionName returns the name the function invoked by inv is traced under, if a wrapper preserves its original signature.
+func (m *InstrumentationManager) TracedFunctionName(inv *invocationInfo) string {
+	if inv == nil {
+		return ""
+	}
+	state, ok := m.packages[inv.packageName]
+	if ok {
+		v, ok := state.tracedFuncs[inv.functionID]
+		if ok {
+			return v.tracedName
+		}
+	}
+	return ""
+}
+
+// AddTxnToFunctionDecl passes a transaction to the body of a traced function. If the function gets its transaction from
+// its context argument, the transaction is defined from that context at the top of the function body. Otherwise, a
+// transaction argument is added to the function declaration.
+//
+// Because the transaction defined from a context would be unused otherwise, it is only defined if the body of the function
+// refers to txnVarName. If transactions are contexts, and txnVarName is the context argument, it is not defined at all.
+func (m *InstrumentationManager) AddTxnToFunctionDecl(decl *dst.FuncDecl, txnVarName string) {
+	if decl == nil {
+		return
+	}
+
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return
+	}
+	fn, ok := state.tracedFuncs[m.functionID(decl)]
+	if !ok || fn.txnContext == nil {
+		m.AddTxnArgumentToFunctionDecl(decl, txnVarName)
+		return
+	}
+
+	fn.requiresTxn = true
+	if txnVarName == fn.txnContext.name {
+		fn.txnVariable = txnVarName
+	} else if usesIdent(decl.Body, txnVarName) {
+		decl.Body.List = append([]dst.Stmt{m.Backend().TransactionFromContext(txnVarName, dst.NewIdent(fn.txnContext.name))}, decl.Body.List...)
+		fn.txnVariable = txnVarName
+	}
+}
+
+// setTransactionVariable records that the body of a traced function declared in the current package has its
+// transaction in the variable txnVarName.
+func (m *InstrumentationManager) setTransactionVariable(decl *dst.FuncDecl, txnVarName string) {
+	state, ok := m.packages[m.currentPackage]
+	if ok {
+		fn, ok := state.tracedFuncs[m.functionID(decl)]
+		if ok {
+			fn.txnVariable = txnVarName
+		}
+	}
+}
+
+// usesIdent returns true if node refers to a local identifier with the given name.
+func usesIdent(node dst.Node, name string) bool {
+	found := false
+	dst.Inspect(node, func(n dst.Node) bool {
+		ident, ok := n.(*dst.Ident)
+		if ok && ident.Name == name && ident.Path == "" {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
+// ShouldInstrumentFunction returns true if the function invoked by inv has not been traced yet, and can be.
+func (m *InstrumentationManager) ShouldInstrumentFunction(inv *invocationInfo) bool {
+	if inv == nil {
+		return false
+	}
+	should, reason := m.shouldInstrumentFunction(inv)
+	m.explainInvocation(inv, "ShouldInstrumentFunction is %t, %s", should, reason)
+	return should
+}
+
+// shouldInstrumentFunction returns whether the function invoked by inv should be traced, and why.
+func (m *InstrumentationManager) shouldInstrumentFunction(inv *invocationInfo) (bool, string) {
+	if m.callGraph != nil && !m.callGraph.IsReachable(inv.functionID) {
+		return false, "the call graph does not reach it from a transaction entry point"
+	}
+
+	state, ok := m.packages[inv.packageName]
+	if ok {
+		v, ok := state.tracedFuncs[inv.functionID]
+		if ok {
+			switch {
+			case v.traced:
+				return false, "it is traced already"
+			case v.inProgress:
+				return false, "it is being traced, and the call is recursive"
+			case v.untraceable:
+				return false, "its signature can not be changed, and it can not be wrapped"
+			case m.ChangeDropped(ruleTraceFunction, v.body):
+				return false, "tracing it does not compile, and was dropped"
+			}
+			return true, "it is not traced yet"
+		}
+	}
+
+	return false, "it is not declared in the instrumented packages"
+}
+
+// conatinsTransactionArgument returns true if a function call contains a transaction argument.
+// This function works for async functions as well.
+func containsTransactionArgument(call *dst.CallExpr, txnName string) bool {
+	if call == nil || call.Args == nil {
+		return false
+	}
+
+	for _, arg := range call.Args {
+		switch v := arg.(type) {
+		case *dst.Ident:
+			if v.Name == txnName {
+				return true
+			}
+		case *dst.CallExpr:
+			sel, ok := v.Fun.(*dst.SelectorExpr)
+			if ok {
+				if sel.Sel.Name == "NewGoroutine" {
+					ident, ok := sel.X.(*dst.Ident)
+					if ok && ident.Name == txnName {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// RequiresTransactionArgument returns true if a modified function needs a transaction as an argument.
+// This can be used to check if transactions should be passed by callers.
+//
+// A function that is still being traced is invoked recursively. Its callers are always passed a transaction, since the
+// recursive call chain makes every function in it need one. Http handlers are the exception, since they get their
+// transaction from the request.
+func (m *InstrumentationManager) RequiresTransactionArgument(inv *invocationInfo, txnVariableName string) bool {
+	if inv == nil {
+		return false
+	}
+
+	state, ok := m.packages[inv.packageName]
+	if ok {
+		v, ok := state.tracedFuncs[inv.functionID]
+		if ok && v.txnContext == nil && !containsTransactionArgument(inv.call, txnVariableName) {
+			if v.inProgress && v.body != nil && !isHandler(v.body, state.pkg) {
+				return true
+			}
+			return v.requiresTxn
+		}
+	}
+	return false
+}
+
+// RequiresTransactionContext returns the index of the context argument a transaction needs to be passed in to the function
+// invoked by inv, and true if that function gets its transaction from a context that does not carry it yet.
+// Like RequiresTransactionArgument, functions that are still being traced are invoked recursively, and always need a transaction.
+func (m *InstrumentationManager) RequiresTransactionContext(inv *invocationInfo) (int, bool) {
+	if inv == nil || inv.call == nil {
+		return 0, false
+	}
+
+	state, ok := m.packages[inv.packageName]
+	if !ok {
+		return 0, false
+	}
+	v, ok := state.tracedFuncs[inv.functionID]
+	if !ok || v.txnContext == nil || v.txnContext.index >= len(inv.call.Args) {
+		return 0, false
+	}
+
+	index := v.txnContext.index
+	if m.Backend().IsContextWithTransaction(inv.call.Args[index]) {
+		return 0, false
+	}
+	if v.inProgress && v.body != nil && !isHandler(v.body, state.pkg) {
+		return index, true
+	}
+	return index, v.requiresTxn
+}
+
+// containsTransactionContext returns true if a context argument has a transaction added to it with newrelic.NewContext.
+func containsTransactionContext(arg dst.Expr) bool {
+	call, ok := arg.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*dst.Ident)
+	return ok && ident.Name == "NewContext" && ident.Path == newrelicAgentImport
+}
+
+// invokedDeclaration returns the declaration of the function invoked by inv.
+func (m *InstrumentationManager) invokedDeclaration(inv *invocationInfo) *dst.FuncDecl {
+	state, ok := m.packages[inv.packageName]
+	if ok {
+		v, ok := state.tracedFuncs[inv.functionID]
+		if ok {
+			return v.body
+		}
+	}
+	return nil
+}
+
+// GetDeclaration returns a pointer to the location in the DST tree where the function with the given ID is declared and defined.
+func (m *InstrumentationManager) GetDeclaration(functionID string) *dst.FuncDecl {
+	if m.packages[m.currentPackage] != nil && m.packages[m.currentPackage].tracedFuncs != nil {
+		v, ok := m.packages[m.currentPackage].tracedFuncs[functionID]
+		if ok {
+			return v.body
+		}
+	}
+	return nil
+}
+
+// WriteDiff writes out the changes made to a file to the diff file for this package.
+func (m *InstrumentationManager) WriteDiff() {
+	for _, patch := range m.filePatches() {
+		f, err := os.OpenFile(m.diffFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if _, err := f.WriteString(patch.patch); err != nil {
+			log.Println(err)
+		}
+		f.Close()
+	}
+	log.Printf("changes written to %s", m.diffFile)
+}
+
+// filePatch is the diff of a file of the application.
+type filePatch struct {
+	path     string // path of the file
+	patch    string // unified diff of the file, which names it relative to the application
+	original string // contents of the file on disk
+	modified string // contents of the file with the changes made to it
+}
+
+// filePatches returns the diffs of the files of all packages, with the changes made to them.
+func (m *InstrumentationManager) filePatches() []filePatch {
+	patches := []filePatch{}
+	for _, state := range m.packages {
+		r := decorator.NewRestorerWithImports(state.pkg.Dir, gopackages.New(state.pkg.Dir))
+
+		for _, file := range state.pkg.Syntax {
+			path := state.pkg.Decorator.Filenames[file]
+			originalFile, err := os.ReadFile(path)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// what this file will be named in the diff file
+			var diffFileName string
+
+			absAppPath, err := filepath.Abs(m.userAppPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			diffFileName, err = filepath.Rel(absAppPath, path)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			modifiedFile := bytes.NewBuffer([]byte{})
+			if err := m.fileRestorer(r, file).Fprint(modifiedFile, file); err != nil {
+				log.Fatal(err)
+			}
+
+			patches = append(patches, filePatch{
+				path:     path,
+				patch:    godiffpatch.GeneratePatch(diffFileName, string(originalFile), modifiedFile.String()),
+				original: string(originalFile),
+				modified: modifiedFile.String(),
+			})
+		}
+	}
+	return patches
+}
+
+// requiredModules returns the import paths the changes added to the packages, sorted, so that the modules that
+// provide them can be added to go.mod.
+func (m *InstrumentationManager) requiredModules() []string {
+	imported := map[string]bool{}
+	for _, state := range m.packages {
+		for path := range state.importsAdded {
+			imported[path] = true
+		}
+	}
+	modules := []string{}
+	for path := range imported {
+		modules = append(modules, path)
+	}
+	sort.Strings(modules)
+	return modules
+}
+
+// getModules adds the modules that provide the imports to the go.mod of the module dir is in with go get, or to
+// modFile instead if it is not empty. The modules of modFile, the scratch go.mod of the verification, are resolved from
+// the module cache when it has them, so that the network is only needed for the modules that are not in it. It is a
+// variable so that tests do not need the network to resolve modules.
+var getModules = func(dir, modFile string, imports []string) error {
+	args := []string{"get"}
+	if modFile != "" {
+		args = append(args, "-modfile="+modFile)
+		if env, err := moduleCacheProxy(); err == nil && goGet(dir, env, append(args, imports...)) == nil {
+			return nil
+		}
+	}
+	return goGet(dir, nil, append(args, imports...))
+}
+
+// goGet runs go with args in dir, in the environment of the tool with env added to it.
+func goGet(dir string, env, args []string) error {
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("go get: %s", msg)
+		}
+		return fmt.Errorf("go get: %w", err)
+	}
+	return nil
+}
+
+// moduleCacheProxy returns the environment that makes go get resolve modules from the module cache only, by using its
+// download directory as the module proxy. The checksum database is not consulted, since the modules are only resolved
+// this way for the scratch go.mod of the verification, which is removed once the application is type checked.
+func moduleCacheProxy() ([]string, error) {
+	out, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		return nil, err
+	}
+	cache := strings.TrimSpace(string(out))
+	if cache == "" {
+		return nil, errors.New("go env: GOMODCACHE is not set")
+	}
+	download := filepath.ToSlash(filepath.Join(cache, "cache", "download"))
+	if !strings.HasPrefix(download, "/") {
+		download = "/" + download
+	}
+	return []string{"GOPROXY=file://" + download, "GOSUMDB=off"}, nil
+}
+
+// AddRequiredModules adds the modules the changes import to the go.mod of the application. It is run once the changes
+// are final, so that go.mod only gets the modules of the changes that are made.
+func (m *InstrumentationManager) AddRequiredModules() error {
+	modules := m.requiredModules()
+	if len(modules) == 0 {
+		return nil
+	}
+	return getModules(m.userAppPath, "", modules)
+}
+
+// InstrumentPackages applies the rules of the registry to all functions in the packages.
+func (m *InstrumentationManager) InstrumentPackages() error {
+	// Create a call graph of all calls made to functions in this package
+	err := tracePackageFunctionCalls(m)
+	if err != nil {
+		return err
+	}
+
+	instrumentPackages(m)
+
+	return nil
+}
+
+// traceFunctionCalls discovers and sets up tracing for all function calls in the current package
+func tracePackageFunctionCalls(manager *InstrumentationManager) error {
+	hasMain := false
+	for packageName, pkg := range manager.packages {
+		manager.SetPackage(packageName)
+		for _, file := range pkg.pkg.Syntax {
+			for _, decl := range file.Decls {
+				if fn, isFn := decl.(*dst.FuncDecl); isFn {
+					manager.CreateFunctionDeclaration(fn)
+					if fn.Name.Name == "main" && fn.Recv == nil {
+						hasMain = true
+					}
+				}
+			}
+		}
+	}
+
+	if !hasMain {
+		return errors.New("cannot find a main method for this application")
+	}
+
+	manager.callGraph = NewCallGraph(manager.decoratorPackages())
+	if manager.callGraph == nil {
+		log.Println("unable to build a call graph for this application, falling back to tracing direct function calls only")
+	}
+
+	findDynamicCallees(manager)
+	findSignatureBoundFunctions(manager)
+	findExistingInstrumentation(manager)
+	return nil
+}
+
+// findDynamicCallees makes the functions that calls through an interface or function value may invoke get their
+// transaction from their context argument, whatever the propagation mode. Their signature is bound to the one of the
+// call, so a transaction argument can not be added to them.
+func findDynamicCallees(manager *InstrumentationManager) {
+	rootPkg := manager.currentPackage
+	defer manager.SetPackage(rootPkg)
+
+	for pkgName, state := range manager.packages {
+		manager.SetPackage(pkgName)
+		for id, fn := range state.tracedFuncs {
+			if fn.txnContext == nil && fn.body != nil && manager.callGraph.IsDynamicCallee(id) {
+				fn.txnContext = manager.contextParameter(fn.body)
+			}
+		}
+	}
+}
+
+// StatelessInstrumentationFunc is a function that does not need to be aware of the current tracing state of the package to apply instrumentation.
+type StatelessInstrumentationFunc func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor)
+
+// apply the stateless rules to the packages that import what they instrument
+func instrumentPackages(manager *InstrumentationManager) {
+	for pkgName, pkgState := range manager.packages {
+		manager.SetPackage(pkgName)
+		instrumentationFunctions := manager.Rules().statelessRules(manager.importsPackage)
+		for _, file := range pkgState.pkg.Syntax {
+			for _, decl := range file.Decls {
+				if fn, isFn := decl.(*dst.FuncDecl); isFn {
+					dstutil.Apply(fn, nil, func(c *dstutil.Cursor) bool {
+						n := c.Node()
+						for _, instFunc := range instrumentationFunctions {
+							instFunc(n, manager, c)
+						}
+						return true
+					})
+				}
+			}
+		}
+	}
+
+}
@@ -1,4 +1,4 @@
-package main
+package instrumentation
 
 import (
 	"reflect"
@@ -169,7 +169,7 @@ func Test_CreateFunctionDeclaration(t *testing.T) {
 		{
 			name: "CreateFunctionDeclaration_already_exists",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args:   args{decl: &dst.FuncDecl{Name: &dst.Ident{Name: "bar"}}},
@@ -190,7 +190,7 @@ func Test_CreateFunctionDeclaration(t *testing.T) {
 			m.CreateFunctionDeclaration(tt.args.decl)
 
 			if tt.expect {
-				if m.packages["foo"].tracedFuncs["bar"] == nil {
+				if m.packages["foo"].tracedFuncs["foo.bar"] == nil {
 					t.Errorf("CreateFunctionDeclaration failed to add new function bar to package foo, got: %+v", m.packages["foo"].tracedFuncs)
 				}
 				if len(m.packages["foo"].tracedFuncs) != 1 {
@@ -198,7 +198,7 @@ func Test_CreateFunctionDeclaration(t *testing.T) {
 				}
 			}
 			if !tt.expect {
-				_, ok := m.packages["foo"].tracedFuncs["bar"]
+				_, ok := m.packages["foo"].tracedFuncs["foo.bar"]
 				if ok {
 					t.Errorf("CreateFunctionDeclaration added function bar to package foo when it should not have: %+v", m.packages["foo"].tracedFuncs)
 				}
@@ -228,7 +228,7 @@ func Test_UpdateFunctionDeclaration(t *testing.T) {
 		{
 			name: "UpdateFunctionDeclaration",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args:    args{decl: &dst.FuncDecl{Name: &dst.Ident{Name: "bar"}}},
@@ -237,7 +237,7 @@ func Test_UpdateFunctionDeclaration(t *testing.T) {
 		{
 			name: "UpdateFunctionDeclaration_nil_check",
 			fields: fields{
-				packages: map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages: map[string]*PackageState{"foo": {importsAdded: map[string]bool{}, tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 			},
 			args:    args{decl: &dst.FuncDecl{Name: &dst.Ident{Name: "bar"}}},
 			updates: false,
@@ -257,11 +257,11 @@ func Test_UpdateFunctionDeclaration(t *testing.T) {
 			defer panicRecovery(t)
 			m.UpdateFunctionDeclaration(tt.args.decl)
 
-			if tt.updates && reflect.DeepEqual(m.packages["foo"].tracedFuncs["bar"].body, tt.args.decl) == false {
+			if tt.updates && reflect.DeepEqual(m.packages["foo"].tracedFuncs["foo.bar"].body, tt.args.decl) == false {
 				t.Errorf("UpdateFunctionDeclaration failed to update function bar to package foo, got: %+v", m.packages["foo"].tracedFuncs)
 			}
 
-			if !tt.updates && reflect.DeepEqual(m.packages["foo"].tracedFuncs["bar"].body, tt.args.decl) == true {
+			if !tt.updates && reflect.DeepEqual(m.packages["foo"].tracedFuncs["foo.bar"].body, tt.args.decl) == true {
 				t.Errorf("UpdateFunctionDeclaration updated function bar to package foo when it should not have: %+v", m.packages["foo"].tracedFuncs)
 			}
 		})
@@ -294,7 +294,7 @@ func Test_GetPackageFunctionInvocation(t *testing.T) {
 				currentPackage: "foo",
 			},
 			args: args{node: &dst.CallExpr{Fun: &dst.Ident{Name: "bar", Path: "foo"}}},
-			want: &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar", Path: "foo"}}},
+			want: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar", Path: "foo"}}},
 		},
 		{
 			name: "empty_path_passes",
@@ -303,7 +303,7 @@ func Test_GetPackageFunctionInvocation(t *testing.T) {
 				currentPackage: "foo",
 			},
 			args: args{node: &dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}},
-			want: &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}},
+			want: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}},
 		},
 		{
 			name: "finds_call_in_complex_node",
@@ -312,7 +312,7 @@ func Test_GetPackageFunctionInvocation(t *testing.T) {
 				currentPackage: "foo",
 			},
 			args: args{node: &dst.ExprStmt{X: &dst.CallExpr{Fun: &dst.Ident{Name: "Sprintf", Path: "fmt"}, Args: []dst.Expr{&dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}}}}},
-			want: &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}},
+			want: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Fun: &dst.Ident{Name: "bar"}}},
 		},
 		{
 			name: "ignore_functions_not_in_package",
@@ -373,7 +373,7 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 		{
 			name: "simple_passing_case",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{
@@ -387,9 +387,9 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 						List: []*dst.Field{{
 							Names: []*dst.Ident{dst.NewIdent("txn")},
 							Type: &dst.StarExpr{
-								X: &dst.SelectorExpr{
-									X:   dst.NewIdent("newrelic"),
-									Sel: dst.NewIdent("Transaction"),
+								X: &dst.Ident{
+									Name: "Transaction",
+									Path: newrelicAgentImport,
 								},
 							},
 						}},
@@ -401,7 +401,7 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 		{
 			name: "simple_case_nil_params",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{
@@ -415,9 +415,9 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 						List: []*dst.Field{{
 							Names: []*dst.Ident{dst.NewIdent("txn")},
 							Type: &dst.StarExpr{
-								X: &dst.SelectorExpr{
-									X:   dst.NewIdent("newrelic"),
-									Sel: dst.NewIdent("Transaction"),
+								X: &dst.Ident{
+									Name: "Transaction",
+									Path: newrelicAgentImport,
 								},
 							},
 						}},
@@ -429,7 +429,7 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 		{
 			name: "nil_function_declaration",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{
@@ -453,7 +453,7 @@ func Test_AddTxnArgumentToFunctionDecl(t *testing.T) {
 			defer panicRecovery(t)
 			m.AddTxnArgumentToFunctionDecl(tt.args.decl, tt.args.txnVarName)
 			assert.Equal(t, tt.want, tt.args.decl)
-			assert.Equal(t, tt.wantRequireTxn, m.packages[m.currentPackage].tracedFuncs["bar"].requiresTxn)
+			assert.Equal(t, tt.wantRequireTxn, m.packages[m.currentPackage].tracedFuncs["foo.bar"].requiresTxn)
 		})
 	}
 }
@@ -479,16 +479,16 @@ func Test_ShouldInstrumentFunction(t *testing.T) {
 		{
 			name: "function_should_be_instrumented",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
-			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar"}},
+			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"}},
 			want: true,
 		},
 		{
 			name: "nil_invocation",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{inv: nil},
@@ -497,10 +497,19 @@ func Test_ShouldInstrumentFunction(t *testing.T) {
 		{
 			name: "already_instrumented",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {traced: true}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {traced: true}}}},
+				currentPackage: "foo",
+			},
+			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"}},
+			want: false,
+		},
+		{
+			name: "tracing_in_progress",
+			fields: fields{
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {inProgress: true}}}},
 				currentPackage: "foo",
 			},
-			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar"}},
+			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"}},
 			want: false,
 		},
 		{
@@ -509,7 +518,7 @@ func Test_ShouldInstrumentFunction(t *testing.T) {
 				packages:       map[string]*PackageState{},
 				currentPackage: "foo",
 			},
-			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar"}},
+			args: args{inv: &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"}},
 			want: false,
 		},
 	}
@@ -554,11 +563,11 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "requres_txn",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {requiresTxn: true}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {requiresTxn: true}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Args: []dst.Expr{}}},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: []dst.Expr{}}},
 				txnVariableName: "txn",
 			},
 			want: true,
@@ -566,11 +575,11 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "call_contains_arguments",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {requiresTxn: true}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {requiresTxn: true}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Args: []dst.Expr{dst.NewIdent("baz")}}},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: []dst.Expr{dst.NewIdent("baz")}}},
 				txnVariableName: "txn",
 			},
 			want: true,
@@ -578,11 +587,11 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "call_contains_txn_argument",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {requiresTxn: true}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {requiresTxn: true}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Args: []dst.Expr{dst.NewIdent("txn")}}},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: []dst.Expr{dst.NewIdent("txn")}}},
 				txnVariableName: "txn",
 			},
 			want: false,
@@ -590,11 +599,11 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "call_contains_async_txn_argument",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {requiresTxn: true}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {requiresTxn: true}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Args: []dst.Expr{txnNewGoroutine("txn")}}},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: []dst.Expr{txnNewGoroutine("txn")}}},
 				txnVariableName: "txn",
 			},
 			want: false,
@@ -602,7 +611,7 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "nil_invocation",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{
@@ -614,23 +623,38 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		{
 			name: "nil_call_arguments",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar", call: &dst.CallExpr{Args: nil}},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: nil}},
 				txnVariableName: "txn",
 			},
 			want: false,
 		},
+		{
+			name: "recursive_call_requires_txn",
+			fields: fields{
+				packages: map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {
+					inProgress: true,
+					body:       &dst.FuncDecl{Name: dst.NewIdent("bar"), Type: &dst.FuncType{Params: &dst.FieldList{}}},
+				}}}},
+				currentPackage: "foo",
+			},
+			args: args{
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar", call: &dst.CallExpr{Args: []dst.Expr{}}},
+				txnVariableName: "txn",
+			},
+			want: true,
+		},
 		{
 			name: "does_not_require_txn",
 			fields: fields{
-				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"bar": {requiresTxn: false}}}},
+				packages:       map[string]*PackageState{"foo": {tracedFuncs: map[string]*tracedFunction{"foo.bar": {requiresTxn: false}}}},
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar"},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"},
 				txnVariableName: "txn",
 			},
 			want: false,
@@ -642,7 +666,7 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 				currentPackage: "foo",
 			},
 			args: args{
-				inv:             &invocationInfo{packageName: "foo", functionName: "bar"},
+				inv:             &invocationInfo{packageName: "foo", functionName: "bar", functionID: "foo.bar"},
 				txnVariableName: "txn",
 			},
 			want: false,
@@ -666,3 +690,286 @@ func Test_RequiresTransactionArgument(t *testing.T) {
 		})
 	}
 }
+
+func Test_functionID(t *testing.T) {
+	tests := []struct {
+		name string
+		decl *dst.FuncDecl
+		want string
+	}{
+		{
+			name: "function",
+			decl: &dst.FuncDecl{Name: dst.NewIdent("bar")},
+			want: "foo.bar",
+		},
+		{
+			name: "value_receiver",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("bar"),
+				Recv: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("f")}, Type: dst.NewIdent("Foo")}}},
+			},
+			want: "(foo.Foo).bar",
+		},
+		{
+			name: "pointer_receiver",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("bar"),
+				Recv: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("f")}, Type: &dst.StarExpr{X: dst.NewIdent("Foo")}}}},
+			},
+			want: "(*foo.Foo).bar",
+		},
+		{
+			name: "generic_receiver",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("bar"),
+				Recv: &dst.FieldList{List: []*dst.Field{{Type: &dst.StarExpr{X: &dst.IndexExpr{X: dst.NewIdent("Foo"), Index: dst.NewIdent("T")}}}}},
+			},
+			want: "(*foo.Foo).bar",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &InstrumentationManager{
+				currentPackage: "foo",
+				packages:       map[string]*PackageState{"foo": {}},
+			}
+			assert.Equal(t, tt.want, m.functionID(tt.decl))
+		})
+	}
+}
+
+func Test_CreateFunctionDeclaration_sameName(t *testing.T) {
+	code := `
+package main
+type File struct{}
+func (f *File) Close() {}
+type Conn struct{}
+func (c Conn) Close() {}
+type Set[T comparable] struct{}
+func (s *Set[T]) Close() {}
+func Close() {}
+func main() {}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	for _, decl := range manager.GetDecoratorPackage().Syntax[0].Decls {
+		if fn, ok := decl.(*dst.FuncDecl); ok {
+			manager.CreateFunctionDeclaration(fn)
+		}
+	}
+
+	for _, id := range []string{"(*" + testAppPackage + ".File).Close", "(" + testAppPackage + ".Conn).Close", "(*" + testAppPackage + ".Set[T]).Close", testAppPackage + ".Close"} {
+		decl := manager.GetDeclaration(id)
+		if assert.NotNil(t, decl, id) {
+			assert.Equal(t, id, manager.functionID(decl))
+		}
+	}
+}
+
+func Test_GetPackageFunctionInvocation_methods(t *testing.T) {
+	tests := []struct {
+		name     string
+		code     string
+		wantName string
+		wantID   string
+	}{
+		{
+			name: "pointer_receiver",
+			code: `
+package main
+type Server struct{}
+func (s *Server) handle() {}
+func main() {
+	s := &Server{}
+	s.handle()
+}`,
+			wantName: "Server.handle",
+			wantID:   "(*" + testAppPackage + ".Server).handle",
+		},
+		{
+			name: "value_receiver",
+			code: `
+package main
+type Server struct{}
+func (s Server) handle() {}
+func main() {
+	s := Server{}
+	s.handle()
+}`,
+			wantName: "Server.handle",
+			wantID:   "(" + testAppPackage + ".Server).handle",
+		},
+		{
+			name: "promoted_method",
+			code: `
+package main
+type Repo struct{}
+func (r *Repo) Load() {}
+type Server struct {
+	*Repo
+}
+func main() {
+	s := Server{Repo: &Repo{}}
+	s.Load()
+}`,
+			wantName: "Repo.Load",
+			wantID:   "(*" + testAppPackage + ".Repo).Load",
+		},
+		{
+			name: "generic_receiver",
+			code: `
+package main
+type Set[T comparable] struct{}
+func (s *Set[T]) Add(v T) {}
+func main() {
+	s := &Set[int]{}
+	s.Add(1)
+}`,
+			wantName: "Set.Add",
+			wantID:   "(*" + testAppPackage + ".Set[T]).Add",
+		},
+		{
+			name: "function_variable",
+			code: `
+package main
+func main() {
+	handle := func() {}
+	handle()
+}`,
+			wantName: "",
+		},
+		{
+			name: "interface_method",
+			code: `
+package main
+type Loader interface {
+	Load()
+}
+func main() {
+	var l Loader
+	l.Load()
+}`,
+			wantName: "",
+		},
+		{
+			name: "method_from_other_package",
+			code: `
+package main
+import "strings"
+func main() {
+	b := strings.Builder{}
+	b.Reset()
+}`,
+			wantName: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, tt.code)
+			defer panicRecovery(t)
+
+			file := manager.GetDecoratorPackage().Syntax[0]
+			mainDecl := file.Decls[len(file.Decls)-1].(*dst.FuncDecl)
+			got := manager.GetPackageFunctionInvocation(mainDecl.Body.List[len(mainDecl.Body.List)-1])
+			if tt.wantName == "" {
+				assert.Nil(t, got)
+				return
+			}
+			if assert.NotNil(t, got) {
+				assert.Equal(t, tt.wantName, got.functionName)
+				assert.Equal(t, tt.wantID, got.functionID)
+				assert.Equal(t, testAppPackage, got.packageName)
+			}
+		})
+	}
+}
+
+func Test_contextParameter(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want *contextParameter
+	}{
+		{
+			name: "first_argument",
+			code: "func foo(ctx context.Context, n int) {}",
+			want: &contextParameter{name: "ctx", index: 0},
+		},
+		{
+			name: "grouped_arguments",
+			code: "func foo(a, b int, c context.Context) {}",
+			want: &contextParameter{name: "c", index: 2},
+		},
+		{
+			name: "method",
+			code: "type T struct{}\nfunc (t *T) foo(n int, ctx context.Context) {}",
+			want: &contextParameter{name: "ctx", index: 1},
+		},
+		{
+			name: "blank_context",
+			code: "func foo(_ context.Context, n int) {}",
+			want: nil,
+		},
+		{
+			name: "no_context",
+			code: "func foo(n int, s string) {}",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := "package main\n\nimport \"context\"\n\nvar _ context.Context\n\n" + tt.code + "\n\nfunc main() {}\n"
+			manager := newTestingInstrumentationManager(t, code)
+			defer panicRecovery(t)
+
+			var decl *dst.FuncDecl
+			for _, d := range manager.GetDecoratorPackage().Syntax[0].Decls {
+				if fn, ok := d.(*dst.FuncDecl); ok && fn.Name.Name == "foo" {
+					decl = fn
+				}
+			}
+			assert.Equal(t, tt.want, manager.contextParameter(decl))
+		})
+	}
+}
+
+func Test_AddRequiredModules(t *testing.T) {
+	tests := []struct {
+		name     string
+		packages map[string]*PackageState
+		want     []moduleRequest
+	}{
+		{
+			name: "imports_of_all_packages",
+			packages: map[string]*PackageState{
+				"foo": {importsAdded: map[string]bool{newrelicAgentImport: true, nrginImport: true}},
+				"bar": {importsAdded: map[string]bool{newrelicAgentImport: true}},
+			},
+			want: []moduleRequest{{dir: "app", imports: []string{nrginImport, newrelicAgentImport}}},
+		},
+		{
+			name:     "no_imports",
+			packages: map[string]*PackageState{"foo": {importsAdded: map[string]bool{}}},
+			want:     []moduleRequest{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := stubGetModules(t)
+			m := &InstrumentationManager{userAppPath: "app", packages: tt.packages}
+
+			assert.NoError(t, m.AddRequiredModules())
+			assert.Equal(t, tt.want, *requests)
+		})
+	}
+}
+
+func Test_moduleCacheProxy(t *testing.T) {
+	env, err := moduleCacheProxy()
+	if !assert.NoError(t, err) || !assert.Len(t, env, 2) {
+		return
+	}
+	assert.Regexp(t, "^GOPROXY=file:///.*/cache/download$", env[0], "the download directory of the module cache is the proxy")
+	assert.Equal(t, "GOSUMDB=off", env[1])
+}
@@ -0,0 +1,104 @@
+package instrumentation
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"github.com/dave/dst"
+)
+
+// Names of the variables injected into the application. If one of these names is already declared where a variable
+// is injected, a numbered variant of it is used instead, e.g. "err2".
+const (
+	defaultErrName             = "err"
+	defaultExternalSegmentName = "externalSegment"
+	defaultSegmentName         = "segment"
+)
+
+// FunctionVariableName returns a name, based on name, for a variable injected at the top of the body of decl, a function
+// declared in the current package. The name is reserved, and will not be returned again for the same function.
+func (m *InstrumentationManager) FunctionVariableName(decl *dst.FuncDecl, name string) string {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil || decl == nil {
+		return m.allocateName(nil, token.NoPos, name)
+	}
+
+	astDecl, ok := pkg.Decorator.Ast.Nodes[decl].(*ast.FuncDecl)
+	if !ok || astDecl.Body == nil {
+		return m.allocateName(nil, token.NoPos, name)
+	}
+	return m.allocateName(pkg.TypesInfo.Scopes[astDecl.Type], astDecl.Body.Lbrace, name)
+}
+
+// SpanVariableName returns a name for a span variable injected into the body of decl, or an empty string if the
+// backend does not declare span variables.
+func (m *InstrumentationManager) SpanVariableName(decl *dst.FuncDecl) string {
+	name := m.Backend().SpanVariableName()
+	if name == "" {
+		return ""
+	}
+	return m.FunctionVariableName(decl, name)
+}
+
+// StatementVariableName returns a name, based on name, for a variable injected next to stmt, a statement in the current
+// package. The name is reserved, and will not be returned again for the function that contains stmt.
+func (m *InstrumentationManager) StatementVariableName(stmt dst.Stmt, name string) string {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil || pkg.Types == nil {
+		return m.allocateName(nil, token.NoPos, name)
+	}
+
+	astStmt, ok := pkg.Decorator.Ast.Nodes[stmt]
+	if !ok {
+		return m.allocateName(nil, token.NoPos, name)
+	}
+	pos := astStmt.Pos()
+	return m.allocateName(pkg.Types.Scope().Innermost(pos), pos, name)
+}
+
+// allocateName returns name, or the first numbered variant of it, that does not conflict with any object visible from
+// pos in scope, any object declared later in scope, or any name already allocated in the function that contains scope.
+// Without a scope, only previously allocated names are avoided.
+func (m *InstrumentationManager) allocateName(scope *types.Scope, pos token.Pos, name string) string {
+	funcScope := functionScope(scope)
+	if m.allocatedNames == nil {
+		m.allocatedNames = map[*types.Scope]map[string]bool{}
+	}
+	allocated, ok := m.allocatedNames[funcScope]
+	if !ok {
+		allocated = map[string]bool{}
+		m.allocatedNames[funcScope] = allocated
+	}
+
+	candidate := name
+	for i := 2; !isFreeName(scope, pos, candidate) || allocated[candidate]; i++ {
+		candidate = name + strconv.Itoa(i)
+	}
+	allocated[candidate] = true
+	return candidate
+}
+
+// isFreeName returns true if a variable named name can be declared at pos in scope. It must not shadow an object that is
+// visible there, and must not be declared again in scope, which would fail to compile.
+func isFreeName(scope *types.Scope, pos token.Pos, name string) bool {
+	if scope == nil {
+		return true
+	}
+	if _, obj := scope.LookupParent(name, pos); obj != nil {
+		return false
+	}
+	return scope.Lookup(name) == nil
+}
+
+// functionScope returns the scope of the top level function declaration that contains scope, or nil if there is none.
+func functionScope(scope *types.Scope) *types.Scope {
+	for s := scope; s != nil && s.Parent() != nil; s = s.Parent() {
+		// the parent of a top level function scope is a file scope, whose parent is the package scope
+		if s.Parent().Parent() != nil && s.Parent().Parent().Parent() == types.Universe {
+			return s
+		}
+	}
+	return nil
+}
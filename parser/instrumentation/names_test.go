@@ -0,0 +1,103 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FunctionVariableName(t *testing.T) {
+	code := `
+package main
+
+import "strconv"
+
+var NewRelicAgent = "taken"
+
+func param(nrTxn string) {}
+
+func later() {
+	_, _ = strconv.Atoi("1")
+	err := error(nil)
+	_ = err
+}
+
+func nested() {
+	if _, err := strconv.Atoi("1"); err != nil {
+		return
+	}
+}
+
+func main() {}
+`
+	tests := []struct {
+		name     string
+		function string
+		variable string
+		want     []string
+	}{
+		{name: "free", function: "main", variable: "nrTxn", want: []string{"nrTxn"}},
+		{name: "parameter", function: "param", variable: "nrTxn", want: []string{"nrTxn2"}},
+		{name: "declared_later", function: "later", variable: "err", want: []string{"err2"}},
+		{name: "declared_in_nested_scope", function: "nested", variable: "err", want: []string{"err"}},
+		{name: "package_variable", function: "main", variable: "NewRelicAgent", want: []string{"NewRelicAgent2"}},
+		{name: "allocated_twice", function: "main", variable: "externalSegment", want: []string{"externalSegment", "externalSegment2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, code)
+			defer panicRecovery(t)
+
+			var decl *dst.FuncDecl
+			for _, d := range manager.GetDecoratorPackage().Syntax[0].Decls {
+				if fn, ok := d.(*dst.FuncDecl); ok && fn.Name.Name == tt.function {
+					decl = fn
+				}
+			}
+
+			got := []string{}
+			for range tt.want {
+				got = append(got, manager.FunctionVariableName(decl, tt.variable))
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_StatementVariableName(t *testing.T) {
+	code := `
+package main
+
+func main() {
+	externalSegment := 1
+	_ = externalSegment
+	{
+		println("nested")
+	}
+}
+
+func other() {
+	println("other")
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	var mainDecl, otherDecl *dst.FuncDecl
+	for _, d := range manager.GetDecoratorPackage().Syntax[0].Decls {
+		if fn, ok := d.(*dst.FuncDecl); ok {
+			switch fn.Name.Name {
+			case "main":
+				mainDecl = fn
+			case "other":
+				otherDecl = fn
+			}
+		}
+	}
+
+	nested := mainDecl.Body.List[2].(*dst.BlockStmt).List[0]
+	assert.Equal(t, "externalSegment2", manager.StatementVariableName(nested, defaultExternalSegmentName))
+	assert.Equal(t, "externalSegment3", manager.StatementVariableName(mainDecl.Body.List[1], defaultExternalSegmentName))
+	assert.Equal(t, "externalSegment", manager.StatementVariableName(otherDecl.Body.List[0], defaultExternalSegmentName))
+}
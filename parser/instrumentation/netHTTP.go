@@ -1,4 +1,4 @@
-package main
+package instrumentation
 
 import (
 	"fmt"
@@ -109,6 +109,15 @@ func GetNetHttpMethod(n *dst.CallExpr, pkg *decorator.Package) string {
 	return ""
 }
 
+// wrapHandlerFunction returns the name of the newrelic function that wraps the handler registered by the net/http
+// method: WrapHandle for Handle, which is passed an http.Handler, and WrapHandleFunc for HandleFunc.
+func wrapHandlerFunction(method string) string {
+	if method == HttpMuxHandle {
+		return "WrapHandle"
+	}
+	return "WrapHandleFunc"
+}
+
 // WrapHandleFunc looks for an instance of http.HandleFunc() and wraps it with a new relic transaction
 func WrapHandleFunc(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
 	callExpr, ok := n.(*dst.CallExpr)
@@ -116,30 +125,31 @@ func WrapHandleFunc(n dst.Node, manager *InstrumentationManager, c *dstutil.Curs
 		funcName := GetNetHttpMethod(callExpr, manager.GetDecoratorPackage())
 		switch funcName {
 		case HttpHandleFunc, HttpMuxHandle:
-			if len(callExpr.Args) == 2 {
-				// Instrument handle funcs
-				oldArgs := callExpr.Args
-				callExpr.Args = []dst.Expr{
-					&dst.CallExpr{
-						Fun: &dst.Ident{
-							Name: "WrapHandleFunc",
-							Path: newrelicAgentImport,
-						},
-						Args: []dst.Expr{
-							&dst.Ident{
-								Name: manager.agentVariableName,
-							},
-							oldArgs[0],
-							oldArgs[1],
-						},
-					},
-				}
+			if !manager.IsInstrumented(callExpr) && !manager.ChangeDropped(ruleWrapHandler, callExpr) &&
+				manager.Backend().WrapHandler(callExpr, funcName, dst.NewIdent(manager.agentVariableName)) {
+				manager.RecordChange(ruleWrapHandler, callExpr, callExpr)
+				manager.AddImports(callExpr)
 			}
 		}
 	}
 }
 
-func txnFromContext(txnVariable string) *dst.AssignStmt {
+// requestContext creates a call to the Context method of the http request requestVariable.
+func requestContext(requestVariable string) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X: &dst.Ident{
+				Name: requestVariable,
+			},
+			Sel: &dst.Ident{
+				Name: "Context",
+			},
+		},
+	}
+}
+
+// defineTxnFromContext creates a statement that defines a transaction variable from the context object ctx.
+func defineTxnFromContext(txnVariable string, ctx dst.Expr) *dst.AssignStmt {
 	return &dst.AssignStmt{
 		Decs: dst.AssignStmtDecorations{
 			NodeDecs: dst.NodeDecs{
@@ -159,26 +169,17 @@ func txnFromContext(txnVariable string) *dst.AssignStmt {
 					Path: newrelicAgentImport,
 				},
 				Args: []dst.Expr{
-					&dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X: &dst.Ident{
-								Name: "r",
-							},
-							Sel: &dst.Ident{
-								Name: "Context",
-							},
-						},
-					},
+					ctx,
 				},
 			},
 		},
 	}
 }
 
-// txnFromCtx injects a line of code that extracts a transaction from the context into the body of a function
-func defineTxnFromCtx(fn *dst.FuncDecl, txnVariable string) {
+// txnFromCtx injects a line of code that extracts a transaction from the context of the request into the body of a function
+func defineTxnFromCtx(fn *dst.FuncDecl, txnVariable, requestVariable string, backend InstrumentationBackend) {
 	stmts := make([]dst.Stmt, len(fn.Body.List)+1)
-	stmts[0] = txnFromContext(txnVariable)
+	stmts[0] = backend.TransactionFromContext(txnVariable, requestContext(requestVariable))
 	for i, stmt := range fn.Body.List {
 		stmts[i+1] = stmt
 	}
@@ -191,6 +192,10 @@ func isHttpHandler(decl *dst.FuncDecl, pkg *decorator.Package) bool {
 	}
 
 	params := decl.Type.Params.List
+	// httprouter handlers are also passed the parameters of their route
+	if len(params) == 3 && isHttpRouterParams(params[2]) {
+		params = params[:2]
+	}
 	if len(params) == 2 {
 		var rw, req bool
 		for _, param := range params {
@@ -223,20 +228,74 @@ func isHttpHandler(decl *dst.FuncDecl, pkg *decorator.Package) bool {
 	return false
 }
 
+// isHandler returns true if decl is a handler of net/http or of a web framework. Handlers are the entry points of
+// transactions, and get their transaction from what they are passed rather than from a new argument.
+func isHandler(decl *dst.FuncDecl, pkg *decorator.Package) bool {
+	return isHttpHandler(decl, pkg) || isGinHandler(decl) || isEchoHandler(decl)
+}
+
+// requestParameterName returns the name of the *http.Request parameter of an http handler, or an empty string if it
+// can not be referred to.
+func requestParameterName(decl *dst.FuncDecl) string {
+	params := decl.Type.Params.List
+	last := params[len(params)-1]
+	// httprouter handlers are passed the parameters of their route after the request
+	if len(params) == 3 && isHttpRouterParams(last) {
+		last = params[1]
+	}
+	if len(last.Names) == 0 {
+		return ""
+	}
+	name := last.Names[len(last.Names)-1].Name
+	if name == "_" {
+		return ""
+	}
+	return name
+}
+
 // Recognize if a function is a handler func based on its contents, and inject instrumentation.
 // This function discovers entrypoints to tracing for a given transaction and should trace all the way
 // down the call chain of the function it is invoked on.
 func InstrumentHandleFunction(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
 	fn, isFn := n.(*dst.FuncDecl)
-	if isFn && isHttpHandler(fn, manager.GetDecoratorPackage()) {
-		txnName := "nrTxn"
-		newFn, ok := TraceFunction(manager, fn, txnName)
-		if ok {
-			defineTxnFromCtx(newFn, txnName)
-			c.Replace(newFn)
-			manager.UpdateFunctionDeclaration(newFn)
-		}
+	if !isFn {
+		return
+	}
+	id := manager.functionID(fn)
+	if !isHttpHandler(fn, manager.GetDecoratorPackage()) {
+		manager.explain(id, "%s: isHttpHandler is false, it does not take an http.ResponseWriter and an *http.Request", RuleHttpHandler)
+		return
+	}
+	if manager.IsTracingStarted(fn) {
+		manager.explain(id, "%s: isHttpHandler is true, but it is traced already, so it does not start a transaction of its own", RuleHttpHandler)
+		return
+	}
+	if manager.ChangeDropped(ruleHandlerTransaction, fn) {
+		manager.explain(id, "%s: isHttpHandler is true, but getting its transaction does not compile, and was dropped", RuleHttpHandler)
+		return
 	}
+	requestName := requestParameterName(fn)
+	if requestName == "" {
+		manager.explain(id, "%s: isHttpHandler is true, but its *http.Request parameter has no name to get the transaction from", RuleHttpHandler)
+		return
+	}
+	manager.explain(id, "%s: isHttpHandler is true, so it is traced as the entry point of a transaction", RuleHttpHandler)
+	manager.entryPoint = &entryPoint{function: id}
+	defer func() { manager.entryPoint = nil }()
+	txnName := manager.TransactionName(fn)
+	newFn, ok := TraceFunction(manager, fn, txnName)
+	if !ok {
+		manager.explain(id, "%s: nothing in its body needs the transaction, so it does not get it from the request", RuleHttpHandler)
+		return
+	}
+	if manager.ExistingTransactionName(fn) == "" {
+		defineTxnFromCtx(newFn, txnName, requestName, manager.Backend())
+		manager.setTransactionVariable(fn, txnName)
+		manager.RecordChange(ruleHandlerTransaction, fn, newFn.Body.List[0])
+		manager.AddImports(newFn.Body.List[0])
+	}
+	c.Replace(newFn)
+	manager.UpdateFunctionDeclaration(newFn)
 }
 
 func injectRoundTripper(clientVariable dst.Expr, spacingAfter dst.SpaceType) *dst.AssignStmt {
@@ -291,18 +350,20 @@ func isNetHttpClientDefinition(stmt *dst.AssignStmt) bool {
 // looks for the following pattern: client := &http.Client{}
 func InstrumentHttpClient(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
 	stmt, ok := n.(*dst.AssignStmt)
-	if ok && isNetHttpClientDefinition(stmt) && c.Index() >= 0 && n.Decorations() != nil {
-		c.InsertAfter(injectRoundTripper(stmt.Lhs[0], n.Decorations().After)) // add roundtripper to transports
+	if ok && isNetHttpClientDefinition(stmt) && c.Index() >= 0 && n.Decorations() != nil && !manager.IsInstrumented(stmt) && !manager.ChangeDropped(ruleRoundTripper, stmt) {
+		roundTripper := manager.Backend().InstrumentClient(stmt.Lhs[0], n.Decorations().After)
+		c.InsertAfter(roundTripper) // add roundtripper to transports
+		manager.RecordChange(ruleRoundTripper, stmt, roundTripper)
 		stmt.Decs.After = dst.None
-		manager.AddImport(newrelicAgentImport)
+		manager.AddImports(roundTripper)
 	}
 }
 
-func cannotTraceOutboundHttp(method string, decs *dst.NodeDecs) []string {
+func cannotTraceOutboundHttp(method string, decs *dst.NodeDecs, documentation string) []string {
 	comment := []string{
 		fmt.Sprintf("// the \"http.%s()\" net/http method can not be instrumented and its outbound traffic can not be traced", method),
 		"// please see these examples of code patterns for external http calls that can be instrumented:",
-		"// https://docs.newrelic.com/docs/apm/agents/go-agent/configuration/distributed-tracing-go-agent/#make-http-requests",
+		"// " + documentation,
 	}
 
 	if decs != nil && len(decs.Start.All()) > 0 {
@@ -345,8 +406,16 @@ func isNetHttpMethodCannotInstrument(node dst.Node) (string, bool) {
 func CannotInstrumentHttpMethod(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
 	funcName, ok := isNetHttpMethodCannotInstrument(n)
 	if ok {
+		manager.RecordSkipped(RuleHttpUnsupported, n, fmt.Sprintf("the outbound traffic of http.%s can not be traced", funcName))
 		if decl := n.Decorations(); decl != nil {
-			decl.Start.Prepend(cannotTraceOutboundHttp(funcName, n.Decorations())...)
+			comment := cannotTraceOutboundHttp(funcName, n.Decorations(), manager.Backend().HttpClientDocumentation())
+			// the comment is only added once, even if the application is instrumented again
+			for _, line := range decl.Start.All() {
+				if line == comment[0] {
+					return
+				}
+			}
+			decl.Start.Prepend(comment...)
 		}
 	}
 }
@@ -469,9 +538,13 @@ func getHttpResponseVariable(manager *InstrumentationManager, stmt dst.Stmt) dst
 		switch v := n.(type) {
 		case *dst.AssignStmt:
 			for _, expr := range v.Lhs {
+				// the blank identifier has no type, and can not be read from
+				if ident, ok := expr.(*dst.Ident); ok && ident.Name == "_" {
+					continue
+				}
 				astExpr := pkg.Decorator.Ast.Nodes[expr].(ast.Expr)
-				t := pkg.TypesInfo.TypeOf(astExpr).String()
-				if t == "*net/http.Response" {
+				t := pkg.TypesInfo.TypeOf(astExpr)
+				if t != nil && t.String() == "*net/http.Response" {
 					expression = expr
 					return false
 				}
@@ -501,22 +574,34 @@ func ExternalHttpCall(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil
 		return true
 	})
 	if call != nil && c.Index() >= 0 {
+		if manager.IsInstrumented(stmt) || manager.ChangeDropped(ruleExternalSegment, stmt) {
+			return false
+		}
 		clientVar := GetNetHttpClientVariableName(call, pkg)
 		requestObject := call.Args[0]
 		if clientVar == HttpDefaultClientVariable {
 			// create external segment to wrap calls made with default client
-			segmentName := "externalSegment"
-			c.InsertBefore(startExternalSegment(requestObject, txnName, segmentName, stmt.Decorations()))
-			c.InsertAfter(endExternalSegment(segmentName, stmt.Decorations()))
+			segmentName := manager.StatementVariableName(stmt, defaultExternalSegmentName)
 			responseVar := getHttpResponseVariable(manager, stmt)
-			manager.AddImport(newrelicAgentImport)
-			if responseVar != nil {
-				c.InsertAfter(captureHttpResponse(segmentName, responseVar))
+			before, after := manager.Backend().ExternalSegment(call, requestObject, responseVar, txnName, segmentName, stmt.Decorations())
+			nodes := []dst.Node{call}
+			for _, inserted := range before {
+				c.InsertBefore(inserted)
+				nodes = append(nodes, inserted)
 			}
+			// each statement is inserted right after the call, so they are inserted in reverse to appear in order
+			for i := len(after) - 1; i >= 0; i-- {
+				c.InsertAfter(after[i])
+				nodes = append(nodes, after[i])
+			}
+			manager.RecordChange(ruleExternalSegment, stmt, nodes...)
+			manager.AddImports(nodes...)
 			return true
 		} else {
-			c.InsertBefore(addTxnToRequestContext(requestObject, txnName, stmt.Decorations()))
-			manager.AddImport(newrelicAgentImport)
+			requestContext := manager.Backend().RequestWithTransaction(requestObject, txnName, stmt.Decorations())
+			c.InsertBefore(requestContext)
+			manager.RecordChange(ruleRequestContext, stmt, requestContext)
+			manager.AddImports(requestContext)
 			return true
 		}
 	}
@@ -535,29 +620,11 @@ func WrapNestedHandleFunction(manager *InstrumentationManager, stmt dst.Stmt, c
 			funcName := GetNetHttpMethod(callExpr, pkg)
 			switch funcName {
 			case HttpHandleFunc, HttpMuxHandle:
-				if len(callExpr.Args) == 2 {
-					// Instrument handle funcs
-					oldArgs := callExpr.Args
-					callExpr.Args = []dst.Expr{
-						&dst.CallExpr{
-							Fun: &dst.Ident{
-								Name: "WrapHandleFunc",
-								Path: newrelicAgentImport,
-							},
-							Args: []dst.Expr{
-								&dst.CallExpr{
-									Fun: &dst.SelectorExpr{
-										X:   dst.NewIdent(txnName),
-										Sel: dst.NewIdent("Application"),
-									},
-								},
-								oldArgs[0],
-								oldArgs[1],
-							},
-						},
-					}
+				if !manager.IsInstrumented(callExpr) && !manager.ChangeDropped(ruleWrapHandler, callExpr) &&
+					manager.Backend().WrapHandler(callExpr, funcName, manager.Backend().TransactionAgent(txnName)) {
 					wasModified = true
-					manager.AddImport(newrelicAgentImport)
+					manager.AddImports(callExpr)
+					manager.RecordChange(ruleWrapHandler, callExpr, callExpr)
 					return false
 				}
 			}
@@ -1,4 +1,4 @@
-package main
+package instrumentation
 
 import (
 	"go/token"
@@ -258,6 +258,20 @@ func index(w http.ResponseWriter, r *http.Request, x string) {
 }`,
 			wantBool: false,
 		},
+		{
+			name: "httprouter_handler",
+			code: `
+package main
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+func index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	io.WriteString(w, ps.ByName("name"))
+}`,
+			wantBool: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -283,6 +297,22 @@ func index(w http.ResponseWriter, r *http.Request, x string) {
 	}
 }
 
+func Test_wrapHandlerFunction(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		want   string
+	}{
+		{name: "handle_func", method: HttpHandleFunc, want: "WrapHandleFunc"},
+		{name: "handle", method: HttpMuxHandle, want: "WrapHandle"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, wrapHandlerFunction(tt.method))
+		})
+	}
+}
+
 func Test_getNetHttpMethod(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -591,7 +621,7 @@ func Test_cannotTraceOutboundHttp(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := cannotTraceOutboundHttp(tt.args.method, tt.args.decs)
+			got := cannotTraceOutboundHttp(tt.args.method, tt.args.decs, newRelicBackend{}.HttpClientDocumentation())
 			if tt.wantBuffer && got[len(got)-1] != "//" {
 				t.Errorf("cannotTraceOutboundHttp() should add a comment ending in \"//\" but did NOT for method %s with decs %+v", tt.args.method, tt.args.decs)
 			}
@@ -867,8 +897,8 @@ func Test_defineTxnFromCtx(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			expectStmt := txnFromContext(tt.args.txnVariable)
-			defineTxnFromCtx(tt.args.fn, tt.args.txnVariable)
+			expectStmt := defineTxnFromContext(tt.args.txnVariable, requestContext("r"))
+			defineTxnFromCtx(tt.args.fn, tt.args.txnVariable, "r", newRelicBackend{})
 			if !reflect.DeepEqual(tt.args.fn.Body.List[0], expectStmt) {
 				t.Errorf("expected the function body to contain the statement %v but got %v", expectStmt, tt.args.fn.Body.List[0])
 			}
@@ -0,0 +1,523 @@
+package instrumentation
+
+import (
+	"fmt"
+	"go/token"
+
+	"github.com/dave/dst"
+)
+
+const (
+	otelImport          = "go.opentelemetry.io/otel"
+	otelAttributeImport = "go.opentelemetry.io/otel/attribute"
+	otelTraceImport     = "go.opentelemetry.io/otel/trace"
+	otelSdkTraceImport  = "go.opentelemetry.io/otel/sdk/trace"
+	otelResourceImport  = "go.opentelemetry.io/otel/sdk/resource"
+	otelExporterImport  = "go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelHttpImport      = "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	defaultTracerProviderName = "tracerProvider"
+	defaultOtelContextName    = "ctx"
+	defaultSpanName           = "span"
+	defaultExporterName       = "exporter"
+)
+
+// otelBackend instruments an application with the OpenTelemetry Go SDK. Main sets up a tracer provider that exports
+// spans over OTLP, and traced functions are passed a context.Context that carries their parent span. Each traced
+// function starts a span with a tracer named after the package it is declared in.
+type otelBackend struct{}
+
+func (otelBackend) AgentVariableName() string       { return defaultTracerProviderName }
+func (otelBackend) TransactionVariableName() string { return defaultOtelContextName }
+func (otelBackend) SpanVariableName() string        { return defaultSpanName }
+func (otelBackend) ContextIsTransaction() bool      { return true }
+
+func (otelBackend) TransactionType() dst.Expr {
+	return &dst.Ident{Name: "Context", Path: "context"}
+}
+
+func (otelBackend) TransactionDescription() string {
+	return "an OpenTelemetry span"
+}
+
+// NoTransaction passes a background context, since spans can not be started from a nil context.
+func (otelBackend) NoTransaction() dst.Expr {
+	return backgroundContext()
+}
+
+// backgroundContext creates a context.Background() call.
+func backgroundContext() *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.Ident{Name: "Background", Path: "context"},
+	}
+}
+
+// spanFromContext creates a trace.SpanFromContext call that returns the span carried by the context txn.
+func spanFromContext(txn dst.Expr) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "SpanFromContext", Path: otelTraceImport},
+		Args: []dst.Expr{txn},
+	}
+}
+
+// CreateAgent creates an OTLP exporter, and a tracer provider that batches spans to it. The tracer provider is set as
+// the global one, so that tracers can be created anywhere in the application with otel.Tracer. If appName is empty,
+// the service name is read from the environment, e.g. OTEL_SERVICE_NAME.
+func (otelBackend) CreateAgent(appName, agentVariableName string, newVariable func(name string) string) []dst.Stmt {
+	exporterVariableName := newVariable(defaultExporterName)
+	errVariableName := newVariable(defaultErrName)
+
+	exporter := &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			dst.NewIdent(exporterVariableName),
+			dst.NewIdent(errVariableName),
+		},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun:  &dst.Ident{Name: "New", Path: otelExporterImport},
+				Args: []dst.Expr{backgroundContext()},
+			},
+		},
+	}
+
+	options := []dst.Expr{
+		&dst.CallExpr{
+			Fun:  &dst.Ident{Name: "WithBatcher", Path: otelSdkTraceImport},
+			Args: []dst.Expr{dst.NewIdent(exporterVariableName)},
+		},
+	}
+	if appName != "" {
+		options = append(options, &dst.CallExpr{
+			Fun: &dst.Ident{Name: "WithResource", Path: otelSdkTraceImport},
+			Args: []dst.Expr{
+				&dst.CallExpr{
+					Fun: &dst.Ident{Name: "NewSchemaless", Path: otelResourceImport},
+					Args: []dst.Expr{
+						&dst.CallExpr{
+							Fun: &dst.Ident{Name: "String", Path: otelAttributeImport},
+							Args: []dst.Expr{
+								&dst.BasicLit{Kind: token.STRING, Value: `"service.name"`},
+								&dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", appName)},
+							},
+						},
+					},
+				},
+			},
+		})
+	}
+
+	provider := &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(agentVariableName)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun:  &dst.Ident{Name: "NewTracerProvider", Path: otelSdkTraceImport},
+				Args: options,
+			},
+		},
+	}
+
+	setProvider := &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun:  &dst.Ident{Name: "SetTracerProvider", Path: otelImport},
+			Args: []dst.Expr{dst.NewIdent(agentVariableName)},
+		},
+		Decs: dst.ExprStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+
+	checkErr := panicOnError(errVariableName)
+	checkErr.Decs.After = dst.NewLine
+	return []dst.Stmt{exporter, checkErr, provider, setProvider}
+}
+
+// ShutdownAgent shuts down the tracer provider, which flushes the spans that have not been exported yet.
+func (otelBackend) ShutdownAgent(agentVariableName string) dst.Stmt {
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(agentVariableName),
+				Sel: dst.NewIdent("Shutdown"),
+			},
+			Args: []dst.Expr{backgroundContext()},
+		},
+		Decs: dst.ExprStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				Before: dst.EmptyLine,
+			},
+		},
+	}
+}
+
+// startSpan creates a statement that starts a span named spanName as a child of the span carried by parent, and
+// assigns the context carrying it to txnVariableName.
+func startSpan(txnVariableName, spanVariableName, spanName, scope string, parent dst.Expr, overwriteVariable bool) *dst.AssignStmt {
+	tok := token.DEFINE
+	if overwriteVariable {
+		tok = token.ASSIGN
+	}
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			dst.NewIdent(txnVariableName),
+			dst.NewIdent(spanVariableName),
+		},
+		Tok: tok,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X: &dst.CallExpr{
+						Fun: &dst.Ident{Name: "Tracer", Path: otelImport},
+						Args: []dst.Expr{
+							&dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", scope)},
+						},
+					},
+					Sel: dst.NewIdent("Start"),
+				},
+				Args: []dst.Expr{
+					parent,
+					&dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", spanName)},
+				},
+			},
+		},
+	}
+}
+
+// endSpan creates a statement that ends the span spanVariableName.
+func endSpan(spanVariableName string) *dst.CallExpr {
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.NewIdent(spanVariableName),
+			Sel: dst.NewIdent("End"),
+		},
+	}
+}
+
+// StartTransaction starts a root span. Main has no parent context, so the span is started from a background context.
+func (otelBackend) StartTransaction(_, txnVariableName, spanVariableName, transactionName, scope string, overwriteVariable bool) dst.Stmt {
+	return startSpan(txnVariableName, spanVariableName, transactionName, scope, backgroundContext(), overwriteVariable)
+}
+
+func (otelBackend) EndTransaction(_, spanVariableName string) dst.Stmt {
+	return &dst.ExprStmt{X: endSpan(spanVariableName)}
+}
+
+// StartSegment starts a child span of the span carried by the context txnVariableName, and ends it when the function
+// returns. The context is replaced by one that carries the new span, so that it is the parent of the spans started by
+// the functions it is passed to.
+func (otelBackend) StartSegment(txnVariableName, spanVariableName, segmentName, scope string) []dst.Stmt {
+	return []dst.Stmt{
+		startSpan(txnVariableName, spanVariableName, segmentName, scope, dst.NewIdent(txnVariableName), false),
+		&dst.DeferStmt{Call: endSpan(spanVariableName)},
+	}
+}
+
+// StartCallSegment starts a child span of the span carried by the context txnVariableName. The context is not replaced,
+// so the span only times the call. Datastore spans are client spans, with the database attributes of the OpenTelemetry
+// semantic conventions.
+func (otelBackend) StartCallSegment(txnVariableName, segmentVariableName string, segment CallSegment, scope string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	start := startSpan("_", segmentVariableName, segment.Name, scope, dst.NewIdent(txnVariableName), false)
+	start.Decs.NodeDecs = takeBeforeDecorations(nodeDecs)
+	if segment.Kind != SegmentKindDatastore {
+		return start
+	}
+
+	attributes := []dst.Expr{}
+	for _, attr := range []struct{ key, value string }{
+		{"db.system", segment.Product},
+		{"db.collection.name", segment.Collection},
+		{"db.operation.name", segment.Name},
+	} {
+		if attr.value != "" {
+			attributes = append(attributes, &dst.CallExpr{
+				Fun: &dst.Ident{Name: "String", Path: otelAttributeImport},
+				Args: []dst.Expr{
+					&dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", attr.key)},
+					&dst.BasicLit{Kind: token.STRING, Value: fmt.Sprintf("%q", attr.value)},
+				},
+			})
+		}
+	}
+	call := start.Rhs[0].(*dst.CallExpr)
+	call.Args = append(call.Args,
+		&dst.CallExpr{
+			Fun:  &dst.Ident{Name: "WithSpanKind", Path: otelTraceImport},
+			Args: []dst.Expr{&dst.Ident{Name: "SpanKindClient", Path: otelTraceImport}},
+		},
+		&dst.CallExpr{
+			Fun:  &dst.Ident{Name: "WithAttributes", Path: otelTraceImport},
+			Args: attributes,
+		},
+	)
+	return start
+}
+
+func (otelBackend) EndCallSegment(segmentVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	return endExternalSegment(segmentVariableName, nodeDecs)
+}
+
+// NewGoroutine passes the context itself, since contexts can be used by more than one goroutine.
+func (otelBackend) NewGoroutine(txnVariableName string) dst.Expr {
+	return dst.NewIdent(txnVariableName)
+}
+
+// NoticeError records the error on the span carried by the context txnVariableName.
+func (otelBackend) NoticeError(errVariableName, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	// move the decorations below the statement the error is assigned in to this statement
+	decs := dst.ExprStmtDecorations{
+		NodeDecs: dst.NodeDecs{
+			After: nodeDecs.After,
+			End:   nodeDecs.End,
+		},
+	}
+	nodeDecs.After = dst.None
+	nodeDecs.End.Clear()
+
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   spanFromContext(dst.NewIdent(txnVariableName)),
+				Sel: dst.NewIdent("RecordError"),
+			},
+			Args: []dst.Expr{dst.NewIdent(errVariableName)},
+		},
+		Decs: decs,
+	}
+}
+
+// TransactionFromContext defines the transaction as the context itself.
+func (otelBackend) TransactionFromContext(txnVariableName string, ctx dst.Expr) dst.Stmt {
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(txnVariableName)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{ctx},
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: dst.EmptyLine,
+			},
+		},
+	}
+}
+
+// ContextWithTransaction adds the span carried by the context txn to the context ctx, keeping the values and deadline
+// of ctx.
+func (otelBackend) ContextWithTransaction(ctx, txn dst.Expr) dst.Expr {
+	return &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "ContextWithSpan", Path: otelTraceImport},
+		Args: []dst.Expr{ctx, spanFromContext(txn)},
+	}
+}
+
+func (otelBackend) IsContextWithTransaction(expr dst.Expr) bool {
+	call, ok := expr.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*dst.Ident)
+	return ok && ident.Name == "ContextWithSpan" && ident.Path == otelTraceImport
+}
+
+// WrapHandler wraps the handler in an otelhttp.NewHandler, which starts a span for each request, named after the
+// pattern it is registered for. Handler functions are converted to an http.HandlerFunc to be wrapped, and registered
+// with the ServeHTTP method of the wrapped handler. The tracer provider is global, so no agent is needed.
+func (otelBackend) WrapHandler(call *dst.CallExpr, method string, _ dst.Expr) bool {
+	if len(call.Args) != 2 || isOtelHandler(call.Args[1]) {
+		return false
+	}
+
+	pattern, handler := call.Args[0], call.Args[1]
+	if method == HttpHandleFunc {
+		handler = &dst.CallExpr{
+			Fun:  &dst.Ident{Name: "HandlerFunc", Path: NetHttp},
+			Args: []dst.Expr{handler},
+		}
+	}
+	var wrapped dst.Expr = &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "NewHandler", Path: otelHttpImport},
+		Args: []dst.Expr{handler, dst.Clone(pattern).(dst.Expr)},
+	}
+	if method == HttpHandleFunc {
+		wrapped = &dst.SelectorExpr{
+			X:   wrapped,
+			Sel: dst.NewIdent("ServeHTTP"),
+		}
+	}
+	call.Args[1] = wrapped
+	return true
+}
+
+// isOtelHandler returns true if a handler is wrapped by otelhttp.NewHandler.
+func isOtelHandler(handler dst.Expr) bool {
+	if sel, ok := handler.(*dst.SelectorExpr); ok && sel.Sel.Name == "ServeHTTP" {
+		handler = sel.X
+	}
+	call, ok := handler.(*dst.CallExpr)
+	if !ok {
+		return false
+	}
+	ident, ok := call.Fun.(*dst.Ident)
+	return ok && ident.Name == "NewHandler" && ident.Path == otelHttpImport
+}
+
+func (otelBackend) TransactionAgent(string) dst.Expr {
+	return nil
+}
+
+// AgentType returns nil, since the middleware of the frameworks OpenTelemetry instruments uses the global tracer
+// provider.
+func (otelBackend) AgentType() dst.Expr {
+	return nil
+}
+
+// InstrumentClient wraps the transport of the client in an otelhttp.NewTransport, which starts a span for each request
+// as a child of the span carried by the context of the request. A nil transport is wrapped as the default transport.
+func (otelBackend) InstrumentClient(client dst.Expr, spacingAfter dst.SpaceType) dst.Stmt {
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			&dst.SelectorExpr{
+				X:   dst.Clone(client).(dst.Expr),
+				Sel: dst.NewIdent("Transport"),
+			},
+		},
+		Tok: token.ASSIGN,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.Ident{Name: "NewTransport", Path: otelHttpImport},
+				Args: []dst.Expr{
+					&dst.SelectorExpr{
+						X:   dst.Clone(client).(dst.Expr),
+						Sel: dst.NewIdent("Transport"),
+					},
+				},
+			},
+		},
+		Decs: dst.AssignStmtDecorations{
+			NodeDecs: dst.NodeDecs{
+				After: spacingAfter,
+			},
+		},
+	}
+}
+
+// RequestWithTransaction replaces the context of the request with the context txnVariableName.
+func (otelBackend) RequestWithTransaction(request dst.Expr, txnVariableName string, nodeDecs *dst.NodeDecs) dst.Stmt {
+	// move the decorations above the statement that sends the request to this statement
+	decs := dst.AssignStmtDecorations{}
+	if nodeDecs != nil {
+		decs.NodeDecs = dst.NodeDecs{
+			Before: nodeDecs.Before,
+			Start:  nodeDecs.Start,
+		}
+		nodeDecs.Before = dst.None
+		nodeDecs.Start.Clear()
+	}
+
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.Clone(request).(dst.Expr)},
+		Tok: token.ASSIGN,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.Clone(request).(dst.Expr),
+					Sel: dst.NewIdent("WithContext"),
+				},
+				Args: []dst.Expr{dst.NewIdent(txnVariableName)},
+			},
+		},
+		Decs: decs,
+	}
+}
+
+// ExternalSegment sends the request with otelhttp.DefaultClient, a default client with an instrumented transport,
+// after adding the context txnVariableName to it.
+func (b otelBackend) ExternalSegment(call *dst.CallExpr, request, _ dst.Expr, txnVariableName, _ string, nodeDecs *dst.NodeDecs) ([]dst.Stmt, []dst.Stmt) {
+	if sel, ok := call.Fun.(*dst.SelectorExpr); ok {
+		sel.X = &dst.Ident{Name: HttpDefaultClient, Path: otelHttpImport}
+	}
+	return []dst.Stmt{b.RequestWithTransaction(request, txnVariableName, nodeDecs)}, nil
+}
+
+func (otelBackend) RouterMiddleware(framework string, _ dst.Expr, service string) dst.Expr {
+	f, ok := webFrameworks[framework]
+	if ok && f.routePattern != "" {
+		return dst.NewIdent(routeMiddlewareName(otelMiddlewarePrefix, framework))
+	}
+	if !ok || f.otelIntegration == "" {
+		return nil
+	}
+	return otelFrameworkMiddleware(framework, service)
+}
+
+// otelMiddlewarePrefix is the prefix of the names of the middleware OpenTelemetry declares for web frameworks without
+// an instrumentation.
+const otelMiddlewarePrefix = "otel"
+
+// otelRouteMiddleware is the source of the middleware OpenTelemetry declares for the routers of a web framework without
+// an instrumentation, formatted with its name, the name of its tracer, and the expression of the pattern of the route
+// of the request r.
+const otelRouteMiddleware = `// %[1]s starts a server span for each request the router routes, and names it
+// after the pattern of the route of the request once it is routed.
+func %[1]s(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := otel.Tracer(%[2]q).Start(r.Context(), r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+		span.SetName(r.Method + " " + %[3]s)
+	})
+}
+`
+
+func (otelBackend) RouteMiddleware(framework, importPath, scope string) (*dst.FuncDecl, error) {
+	f, ok := webFrameworks[framework]
+	if !ok || f.routePattern == "" {
+		return nil, nil
+	}
+	src := fmt.Sprintf(otelRouteMiddleware, routeMiddlewareName(otelMiddlewarePrefix, framework), scope, f.routePattern)
+	return parseRouteMiddleware(src, map[string]string{
+		"net/http":      "http",
+		otelImport:      "otel",
+		otelTraceImport: "trace",
+		importPath:      framework,
+	})
+}
+
+// InstrumentedRouter returns nil, since the routers of the frameworks OpenTelemetry instruments get middleware.
+func (otelBackend) InstrumentedRouter(string, dst.Expr) dst.Expr {
+	return nil
+}
+
+// RouterHandler wraps the router in an otelhttp.NewHandler, which starts a server span for each request, if OpenTelemetry
+// has no instrumentation of the framework. The spans are named after the service.
+func (otelBackend) RouterHandler(framework string, router dst.Expr, service string) dst.Expr {
+	f, ok := webFrameworks[framework]
+	if !ok || f.otelIntegration != "" || f.routePattern != "" {
+		return nil
+	}
+	return &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "NewHandler", Path: otelHttpImport},
+		Args: []dst.Expr{router, otelServiceName(service)},
+	}
+}
+
+// HandlerTransaction defines the transaction as the context of the request, which carries the span started by the
+// middleware.
+func (b otelBackend) HandlerTransaction(framework, txnVariableName string, handlerContext dst.Expr) dst.Stmt {
+	f, ok := webFrameworks[framework]
+	if !ok || f.requestContext == nil {
+		return nil
+	}
+	return b.TransactionFromContext(txnVariableName, f.requestContext(handlerContext))
+}
+
+// ImportAliases imports the trace package of the SDK as sdktrace, since it has the same name as the trace API package.
+func (otelBackend) ImportAliases() map[string]string {
+	return map[string]string{otelSdkTraceImport: "sdktrace"}
+}
+
+func (otelBackend) HttpClientDocumentation() string {
+	return "https://pkg.go.dev/go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+}
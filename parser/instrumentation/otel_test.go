@@ -0,0 +1,114 @@
+package instrumentation
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_InstrumentPackages_otel(t *testing.T) {
+	code := `package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+func check(ctx context.Context) error {
+	return errors.New("failed")
+}
+
+func work(ctx context.Context) error {
+	err := check(ctx)
+	return err
+}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	http.DefaultClient.Do(req)
+	err := work(r.Context())
+	if err != nil {
+		return
+	}
+}
+
+func main() {
+	http.HandleFunc("/", index)
+	work(context.Background())
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	manager.backend = otelBackend{}
+	manager.agentVariableName = otelBackend{}.AgentVariableName()
+	manager.propagation = PropagateTxnContext
+	defer panicRecovery(t)
+
+	err := manager.InstrumentPackages()
+	assert.NoError(t, err)
+
+	want := `package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func check(ctx context.Context) error {
+	return errors.New("failed")
+}
+
+func work(ctx context.Context) error {
+	ctx, span := otel.Tracer("github.com/newrelic/go-easy-instrumentation/parser/instrumentation/tmp").Start(ctx, "work")
+	defer span.End()
+	err := check(ctx)
+	trace.SpanFromContext(ctx).RecordError(err)
+	return err
+}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	req = req.WithContext(ctx)
+	otelhttp.DefaultClient.Do(req)
+	err := work(trace.ContextWithSpan(r.Context(), trace.SpanFromContext(ctx)))
+	if err != nil {
+		return
+	}
+}
+
+func main() {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+
+	http.HandleFunc("/", otelhttp.NewHandler(http.HandlerFunc(index), "/").ServeHTTP)
+	ctx, span := otel.Tracer("github.com/newrelic/go-easy-instrumentation/parser/instrumentation/tmp").Start(context.Background(), "work")
+	work(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)))
+	span.End()
+
+	tracerProvider.Shutdown(context.Background())
+}
+`
+	got := bytes.NewBuffer([]byte{})
+	file := manager.GetDecoratorPackage().Syntax[0]
+	r := manager.fileRestorer(decorator.NewRestorerWithImports(testAppPackage, guess.New()), file)
+	if err := r.Fprint(got, file); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got.String())
+}
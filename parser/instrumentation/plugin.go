@@ -0,0 +1,452 @@
+package instrumentation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/goast"
+)
+
+// PluginProtocolVersion is the version of the protocol plugins are run with. It is sent to plugins in every request.
+const PluginProtocolVersion = 1
+
+// Kinds of the edits plugins make to an application.
+const (
+	// EditInsertBefore inserts statements before a statement of the application.
+	EditInsertBefore = "insert-before"
+	// EditInsertAfter inserts statements after a statement of the application.
+	EditInsertAfter = "insert-after"
+	// EditReplace replaces a statement of the application with statements.
+	EditReplace = "replace"
+	// EditAddImport makes a package available to the code the other edits to a file insert.
+	EditAddImport = "add-import"
+)
+
+// PluginRequest is written as JSON to the standard input of a plugin, once for every package of the application.
+//
+// A plugin is an executable, written in any language, that instruments an application in addition to the rules of the
+// registry. It reads a request, and writes a PluginResponse as JSON to its standard output. What it writes to its
+// standard error is passed through. The edits it returns are applied to the application after the rules of the
+// registry, and are written to the diff with the changes the rules made.
+type PluginRequest struct {
+	Version int           `json:"version"`
+	Target  string        `json:"target"` // TargetNewRelic or TargetOpenTelemetry
+	Package PluginPackage `json:"package"`
+}
+
+// PluginPackage summarizes a package of the application and its type information.
+type PluginPackage struct {
+	Path      string           `json:"path"`
+	Name      string           `json:"name"`
+	Imports   []string         `json:"imports"`
+	Files     []PluginFile     `json:"files"`
+	Functions []PluginFunction `json:"functions"`
+	Calls     []PluginCall     `json:"calls"`
+}
+
+// PluginFile is a source file of a package, as it was before the application was instrumented.
+type PluginFile struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+}
+
+// PluginFunction is a function or method declared in a package.
+type PluginFunction struct {
+	Name      string         `json:"name"`      // full name, e.g. "(*example.com/app.Server).Close"
+	Signature string         `json:"signature"` // type of the function, with package qualified types
+	Position  PluginPosition `json:"position"`
+	// Transaction is the variable the body of the function has its transaction in once it is instrumented, or empty
+	// if the function is not traced.
+	Transaction string `json:"transaction,omitempty"`
+}
+
+// PluginCall is a call to a function or method from the body of a function declared in a package.
+type PluginCall struct {
+	Function string         `json:"function"` // full name of the called function
+	Caller   string         `json:"caller"`   // full name of the function the call is in
+	Position PluginPosition `json:"position"`
+	// Statement is the position of the statement the call is in, which edits that instrument the call refer to.
+	Statement PluginPosition `json:"statement"`
+}
+
+// PluginPosition is a position in the original source code of the application. Lines and columns start at 1.
+type PluginPosition struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Column int    `json:"column,omitempty"`
+}
+
+func (p PluginPosition) String() string {
+	if p.Column == 0 {
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// PluginResponse is the response of a plugin to a request. A plugin that sets Error fails the instrumentation.
+type PluginResponse struct {
+	Edits []PluginEdit `json:"edits"`
+	Error string       `json:"error,omitempty"`
+}
+
+// PluginEdit is an edit a plugin makes to a package.
+//
+// Statement edits refer to the statement at Position, which is the first statement that starts on its line if the
+// column is not set. Their code is a list of Go statements, which can refer to the packages the file imports and the
+// packages of its add-import edits by their names. An add-import edit without a file applies to every file of the package.
+type PluginEdit struct {
+	Kind     string         `json:"kind"`
+	Position PluginPosition `json:"position"`
+	Code     string         `json:"code,omitempty"`
+	Import   string         `json:"import,omitempty"` // import path of an add-import edit
+	// Rule names the changes the edit makes, under the name of the plugin. Changes can be dropped by rule.
+	Rule string `json:"rule,omitempty"`
+}
+
+// RunPlugins runs the plugins at the given paths on every package of the application, in order, and applies the edits
+// they return.
+func (m *InstrumentationManager) RunPlugins(plugins []string) error {
+	pkgNames := []string{}
+	for pkgName := range m.packages {
+		pkgNames = append(pkgNames, pkgName)
+	}
+	sort.Strings(pkgNames)
+
+	for _, plugin := range plugins {
+		for _, pkgName := range pkgNames {
+			m.SetPackage(pkgName)
+			request, err := m.pluginRequest()
+			if err != nil {
+				return err
+			}
+			response, err := runPlugin(plugin, request)
+			if err != nil {
+				return fmt.Errorf("plugin %s: %w", plugin, err)
+			}
+			if err := m.applyPluginEdits(filepath.Base(plugin), response.Edits); err != nil {
+				return fmt.Errorf("plugin %s: package %s: %w", plugin, pkgName, err)
+			}
+		}
+	}
+	return nil
+}
+
+// runPlugin writes a request to a plugin, and reads its response.
+func runPlugin(plugin string, request *PluginRequest) (*PluginResponse, error) {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	response := &PluginResponse{}
+	if err := json.Unmarshal(output, response); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if response.Error != "" {
+		return nil, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// pluginRequest summarizes the current package for plugins. Functions and calls are read from the syntax the package
+// was loaded with, so their positions and names are the ones of the original source code.
+func (m *InstrumentationManager) pluginRequest() (*PluginRequest, error) {
+	pkg := m.GetDecoratorPackage()
+	request := &PluginRequest{
+		Version: PluginProtocolVersion,
+		Target:  m.target,
+		Package: PluginPackage{
+			Path:      pkg.PkgPath,
+			Name:      pkg.Name,
+			Imports:   []string{},
+			Files:     []PluginFile{},
+			Functions: []PluginFunction{},
+			Calls:     []PluginCall{},
+		},
+	}
+	for path := range pkg.Imports {
+		request.Package.Imports = append(request.Package.Imports, path)
+	}
+	sort.Strings(request.Package.Imports)
+
+	for _, file := range pkg.Package.Syntax {
+		filePath := pkg.Fset.Position(file.Pos()).Filename
+		source, err := os.ReadFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		request.Package.Files = append(request.Package.Files, PluginFile{Path: filePath, Source: string(source)})
+
+		for _, decl := range file.Decls {
+			funcDecl, ok := decl.(*ast.FuncDecl)
+			if !ok || funcDecl.Body == nil || pkg.TypesInfo == nil {
+				continue
+			}
+			fn, ok := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func)
+			if !ok {
+				continue
+			}
+			request.Package.Functions = append(request.Package.Functions, PluginFunction{
+				Name:        fn.FullName(),
+				Signature:   fn.Type().String(),
+				Position:    pluginPosition(pkg.Fset.Position(funcDecl.Pos())),
+				Transaction: m.transactionVariable(fn.FullName()),
+			})
+			request.Package.Calls = append(request.Package.Calls, pluginCalls(pkg, fn, funcDecl.Body)...)
+		}
+	}
+	return request, nil
+}
+
+// transactionVariable returns the variable the body of a function of the current package has its transaction in, or
+// an empty string if it does not have one.
+func (m *InstrumentationManager) transactionVariable(functionID string) string {
+	state, ok := m.packages[m.currentPackage]
+	if !ok {
+		return ""
+	}
+	fn, ok := state.tracedFuncs[functionID]
+	if !ok {
+		return ""
+	}
+	if fn.txnVariable != "" {
+		return fn.txnVariable
+	}
+	return m.ExistingTransactionName(fn.body)
+}
+
+// pluginCalls returns the calls to functions and methods in body, the body of the function caller.
+func pluginCalls(pkg *decorator.Package, caller *types.Func, body *ast.BlockStmt) []PluginCall {
+	calls := []PluginCall{}
+	stack := []ast.Node{}
+	ast.Inspect(body, func(n ast.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		stack = append(stack, n)
+
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		fn := invokedFunction(pkg.TypesInfo, call.Fun)
+		stmt := enclosingStatement(stack)
+		if fn != nil && stmt != nil {
+			calls = append(calls, PluginCall{
+				Function:  fn.FullName(),
+				Caller:    caller.FullName(),
+				Position:  pluginPosition(pkg.Fset.Position(call.Pos())),
+				Statement: pluginPosition(pkg.Fset.Position(stmt.Pos())),
+			})
+		}
+		return true
+	})
+	return calls
+}
+
+// enclosingStatement returns the innermost statement of a list of statements that contains the last node of stack,
+// the path from the root of a syntax tree to a node.
+func enclosingStatement(stack []ast.Node) ast.Stmt {
+	for i := len(stack) - 1; i > 0; i-- {
+		stmt, ok := stack[i].(ast.Stmt)
+		if !ok {
+			continue
+		}
+		switch stmt.(type) {
+		case *ast.CaseClause, *ast.CommClause:
+			continue
+		}
+		switch stack[i-1].(type) {
+		case *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+			return stmt
+		}
+	}
+	return nil
+}
+
+func pluginPosition(pos token.Position) PluginPosition {
+	return PluginPosition{File: pos.Filename, Line: pos.Line, Column: pos.Column}
+}
+
+// editedStatement is the statement of the original source code an edit refers to, and the list it is in.
+type editedStatement struct {
+	file *dst.File
+	list *[]dst.Stmt
+	stmt dst.Stmt
+}
+
+// applyPluginEdits applies the edits a plugin returned for the current package. The statements the edits refer to are
+// all found before any edit is applied, so that edits can refer to statements next to the code earlier edits inserted.
+func (m *InstrumentationManager) applyPluginEdits(plugin string, edits []PluginEdit) error {
+	pkg := m.GetDecoratorPackage()
+
+	imports := map[string][]string{}
+	targets := make([]*editedStatement, len(edits))
+	for i, edit := range edits {
+		switch edit.Kind {
+		case EditAddImport:
+			if edit.Import == "" {
+				return fmt.Errorf("%s edit must set an import", EditAddImport)
+			}
+			imports[edit.Position.File] = append(imports[edit.Position.File], edit.Import)
+			continue
+		case EditInsertBefore, EditInsertAfter, EditReplace:
+		default:
+			return fmt.Errorf("unknown edit kind %q", edit.Kind)
+		}
+		if edit.Kind != EditReplace && strings.TrimSpace(edit.Code) == "" {
+			return fmt.Errorf("%s edit at %s has no code", edit.Kind, edit.Position)
+		}
+		targets[i] = m.findStatement(pkg, edit.Position)
+		if targets[i] == nil {
+			return fmt.Errorf("%s edit: no statement at %s", edit.Kind, edit.Position)
+		}
+	}
+
+	for i, edit := range edits {
+		target := targets[i]
+		if target == nil {
+			continue
+		}
+		rule := "plugin:" + plugin
+		if edit.Rule != "" {
+			rule += "/" + edit.Rule
+		}
+		if m.ChangeDropped(rule, target.stmt) {
+			continue
+		}
+
+		stmts, err := parsePluginCode(pkg, target.file, edit.Code, append(imports[""], imports[edit.Position.File]...))
+		if err != nil {
+			return fmt.Errorf("%s edit at %s: %w", edit.Kind, edit.Position, err)
+		}
+		index := -1
+		for j, stmt := range *target.list {
+			if stmt == target.stmt {
+				index = j
+			}
+		}
+		if index < 0 {
+			return fmt.Errorf("%s edit at %s: the statement was replaced by an earlier edit", edit.Kind, edit.Position)
+		}
+
+		list := *target.list
+		switch edit.Kind {
+		case EditInsertBefore:
+			decs := takeBeforeDecorations(target.stmt.Decorations())
+			stmts[0].Decorations().Before = decs.Before
+			stmts[0].Decorations().Start = decs.Start
+			list = append(list[:index], append(stmts, list[index:]...)...)
+		case EditInsertAfter:
+			list = append(list[:index+1], append(stmts, list[index+1:]...)...)
+		case EditReplace:
+			if len(stmts) > 0 {
+				decs := target.stmt.Decorations()
+				stmts[0].Decorations().Start = decs.Start
+				stmts[len(stmts)-1].Decorations().End = decs.End
+			}
+			list = append(list[:index], append(stmts, list[index+1:]...)...)
+		}
+		*target.list = list
+
+		nodes := make([]dst.Node, len(stmts))
+		for j, stmt := range stmts {
+			nodes[j] = stmt
+		}
+		m.RecordChange(rule, target.stmt, nodes...)
+		m.AddImports(nodes...)
+	}
+	return nil
+}
+
+// findStatement returns the statement of the original source code of a package at pos, or nil if there is none.
+// Statements that instrumentation created have no position, and are never found.
+func (m *InstrumentationManager) findStatement(pkg *decorator.Package, pos PluginPosition) *editedStatement {
+	var found *editedStatement
+	for _, file := range pkg.Syntax {
+		dst.Inspect(file, func(n dst.Node) bool {
+			var list *[]dst.Stmt
+			switch v := n.(type) {
+			case *dst.BlockStmt:
+				list = &v.List
+			case *dst.CaseClause:
+				list = &v.Body
+			case *dst.CommClause:
+				list = &v.Body
+			}
+			if list == nil || found != nil {
+				return found == nil
+			}
+			for _, stmt := range *list {
+				astStmt, ok := pkg.Decorator.Ast.Nodes[stmt]
+				if !ok {
+					continue
+				}
+				stmtPos := pkg.Fset.Position(astStmt.Pos())
+				if stmtPos.Filename == pos.File && stmtPos.Line == pos.Line && (pos.Column == 0 || stmtPos.Column == pos.Column) {
+					found = &editedStatement{file: file, list: list, stmt: stmt}
+					return false
+				}
+			}
+			return true
+		})
+		if found != nil {
+			break
+		}
+	}
+	return found
+}
+
+// parsePluginCode parses the code of an edit to file into statements. Qualified identifiers in the code are resolved to
+// the packages the file imports, and the additional imports, so that the restorer imports the packages they refer to.
+func parsePluginCode(pkg *decorator.Package, file *dst.File, code string, imports []string) ([]dst.Stmt, error) {
+	src := &strings.Builder{}
+	fmt.Fprintf(src, "package %s\n\n", pkg.Name)
+	for _, spec := range file.Imports {
+		if spec.Name != nil && spec.Name.Name == "." {
+			// identifiers of dot imported packages can not be told apart from the ones of the package
+			continue
+		}
+		if spec.Name != nil {
+			fmt.Fprintf(src, "import %s %s\n", spec.Name.Name, spec.Path.Value)
+		} else {
+			fmt.Fprintf(src, "import %s\n", spec.Path.Value)
+		}
+	}
+	for _, path := range imports {
+		if !importsPath(file, path) {
+			fmt.Fprintf(src, "import %q\n", path)
+		}
+	}
+	fmt.Fprintf(src, "\nfunc _() {\n%s\n}\n", code)
+
+	parsed, err := decorator.NewDecoratorWithImports(token.NewFileSet(), pkg.PkgPath, goast.New()).Parse(src.String())
+	if err != nil {
+		return nil, err
+	}
+	body := parsed.Decls[len(parsed.Decls)-1].(*dst.FuncDecl).Body
+	stmts := body.List
+	body.List = nil
+	return stmts, nil
+}
@@ -0,0 +1,170 @@
+package instrumentation
+
+import (
+	"bytes"
+	"go/ast"
+	"go/types"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pluginCalls(t *testing.T) {
+	code := `package main
+
+import "strconv"
+
+func parse(s string) int {
+	n, _ := strconv.Atoi(s)
+	if n > 0 {
+		return n
+	}
+	switch {
+	case n < 0:
+		println(strconv.Itoa(n))
+	}
+	return 0
+}
+
+func main() {
+	parse("1")
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	pkg := manager.GetDecoratorPackage()
+	got := []string{}
+	for _, decl := range pkg.Package.Syntax[0].Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		fn := pkg.TypesInfo.Defs[funcDecl.Name].(*types.Func)
+		for _, call := range pluginCalls(pkg, fn, funcDecl.Body) {
+			assert.Equal(t, fn.FullName(), call.Caller)
+			got = append(got, call.Function+"@"+call.Statement.String()[len(call.Statement.File):])
+		}
+	}
+	assert.Equal(t, []string{
+		"strconv.Atoi@:6:2",
+		"strconv.Itoa@:12:3",
+		testAppPackage + ".parse@:18:2",
+	}, got, "calls must refer to the statement they are in, and builtin functions must be left out")
+}
+
+func Test_applyPluginEdits(t *testing.T) {
+	code := `package main
+
+import "fmt"
+
+func main() {
+	// say hello
+	fmt.Println("hello")
+	fmt.Println("bye")
+}
+`
+	tests := []struct {
+		name    string
+		edits   []PluginEdit
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "insert_before_and_after",
+			edits: []PluginEdit{
+				{Kind: EditInsertBefore, Position: PluginPosition{Line: 7}, Code: `fmt.Println("before")`},
+				{Kind: EditInsertAfter, Position: PluginPosition{Line: 7, Column: 2}, Code: "x := 1\n_ = x"},
+			},
+			want: `package main
+
+import "fmt"
+
+func main() {
+	// say hello
+	fmt.Println("before")
+	fmt.Println("hello")
+	x := 1
+	_ = x
+	fmt.Println("bye")
+}
+`,
+		},
+		{
+			name: "replace_with_import",
+			edits: []PluginEdit{
+				{Kind: EditAddImport, Import: "strings"},
+				{Kind: EditReplace, Position: PluginPosition{Line: 8}, Code: `fmt.Println(strings.ToUpper("bye"))`},
+			},
+			want: `package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func main() {
+	// say hello
+	fmt.Println("hello")
+	fmt.Println(strings.ToUpper("bye"))
+}
+`,
+		},
+		{
+			name:    "no_statement",
+			edits:   []PluginEdit{{Kind: EditInsertBefore, Position: PluginPosition{Line: 3}, Code: "_ = 1"}},
+			wantErr: true,
+		},
+		{
+			name:    "wrong_column",
+			edits:   []PluginEdit{{Kind: EditInsertBefore, Position: PluginPosition{Line: 7, Column: 3}, Code: "_ = 1"}},
+			wantErr: true,
+		},
+		{
+			name: "replaced_statement",
+			edits: []PluginEdit{
+				{Kind: EditReplace, Position: PluginPosition{Line: 8}},
+				{Kind: EditInsertAfter, Position: PluginPosition{Line: 8}, Code: "_ = 1"},
+			},
+			wantErr: true,
+		},
+		{name: "no_code", edits: []PluginEdit{{Kind: EditInsertAfter, Position: PluginPosition{Line: 7}}}, wantErr: true},
+		{name: "invalid_code", edits: []PluginEdit{{Kind: EditInsertAfter, Position: PluginPosition{Line: 7}, Code: "func {"}}, wantErr: true},
+		{name: "no_import", edits: []PluginEdit{{Kind: EditAddImport}}, wantErr: true},
+		{name: "unknown_kind", edits: []PluginEdit{{Kind: "delete", Position: PluginPosition{Line: 7}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newTestingInstrumentationManager(t, code)
+			defer panicRecovery(t)
+
+			pkg := manager.GetDecoratorPackage()
+			file := pkg.Package.Syntax[0]
+			fileName := pkg.Fset.Position(file.Pos()).Filename
+			for i := range tt.edits {
+				if tt.edits[i].Kind != EditAddImport {
+					tt.edits[i].Position.File = fileName
+				}
+			}
+
+			err := manager.applyPluginEdits("test", tt.edits)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			got := bytes.NewBuffer([]byte{})
+			r := decorator.NewRestorerWithImports(testAppPackage, guess.New())
+			if err := r.Fprint(got, pkg.Syntax[0]); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, got.String())
+			for _, change := range manager.changes {
+				assert.Equal(t, "plugin:test", change.rule)
+			}
+		})
+	}
+}
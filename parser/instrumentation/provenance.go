@@ -0,0 +1,225 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// Provenance options control how the rule that made each change is shown to reviewers.
+const (
+	// ProvenanceMap writes a side-car file next to the diff that maps each hunk of the diff to the changes in it.
+	ProvenanceMap = "map"
+	// ProvenanceComments adds a "// nr:" review comment above the code of each change. The remove command removes
+	// them.
+	ProvenanceComments = "comments"
+)
+
+// provenanceMapSuffix is appended to the name of the diff file to name the side-car file written with ProvenanceMap.
+const provenanceMapSuffix = ".provenance.json"
+
+// provenanceCommentPrefix starts the review comments added with ProvenanceComments.
+const provenanceCommentPrefix = "// nr:"
+
+// Provenance describes why a change was made: the rule that made it, and the code it traces.
+type Provenance struct {
+	Rule string `json:"rule"`
+	// EntryPoint is the function the transaction the change traces starts in, and Transaction its name. They are
+	// empty for changes that do not trace a transaction, and the name is empty when it is not known.
+	EntryPoint  string `json:"entryPoint,omitempty"`
+	Transaction string `json:"transaction,omitempty"`
+	// CallChain is the chain of calls from the entry point to the function the change was made in.
+	CallChain []string `json:"callChain,omitempty"`
+}
+
+// HunkProvenance is a hunk of the diff, and the provenance of the changes in it.
+type HunkProvenance struct {
+	File    string       `json:"file"` // path of the file, relative to the application
+	Hunk    string       `json:"hunk"` // header of the hunk, e.g. "@@ -10,6 +10,9 @@"
+	Changes []Provenance `json:"changes"`
+}
+
+// changeProvenance returns the provenance of a change. Handler transactions are named after the route in routes.
+func changeProvenance(c *change, routes map[string]string) Provenance {
+	provenance := Provenance{Rule: c.rule}
+	if c.entryPoint == nil {
+		return provenance
+	}
+	provenance.EntryPoint = c.entryPoint.function
+	provenance.Transaction = c.entryPoint.transaction
+	if provenance.Transaction == "" {
+		provenance.Transaction = routes[c.entryPoint.function]
+	}
+	provenance.CallChain = []string{c.entryPoint.function}
+	for _, function := range c.callChain {
+		if function != provenance.CallChain[len(provenance.CallChain)-1] {
+			provenance.CallChain = append(provenance.CallChain, function)
+		}
+	}
+	return provenance
+}
+
+// comment formats the provenance as a review comment.
+func (p Provenance) comment() string {
+	comment := provenanceCommentPrefix + " rule=" + p.Rule
+	if p.EntryPoint != "" {
+		comment += " entry-point=" + p.EntryPoint
+	}
+	if p.Transaction != "" {
+		comment += " transaction=" + strconv.Quote(p.Transaction)
+	}
+	if len(p.CallChain) > 1 {
+		comment += " call-chain=" + strings.Join(p.CallChain, ">")
+	}
+	return comment
+}
+
+// AnnotateChanges adds a review comment with the provenance of each change above the first statement or declaration
+// it generated or modified.
+func (m *InstrumentationManager) AnnotateChanges() {
+	routes := m.handlerRoutes()
+	changesByNode := map[dst.Node][]*change{}
+	for _, c := range m.changes {
+		nodes := c.nodes
+		if len(nodes) == 0 {
+			nodes = []dst.Node{c.anchor}
+		}
+		for _, node := range nodes {
+			changesByNode[node] = append(changesByNode[node], c)
+		}
+	}
+
+	// each change is annotated above the first of its nodes in the source
+	annotated := map[*change]bool{}
+
+	for _, state := range m.packages {
+		for _, file := range state.pkg.Syntax {
+			stack := []dst.Node{}
+			dst.Inspect(file, func(n dst.Node) bool {
+				if n == nil {
+					stack = stack[:len(stack)-1]
+					return true
+				}
+				stack = append(stack, n)
+
+				changes, ok := changesByNode[n]
+				if !ok {
+					return true
+				}
+				target := commentedNode(stack)
+				if target == nil {
+					return true
+				}
+				decs := target.Decorations()
+				for _, c := range changes {
+					if annotated[c] {
+						continue
+					}
+					annotated[c] = true
+					comment := changeProvenance(c, routes).comment()
+					if !containsLine(decs.Start.All(), comment) {
+						decs.Start.Append(comment)
+					}
+				}
+				if decs.Before == dst.None {
+					decs.Before = dst.NewLine
+				}
+				return true
+			})
+		}
+	}
+}
+
+// commentedNode returns the innermost statement of a list of statements, or declaration, that contains the last node
+// of stack, the path from the root of a syntax tree to a node. Review comments are added above it.
+func commentedNode(stack []dst.Node) dst.Node {
+	for i := len(stack) - 1; i > 0; i-- {
+		switch stack[i].(type) {
+		case *dst.CaseClause, *dst.CommClause:
+			continue
+		case dst.Decl:
+			return stack[i]
+		case dst.Stmt:
+			switch stack[i-1].(type) {
+			case *dst.BlockStmt, *dst.CaseClause, *dst.CommClause:
+				return stack[i]
+			}
+		}
+	}
+	return nil
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+// hunkHeader matches the header of a hunk of a unified diff, capturing the start and length of the new lines.
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,(\d+))? @@`)
+
+// ProvenanceMap maps each hunk of the diff to the provenance of the changes whose generated lines are in it.
+func (m *InstrumentationManager) ProvenanceMap() ([]HunkProvenance, error) {
+	_, ranges, err := m.restoreFiles()
+	if err != nil {
+		return nil, err
+	}
+	routes := m.handlerRoutes()
+
+	hunks := []HunkProvenance{}
+	for _, patch := range m.filePatches() {
+		for _, line := range strings.Split(patch.patch, "\n") {
+			match := hunkHeader.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			start, _ := strconv.Atoi(match[1])
+			length := 1
+			if match[2] != "" {
+				length, _ = strconv.Atoi(match[2])
+			}
+
+			hunk := HunkProvenance{
+				File:    m.appRelativePath(patch.path),
+				Hunk:    line,
+				Changes: []Provenance{},
+			}
+			seen := map[*change]bool{}
+			for _, r := range ranges[patch.path] {
+				if seen[r.change] || r.end < start || r.start >= start+length {
+					continue
+				}
+				seen[r.change] = true
+				hunk.Changes = append(hunk.Changes, changeProvenance(r.change, routes))
+			}
+			hunks = append(hunks, hunk)
+		}
+	}
+	// packages are written to the diff in no particular order
+	sort.SliceStable(hunks, func(i, j int) bool {
+		return hunks[i].File < hunks[j].File
+	})
+	return hunks, nil
+}
+
+// WriteProvenanceMap writes the provenance of the hunks of the diff to a file, as JSON.
+func (m *InstrumentationManager) WriteProvenanceMap(path string) error {
+	hunks, err := m.ProvenanceMap()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(hunks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("provenance map: %w", err)
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,162 @@
+package instrumentation
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenance_comment(t *testing.T) {
+	tests := []struct {
+		name       string
+		provenance Provenance
+		want       string
+	}{
+		{
+			name:       "rule",
+			provenance: Provenance{Rule: ruleAgent},
+			want:       "// nr: rule=agent",
+		},
+		{
+			name:       "entry_point",
+			provenance: Provenance{Rule: ruleNoticeError, EntryPoint: "app.index", Transaction: "/index", CallChain: []string{"app.index"}},
+			want:       `// nr: rule=notice-error entry-point=app.index transaction="/index"`,
+		},
+		{
+			name:       "call_chain",
+			provenance: Provenance{Rule: ruleTraceFunction, EntryPoint: "app.main", CallChain: []string{"app.main", "app.work", "app.step"}},
+			want:       "// nr: rule=trace-function entry-point=app.main call-chain=app.main>app.work>app.step",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.provenance.comment())
+		})
+	}
+}
+
+func Test_changeProvenance(t *testing.T) {
+	c := &change{
+		rule:       ruleTraceFunction,
+		entryPoint: &entryPoint{function: "app.index"},
+		callChain:  []string{"app.index", "app.work", "app.work", "app.step"},
+	}
+	assert.Equal(t, Provenance{
+		Rule:        ruleTraceFunction,
+		EntryPoint:  "app.index",
+		Transaction: "/index",
+		CallChain:   []string{"app.index", "app.work", "app.step"},
+	}, changeProvenance(c, map[string]string{"app.index": "/index"}), "handler transactions must be named after their route")
+	assert.Equal(t, Provenance{Rule: ruleRoundTripper}, changeProvenance(&change{rule: ruleRoundTripper}, nil))
+}
+
+func TestInstrumentationManager_AnnotateChanges(t *testing.T) {
+	code := `package main
+
+func work(n int) int {
+	if n > 0 {
+		return n
+	}
+	return 0
+}
+
+func main() {
+	work(1)
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	decls := manager.GetDecoratorPackage().Syntax[0].Decls
+	work, main := decls[0].(*dst.FuncDecl), decls[1].(*dst.FuncDecl)
+	manager.entryPoint = &entryPoint{function: manager.functionID(main), transaction: "main"}
+	manager.RecordChange(ruleTraceFunction, work, work)
+	manager.callChain = []string{manager.functionID(work)}
+	ret := work.Body.List[0].(*dst.IfStmt).Body.List[0].(*dst.ReturnStmt)
+	manager.RecordChange(ruleNoticeError, ret, ret.Results[0])
+	manager.entryPoint, manager.callChain = nil, nil
+	println := &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("println")}}
+	main.Body.List = append(main.Body.List, println)
+	manager.RecordChange(ruleAgent, main, println, main.Body.List[0])
+
+	manager.AnnotateChanges()
+	manager.AnnotateChanges()
+
+	got := bytes.NewBuffer([]byte{})
+	r := decorator.NewRestorerWithImports(testAppPackage, guess.New())
+	if err := r.Fprint(got, manager.GetDecoratorPackage().Syntax[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `package main
+
+// nr: rule=trace-function entry-point=`+testAppPackage+`.main transaction="main"
+func work(n int) int {
+	if n > 0 {
+		// nr: rule=notice-error entry-point=`+testAppPackage+`.main transaction="main" call-chain=`+testAppPackage+`.main>`+testAppPackage+`.work
+		return n
+	}
+	return 0
+}
+
+func main() {
+	// nr: rule=agent
+	work(1)
+	println()
+}
+`, got.String(), "comments must be added once, above the first statement of each change")
+}
+
+func TestInstrumentationManager_ProvenanceMap(t *testing.T) {
+	defer panicRecovery(t)
+	code := `package main
+
+import "net/http"
+
+func index(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("index"))
+}
+
+func main() {
+	http.HandleFunc("/index", index)
+
+	http.ListenAndServe(":8000", nil)
+}
+`
+	testAppDir := "tmp"
+	pkgs, err := createTestAppPackage(testAppDir, "app.go", code)
+	defer cleanupTestApp(t, testAppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+	manager.SetRules(NewRuleRegistry())
+	assert.NoError(t, manager.InstrumentPackages())
+
+	manager.SetPackage(testAppPackage)
+	decls := manager.GetDecoratorPackage().Syntax[0].Decls
+	index, main := decls[1].(*dst.FuncDecl), decls[2].(*dst.FuncDecl)
+	handleFunc := main.Body.List[0].(*dst.ExprStmt).X
+	manager.RecordChange(ruleWrapHandler, handleFunc, handleFunc)
+	manager.entryPoint = &entryPoint{function: manager.functionID(index)}
+	println := &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("println")}}
+	index.Body.List = append([]dst.Stmt{println}, index.Body.List...)
+	manager.RecordChange("log", index.Body.List[1], println)
+	manager.entryPoint = nil
+
+	hunks, err := manager.ProvenanceMap()
+	assert.NoError(t, err)
+	assert.Equal(t, []HunkProvenance{
+		{
+			File: "app.go",
+			Hunk: "@@ -3,6 +3,7 @@",
+			Changes: []Provenance{
+				{Rule: "log", EntryPoint: testAppPackage + ".index", Transaction: "/index", CallChain: []string{testAppPackage + ".index"}},
+			},
+		},
+	}, hunks, "hunks must only carry the changes whose lines they contain")
+}
@@ -0,0 +1,506 @@
+package instrumentation
+
+import (
+	"go/token"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// RemoveInstrumentation removes the New Relic instrumentation this tool adds from all packages of the application, so that
+// the diff written for them strips the agent out of it.
+func (m *InstrumentationManager) RemoveInstrumentation() {
+	rootPkg := m.currentPackage
+	defer m.SetPackage(rootPkg)
+
+	renamed := &renamedFunctions{functions: map[string]string{}, methods: map[string]string{}}
+	for _, state := range m.packages {
+		removeSignaturePreservingWrappers(state.pkg, renamed)
+	}
+
+	for pkgName, state := range m.packages {
+		m.SetPackage(pkgName)
+		for _, file := range state.pkg.Syntax {
+			removeRouteMiddlewareDeclarations(file)
+			for _, decl := range file.Decls {
+				if fn, ok := decl.(*dst.FuncDecl); ok && fn.Body != nil {
+					removeFunctionInstrumentation(fn, state.pkg, renamed, m.agentVariableName)
+				}
+			}
+			removeGeneratedComments(file)
+		}
+	}
+}
+
+// renamedFunctions are the original names of functions that were traced under a new name.
+type renamedFunctions struct {
+	functions map[string]string // by the package path and name they were traced under, e.g. "example.com/app.RunWithTxn"
+	methods   map[string]string // by the name they were traced under
+}
+
+// originalName returns the original name of the function invoked by call, or an empty string if it was not renamed.
+// Calls made within pkgPath refer to functions without a path.
+func (r *renamedFunctions) originalName(call *dst.CallExpr, pkgPath string) string {
+	switch fun := call.Fun.(type) {
+	case *dst.Ident:
+		path := fun.Path
+		if path == "" {
+			path = pkgPath
+		}
+		return r.functions[path+"."+fun.Name]
+	case *dst.SelectorExpr:
+		return r.methods[fun.Sel.Name]
+	}
+	return ""
+}
+
+// removeSignaturePreservingWrappers removes the wrappers of functions that were traced under a new name, and gives the
+// traced functions their original name and doc comment back.
+func removeSignaturePreservingWrappers(pkg *decorator.Package, renamed *renamedFunctions) {
+	traced := map[string]*dst.FuncDecl{}
+	for _, file := range pkg.Syntax {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*dst.FuncDecl); ok {
+				traced[fn.Name.Name] = fn
+			}
+		}
+	}
+
+	for _, file := range pkg.Syntax {
+		decls := []dst.Decl{}
+		for _, decl := range file.Decls {
+			wrapper, ok := decl.(*dst.FuncDecl)
+			if !ok || wrapper.Body == nil || !isSignaturePreservingWrapper(wrapper) {
+				decls = append(decls, decl)
+				continue
+			}
+			tracedName := wrapper.Name.Name + tracedFunctionSuffix
+			fn, ok := traced[tracedName]
+			if !ok {
+				decls = append(decls, decl)
+				continue
+			}
+			fn.Name.Name = wrapper.Name.Name
+			fn.Decs.Start = wrapper.Decs.Start
+			if fn.Recv != nil {
+				renamed.methods[tracedName] = wrapper.Name.Name
+			} else {
+				renamed.functions[pkg.PkgPath+"."+tracedName] = wrapper.Name.Name
+			}
+		}
+		file.Decls = decls
+	}
+}
+
+// removeRouteMiddlewareDeclarations removes the middleware declared for the routers of web frameworks without an
+// integration from file.
+func removeRouteMiddlewareDeclarations(file *dst.File) {
+	decls := []dst.Decl{}
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*dst.FuncDecl); ok && isRouteMiddlewareDeclaration(fn) {
+			continue
+		}
+		decls = append(decls, decl)
+	}
+	file.Decls = decls
+}
+
+// removeFunctionInstrumentation removes the New Relic instrumentation from the body and parameters of fn, and renames
+// the calls it makes to functions that were traced under a new name. Functions that create routers are passed the agent
+// in a parameter named agentVariableName.
+func removeFunctionInstrumentation(fn *dst.FuncDecl, pkg *decorator.Package, renamed *renamedFunctions, agentVariableName string) {
+	// variables holding the agent, transactions and segments
+	vars := map[string]bool{}
+	// the function is a handler that notices the errors it returns
+	returnsErrors := false
+	removeTransactionParameters(fn.Type, vars, agentVariableName)
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		if lit, ok := n.(*dst.FuncLit); ok {
+			removeTransactionParameters(lit.Type, vars, agentVariableName)
+		}
+		if name := assignedDatastoreSegment(n); name != "" {
+			vars[name] = true
+		}
+		name, call := assignedCall(n)
+		if call == nil {
+			return true
+		}
+		switch newrelicFunctionName(call) {
+		case "NewApplication", "FromContext", "StartExternalSegment":
+			vars[name] = true
+		}
+		if framework := handlerTransactionFramework(call); framework != "" {
+			vars[name] = true
+			returnsErrors = returnsErrors || webFrameworks[framework].returnsErrors
+		}
+		switch newrelicMethodName(call, pkg) {
+		case "StartTransaction", "StartSegment":
+			vars[name] = true
+		}
+		return true
+	})
+
+	remove := func(stmts []dst.Stmt) []dst.Stmt {
+		if returnsErrors {
+			stmts = inlineReturnedErrors(stmts, vars, pkg)
+		}
+		return removeStatements(stmts, vars, pkg)
+	}
+	dst.Inspect(fn.Body, func(n dst.Node) bool {
+		switch v := n.(type) {
+		case *dst.BlockStmt:
+			v.List = remove(v.List)
+		case *dst.CaseClause:
+			v.Body = remove(v.Body)
+		case *dst.CommClause:
+			v.Body = remove(v.Body)
+		case *dst.CallExpr:
+			if name := renamed.originalName(v, pkg.PkgPath); name != "" {
+				renameCall(v, name)
+			}
+			if uninstrumentRouter(v) {
+				return true
+			}
+			removeTransactionArguments(v, vars)
+		}
+		return true
+	})
+}
+
+// inlineReturnedErrors returns the errors that a handler noticed before returning them from the calls that return them
+// again, undoing noticeReturnedErrors: err := c.JSON(200, n), nrTxn.NoticeError(err) and return err become
+// return c.JSON(200, n).
+func inlineReturnedErrors(stmts []dst.Stmt, vars map[string]bool, pkg *decorator.Package) []dst.Stmt {
+	kept := []dst.Stmt{}
+	for i := 0; i < len(stmts); i++ {
+		if i+2 < len(stmts) {
+			if ret := inlinedReturn(stmts[i], stmts[i+1], stmts[i+2], vars, pkg); ret != nil {
+				kept = append(kept, ret)
+				i += 2
+				continue
+			}
+		}
+		kept = append(kept, stmts[i])
+	}
+	return kept
+}
+
+// inlinedReturn returns the statement that returns the error returned by the call assigned by stmt, if the error is then
+// noticed by notice and returned by ret, or nil if it is not.
+func inlinedReturn(stmt, notice, ret dst.Stmt, vars map[string]bool, pkg *decorator.Package) *dst.ReturnStmt {
+	assign, ok := stmt.(*dst.AssignStmt)
+	if !ok || assign.Tok != token.DEFINE || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return nil
+	}
+	errVar, ok := assign.Lhs[0].(*dst.Ident)
+	if !ok {
+		return nil
+	}
+	if _, ok := assign.Rhs[0].(*dst.CallExpr); !ok {
+		return nil
+	}
+	expr, ok := notice.(*dst.ExprStmt)
+	if generated, _ := isGeneratedStatement(notice, vars, "", pkg); !ok || !generated {
+		return nil
+	}
+	noticed, ok := expr.X.(*dst.CallExpr)
+	if !ok || len(noticed.Args) != 1 {
+		return nil
+	}
+	if arg, ok := noticed.Args[0].(*dst.Ident); !ok || arg.Name != errVar.Name {
+		return nil
+	}
+	returned, ok := ret.(*dst.ReturnStmt)
+	if !ok || len(returned.Results) != 1 {
+		return nil
+	}
+	if result, ok := returned.Results[0].(*dst.Ident); !ok || result.Name != errVar.Name {
+		return nil
+	}
+	returned.Results[0] = assign.Rhs[0]
+	returned.Decs.Before = assign.Decs.Before
+	returned.Decs.Start = assign.Decs.Start
+	return returned
+}
+
+// removeTransactionParameters removes the *newrelic.Transaction parameters of a function type, and the
+// *newrelic.Application parameter named agentVariableName, and adds their names to vars.
+func removeTransactionParameters(fnType *dst.FuncType, vars map[string]bool, agentVariableName string) {
+	if fnType.Params == nil {
+		return
+	}
+	fields := []*dst.Field{}
+	for _, field := range fnType.Params.List {
+		star, ok := field.Type.(*dst.StarExpr)
+		if ok {
+			ident, ok := star.X.(*dst.Ident)
+			if ok && ident.Name == "Transaction" && ident.Path == newrelicAgentImport {
+				for _, name := range field.Names {
+					vars[name.Name] = true
+				}
+				continue
+			}
+			if ok && ident.Name == "Application" && ident.Path == newrelicAgentImport && len(field.Names) == 1 && field.Names[0].Name == agentVariableName {
+				vars[agentVariableName] = true
+				continue
+			}
+		}
+		fields = append(fields, field)
+	}
+	fnType.Params.List = fields
+}
+
+// removeTransactionArguments removes the transactions passed to a call, and unwraps the http handlers passed to it.
+func removeTransactionArguments(call *dst.CallExpr, vars map[string]bool) {
+	if len(call.Args) == 1 && wrapsHandler(call) {
+		// handle(newrelic.WrapHandleFunc(app, pattern, handler)) becomes handle(pattern, handler)
+		wrap := call.Args[0].(*dst.CallExpr)
+		call.Args = wrap.Args[1:]
+		return
+	}
+
+	args := []dst.Expr{}
+	for _, arg := range call.Args {
+		switch v := arg.(type) {
+		case *dst.Ident:
+			if v.Path == "" && vars[v.Name] {
+				continue
+			}
+		case *dst.CallExpr:
+			if newrelicFunctionName(v) == "NewContext" && len(v.Args) == 2 {
+				args = append(args, v.Args[0])
+				continue
+			}
+			if sel, ok := v.Fun.(*dst.SelectorExpr); ok && sel.Sel.Name == "NewGoroutine" {
+				if ident, ok := sel.X.(*dst.Ident); ok && vars[ident.Name] {
+					continue
+				}
+			}
+		}
+		args = append(args, arg)
+	}
+	call.Args = args
+}
+
+// removeStatements returns the statements in a list that were not generated by this tool. The decorations of the
+// statements that are removed are moved to the statements around them.
+func removeStatements(stmts []dst.Stmt, vars map[string]bool, pkg *decorator.Package) []dst.Stmt {
+	kept := []dst.Stmt{}
+	var pending dst.NodeDecs // decorations of removed statements that belong to the next statement that is kept
+	removed := false         // the last statement was removed
+	agentErr := ""           // error returned when the agent is created, which is checked by the statement that follows
+	for _, stmt := range stmts {
+		remove, errName := isGeneratedStatement(stmt, vars, agentErr, pkg)
+		agentErr = errName
+		decs := stmt.Decorations()
+		if !remove {
+			if removed {
+				// the first statement of a list is spaced like the statements removed before it
+				if len(kept) == 0 || pending.Before > decs.Before {
+					decs.Before = pending.Before
+				}
+				decs.Start.Prepend(pending.Start.All()...)
+			}
+			pending = dst.NodeDecs{}
+			removed = false
+			kept = append(kept, stmt)
+			continue
+		}
+
+		if !removed || (len(kept) > 0 && decs.Before > pending.Before) {
+			pending.Before = decs.Before
+		}
+		removed = true
+		pending.Start.Append(decs.Start.All()...)
+		if len(kept) == 0 {
+			pending.Start.Append(decs.End.All()...)
+			continue
+		}
+		prev := kept[len(kept)-1].Decorations()
+		prev.End.Append(decs.End.All()...)
+		if decs.After > prev.After {
+			prev.After = decs.After
+		}
+	}
+
+	// the last statement of a list is spaced like the statements removed after it
+	if removed && len(kept) > 0 {
+		last := stmts[len(stmts)-1].Decorations()
+		prev := kept[len(kept)-1].Decorations()
+		prev.After = last.After
+		prev.End.Append(pending.Start.All()...)
+	}
+	return kept
+}
+
+// isGeneratedStatement returns true if stmt is instrumentation this tool generates. If the statement creates an agent,
+// the name of the error it returns is also returned, since the error is checked by the statement that follows it.
+func isGeneratedStatement(stmt dst.Stmt, vars map[string]bool, agentErr string, pkg *decorator.Package) (bool, string) {
+	switch v := stmt.(type) {
+	case *dst.AssignStmt:
+		if len(v.Rhs) == 1 {
+			if call, ok := v.Rhs[0].(*dst.CallExpr); ok {
+				switch newrelicFunctionName(call) {
+				case "NewApplication":
+					errName := ""
+					if len(v.Lhs) == 2 {
+						if ident, ok := v.Lhs[1].(*dst.Ident); ok {
+							errName = ident.Name
+						}
+					}
+					return true, errName
+				case "FromContext", "StartExternalSegment", "RequestWithTransactionContext", "NewRoundTripper":
+					return true, ""
+				}
+				switch newrelicMethodName(call, pkg) {
+				case "StartTransaction", "StartSegment":
+					return true, ""
+				}
+				if isHandlerTransaction(call) {
+					return true, ""
+				}
+			}
+		}
+		if assignedDatastoreSegment(v) != "" {
+			return true, ""
+		}
+		// segment.Response = resp
+		if len(v.Lhs) == 1 {
+			if sel, ok := v.Lhs[0].(*dst.SelectorExpr); ok && sel.Sel.Name == "Response" && isVariable(sel.X, vars) {
+				return true, ""
+			}
+		}
+	case *dst.ExprStmt:
+		if usesRouterMiddleware(v) {
+			return true, ""
+		}
+		call, ok := v.X.(*dst.CallExpr)
+		if !ok {
+			return false, ""
+		}
+		sel, ok := call.Fun.(*dst.SelectorExpr)
+		if !ok || !isVariable(sel.X, vars) {
+			return false, ""
+		}
+		switch newrelicMethodName(call, pkg) {
+		case "NoticeError", "End", "Shutdown":
+			return true, ""
+		}
+	case *dst.DeferStmt:
+		return isSegmentStart(v, pkg), ""
+	case *dst.IfStmt:
+		return agentErr != "" && isPanicOnError(v, agentErr), ""
+	}
+	return false, ""
+}
+
+// assignedDatastoreSegment returns the name of the variable a newrelic.DatastoreSegment is assigned to by n, or an empty
+// string if n does not assign one.
+func assignedDatastoreSegment(n dst.Node) string {
+	assign, ok := n.(*dst.AssignStmt)
+	if !ok || len(assign.Lhs) != 1 || len(assign.Rhs) != 1 {
+		return ""
+	}
+	lit, ok := assign.Rhs[0].(*dst.CompositeLit)
+	if !ok {
+		return ""
+	}
+	typ, ok := lit.Type.(*dst.Ident)
+	ident, isIdent := assign.Lhs[0].(*dst.Ident)
+	if !ok || !isIdent || typ.Name != "DatastoreSegment" || typ.Path != newrelicAgentImport {
+		return ""
+	}
+	return ident.Name
+}
+
+// isVariable returns true if expr refers to one of the local variables vars.
+func isVariable(expr dst.Expr, vars map[string]bool) bool {
+	ident, ok := expr.(*dst.Ident)
+	return ok && ident.Path == "" && vars[ident.Name]
+}
+
+// isPanicOnError returns true if stmt is the check of the error errName that this tool generates after creating an agent.
+func isPanicOnError(stmt *dst.IfStmt, errName string) bool {
+	if stmt.Init != nil || stmt.Else != nil || len(stmt.Body.List) != 1 {
+		return false
+	}
+	cond, ok := stmt.Cond.(*dst.BinaryExpr)
+	if !ok || cond.Op != token.NEQ {
+		return false
+	}
+	x, ok := cond.X.(*dst.Ident)
+	if !ok || x.Name != errName {
+		return false
+	}
+	y, ok := cond.Y.(*dst.Ident)
+	if !ok || y.Name != "nil" {
+		return false
+	}
+
+	expr, ok := stmt.Body.List[0].(*dst.ExprStmt)
+	if !ok {
+		return false
+	}
+	call, ok := expr.X.(*dst.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return false
+	}
+	fun, ok := call.Fun.(*dst.Ident)
+	return ok && fun.Name == "panic"
+}
+
+// removeGeneratedComments removes the comments this tool adds above net/http calls that can not be instrumented, and the
+// review comments it adds above its changes.
+func removeGeneratedComments(file *dst.File) {
+	dst.Inspect(file, func(n dst.Node) bool {
+		if n == nil {
+			return false
+		}
+		decs := n.Decorations()
+		if decs == nil {
+			return true
+		}
+		lines := decs.Start.All()
+		for i := 0; i < len(lines); i++ {
+			if strings.HasPrefix(lines[i], provenanceCommentPrefix) {
+				lines = append(lines[:i:i], lines[i+1:]...)
+				i--
+				continue
+			}
+			generated := cannotTraceOutboundHttp(strings.TrimSuffix(strings.TrimPrefix(lines[i], "// the \"http."), "()\" net/http method can not be instrumented and its outbound traffic can not be traced"), nil, newRelicBackend{}.HttpClientDocumentation())
+			if i+len(generated) > len(lines) || !equalLines(lines[i:i+len(generated)], generated) {
+				continue
+			}
+			end := i + len(generated)
+			if end < len(lines) && lines[end] == "//" {
+				end++
+			}
+			lines = append(lines[:i:i], lines[end:]...)
+			i--
+		}
+		decs.Start.Replace(lines...)
+
+		// review comments above statements that were removed are moved after the statement before them
+		end := []string{}
+		for _, line := range decs.End.All() {
+			if !strings.HasPrefix(line, provenanceCommentPrefix) {
+				end = append(end, line)
+			}
+		}
+		decs.End.Replace(end...)
+		return true
+	})
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
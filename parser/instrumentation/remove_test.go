@@ -0,0 +1,128 @@
+package instrumentation
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RemoveInstrumentation(t *testing.T) {
+	manager := newTestingInstrumentationManager(t, instrumentedApp)
+	defer panicRecovery(t)
+
+	manager.RemoveInstrumentation()
+
+	want := `package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+func work() error {
+	err := errors.New("failed")
+	return err
+}
+
+func Exported() {
+	work()
+}
+
+func index(w http.ResponseWriter, r *http.Request) {
+	client := &http.Client{}
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	client.Do(req)
+	go func() {
+		work()
+	}()
+}
+
+func main() {
+	http.HandleFunc("/", index)
+	work()
+	Exported()
+}
+`
+	got := bytes.NewBuffer([]byte{})
+	r := decorator.NewRestorerWithImports(testAppPackage, guess.New())
+	if err := r.Fprint(got, manager.GetDecoratorPackage().Syntax[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got.String())
+}
+
+func Test_removeGeneratedComments(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "only generated comments",
+			code: "\t" + `// the "http.Get()" net/http method can not be instrumented and its outbound traffic can not be traced
+	// please see these examples of code patterns for external http calls that can be instrumented:
+	// https://docs.newrelic.com/docs/apm/agents/go-agent/configuration/distributed-tracing-go-agent/#make-http-requests
+	http.Get("https://example.com")
+`,
+			want: "\thttp.Get(\"https://example.com\")\n",
+		},
+		{
+			name: "user comments are kept",
+			code: "\t" + `// the "http.Post()" net/http method can not be instrumented and its outbound traffic can not be traced
+	// please see these examples of code patterns for external http calls that can be instrumented:
+	// https://docs.newrelic.com/docs/apm/agents/go-agent/configuration/distributed-tracing-go-agent/#make-http-requests
+	//
+	// post the form
+	http.Post("https://example.com", "text/plain", nil)
+`,
+			want: "\t// post the form\n\thttp.Post(\"https://example.com\", \"text/plain\", nil)\n",
+		},
+		{
+			name: "other comments",
+			code: "\t// the \"http.Get()\" call\n\thttp.Get(\"https://example.com\")\n",
+			want: "\t// the \"http.Get()\" call\n\thttp.Get(\"https://example.com\")\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := decorator.Parse("package main\n\nimport \"net/http\"\n\nfunc main() {\n" + tt.code + "}\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			removeGeneratedComments(file)
+
+			got := bytes.NewBuffer([]byte{})
+			if err := decorator.Fprint(got, file); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "package main\n\nimport \"net/http\"\n\nfunc main() {\n"+tt.want+"}\n", got.String())
+		})
+	}
+}
+
+func Test_isPanicOnError(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "panic on error", code: "if err != nil {\n\tpanic(err)\n}", want: true},
+		{name: "other error", code: "if err2 != nil {\n\tpanic(err2)\n}", want: false},
+		{name: "handles error", code: "if err != nil {\n\tprintln(err)\n}", want: false},
+		{name: "else branch", code: "if err != nil {\n\tpanic(err)\n} else {\n\tprintln()\n}", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := decorator.Parse("package main\n\nfunc main() {\n\tvar err, err2 error\n" + tt.code + "\n}\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stmt := file.Decls[0].(*dst.FuncDecl).Body.List[1].(*dst.IfStmt)
+			assert.Equal(t, tt.want, isPanicOnError(stmt, "err"))
+		})
+	}
+}
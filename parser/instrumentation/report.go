@@ -0,0 +1,385 @@
+package instrumentation
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Report formats
+const (
+	// ReportFormatJSON writes the report as a Report object in JSON.
+	ReportFormatJSON = "json"
+	// ReportFormatSARIF writes the report in SARIF 2.1.0, so that code scanning tools can show it as annotations.
+	ReportFormatSARIF = "sarif"
+)
+
+// reasons of the changes made by the built in rules. The changes made by other rules are described by the name of
+// the rule.
+var changeReasons = map[string]string{
+	ruleAgent:              "creates the agent when main starts, and shuts it down when main returns",
+	ruleTransaction:        "starts a transaction around a call in main",
+	ruleTraceFunction:      "passes a transaction to a function that calls traced code",
+	ruleAsyncLiteral:       "traces a goroutine in an async segment",
+	ruleNoticeError:        "reports the error to the transaction",
+	ruleExternalSegment:    "times an outbound http request in an external segment",
+	ruleRequestContext:     "adds the transaction to the context of an outbound http request",
+	ruleWrapHandler:        "wraps an http handler so that it starts a transaction for each request",
+	ruleHandlerTransaction: "gets the transaction of an http handler from its request",
+	ruleRoundTripper:       "wraps the transport of an http client so that its requests are traced",
+	ruleMiddleware:         "adds middleware to a router that starts a transaction for each request",
+	ruleRouterAgent:        "passes the agent down from main to a function that creates a router",
+	ruleReturnedError:      "notices the error a handler returns to its web framework",
+	ruleRouter:             "creates a router that starts a transaction for each request",
+	ruleRouterHandler:      "wraps a router where it is used as a handler, so that it starts a transaction for each request",
+}
+
+// changeReason returns why a rule made a change.
+func changeReason(rule string) string {
+	if reason, ok := changeReasons[rule]; ok {
+		return reason
+	}
+	return fmt.Sprintf("made by the %q rule", rule)
+}
+
+// Report lists the changes made to an application, and the opportunities to instrument it that were skipped.
+type Report struct {
+	Target  string          `json:"target"`
+	Changes []ReportChange  `json:"changes"`
+	Skipped []ReportSkipped `json:"skipped"`
+}
+
+// ReportChange is a change made to the application. Files are relative to the application.
+type ReportChange struct {
+	Rule string `json:"rule"`
+	File string `json:"file"`
+	// Line is the line of the original source code the change was made to.
+	Line int `json:"line"`
+	// StartLine and EndLine are the lines of the instrumented file the change generated.
+	StartLine int `json:"startLine"`
+	EndLine   int `json:"endLine"`
+	// EntryPoint is the function the transaction the change traces starts in, and Transaction its name. They are
+	// empty for changes that do not trace a transaction, and the name is empty when it is not known.
+	EntryPoint  string   `json:"entryPoint,omitempty"`
+	Transaction string   `json:"transaction,omitempty"`
+	CallChain   []string `json:"callChain,omitempty"` // calls from the entry point to the function the change was made in
+	Reason      string   `json:"reason"`
+}
+
+// ReportSkipped is an opportunity to instrument the application that was not taken.
+type ReportSkipped struct {
+	Rule   string `json:"rule"`
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+// Report lists the changes made to the application, and the opportunities to instrument it that were skipped.
+func (m *InstrumentationManager) Report() (*Report, error) {
+	_, ranges, err := m.restoreFiles()
+	if err != nil {
+		return nil, err
+	}
+	changeLines := map[*change]lineRange{}
+	for path, fileRanges := range ranges {
+		for _, r := range fileRanges {
+			if path != r.change.pos.Filename {
+				continue
+			}
+			lines, ok := changeLines[r.change]
+			if !ok || r.start < lines.start {
+				lines.start = r.start
+			}
+			if r.end > lines.end {
+				lines.end = r.end
+			}
+			changeLines[r.change] = lines
+		}
+	}
+
+	routes := m.handlerRoutes()
+	report := &Report{
+		Target:  m.target,
+		Changes: []ReportChange{},
+		Skipped: []ReportSkipped{},
+	}
+	entryPoints := map[string]bool{}
+	for _, c := range m.changes {
+		reportChange := ReportChange{
+			Rule:      c.rule,
+			File:      m.appRelativePath(c.pos.Filename),
+			Line:      c.pos.Line,
+			StartLine: c.pos.Line,
+			EndLine:   c.pos.Line,
+			Reason:    changeReason(c.rule),
+		}
+		if lines, ok := changeLines[c]; ok {
+			reportChange.StartLine, reportChange.EndLine = lines.start, lines.end
+		}
+		if c.entryPoint != nil {
+			entryPoints[c.entryPoint.function] = true
+			provenance := changeProvenance(c, routes)
+			reportChange.EntryPoint = provenance.EntryPoint
+			reportChange.Transaction = provenance.Transaction
+			reportChange.CallChain = provenance.CallChain
+		}
+		report.Changes = append(report.Changes, reportChange)
+	}
+
+	for _, skipped := range m.skipped {
+		report.Skipped = append(report.Skipped, ReportSkipped{
+			Rule:   skipped.rule,
+			File:   m.appRelativePath(skipped.pos.Filename),
+			Line:   skipped.pos.Line,
+			Reason: skipped.reason,
+		})
+	}
+	for key := range m.droppedChanges {
+		rule, pos, ok := strings.Cut(key, "@")
+		if !ok {
+			continue
+		}
+		path, line, ok := parsePosition(pos)
+		if !ok {
+			continue
+		}
+		report.Skipped = append(report.Skipped, ReportSkipped{
+			Rule:   rule,
+			File:   m.appRelativePath(path),
+			Line:   line,
+			Reason: "the change does not compile, and was dropped",
+		})
+	}
+	report.Skipped = append(report.Skipped, m.unreachedHandlers(routes, entryPoints)...)
+
+	// packages are instrumented in no particular order
+	sort.SliceStable(report.Changes, func(i, j int) bool {
+		a, b := report.Changes[i], report.Changes[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	sort.SliceStable(report.Skipped, func(i, j int) bool {
+		a, b := report.Skipped[i], report.Skipped[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return report, nil
+}
+
+// handlerRoutes returns the patterns of the routes the handlers wrapped by the application are registered for, by the
+// ID of the handler function. Handler transactions are named after their route.
+func (m *InstrumentationManager) handlerRoutes() map[string]string {
+	routes := map[string]string{}
+	for _, c := range m.changes {
+		state, ok := m.packages[c.pkg]
+		if c.rule != ruleWrapHandler || !ok || state.pkg.TypesInfo == nil {
+			continue
+		}
+		call, ok := state.pkg.Decorator.Ast.Nodes[c.anchor].(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			continue
+		}
+		lit, ok := call.Args[0].(*ast.BasicLit)
+		if !ok || lit.Kind != token.STRING {
+			continue
+		}
+		pattern, err := strconv.Unquote(lit.Value)
+		if err != nil {
+			continue
+		}
+		if handler := invokedFunction(state.pkg.TypesInfo, call.Args[1]); handler != nil {
+			routes[handler.FullName()] = pattern
+		}
+	}
+	return routes
+}
+
+// unreachedHandlers returns the http handlers that are neither wrapped nor traced, so that they do not start a
+// transaction. Handlers that were instrumented before the application was loaded are left out.
+func (m *InstrumentationManager) unreachedHandlers(routes map[string]string, entryPoints map[string]bool) []ReportSkipped {
+	skipped := []ReportSkipped{}
+	currentPackage := m.currentPackage
+	defer m.SetPackage(currentPackage)
+	for pkgName, state := range m.packages {
+		m.SetPackage(pkgName)
+		for id, fn := range state.tracedFuncs {
+			if _, ok := routes[id]; ok || entryPoints[id] || fn.traced || fn.body == nil {
+				continue
+			}
+			if !isHttpHandler(fn.body, state.pkg) || m.ExistingTransactionName(fn.body) != "" {
+				continue
+			}
+			pos := m.sourcePosition(fn.body)
+			skipped = append(skipped, ReportSkipped{
+				Rule:   RuleHttpHandler,
+				File:   m.appRelativePath(pos.Filename),
+				Line:   pos.Line,
+				Reason: fmt.Sprintf("the http handler %s is not registered in a way that can be instrumented, so it does not start a transaction", fn.name),
+			})
+		}
+	}
+	return skipped
+}
+
+// appRelativePath returns the path of a file of the application relative to the application, as it is named in the diff.
+func (m *InstrumentationManager) appRelativePath(path string) string {
+	absAppPath, err := filepath.Abs(m.userAppPath)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(absAppPath, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// WriteReport writes the report of the instrumentation to a file, in the given format.
+func (m *InstrumentationManager) WriteReport(path, format string) error {
+	report, err := m.Report()
+	if err != nil {
+		return err
+	}
+
+	var out any = report
+	if format == ReportFormatSARIF {
+		out = report.sarif()
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// sarifLog is the subset of the SARIF 2.1.0 format the report is written in.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           sarifRegion           `json:"region"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// sarif converts the report to SARIF. Changes are notes, and skipped opportunities are warnings, at the lines of the
+// original source code they refer to.
+func (r *Report) sarif() *sarifLog {
+	rules := []sarifRule{}
+	ruleIDs := map[string]bool{}
+	addRule := func(id, description string) {
+		if !ruleIDs[id] {
+			ruleIDs[id] = true
+			rules = append(rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: description}})
+		}
+	}
+	location := func(file string, line int) []sarifLocation {
+		return []sarifLocation{{PhysicalLocation: sarifPhysicalLocation{
+			ArtifactLocation: sarifArtifactLocation{URI: file},
+			Region:           sarifRegion{StartLine: line},
+		}}}
+	}
+
+	results := []sarifResult{}
+	for _, c := range r.Changes {
+		addRule(c.Rule, c.Reason)
+		properties := map[string]string{
+			"instrumentedLines": fmt.Sprintf("%d-%d", c.StartLine, c.EndLine),
+		}
+		message := c.Reason
+		if c.EntryPoint != "" {
+			properties["entryPoint"] = c.EntryPoint
+			message += fmt.Sprintf(" (entry point %s", c.EntryPoint)
+			if c.Transaction != "" {
+				properties["transaction"] = c.Transaction
+				message += fmt.Sprintf(", transaction %q", c.Transaction)
+			}
+			message += ")"
+		}
+		results = append(results, sarifResult{
+			RuleID:     c.Rule,
+			Level:      "note",
+			Message:    sarifMessage{Text: message},
+			Locations:  location(c.File, c.Line),
+			Properties: properties,
+		})
+	}
+	for _, s := range r.Skipped {
+		addRule(s.Rule, s.Reason)
+		results = append(results, sarifResult{
+			RuleID:    s.Rule,
+			Level:     "warning",
+			Message:   sarifMessage{Text: s.Reason},
+			Locations: location(s.File, s.Line),
+		})
+	}
+
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "go-easy-instrumentation",
+				InformationURI: "https://github.com/newrelic/go-easy-instrumentation",
+				Rules:          rules,
+			}},
+			Results: results,
+		}},
+	}
+}
@@ -0,0 +1,93 @@
+package instrumentation
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Report(t *testing.T) {
+	defer panicRecovery(t)
+	code := `package main
+
+import "net/http"
+
+func index(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("index"))
+}
+
+func unused(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("unused"))
+}
+
+func main() {
+	http.HandleFunc("/index", index)
+	http.Get("https://example.com")
+}
+`
+	testAppDir := "tmp"
+	pkgs, err := createTestAppPackage(testAppDir, "app.go", code)
+	defer cleanupTestApp(t, testAppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+	registry := NewRuleRegistry()
+	assert.NoError(t, registry.Register(Rule{Name: RuleHttpUnsupported, Stateless: CannotInstrumentHttpMethod}))
+	manager.SetRules(registry)
+	assert.NoError(t, manager.InstrumentPackages())
+
+	// changes the rules of the default registry would make, without the code that needs the agent to be restored
+	manager.SetPackage(testAppPackage)
+	decls := manager.GetDecoratorPackage().Syntax[0].Decls
+	index, main := decls[1].(*dst.FuncDecl), decls[3].(*dst.FuncDecl)
+	handleFunc := main.Body.List[0].(*dst.ExprStmt).X
+	manager.RecordChange(ruleWrapHandler, handleFunc, handleFunc)
+	manager.entryPoint = &entryPoint{function: manager.functionID(index)}
+	println := &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("println")}}
+	index.Body.List = append([]dst.Stmt{println}, index.Body.List...)
+	manager.RecordChange("log", index.Body.List[1], println)
+	manager.entryPoint = nil
+
+	report, err := manager.Report()
+	assert.NoError(t, err)
+	assert.Equal(t, TargetNewRelic, report.Target)
+	assert.Equal(t, []ReportChange{
+		{Rule: "log", File: "app.go", Line: 6, StartLine: 6, EndLine: 6, EntryPoint: testAppPackage + ".index", Transaction: "/index", CallChain: []string{testAppPackage + ".index"}, Reason: `made by the "log" rule`},
+		{Rule: ruleWrapHandler, File: "app.go", Line: 14, StartLine: 15, EndLine: 15, Reason: changeReasons[ruleWrapHandler]},
+	}, report.Changes, "changes in handlers must be reported with the route of the handler")
+	assert.Equal(t, []ReportSkipped{
+		{Rule: RuleHttpHandler, File: "app.go", Line: 9, Reason: "the http handler unused is not registered in a way that can be instrumented, so it does not start a transaction"},
+		{Rule: RuleHttpUnsupported, File: "app.go", Line: 15, Reason: "the outbound traffic of http.Get can not be traced"},
+	}, report.Skipped)
+}
+
+func Test_Report_sarif(t *testing.T) {
+	report := &Report{
+		Target: TargetNewRelic,
+		Changes: []ReportChange{
+			{Rule: ruleNoticeError, File: "app.go", Line: 4, StartLine: 6, EndLine: 6, EntryPoint: "app.index", Transaction: "/index", Reason: changeReasons[ruleNoticeError]},
+			{Rule: ruleNoticeError, File: "app.go", Line: 8, StartLine: 11, EndLine: 11, Reason: changeReasons[ruleNoticeError]},
+		},
+		Skipped: []ReportSkipped{
+			{Rule: RuleHttpUnsupported, File: "app.go", Line: 12, Reason: "skipped"},
+		},
+	}
+
+	log := report.sarif()
+	assert.Equal(t, "2.1.0", log.Version)
+	if assert.Len(t, log.Runs, 1) {
+		run := log.Runs[0]
+		assert.Len(t, run.Tool.Driver.Rules, 2, "each rule must be described once")
+		if assert.Len(t, run.Results, 3) {
+			assert.Equal(t, "note", run.Results[0].Level)
+			assert.Equal(t, `reports the error to the transaction (entry point app.index, transaction "/index")`, run.Results[0].Message.Text)
+			assert.Equal(t, "6-6", run.Results[0].Properties["instrumentedLines"])
+			assert.Equal(t, 4, run.Results[0].Locations[0].PhysicalLocation.Region.StartLine)
+			assert.Equal(t, "warning", run.Results[2].Level)
+			assert.Equal(t, "app.go", run.Results[2].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package instrumentation
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// reviewContextLines is the number of lines shown around the lines of a change when it is reviewed.
+const reviewContextLines = 3
+
+// errReviewEnded is returned when the input ends before every change is reviewed.
+var errReviewEnded = errors.New("the review ended before every change was accepted or rejected, nothing was written")
+
+// reviewHelp describes the answers to the review prompt.
+const reviewHelp = `y - accept this change
+n - reject this change, and the changes that depend on it
+e - accept this change, and edit the name of the transaction or segment it starts
+a - accept this change, and every change after it
+q - reject this change, and every change after it
+? - print help
+`
+
+// reviewGroup is the changes with the same key, which are made by the same decision of a rule. They are accepted or
+// rejected together.
+type reviewGroup struct {
+	key     string
+	changes []*change
+}
+
+// name returns the name of the transaction or segment the changes start, or an empty string if they do not start one.
+func (g *reviewGroup) name() string {
+	for _, c := range g.changes {
+		if c.name != "" {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// ReinstrumentFunc instruments the application again without the dropped changes, and with the transactions and
+// segments of the renamed changes given new names. Both are keyed by the keys of the changes.
+type ReinstrumentFunc func(dropped map[string]bool, names map[string]string) *InstrumentationManager
+
+// ReviewChanges walks the user through the changes made to the application by manager, writing each one to out with
+// the code around it, and reading whether to accept, reject or rename it from in. Changes are grouped by their rule,
+// and the entry point of the transaction they trace.
+//
+// Rejected and renamed changes are made again with reinstrument, which also leaves out the changes that depended on the
+// rejected ones, such as the transaction argument a rejected segment needed. New changes that this makes are reviewed
+// the same way. The manager with only the accepted changes is returned.
+func ReviewChanges(in io.Reader, out io.Writer, manager *InstrumentationManager, reinstrument ReinstrumentFunc) (*InstrumentationManager, error) {
+	reader := bufio.NewReader(in)
+	dropped := map[string]bool{}
+	for key := range manager.droppedChanges {
+		dropped[key] = true
+	}
+	names := map[string]string{}
+	reviewed := map[string]bool{}
+	accepted := map[string]*reviewGroup{}
+	rest := "" // the answer given for every remaining change, if one was
+
+	for {
+		groups := manager.reviewGroups(reviewed)
+		if len(groups) == 0 {
+			return manager, nil
+		}
+		contents, ranges, err := manager.restoreFiles()
+		if err != nil {
+			return nil, err
+		}
+		routes := manager.handlerRoutes()
+
+		changed := false
+		previous := ""
+		for i, group := range groups {
+			reviewed[group.key] = true
+			answer := rest
+			if answer == "" {
+				if heading := reviewHeading(changeProvenance(group.changes[0], routes)); heading != previous {
+					fmt.Fprintf(out, "\n== %s ==\n", heading)
+					previous = heading
+				}
+				manager.writeReviewGroup(out, group, i+1, len(groups), contents, ranges)
+				answer, err = promptReview(reader, out, group)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			switch answer {
+			case "a", "q":
+				rest = answer
+			}
+			switch answer {
+			case "n", "q":
+				dropped[group.key] = true
+				changed = true
+			default:
+				accepted[group.key] = group
+				if name, ok := strings.CutPrefix(answer, "e "); ok {
+					names[group.key] = name
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return manager, nil
+		}
+
+		manager = reinstrument(dropped, names)
+		made := map[string]bool{}
+		for _, c := range manager.changes {
+			made[c.key()] = true
+		}
+		keys := []string{}
+		for key := range accepted {
+			if !made[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			c := accepted[key].changes[0]
+			fmt.Fprintf(out, "the %s change at %s:%d was dropped, since it depends on a rejected change\n", c.rule, manager.appRelativePath(c.pos.Filename), c.pos.Line)
+			delete(accepted, key)
+		}
+	}
+}
+
+// reviewHeading returns the heading of the changes of a rule for an entry point.
+func reviewHeading(p Provenance) string {
+	heading := p.Rule
+	if p.EntryPoint != "" {
+		heading += ", entry point " + p.EntryPoint
+	}
+	if p.Transaction != "" {
+		heading += fmt.Sprintf(", transaction %q", p.Transaction)
+	}
+	return heading
+}
+
+// reviewGroups returns the changes that have not been reviewed, grouped by key, and ordered by rule, entry point and
+// position.
+func (m *InstrumentationManager) reviewGroups(reviewed map[string]bool) []*reviewGroup {
+	groups := []*reviewGroup{}
+	byKey := map[string]*reviewGroup{}
+	for _, c := range m.changes {
+		key := c.key()
+		if reviewed[key] {
+			continue
+		}
+		group, ok := byKey[key]
+		if !ok {
+			group = &reviewGroup{key: key}
+			byKey[key] = group
+			groups = append(groups, group)
+		}
+		group.changes = append(group.changes, c)
+	}
+
+	entryPoint := func(c *change) string {
+		if c.entryPoint == nil {
+			return ""
+		}
+		return c.entryPoint.function
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i].changes[0], groups[j].changes[0]
+		if a.rule != b.rule {
+			return a.rule < b.rule
+		}
+		if entryPoint(a) != entryPoint(b) {
+			return entryPoint(a) < entryPoint(b)
+		}
+		if a.pos.Filename != b.pos.Filename {
+			return a.pos.Filename < b.pos.Filename
+		}
+		return a.pos.Line < b.pos.Line
+	})
+	return groups
+}
+
+// writeReviewGroup writes the changes of a group to out, with the lines of the instrumented files around them. The lines
+// the changes added or modified are marked with a "+".
+func (m *InstrumentationManager) writeReviewGroup(out io.Writer, group *reviewGroup, index, total int, contents map[string][]byte, ranges map[string][]lineRange) {
+	c := group.changes[0]
+	fmt.Fprintf(out, "[%d/%d] %s at %s:%d: %s\n", index, total, c.rule, m.appRelativePath(c.pos.Filename), c.pos.Line, changeReason(c.rule))
+	if name := group.name(); name != "" {
+		fmt.Fprintf(out, "it starts the transaction or segment %q\n", name)
+	}
+
+	inGroup := map[*change]bool{}
+	for _, c := range group.changes {
+		inGroup[c] = true
+	}
+	paths := []string{}
+	for path := range ranges {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		changed := map[int]bool{}
+		for _, r := range ranges[path] {
+			if !inGroup[r.change] {
+				continue
+			}
+			for line := r.start; line <= r.end; line++ {
+				changed[line] = true
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(contents[path]), "\n"), "\n")
+		fmt.Fprintf(out, "%s\n", m.appRelativePath(path))
+		last := 0 // last line written
+		for line := 1; line <= len(lines); line++ {
+			shown := false
+			for l := line - reviewContextLines; l <= line+reviewContextLines; l++ {
+				shown = shown || changed[l]
+			}
+			if !shown {
+				continue
+			}
+			if last != 0 && line > last+1 {
+				fmt.Fprintln(out, "     ...")
+			}
+			marker := " "
+			if changed[line] {
+				marker = "+"
+			}
+			fmt.Fprintf(out, "%4d %s %s\n", line, marker, lines[line-1])
+			last = line
+		}
+	}
+}
+
+// promptReview asks the user whether to accept a group of changes, until they give a valid answer, and returns it. A
+// new name is returned as "e <name>".
+func promptReview(reader *bufio.Reader, out io.Writer, group *reviewGroup) (string, error) {
+	options := "y,n,a,q,?"
+	if group.name() != "" {
+		options = "y,n,e,a,q,?"
+	}
+	for {
+		fmt.Fprintf(out, "accept this change [%s]? ", options)
+		answer, err := readLine(reader)
+		if err != nil {
+			return "", err
+		}
+		switch answer {
+		case "y", "n", "a", "q":
+			return answer, nil
+		case "e":
+			if group.name() == "" {
+				fmt.Fprintln(out, "this change does not start a transaction or segment")
+				continue
+			}
+			fmt.Fprintf(out, "new name for %q: ", group.name())
+			name, err := readLine(reader)
+			if err != nil {
+				return "", err
+			}
+			if name == "" {
+				continue
+			}
+			return "e " + name, nil
+		default:
+			fmt.Fprint(out, reviewHelp)
+		}
+	}
+}
+
+// readLine reads a line of input, without the spaces around it.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errReviewEnded
+	}
+	return strings.TrimSpace(line), nil
+}
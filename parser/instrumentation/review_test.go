@@ -0,0 +1,171 @@
+package instrumentation
+
+import (
+	"bytes"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/dstutil"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/tools/go/packages"
+)
+
+// reviewTestRules logs each call in main with a named "log" change, and counts them at the end of main with a "count"
+// change, which depends on the "log" change of the first call.
+func reviewTestRules(t *testing.T) *RuleRegistry {
+	printCall := func(arg string) *dst.ExprStmt {
+		return &dst.ExprStmt{X: &dst.CallExpr{
+			Fun:  dst.NewIdent("println"),
+			Args: []dst.Expr{&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(arg)}},
+		}}
+	}
+	registry := NewRuleRegistry()
+	assert.NoError(t, registry.Register(Rule{Name: "log", Stateless: func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+		decl, ok := n.(*dst.FuncDecl)
+		if !ok || decl.Name.Name != "main" {
+			return
+		}
+		stmts := []dst.Stmt{}
+		for _, stmt := range decl.Body.List {
+			stmts = append(stmts, stmt)
+			if manager.ChangeDropped("log", stmt) {
+				continue
+			}
+			name := manager.changeName("log", stmt, "work")
+			log := printCall(name)
+			stmts = append(stmts, log)
+			manager.recordNamedChange("log", name, stmt, log)
+		}
+		if !manager.ChangeDropped("log", decl.Body.List[0]) && !manager.ChangeDropped("count", decl) {
+			count := printCall("count")
+			stmts = append(stmts, count)
+			manager.RecordChange("count", decl, count)
+		}
+		decl.Body.List = stmts
+	}}))
+	return registry
+}
+
+func Test_ReviewChanges(t *testing.T) {
+	code := `package main
+
+func work() {}
+
+func main() {
+	work()
+	work()
+}
+`
+	tests := []struct {
+		name          string
+		input         string
+		wantChanges   []string // rule, line and name of the changes that are made
+		wantOutput    []string
+		wantErr       bool
+		reinstruments int
+	}{
+		{
+			name:        "accept",
+			input:       "y\ny\ny\n",
+			wantChanges: []string{"count@5", "log@6:work", "log@7:work"},
+			wantOutput: []string{
+				"== count ==\n[1/3] count at app.go:5: made by the \"count\" rule\n",
+				"[2/3] log at app.go:6: made by the \"log\" rule\nit starts the transaction or segment \"work\"\napp.go\n   4   \n   5   func main() {\n   6   \twork()\n   7 + \tprintln(\"work\")\n   8   \twork()\n   9   \tprintln(\"work\")\n  10   \tprintln(\"count\")\n",
+			},
+		},
+		{
+			name:          "reject_dependency",
+			input:         "y\nn\ny\n",
+			wantChanges:   []string{"log@7:work"},
+			wantOutput:    []string{"the count change at app.go:5 was dropped, since it depends on a rejected change\n"},
+			reinstruments: 1,
+		},
+		{
+			name:          "rename",
+			input:         "a\nwrong\ne\n\ne\nstart\n",
+			wantChanges:   []string{"count@5", "log@6:work", "log@7:work"},
+			wantOutput:    []string{"[1/3] count"},
+			reinstruments: 0,
+		},
+		{
+			name:          "edit_name",
+			input:         "y\ne\nstart\ny\n",
+			wantChanges:   []string{"count@5", "log@6:start", "log@7:work"},
+			wantOutput:    []string{"new name for \"work\": "},
+			reinstruments: 1,
+		},
+		{
+			name:        "help",
+			input:       "e\n?\ny\ny\ny\n",
+			wantChanges: []string{"count@5", "log@6:work", "log@7:work"},
+			wantOutput:  []string{"this change does not start a transaction or segment\n", reviewHelp},
+		},
+		{
+			name:          "quit",
+			input:         "y\nq\n",
+			wantChanges:   []string{},
+			wantOutput:    []string{"the count change at app.go:5 was dropped, since it depends on a rejected change\n"},
+			reinstruments: 1,
+		},
+		{
+			name:    "input_ends",
+			input:   "y\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer panicRecovery(t)
+			testAppDir := "tmp"
+			_, err := createTestAppPackage(testAppDir, "app.go", code)
+			defer cleanupTestApp(t, testAppDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			instrument := func(dropped map[string]bool, names map[string]string) *InstrumentationManager {
+				pkgs, err := decorator.Load(&packages.Config{Dir: testAppDir, Mode: loadMode})
+				if err != nil {
+					t.Fatal(err)
+				}
+				manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+				manager.SetPackage(testAppPackage)
+				manager.SetRules(reviewTestRules(t))
+				manager.DropChanges(dropped)
+				manager.RenameChanges(names)
+				assert.NoError(t, manager.InstrumentPackages())
+				return manager
+			}
+			reinstruments := 0
+			out := &bytes.Buffer{}
+			manager, err := ReviewChanges(strings.NewReader(tt.input), out, instrument(nil, nil), func(dropped map[string]bool, names map[string]string) *InstrumentationManager {
+				reinstruments++
+				return instrument(dropped, names)
+			})
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errReviewEnded)
+				return
+			}
+			assert.NoError(t, err)
+
+			changes := []string{}
+			for _, c := range manager.changes {
+				change := c.rule + "@" + strconv.Itoa(c.pos.Line)
+				if c.name != "" {
+					change += ":" + c.name
+				}
+				changes = append(changes, change)
+			}
+			assert.ElementsMatch(t, tt.wantChanges, changes)
+			for _, want := range tt.wantOutput {
+				assert.Contains(t, out.String(), want)
+			}
+			assert.Equal(t, tt.reinstruments, reinstruments, "the application must only be instrumented again when a change is rejected or renamed")
+		})
+	}
+}
@@ -0,0 +1,319 @@
+package instrumentation
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/types"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+	"gopkg.in/yaml.v3"
+)
+
+// Priority of the rules compiled from function definitions. They are applied to main before InstrumentMain, so that
+// it starts the transactions they add.
+const transactionRootPriority = 1
+
+// RuleFile is a file of declarative instrumentation rules, loaded with the -rules flag. Each rule either traces calls
+// to a function in a segment, or starts a background transaction around calls to a function from main:
+//
+//	rules:
+//	  - name: cache-get
+//	    call: github.com/acme/cache.(*Client).Get
+//	    segment:
+//	      kind: datastore
+//	      name: get
+//	      product: Redis
+//	      collection: sessions
+//	  - name: jobs
+//	    function: github.com/acme/app/jobs.Run*
+//	    transaction:
+//	      name: background-job
+//
+// Functions are named by their import path and name, and methods by the import path, receiver type and name. In
+// function names, * matches any characters but /.
+type RuleFile struct {
+	Rules []RuleDefinition `yaml:"rules"`
+}
+
+// RuleDefinition is a declarative instrumentation rule. It sets either Call and Segment, or Function and Transaction.
+type RuleDefinition struct {
+	// Name identifies the rule. Defaults to the function it instruments.
+	Name string `yaml:"name"`
+	// Call is the function whose calls in traced functions are timed by Segment.
+	Call    string             `yaml:"call"`
+	Segment *SegmentDefinition `yaml:"segment"`
+	// Function is the function whose calls in main start the background transaction Transaction.
+	Function    string                 `yaml:"function"`
+	Transaction *TransactionDefinition `yaml:"transaction"`
+}
+
+// SegmentDefinition is the segment a call is timed in.
+type SegmentDefinition struct {
+	// Name of the segment, and the operation of a datastore segment. Defaults to the name of the called function.
+	Name string `yaml:"name"`
+	// Kind is "custom" or "datastore". Defaults to "custom".
+	Kind       string `yaml:"kind"`
+	Product    string `yaml:"product"`
+	Collection string `yaml:"collection"`
+}
+
+// TransactionDefinition is the background transaction a call in main is the root of.
+type TransactionDefinition struct {
+	// Name of the transaction. Defaults to the name of the called function.
+	Name string `yaml:"name"`
+}
+
+// LoadRules reads a rule file, and compiles its rules.
+func LoadRules(filePath string) ([]Rule, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := ParseRules(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return rules, nil
+}
+
+// ParseRules compiles the rules of a rule file into the functions TraceFunction and InstrumentPackages apply.
+func ParseRules(data []byte) ([]Rule, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	file := RuleFile{}
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	rules := []Rule{}
+	for i, def := range file.Rules {
+		rule, err := def.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// compile validates a rule definition, and compiles it into a rule.
+func (def RuleDefinition) compile() (Rule, error) {
+	switch {
+	case def.Call != "" && def.Function != "":
+		return Rule{}, fmt.Errorf("rule must set one of call and function, not both")
+	case def.Call != "":
+		if def.Segment == nil || def.Transaction != nil {
+			return Rule{}, fmt.Errorf("call rule %q must set a segment, and no transaction", def.Call)
+		}
+		pattern, err := parseFunctionPattern(def.Call)
+		if err != nil {
+			return Rule{}, err
+		}
+		segment := CallSegment{
+			Name:       def.Segment.Name,
+			Kind:       def.Segment.Kind,
+			Product:    def.Segment.Product,
+			Collection: def.Segment.Collection,
+		}
+		if segment.Kind == "" {
+			segment.Kind = SegmentKindCustom
+		}
+		if segment.Kind != SegmentKindCustom && segment.Kind != SegmentKindDatastore {
+			return Rule{}, fmt.Errorf("segment kind must be %q or %q", SegmentKindCustom, SegmentKindDatastore)
+		}
+		return compileCallRule(ruleName(def.Name, def.Call), pattern, segment), nil
+	case def.Function != "":
+		if def.Transaction == nil || def.Segment != nil {
+			return Rule{}, fmt.Errorf("function rule %q must set a transaction, and no segment", def.Function)
+		}
+		pattern, err := parseFunctionPattern(def.Function)
+		if err != nil {
+			return Rule{}, err
+		}
+		return compileFunctionRule(ruleName(def.Name, def.Function), pattern, def.Transaction.Name), nil
+	}
+	return Rule{}, fmt.Errorf("rule must set a call or a function")
+}
+
+func ruleName(name, function string) string {
+	if name != "" {
+		return name
+	}
+	return function
+}
+
+// compileCallRule compiles a rule that times the statements of traced functions that call a function matching pattern
+// in a segment. Without a name, the segment is named after the called function.
+func compileCallRule(name string, pattern *functionPattern, segment CallSegment) Rule {
+	return Rule{
+		Name:        name,
+		ImportPaths: pattern.importPaths(),
+		Stateful: func(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, txnName string) bool {
+			switch stmt.(type) {
+			case *dst.ExprStmt, *dst.AssignStmt:
+			default:
+				return false
+			}
+			if c.Index() < 0 || manager.IsInstrumented(stmt) || manager.ChangeDropped(name, stmt) {
+				return false
+			}
+			fn := manager.calledFunctionMatching(stmt, pattern)
+			if fn == nil {
+				return false
+			}
+
+			callSegment := segment
+			if callSegment.Name == "" {
+				callSegment.Name = functionDisplayName(fn)
+			}
+			segmentVar := manager.StatementVariableName(stmt, defaultSegmentName)
+			start := manager.Backend().StartCallSegment(txnName, segmentVar, callSegment, manager.GetPackageName(), stmt.Decorations())
+			end := manager.Backend().EndCallSegment(segmentVar, stmt.Decorations())
+			c.InsertBefore(start)
+			c.InsertAfter(end)
+			manager.RecordChange(name, stmt, start, end)
+			manager.AddImports(start, end)
+			return true
+		},
+	}
+}
+
+// compileFunctionRule compiles a rule that makes the call statements in main that call a function matching pattern the
+// roots of background transactions. Without a transaction name, the transactions are named after the called function.
+func compileFunctionRule(name string, pattern *functionPattern, transactionName string) Rule {
+	return Rule{
+		Name:     name,
+		Priority: transactionRootPriority,
+		Stateless: func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+			decl, ok := n.(*dst.FuncDecl)
+			if !ok || decl.Name.Name != "main" || decl.Recv != nil {
+				return
+			}
+			dst.Inspect(decl.Body, func(n dst.Node) bool {
+				switch v := n.(type) {
+				case *dst.FuncLit:
+					return false
+				case *dst.ExprStmt:
+					if fn := manager.calledFunctionMatching(v, pattern); fn != nil {
+						txnName := transactionName
+						if txnName == "" {
+							txnName = functionDisplayName(fn)
+						}
+						manager.AddTransactionRoot(v, txnName)
+					}
+				}
+				return true
+			})
+		},
+	}
+}
+
+// calledFunctionMatching returns the first function called by stmt whose full name matches pattern, or nil if it calls
+// none.
+func (m *InstrumentationManager) calledFunctionMatching(stmt dst.Stmt, pattern *functionPattern) *types.Func {
+	for _, call := range statementCalls(stmt) {
+		if fn := m.calledFunction(call); fn != nil && pattern.match(fn.FullName()) {
+			return fn
+		}
+	}
+	return nil
+}
+
+// calledFunction returns the function or method invoked by call, or nil if it does not invoke one, or there is no type
+// information for it.
+func (m *InstrumentationManager) calledFunction(call *dst.CallExpr) *types.Func {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+
+	fun, ok := pkg.Decorator.Ast.Nodes[call.Fun].(ast.Expr)
+	if !ok {
+		return nil
+	}
+	return invokedFunction(pkg.TypesInfo, fun)
+}
+
+// invokedFunction returns the function or method that fun, the function expression of a call, refers to, or nil if it
+// does not refer to one.
+func invokedFunction(info *types.Info, fun ast.Expr) *types.Func {
+	var ident *ast.Ident
+	switch v := fun.(type) {
+	case *ast.Ident:
+		ident = v
+	case *ast.SelectorExpr:
+		ident = v.Sel
+	default:
+		return nil
+	}
+	fn, ok := info.Uses[ident].(*types.Func)
+	if !ok {
+		return nil
+	}
+	return fn.Origin()
+}
+
+// functionPattern matches the full names of functions, as returned by types.Func.FullName.
+type functionPattern struct {
+	pattern string // pattern of the full name, in the syntax of path.Match
+	pkg     string // import path of the package the functions are declared in
+	method  bool
+}
+
+// parseFunctionPattern parses the name of a function, such as "github.com/acme/jobs.Run*", or of a method, such as
+// "github.com/acme/cache.(*Client).Get". In names, * matches any characters but /.
+func parseFunctionPattern(name string) (*functionPattern, error) {
+	p := &functionPattern{}
+	if i := strings.Index(name, ".("); i >= 0 {
+		// methods are named (*pkg.Type).Method by FullName
+		p.pkg, p.method = name[:i], true
+		recv, method, ok := strings.Cut(name[i+2:], ").")
+		typeName := strings.TrimPrefix(recv, "*")
+		if !ok || typeName == "" || method == "" {
+			return nil, fmt.Errorf("invalid method name %q, methods are named like \"example.com/pkg.(*Type).Method\"", name)
+		}
+		star := ""
+		if strings.HasPrefix(recv, "*") {
+			star = `\*`
+		}
+		p.pattern = "(" + star + p.pkg + "." + typeName + ")." + method
+	} else {
+		slash := strings.LastIndex(name, "/")
+		dot := strings.Index(name[slash+1:], ".")
+		if dot < 0 || dot == len(name[slash+1:])-1 {
+			return nil, fmt.Errorf("invalid function name %q, functions are named like \"example.com/pkg.Function\"", name)
+		}
+		p.pkg = name[:slash+1+dot]
+		p.pattern = name
+	}
+
+	if p.pkg == "" {
+		return nil, fmt.Errorf("function name %q must start with an import path", name)
+	}
+	if _, err := path.Match(p.pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid function name %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// match returns true if fullName, the full name of a function, matches the pattern.
+func (p *functionPattern) match(fullName string) bool {
+	ok, _ := path.Match(p.pattern, fullName)
+	return ok
+}
+
+// importPaths returns the import paths of the packages that must be imported to call the functions the pattern
+// matches. Methods can be called on values of types from packages that are not imported, so they have none.
+func (p *functionPattern) importPaths() []string {
+	if p.method || strings.ContainsAny(p.pkg, `*?[\`) {
+		return nil
+	}
+	return []string{p.pkg}
+}
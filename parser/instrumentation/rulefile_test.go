@@ -0,0 +1,193 @@
+package instrumentation
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/guess"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseFunctionPattern(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		matches     []string
+		notMatches  []string
+		importPaths []string
+		wantErr     bool
+	}{
+		{
+			name:        "function",
+			pattern:     "github.com/acme/jobs.Run*",
+			matches:     []string{"github.com/acme/jobs.Run", "github.com/acme/jobs.RunNightly"},
+			notMatches:  []string{"github.com/acme/jobs.Stop", "github.com/acme/jobs/sub.Run", "(*github.com/acme/jobs.Runner).Run"},
+			importPaths: []string{"github.com/acme/jobs"},
+		},
+		{
+			name:       "pointer_method",
+			pattern:    "github.com/acme/cache.(*Client).Get",
+			matches:    []string{"(*github.com/acme/cache.Client).Get"},
+			notMatches: []string{"(github.com/acme/cache.Client).Get", "(*github.com/acme/cache.Client).GetAll"},
+		},
+		{
+			name:       "value_method",
+			pattern:    "github.com/acme/cache.(Client).Get*",
+			matches:    []string{"(github.com/acme/cache.Client).GetAll"},
+			notMatches: []string{"(*github.com/acme/cache.Client).Get"},
+		},
+		{
+			name:       "package_wildcard",
+			pattern:    "github.com/acme/*.Run",
+			matches:    []string{"github.com/acme/jobs.Run"},
+			notMatches: []string{"github.com/acme/jobs/sub.Run"},
+		},
+		{name: "no_package", pattern: "Run", wantErr: true},
+		{name: "no_function", pattern: "github.com/acme/jobs.", wantErr: true},
+		{name: "no_method", pattern: "github.com/acme/cache.(*Client)", wantErr: true},
+		{name: "bad_pattern", pattern: "github.com/acme/jobs.Run[", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := parseFunctionPattern(tt.pattern)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			for _, name := range tt.matches {
+				assert.True(t, pattern.match(name), "%s must match %s", tt.pattern, name)
+			}
+			for _, name := range tt.notMatches {
+				assert.False(t, pattern.match(name), "%s must not match %s", tt.pattern, name)
+			}
+			assert.Equal(t, tt.importPaths, pattern.importPaths())
+		})
+	}
+}
+
+func Test_ParseRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		wantNames []string
+		wantErr   bool
+	}{
+		{
+			name: "call_and_function",
+			yaml: `
+rules:
+  - name: cache-get
+    call: github.com/acme/cache.(*Client).Get
+    segment:
+      kind: datastore
+      product: Redis
+  - function: github.com/acme/jobs.Run*
+    transaction: {}
+`,
+			wantNames: []string{"cache-get", "github.com/acme/jobs.Run*"},
+		},
+		{name: "empty", yaml: "", wantNames: []string{}},
+		{name: "both", yaml: "rules: [{call: a.b/c.F, function: a.b/c.G, segment: {}}]", wantErr: true},
+		{name: "neither", yaml: "rules: [{name: x}]", wantErr: true},
+		{name: "call_without_segment", yaml: "rules: [{call: a.b/c.F}]", wantErr: true},
+		{name: "function_without_transaction", yaml: "rules: [{function: a.b/c.F}]", wantErr: true},
+		{name: "unknown_kind", yaml: "rules: [{call: a.b/c.F, segment: {kind: queue}}]", wantErr: true},
+		{name: "unknown_field", yaml: "rules: [{call: a.b/c.F, segmnt: {}}]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules([]byte(tt.yaml))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			names := []string{}
+			for _, rule := range rules {
+				names = append(names, rule.Name)
+			}
+			assert.Equal(t, tt.wantNames, names)
+		})
+	}
+}
+
+func Test_ParseRules_instrument(t *testing.T) {
+	code := `package main
+
+import "strconv"
+
+func runJob(s string) int {
+	// parse the input
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+func main() {
+	runJob("1")
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	rules, err := ParseRules([]byte(`
+rules:
+  - call: strconv.Atoi
+    segment:
+      kind: datastore
+      name: parse
+      product: Memory
+  - function: ` + testAppPackage + `.run*
+    transaction:
+      name: job
+`))
+	assert.NoError(t, err)
+	registry := NewRuleRegistry()
+	for _, rule := range append(DefaultRuleRegistry().Rules(), rules...) {
+		assert.NoError(t, registry.Register(rule))
+	}
+	manager.SetRules(registry)
+	assert.NoError(t, manager.InstrumentPackages())
+
+	want := `package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+func runJob(s string, nrTxn *newrelic.Transaction) int {
+	// parse the input
+	segment := newrelic.DatastoreSegment{
+		StartTime: nrTxn.StartSegmentNow(),
+		Product:   "Memory",
+		Operation: "parse",
+	}
+	n, _ := strconv.Atoi(s)
+	segment.End()
+	return n
+}
+
+func main() {
+	NewRelicAgent, err := newrelic.NewApplication(newrelic.ConfigFromEnvironment())
+	if err != nil {
+		panic(err)
+	}
+
+	nrTxn := NewRelicAgent.StartTransaction("job")
+	runJob("1", nrTxn)
+	nrTxn.End()
+
+	NewRelicAgent.Shutdown(5 * time.Second)
+}
+`
+	got := bytes.NewBuffer([]byte{})
+	r := decorator.NewRestorerWithImports(testAppPackage, guess.New())
+	if err := r.Fprint(got, manager.GetDecoratorPackage().Syntax[0]); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got.String())
+}
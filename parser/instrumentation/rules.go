@@ -0,0 +1,202 @@
+package instrumentation
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Names of the rules in the default registry.
+const (
+	RuleMain              = "main"
+	RuleHttpHandler       = "net/http-handler"
+	RuleHttpClient        = "net/http-client"
+	RuleHttpUnsupported   = "net/http-unsupported-method"
+	RuleHttpExternalCall  = "net/http-external-call"
+	RuleHttpNestedHandler = "net/http-nested-handler"
+	RuleGinRouter         = "gin-router"
+	RuleGinHandler        = "gin-handler"
+	RuleGinNestedRouter   = "gin-nested-router"
+	RuleEchoRouter        = "echo-router"
+	RuleEchoHandler       = "echo-handler"
+	RuleEchoNestedRouter  = "echo-nested-router"
+	RuleGorillaMuxRouter  = "gorilla/mux-router"
+	RuleGorillaMuxNested  = "gorilla/mux-nested-router"
+	RuleHttpRouter        = "httprouter-router"
+	RuleHttpRouterNested  = "httprouter-nested-router"
+	RuleChiRouter         = "chi-router"
+	RuleChiNestedRouter   = "chi-nested-router"
+)
+
+// Rule is an instrumentation rule, and the metadata it is registered with. A rule sets exactly one of Stateless and
+// Stateful.
+type Rule struct {
+	// Name identifies the rule. Names are unique within a registry.
+	Name string
+	// ImportPaths are the import paths of the packages the rule instruments. The rule is only applied to packages that
+	// import one of them. A path without a major version suffix is also imported by importing one of the major versions of
+	// its module. A rule without import paths is applied to every package.
+	ImportPaths []string
+	// Priority orders the rules. Rules with a higher priority are applied to a node before rules with a lower one, and
+	// rules with the same priority are applied in the order they were registered.
+	Priority int
+	// Stateless is applied to every node of the application, and does not need to know whether the function the node
+	// is in is traced.
+	Stateless StatelessInstrumentationFunc
+	// Stateful is applied to every statement of a traced function, and is passed the name of its transaction.
+	Stateful StatefulTracingFunction
+}
+
+// appliesTo returns true if the rule is applied to a package with the given imports.
+func (r Rule) appliesTo(imports func(path string) bool) bool {
+	if len(r.ImportPaths) == 0 {
+		return true
+	}
+	for _, path := range r.ImportPaths {
+		if imports(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleRegistry is a set of instrumentation rules. It is safe to register rules concurrently.
+type RuleRegistry struct {
+	mu    sync.Mutex
+	rules []Rule
+}
+
+// NewRuleRegistry creates an empty registry.
+func NewRuleRegistry() *RuleRegistry {
+	return &RuleRegistry{}
+}
+
+// Register adds a rule to the registry. It returns an error if the rule has no name, does not set exactly one
+// function, or has the same name as a rule already in the registry.
+func (r *RuleRegistry) Register(rule Rule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("instrumentation rule must have a name")
+	}
+	if (rule.Stateless == nil) == (rule.Stateful == nil) {
+		return fmt.Errorf("instrumentation rule %q must set exactly one of Stateless and Stateful", rule.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, registered := range r.rules {
+		if registered.Name == rule.Name {
+			return fmt.Errorf("instrumentation rule %q is already registered", rule.Name)
+		}
+	}
+	rule.ImportPaths = append([]string(nil), rule.ImportPaths...)
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Rules returns the registered rules, ordered by priority.
+func (r *RuleRegistry) Rules() []Rule {
+	r.mu.Lock()
+	rules := append([]Rule(nil), r.rules...)
+	r.mu.Unlock()
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+	return rules
+}
+
+// statelessRules returns the stateless functions of the rules that apply to a package with the given imports.
+func (r *RuleRegistry) statelessRules(imports func(path string) bool) []StatelessInstrumentationFunc {
+	funcs := []StatelessInstrumentationFunc{}
+	for _, rule := range r.Rules() {
+		if rule.Stateless != nil && rule.appliesTo(imports) {
+			funcs = append(funcs, rule.Stateless)
+		}
+	}
+	return funcs
+}
+
+// statefulRules returns the stateful functions of the rules that apply to a package with the given imports.
+func (r *RuleRegistry) statefulRules(imports func(path string) bool) []StatefulTracingFunction {
+	funcs := []StatefulTracingFunction{}
+	for _, rule := range r.Rules() {
+		if rule.Stateful != nil && rule.appliesTo(imports) {
+			funcs = append(funcs, rule.Stateful)
+		}
+	}
+	return funcs
+}
+
+// defaultRegistry holds the built in rules, and the rules registered with RegisterRule.
+var defaultRegistry = NewRuleRegistry()
+
+// the built in rules are registered in init, since they refer to the default registry when they trace functions
+func init() {
+	for _, rule := range []Rule{
+		{Name: RuleMain, Stateless: InstrumentMain},
+		{Name: RuleHttpHandler, ImportPaths: []string{NetHttp}, Stateless: InstrumentHandleFunction},
+		{Name: RuleHttpClient, ImportPaths: []string{NetHttp}, Stateless: InstrumentHttpClient},
+		{Name: RuleHttpUnsupported, ImportPaths: []string{NetHttp}, Stateless: CannotInstrumentHttpMethod},
+		{Name: RuleHttpExternalCall, ImportPaths: []string{NetHttp}, Stateful: ExternalHttpCall},
+		{Name: RuleHttpNestedHandler, ImportPaths: []string{NetHttp}, Stateful: WrapNestedHandleFunction},
+		{Name: RuleGinRouter, ImportPaths: []string{Gin}, Stateless: InstrumentGinRouter},
+		{Name: RuleGinHandler, ImportPaths: []string{Gin}, Stateless: InstrumentGinHandler},
+		{Name: RuleGinNestedRouter, ImportPaths: []string{Gin}, Stateless: InstrumentNestedGinRouter},
+		{Name: RuleEchoRouter, ImportPaths: []string{Echo}, Stateless: InstrumentEchoRouter},
+		{Name: RuleEchoHandler, ImportPaths: []string{Echo}, Stateless: InstrumentEchoHandler},
+		{Name: RuleEchoNestedRouter, ImportPaths: []string{Echo}, Stateless: InstrumentNestedEchoRouter},
+		{Name: RuleGorillaMuxRouter, ImportPaths: []string{GorillaMux}, Stateless: InstrumentGorillaMuxRouter},
+		{Name: RuleGorillaMuxNested, ImportPaths: []string{GorillaMux}, Stateless: InstrumentNestedGorillaMuxRouter},
+		{Name: RuleHttpRouter, ImportPaths: []string{HttpRouter}, Stateless: InstrumentHttpRouter},
+		{Name: RuleHttpRouterNested, ImportPaths: []string{HttpRouter}, Stateless: InstrumentNestedHttpRouter},
+		{Name: RuleChiRouter, ImportPaths: []string{Chi}, Stateless: InstrumentChiRouter},
+		{Name: RuleChiNestedRouter, ImportPaths: []string{Chi}, Stateless: InstrumentNestedChiRouter},
+	} {
+		if err := defaultRegistry.Register(rule); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// DefaultRuleRegistry returns the registry applications are instrumented with, unless a manager is given another one
+// with SetRules.
+func DefaultRuleRegistry() *RuleRegistry {
+	return defaultRegistry
+}
+
+// RegisterRule adds a rule to the default registry. Programs that ship their own rules register them before calling
+// Main.
+func RegisterRule(rule Rule) error {
+	return defaultRegistry.Register(rule)
+}
+
+// Rules returns the registry the application is instrumented with. Without a registry, the default one is used.
+func (m *InstrumentationManager) Rules() *RuleRegistry {
+	if m.rules == nil {
+		return defaultRegistry
+	}
+	return m.rules
+}
+
+// SetRules sets the registry the application is instrumented with.
+func (m *InstrumentationManager) SetRules(rules *RuleRegistry) {
+	m.rules = rules
+}
+
+// importsPackage returns true if the current package imports the package path, or one of the major versions of its
+// module if path has no major version suffix, such as github.com/go-chi/chi/v5 for github.com/go-chi/chi.
+func (m *InstrumentationManager) importsPackage(path string) bool {
+	pkg := m.GetDecoratorPackage()
+	if pkg == nil || pkg.Package == nil {
+		return false
+	}
+	if pkg.Imports[path] != nil {
+		return true
+	}
+	for imported := range pkg.Imports {
+		if withoutMajorVersion(imported) == path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/dstutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RuleRegistry_Register(t *testing.T) {
+	stateless := func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {}
+	stateful := func(manager *InstrumentationManager, stmt dst.Stmt, c *dstutil.Cursor, tracingName string) bool {
+		return false
+	}
+
+	tests := []struct {
+		name    string
+		rule    Rule
+		wantErr bool
+	}{
+		{name: "stateless", rule: Rule{Name: "a", Stateless: stateless}},
+		{name: "stateful", rule: Rule{Name: "b", Stateful: stateful}},
+		{name: "no_name", rule: Rule{Stateless: stateless}, wantErr: true},
+		{name: "no_function", rule: Rule{Name: "c"}, wantErr: true},
+		{name: "both_functions", rule: Rule{Name: "d", Stateless: stateless, Stateful: stateful}, wantErr: true},
+		{name: "duplicate", rule: Rule{Name: "a", Stateful: stateful}, wantErr: true},
+	}
+	registry := NewRuleRegistry()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := registry.Register(tt.rule)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_RuleRegistry_Rules(t *testing.T) {
+	stateless := func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {}
+	registry := NewRuleRegistry()
+	for _, rule := range []Rule{
+		{Name: "first", Stateless: stateless},
+		{Name: "rpc", ImportPaths: []string{"example.com/rpc"}, Stateless: stateless},
+		{Name: "high", Priority: 10, Stateless: stateless},
+		{Name: "second", Stateless: stateless},
+	} {
+		assert.NoError(t, registry.Register(rule))
+	}
+
+	names := []string{}
+	for _, rule := range registry.Rules() {
+		names = append(names, rule.Name)
+	}
+	assert.Equal(t, []string{"high", "first", "rpc", "second"}, names)
+
+	importsRPC := func(path string) bool { return path == "example.com/rpc" }
+	importsNothing := func(path string) bool { return false }
+	assert.Len(t, registry.statelessRules(importsRPC), 4)
+	assert.Len(t, registry.statelessRules(importsNothing), 3)
+}
+
+func Test_InstrumentPackages_customRule(t *testing.T) {
+	code := `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+
+	calls := map[string]int{}
+	count := func(name string) StatelessInstrumentationFunc {
+		return func(n dst.Node, manager *InstrumentationManager, c *dstutil.Cursor) {
+			if _, ok := n.(*dst.CallExpr); ok {
+				calls[name]++
+			}
+		}
+	}
+	registry := NewRuleRegistry()
+	assert.NoError(t, registry.Register(Rule{Name: "fmt", ImportPaths: []string{"fmt"}, Stateless: count("fmt")}))
+	assert.NoError(t, registry.Register(Rule{Name: "rpc", ImportPaths: []string{"example.com/rpc"}, Stateless: count("rpc")}))
+	manager.SetRules(registry)
+
+	assert.NoError(t, manager.InstrumentPackages())
+	assert.Equal(t, map[string]int{"fmt": 1}, calls, "rules must only be applied to packages that import what they instrument")
+	assert.Empty(t, manager.changes, "rules that are not registered must not be applied")
+}
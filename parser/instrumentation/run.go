@@ -0,0 +1,260 @@
+package instrumentation
+
+import (
+	"log"
+	"os"
+
+	"github.com/dave/dst/decorator"
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	loadMode = packages.LoadSyntax
+)
+
+func createDiffFile(path string) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+}
+
+// Main runs the command line tool with the rules of the default registry. Programs that register their own rules call
+// it after registering them.
+func Main() {
+	log.Default().SetFlags(0)
+	cfg := NewCLIConfig()
+
+	if cfg.Since != "" {
+		changed, err := ChangedPackages(cfg.PackagePath, cfg.PackageName, cfg.Since)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(changed) == 0 {
+			log.Printf("no packages changed since %s", cfg.Since)
+			return
+		}
+		cfg.Packages = changed
+	}
+	switch cfg.Command {
+	case CommandExplain:
+		registerRuleFile(cfg.RulesFile)
+		log.Print(explain(cfg).Explain())
+		return
+	case CommandRollback:
+		restored, err := RollbackChanges(cfg.PackagePath, cfg.JournalDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%d files restored from %s", restored, cfg.JournalDir)
+		return
+	}
+
+	// the instrumentation adds modules to go.mod, so the working tree is checked before the application is instrumented
+	if cfg.Git {
+		if err := CheckCleanWorkingTree(cfg.PackagePath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	createDiffFile(cfg.DiffFile)
+
+	var manager *InstrumentationManager
+	switch cfg.Command {
+	case CommandRemove:
+		manager = remove(cfg)
+	default:
+		registerRuleFile(cfg.RulesFile)
+		manager = instrumentAndVerify(cfg)
+		if cfg.Review {
+			manager = review(cfg, manager)
+		}
+	}
+
+	manager.WriteDiff()
+	if cfg.Provenance == ProvenanceMap {
+		if err := manager.WriteProvenanceMap(cfg.DiffFile + provenanceMapSuffix); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("provenance written to %s", cfg.DiffFile+provenanceMapSuffix)
+	}
+	if cfg.ReportFile != "" {
+		if err := manager.WriteReport(cfg.ReportFile, cfg.ReportFormat); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("report written to %s", cfg.ReportFile)
+	}
+	// the diff, its provenance and the report are made from the original files, so they are changed last. The modules
+	// are added once the changes are final, so that go.mod only gets the modules of the changes that are made, and the
+	// changes that were dropped or rejected in the review add none
+	switch {
+	case cfg.Git:
+		commit(cfg, manager)
+	case cfg.Apply:
+		applied, err := manager.ApplyChanges(cfg.JournalDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("changes applied to %d files, the original files are backed up to %s", len(applied), cfg.JournalDir)
+	default:
+		if err := manager.AddRequiredModules(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// commit writes the changes in place on a new branch, and commits them with the modules they need. The original files
+// are kept by git, so they are not backed up to a journal.
+func commit(cfg *CLIConfig, manager *InstrumentationManager) {
+	if len(manager.changes) == 0 {
+		log.Println("no changes to commit")
+		return
+	}
+	if err := CreateBranch(cfg.PackagePath, cfg.Branch); err != nil {
+		log.Fatal(err)
+	}
+	applied, err := manager.ApplyChanges("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	modules, err := moduleFiles(cfg.PackagePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := CommitFiles(cfg.PackagePath, append(applied, modules...), manager.CommitMessage(applied)); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("changes to %d files committed to branch %s", len(applied), cfg.Branch)
+}
+
+// registerRuleFile adds the rules of a rule file to the default registry, if one is given.
+func registerRuleFile(filePath string) {
+	if filePath == "" {
+		return
+	}
+	rules, err := LoadRules(filePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, rule := range rules {
+		if err := RegisterRule(rule); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// instrumentAndVerify instruments the application, and verifies that the instrumented application compiles. If the
+// DropFailed option is set, the application is instrumented again without the changes that did not compile. It exits
+// if the application does not compile, so that a diff that does not compile is not written.
+func instrumentAndVerify(cfg *CLIConfig) *InstrumentationManager {
+	var manager *InstrumentationManager
+	var verificationErrors []*verificationError
+	dropped := map[string]bool{}
+	for attempt := 1; attempt <= maxVerificationAttempts; attempt++ {
+		manager = instrument(cfg, dropped, nil)
+		if !cfg.Verify {
+			break
+		}
+
+		verificationErrors = verify(cfg, manager)
+		failed := failedChanges(verificationErrors)
+		retry := false
+		for key := range failed {
+			if !dropped[key] {
+				dropped[key] = true
+				retry = true
+			}
+		}
+		if !cfg.DropFailed || !retry {
+			break
+		}
+		log.Printf("dropping %d changes that do not compile", len(failed))
+	}
+	if len(verificationErrors) > 0 {
+		if cfg.DropFailed {
+			log.Fatal("the instrumented application does not compile without the changes that were dropped")
+		}
+		log.Fatal("the instrumented application does not compile; run with -drop-failed to leave out the changes that do not compile")
+	}
+	return manager
+}
+
+// verify type checks the changed application, and logs the errors found.
+func verify(cfg *CLIConfig, manager *InstrumentationManager) []*verificationError {
+	verificationErrors, err := manager.VerifyPackages(cfg.Packages...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, verificationErr := range verificationErrors {
+		log.Println(verificationErr)
+	}
+	return verificationErrors
+}
+
+// loadPackages loads the packages of the application with the syntax and type information needed to change them.
+func loadPackages(cfg *CLIConfig) []*decorator.Package {
+	pkgs, err := decorator.Load(&packages.Config{Dir: cfg.PackagePath, Mode: loadMode}, cfg.Packages...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return pkgs
+}
+
+// review lets the user accept, reject or rename each change in the terminal, and verifies the changes they accepted.
+func review(cfg *CLIConfig, manager *InstrumentationManager) *InstrumentationManager {
+	reviewed, err := ReviewChanges(os.Stdin, os.Stdout, manager, func(dropped map[string]bool, names map[string]string) *InstrumentationManager {
+		return instrument(cfg, dropped, names)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Verify && reviewed != manager {
+		verify(cfg, reviewed)
+	}
+	return reviewed
+}
+
+// instrument loads and instruments the application, without making the dropped changes, and with the transactions and
+// segments of the renamed changes given their new names. The modules the changes import are not added to go.mod yet, since the
+// changes can still be dropped.
+func instrument(cfg *CLIConfig, dropped map[string]bool, names map[string]string) *InstrumentationManager {
+	manager := NewInstrumentationManager(loadPackages(cfg), cfg.AppName, cfg.AgentVariableName, cfg.DiffFile, cfg.PackagePath, cfg.Propagation, cfg.Target)
+	manager.DropChanges(dropped)
+	manager.RenameChanges(names)
+	err := manager.InstrumentPackages()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = manager.RunPlugins(cfg.Plugins)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Provenance == ProvenanceComments {
+		manager.AnnotateChanges()
+	}
+	return manager
+}
+
+// explain loads the application and applies the rules to it, recording the decisions made about the function the
+// explain command describes. Plugins are not run and the modules the changes import are not added to go.mod, so that
+// the application is left as it is; the changes are not verified, since they can not compile without those modules.
+func explain(cfg *CLIConfig) *InstrumentationManager {
+	manager := NewInstrumentationManager(loadPackages(cfg), cfg.AppName, cfg.AgentVariableName, cfg.DiffFile, cfg.PackagePath, cfg.Propagation, cfg.Target)
+	if err := manager.ExplainFunction(cfg.ExplainFunction); err != nil {
+		log.Fatal(err)
+	}
+	if err := manager.InstrumentPackages(); err != nil {
+		log.Fatal(err)
+	}
+	return manager
+}
+
+// remove loads the application and removes its New Relic instrumentation.
+func remove(cfg *CLIConfig) *InstrumentationManager {
+	manager := NewInstrumentationManager(loadPackages(cfg), cfg.AppName, cfg.AgentVariableName, cfg.DiffFile, cfg.PackagePath, cfg.Propagation, cfg.Target)
+	manager.RemoveInstrumentation()
+	if cfg.Verify && len(verify(cfg, manager)) > 0 {
+		log.Fatal("the application does not compile without its instrumentation")
+	}
+	return manager
+}
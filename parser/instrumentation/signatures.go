@@ -0,0 +1,309 @@
+package instrumentation
+
+import (
+	"go/ast"
+	"go/types"
+
+	"github.com/dave/dst"
+)
+
+const (
+	// tracedFunctionSuffix is added to the name of a function that is traced under a new name, because callers the tool
+	// can not see depend on its signature.
+	tracedFunctionSuffix = "WithTxn"
+)
+
+// findSignatureBoundFunctions finds the functions declared in the instrumented packages whose signature can not be changed
+// without breaking code the tool can not see, such as exported functions of library packages, methods that satisfy an
+// interface, and functions used as values. If one of them needs to be passed a transaction argument, it is traced under
+// a new name, and a wrapper with its original name and signature is added. Functions that can not be wrapped will not be traced.
+func findSignatureBoundFunctions(manager *InstrumentationManager) {
+	rootPkg := manager.currentPackage
+	defer manager.SetPackage(rootPkg)
+
+	values := functionsUsedAsValues(manager)
+	interfaces := interfacesInScope(manager)
+	for pkgName, state := range manager.packages {
+		manager.SetPackage(pkgName)
+		for _, fn := range state.tracedFuncs {
+			if fn.txnContext != nil || fn.body == nil || isHandler(fn.body, state.pkg) {
+				continue
+			}
+
+			obj := manager.declaredFunction(fn.body)
+			if obj == nil {
+				continue
+			}
+
+			// a transaction argument can not be added after a variadic argument
+			if obj.Type().(*types.Signature).Variadic() {
+				fn.untraceable = true
+				continue
+			}
+
+			if !isSignatureBound(obj, values, interfaces) {
+				continue
+			}
+
+			name := tracedFunctionName(obj)
+			if name == "" || !canWrapFunction(fn.body) {
+				fn.untraceable = true
+				continue
+			}
+			fn.tracedName = name
+		}
+	}
+}
+
+// isSignatureBound returns true if callers that the tool can not see may depend on the signature of fn.
+func isSignatureBound(fn *types.Func, values map[string]bool, interfaces []*types.Interface) bool {
+	if fn.Exported() && fn.Pkg().Name() != "main" {
+		return true
+	}
+	if values[fn.FullName()] {
+		return true
+	}
+
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		return false
+	}
+	recvType := recv.Type()
+	if ptr, ok := recvType.(*types.Pointer); ok {
+		recvType = ptr.Elem()
+	}
+	named, ok := recvType.(*types.Named)
+
+	for _, iface := range interfaces {
+		if !hasMethod(iface, fn.Name()) {
+			continue
+		}
+		// the interfaces implemented by generic types can not be checked, so assume they are
+		if !ok || named.TypeArgs().Len() > 0 || named.TypeParams().Len() > 0 {
+			return true
+		}
+		if types.Implements(named, iface) || types.Implements(types.NewPointer(named), iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMethod(iface *types.Interface, name string) bool {
+	for i := 0; i < iface.NumMethods(); i++ {
+		if iface.Method(i).Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// functionsUsedAsValues returns the IDs of all functions and methods that are referred to without being called, for
+// example when they are passed as callbacks.
+func functionsUsedAsValues(manager *InstrumentationManager) map[string]bool {
+	values := map[string]bool{}
+	for _, state := range manager.packages {
+		pkg := state.pkg
+		if pkg.TypesInfo == nil {
+			continue
+		}
+
+		for _, file := range pkg.Package.Syntax {
+			called := map[*ast.Ident]bool{}
+			ast.Inspect(file, func(n ast.Node) bool {
+				if call, ok := n.(*ast.CallExpr); ok {
+					if ident := calledIdent(call.Fun); ident != nil {
+						called[ident] = true
+					}
+				}
+				return true
+			})
+
+			ast.Inspect(file, func(n ast.Node) bool {
+				ident, ok := n.(*ast.Ident)
+				if !ok || called[ident] {
+					return true
+				}
+				if fn, ok := pkg.TypesInfo.Uses[ident].(*types.Func); ok {
+					values[fn.Origin().FullName()] = true
+				}
+				return true
+			})
+		}
+	}
+	return values
+}
+
+// calledIdent returns the identifier naming the function invoked by a call expression.
+func calledIdent(expr ast.Expr) *ast.Ident {
+	switch v := expr.(type) {
+	case *ast.Ident:
+		return v
+	case *ast.SelectorExpr:
+		return v.Sel
+	case *ast.ParenExpr:
+		return calledIdent(v.X)
+	case *ast.IndexExpr:
+		return calledIdent(v.X)
+	case *ast.IndexListExpr:
+		return calledIdent(v.X)
+	}
+	return nil
+}
+
+// interfacesInScope returns the interfaces with methods that types declared in the instrumented packages may be used as.
+// These are the interfaces declared in the instrumented packages and the packages they import, interface literals, and error.
+func interfacesInScope(manager *InstrumentationManager) []*types.Interface {
+	interfaces := []*types.Interface{types.Universe.Lookup("error").Type().Underlying().(*types.Interface)}
+	seen := map[*types.Package]bool{}
+
+	addInterface := func(t types.Type) {
+		iface, ok := t.Underlying().(*types.Interface)
+		if ok && iface.IsMethodSet() && iface.NumMethods() > 0 {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	addScope := func(pkg *types.Package) {
+		if pkg == nil || seen[pkg] {
+			return
+		}
+		seen[pkg] = true
+		scope := pkg.Scope()
+		for _, name := range scope.Names() {
+			obj, ok := scope.Lookup(name).(*types.TypeName)
+			if !ok {
+				continue
+			}
+			if named, ok := obj.Type().(*types.Named); ok && named.TypeParams().Len() > 0 {
+				continue
+			}
+			addInterface(obj.Type())
+		}
+	}
+
+	for _, state := range manager.packages {
+		pkg := state.pkg
+		if pkg.Types == nil || pkg.TypesInfo == nil {
+			continue
+		}
+		addScope(pkg.Types)
+		for _, imported := range pkg.Types.Imports() {
+			addScope(imported)
+		}
+		for expr, tv := range pkg.TypesInfo.Types {
+			if _, ok := expr.(*ast.InterfaceType); ok && tv.Type != nil {
+				addInterface(tv.Type)
+			}
+		}
+	}
+	return interfaces
+}
+
+// tracedFunctionName returns the name a signature bound function is traced under, or an empty string if that name is taken.
+func tracedFunctionName(fn *types.Func) string {
+	name := fn.Name() + tracedFunctionSuffix
+	recv := fn.Type().(*types.Signature).Recv()
+	if recv == nil {
+		if fn.Pkg().Scope().Lookup(name) != nil {
+			return ""
+		}
+		return name
+	}
+
+	if obj, _, _ := types.LookupFieldOrMethod(recv.Type(), true, fn.Pkg(), name); obj != nil {
+		return ""
+	}
+	return name
+}
+
+// canWrapFunction returns true if a wrapper that calls decl can be generated. All of its parameters and its receiver must be
+// named, and it must not be generic.
+func canWrapFunction(decl *dst.FuncDecl) bool {
+	if decl.Type.TypeParams != nil && len(decl.Type.TypeParams.List) > 0 {
+		return false
+	}
+
+	if decl.Recv != nil {
+		if len(decl.Recv.List) != 1 || len(decl.Recv.List[0].Names) != 1 || decl.Recv.List[0].Names[0].Name == "_" {
+			return false
+		}
+		recvType := decl.Recv.List[0].Type
+		if star, ok := recvType.(*dst.StarExpr); ok {
+			recvType = star.X
+		}
+		if _, ok := recvType.(*dst.Ident); !ok {
+			return false
+		}
+	}
+
+	if decl.Type.Params != nil {
+		for _, field := range decl.Type.Params.List {
+			if len(field.Names) == 0 {
+				return false
+			}
+			for _, name := range field.Names {
+				if name.Name == "_" {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// signaturePreservingWrapper creates a function with the name and signature of decl that calls the function it is traced
+// under, tracedName, without a transaction. The doc comment of decl is moved to the wrapper.
+func signaturePreservingWrapper(decl *dst.FuncDecl, tracedName string, backend InstrumentationBackend) *dst.FuncDecl {
+	args := []dst.Expr{}
+	if decl.Type.Params != nil {
+		for _, field := range decl.Type.Params.List {
+			for _, name := range field.Names {
+				args = append(args, dst.NewIdent(name.Name))
+			}
+		}
+	}
+	args = append(args, backend.NoTransaction())
+
+	var fun dst.Expr = dst.NewIdent(tracedName)
+	var recv *dst.FieldList
+	if decl.Recv != nil {
+		recv = dst.Clone(decl.Recv).(*dst.FieldList)
+		fun = &dst.SelectorExpr{
+			X:   dst.NewIdent(decl.Recv.List[0].Names[0].Name),
+			Sel: dst.NewIdent(tracedName),
+		}
+	}
+
+	call := &dst.CallExpr{
+		Fun:  fun,
+		Args: args,
+	}
+	var body dst.Stmt = &dst.ExprStmt{X: call}
+	if decl.Type.Results != nil && len(decl.Type.Results.List) > 0 {
+		body = &dst.ReturnStmt{Results: []dst.Expr{call}}
+	}
+	body.Decorations().Before = dst.NewLine
+	body.Decorations().After = dst.NewLine
+
+	wrapper := &dst.FuncDecl{
+		Recv: recv,
+		Name: dst.NewIdent(decl.Name.Name),
+		Type: dst.Clone(decl.Type).(*dst.FuncType),
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{body},
+		},
+		Decs: dst.FuncDeclDecorations{
+			NodeDecs: dst.NodeDecs{
+				Before: dst.EmptyLine,
+				Start:  decl.Decs.Start,
+				After:  dst.EmptyLine,
+			},
+		},
+	}
+
+	decl.Decs.Start = dst.Decorations{
+		"// " + tracedName + " is " + decl.Name.Name + ", traced with " + backend.TransactionDescription() + ".",
+		"// " + decl.Name.Name + " preserves its original signature for callers that are not passed a transaction.",
+	}
+	return wrapper
+}
@@ -0,0 +1,205 @@
+package instrumentation
+
+import (
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_findSignatureBoundFunctions(t *testing.T) {
+	code := `
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type loader interface {
+	Load(key string) (int, error)
+}
+
+type store struct{}
+
+func (s *store) Load(key string) (int, error) {
+	return strconv.Atoi(key)
+}
+
+func (s *store) String() string {
+	return "store"
+}
+
+func (s store) Error() string {
+	return "store"
+}
+
+func (s *store) Reset() {}
+
+func (store) Flush() {}
+
+func convert(s string) error {
+	_, err := strconv.Atoi(s)
+	return err
+}
+
+func convertWithTxn() {}
+
+func apply(f func(string) error) {
+	f("1")
+}
+
+func sum(nums ...int) int {
+	return len(nums)
+}
+
+func Exported() {}
+
+func run() {
+	var l loader = &store{}
+	l.Load("1")
+	apply(convert)
+	reset := (&store{}).Reset
+	reset()
+	fmt.Println(sum(1, 2), convert("2"))
+	Exported()
+}
+
+func main() {
+	run()
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	defer panicRecovery(t)
+	if err := tracePackageFunctionCalls(manager); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		id              string
+		wantTracedName  string
+		wantUntraceable bool
+	}{
+		{name: "interface_method", id: "(*" + testAppPackage + ".store).Load", wantTracedName: "LoadWithTxn"},
+		{name: "imported_interface_method", id: "(*" + testAppPackage + ".store).String", wantTracedName: "StringWithTxn"},
+		{name: "error_method", id: "(" + testAppPackage + ".store).Error", wantTracedName: "ErrorWithTxn"},
+		{name: "method_value", id: "(*" + testAppPackage + ".store).Reset", wantTracedName: "ResetWithTxn"},
+		{name: "unnamed_receiver", id: "(" + testAppPackage + ".store).Flush"},
+		{name: "name_taken", id: testAppPackage + ".convert", wantUntraceable: true},
+		{name: "variadic", id: testAppPackage + ".sum", wantUntraceable: true},
+		{name: "exported_main_package", id: testAppPackage + ".Exported"},
+		{name: "called_function", id: testAppPackage + ".apply"},
+		{name: "main", id: testAppPackage + ".main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn, ok := manager.packages[testAppPackage].tracedFuncs[tt.id]
+			if !ok {
+				t.Fatalf("function %s is not tracked", tt.id)
+			}
+			assert.Equal(t, tt.wantTracedName, fn.tracedName)
+			assert.Equal(t, tt.wantUntraceable, fn.untraceable)
+		})
+	}
+}
+
+func Test_canWrapFunction(t *testing.T) {
+	tests := []struct {
+		name string
+		decl *dst.FuncDecl
+		want bool
+	}{
+		{
+			name: "named_parameters",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{Params: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("a"), dst.NewIdent("b")}, Type: dst.NewIdent("int")}}}},
+			},
+			want: true,
+		},
+		{
+			name: "unnamed_parameter",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{Params: &dst.FieldList{List: []*dst.Field{{Type: dst.NewIdent("int")}}}},
+			},
+			want: false,
+		},
+		{
+			name: "blank_parameter",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{Params: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("_")}, Type: dst.NewIdent("int")}}}},
+			},
+			want: false,
+		},
+		{
+			name: "pointer_receiver",
+			decl: &dst.FuncDecl{
+				Recv: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("s")}, Type: &dst.StarExpr{X: dst.NewIdent("S")}}}},
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{Params: &dst.FieldList{}},
+			},
+			want: true,
+		},
+		{
+			name: "generic_receiver",
+			decl: &dst.FuncDecl{
+				Recv: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("s")}, Type: &dst.StarExpr{X: &dst.IndexExpr{X: dst.NewIdent("S"), Index: dst.NewIdent("T")}}}}},
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{Params: &dst.FieldList{}},
+			},
+			want: false,
+		},
+		{
+			name: "type_parameters",
+			decl: &dst.FuncDecl{
+				Name: dst.NewIdent("foo"),
+				Type: &dst.FuncType{
+					TypeParams: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("T")}, Type: dst.NewIdent("any")}}},
+					Params:     &dst.FieldList{},
+				},
+			},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, canWrapFunction(tt.decl))
+		})
+	}
+}
+
+func Test_signaturePreservingWrapper(t *testing.T) {
+	decl := &dst.FuncDecl{
+		Recv: &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("s")}, Type: &dst.StarExpr{X: dst.NewIdent("S")}}}},
+		Name: dst.NewIdent("Load"),
+		Type: &dst.FuncType{
+			Params:  &dst.FieldList{List: []*dst.Field{{Names: []*dst.Ident{dst.NewIdent("a"), dst.NewIdent("b")}, Type: dst.NewIdent("int")}}},
+			Results: &dst.FieldList{List: []*dst.Field{{Type: dst.NewIdent("error")}}},
+		},
+		Body: &dst.BlockStmt{},
+		Decs: dst.FuncDeclDecorations{NodeDecs: dst.NodeDecs{Start: dst.Decorations{"// Load loads a and b."}}},
+	}
+
+	wrapper := signaturePreservingWrapper(decl, "LoadWithTxn", newRelicBackend{})
+	assert.Equal(t, "Load", wrapper.Name.Name)
+	assert.Equal(t, dst.Decorations{"// Load loads a and b."}, wrapper.Decs.Start)
+	assert.NotEqual(t, dst.Decorations{"// Load loads a and b."}, decl.Decs.Start)
+
+	ret, ok := wrapper.Body.List[0].(*dst.ReturnStmt)
+	if !ok {
+		t.Fatal("wrapper of a function with results must return them")
+	}
+	call := ret.Results[0].(*dst.CallExpr)
+	sel := call.Fun.(*dst.SelectorExpr)
+	assert.Equal(t, "s", sel.X.(*dst.Ident).Name)
+	assert.Equal(t, "LoadWithTxn", sel.Sel.Name)
+
+	args := []string{}
+	for _, arg := range call.Args {
+		args = append(args, arg.(*dst.Ident).Name)
+	}
+	assert.Equal(t, []string{"a", "b", "nil"}, args)
+}
@@ -0,0 +1,145 @@
+// Test Utils contains tools and building blocks that can be generically used for unit tests
+
+package instrumentation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst/decorator"
+	"golang.org/x/tools/go/packages"
+)
+
+// testAppPackage is the import path of the test applications created by createTestAppPackage.
+const testAppPackage = "github.com/newrelic/go-easy-instrumentation/parser/instrumentation/tmp"
+
+func createTestAppPackage(testAppDir, fileName, contents string) ([]*decorator.Package, error) {
+	err := os.Mkdir(testAppDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	filepath := filepath.Join(testAppDir, fileName)
+
+	f, err := os.Create(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = f.WriteString(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	return decorator.Load(&packages.Config{Dir: testAppDir, Mode: loadMode})
+}
+
+func cleanupTestApp(t *testing.T, appDirectoryName string) {
+	err := os.RemoveAll(appDirectoryName)
+	if err != nil {
+		t.Logf("Failed to cleanup test app directory %s: %v", appDirectoryName, err)
+	}
+}
+
+func panicRecovery(t *testing.T) {
+	err := recover()
+	if err != nil {
+		t.Fatalf("%s recovered from panic: %+v\n\n%s", t.Name(), err, debug.Stack())
+	}
+}
+
+func newTestingInstrumentationManager(t *testing.T, code string) *InstrumentationManager {
+	defer panicRecovery(t)
+
+	testAppDir := "tmp"
+	fileName := "app.go"
+	pkgs, err := createTestAppPackage(testAppDir, fileName, code)
+	defer cleanupTestApp(t, testAppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appName := defaultAppName
+	varName := defaultAgentVariableName
+	diffFile := filepath.Join(testAppDir, defaultDiffFileName)
+
+	manager := NewInstrumentationManager(pkgs, appName, varName, diffFile, testAppDir, defaultPropagation, defaultTarget)
+	manager.SetPackage(testAppPackage)
+	return manager
+}
+
+// newTypedTestingInstrumentationManager creates a manager for code that is type checked against a stub of the package
+// it imports from importPath. The stub replaces that package in the module of the test application, so that the
+// application is loaded with the type information the tool gets for a real one, without the network.
+func newTypedTestingInstrumentationManager(t *testing.T, code, importPath, stub string) *InstrumentationManager {
+	defer panicRecovery(t)
+
+	// the version of a module with a major version suffix in its path must be of that major version
+	version := "v0.0.0"
+	if i := strings.LastIndex(importPath, "/v"); i >= 0 {
+		if _, err := strconv.Atoi(importPath[i+2:]); err == nil {
+			version = importPath[i+1:] + ".0.0"
+		}
+	}
+
+	testAppDir := t.TempDir()
+	files := map[string]string{
+		"go.mod":       fmt.Sprintf("module %s\n\ngo 1.22\n\nrequire %s %s\n\nreplace %s => ./stub\n", testAppPackage, importPath, version, importPath),
+		"app.go":       code,
+		"stub/go.mod":  fmt.Sprintf("module %s\n\ngo 1.22\n", importPath),
+		"stub/stub.go": stub,
+	}
+	for name, contents := range files {
+		path := filepath.Join(testAppDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &packages.Config{
+		Dir:  testAppDir,
+		Mode: loadMode,
+		Env:  append(os.Environ(), "GOFLAGS=-mod=mod", "GOPROXY=off"),
+	}
+	pkgs, err := decorator.Load(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		if len(pkg.Errors) > 0 {
+			t.Fatalf("the test application does not type check: %v", pkg.Errors)
+		}
+	}
+
+	diffFile := filepath.Join(testAppDir, defaultDiffFileName)
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, diffFile, testAppDir, defaultPropagation, defaultTarget)
+	manager.SetPackage(testAppPackage)
+	return manager
+}
+
+// moduleRequest is a call made to getModules.
+type moduleRequest struct {
+	dir     string
+	modFile string
+	imports []string
+}
+
+// stubGetModules records the modules the manager resolves instead of running go get, so that tests neither need the
+// network nor change go.mod, and restores go get when the test ends.
+func stubGetModules(t *testing.T) *[]moduleRequest {
+	requests := &[]moduleRequest{}
+	original := getModules
+	getModules = func(dir, modFile string, imports []string) error {
+		*requests = append(*requests, moduleRequest{dir: dir, modFile: modFile, imports: imports})
+		return nil
+	}
+	t.Cleanup(func() { getModules = original })
+	return requests
+}
@@ -0,0 +1,255 @@
+package instrumentation
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst/decorator"
+	"github.com/dave/dst/decorator/resolver/gopackages"
+	"golang.org/x/tools/go/packages"
+)
+
+const (
+	// maxVerificationAttempts is the number of times an application is instrumented again after dropping the changes
+	// that did not compile.
+	maxVerificationAttempts = 5
+)
+
+// verificationError is an error reported when type checking the instrumented application.
+type verificationError struct {
+	pos    string // position of the error in the instrumented file
+	msg    string
+	change *change // change that caused the error, nil if it could not be determined
+}
+
+func (e *verificationError) Error() string {
+	if e.change == nil {
+		return fmt.Sprintf("%s: %s", e.pos, e.msg)
+	}
+	return fmt.Sprintf("%s: %s (caused by the %q instrumentation of %s)", e.pos, e.msg, e.change.rule, e.change.pos)
+}
+
+// lineRange is a range of lines in a file that were generated for a change.
+type lineRange struct {
+	start, end int
+	change     *change
+}
+
+// restoreFiles returns the instrumented contents of all files in the instrumented packages by their path, along with
+// the lines in them that each recorded change generated.
+func (m *InstrumentationManager) restoreFiles() (map[string][]byte, map[string][]lineRange, error) {
+	contents := map[string][]byte{}
+	ranges := map[string][]lineRange{}
+	for _, state := range m.packages {
+		for _, file := range state.pkg.Syntax {
+			path := state.pkg.Decorator.Filenames[file]
+
+			// use a restorer for each file, so that only the nodes in this file are mapped
+			r := m.fileRestorer(decorator.NewRestorerWithImports(state.pkg.Dir, gopackages.New(state.pkg.Dir)), file)
+			restored, err := r.RestoreFile(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			buf := bytes.NewBuffer([]byte{})
+			if err := format.Node(buf, r.Fset, restored); err != nil {
+				return nil, nil, err
+			}
+			contents[path] = buf.Bytes()
+
+			// the positions of the restored nodes do not match the formatted output, so the lines of each node are
+			// found by parsing the output, and matching its nodes to the restored ones by the order they are visited in
+			fset := token.NewFileSet()
+			parsed, err := parser.ParseFile(fset, path, buf.Bytes(), 0)
+			if err != nil {
+				return nil, nil, err
+			}
+			restoredNodes := map[ast.Node]int{}
+			for i, node := range syntaxNodes(restored) {
+				restoredNodes[node] = i
+			}
+			parsedNodes := syntaxNodes(parsed)
+
+			for _, c := range m.changes {
+				for _, node := range c.nodes {
+					astNode, ok := r.Ast.Nodes[node]
+					if !ok || astNode == nil {
+						continue
+					}
+					i, ok := restoredNodes[astNode]
+					if !ok || i >= len(parsedNodes) {
+						continue
+					}
+					ranges[path] = append(ranges[path], lineRange{
+						start:  fset.Position(parsedNodes[i].Pos()).Line,
+						end:    fset.Position(parsedNodes[i].End()).Line,
+						change: c,
+					})
+				}
+			}
+		}
+	}
+	return contents, ranges, nil
+}
+
+// syntaxNodes returns the nodes of a file in the order they are visited, leaving out comments.
+func syntaxNodes(file *ast.File) []ast.Node {
+	nodes := []ast.Node{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n.(type) {
+		case nil, *ast.CommentGroup, *ast.Comment:
+			return false
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+	return nodes
+}
+
+// VerifyPackages type checks the instrumented application without writing it to disk, by loading the packages matching
+// the patterns with the instrumented files as an overlay, and the modules the changes import added to a scratch copy
+// of go.mod. The type errors found are returned, along with the change that caused each one when it can be determined.
+func (m *InstrumentationManager) VerifyPackages(patterns ...string) ([]*verificationError, error) {
+	overlay, ranges, err := m.restoreFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	modFile, cleanup, err := m.scratchModFile()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	cfg := &packages.Config{Dir: m.userAppPath, Mode: loadMode, Overlay: overlay}
+	if modFile != "" {
+		// the scratch go.mod has every module the changes import, so loading the packages does not resolve any, even
+		// when the application vendors its modules
+		cfg.BuildFlags = []string{"-modfile=" + modFile, "-mod=mod"}
+		cfg.Env = append(os.Environ(), "GOPROXY=off")
+	}
+
+	pkgs, err := packages.Load(cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	verificationErrors := []*verificationError{}
+	for _, pkg := range pkgs {
+		typeErrors := false
+		for _, pkgErr := range pkg.Errors {
+			typeErrors = typeErrors || pkgErr.Kind == packages.TypeError
+		}
+		for _, pkgErr := range pkg.Errors {
+			// the go command reports the same type errors as the type checker, but with positions in the overlay files
+			if typeErrors && pkgErr.Kind == packages.ListError {
+				continue
+			}
+			verificationErrors = append(verificationErrors, &verificationError{
+				pos:    pkgErr.Pos,
+				msg:    pkgErr.Msg,
+				change: changeAtPosition(pkgErr.Pos, ranges),
+			})
+		}
+	}
+	return verificationErrors, nil
+}
+
+// scratchModFile copies the go.mod and go.sum of the application to a temporary directory, and adds the modules the
+// changes import to the copies, so that the changes can be type checked without changing the application. It returns
+// the path of the copy of go.mod, empty if the changes import nothing or the application is not in a module, and a
+// function that removes the copies.
+func (m *InstrumentationManager) scratchModFile() (string, func(), error) {
+	cleanup := func() {}
+	modules := m.requiredModules()
+	if len(modules) == 0 {
+		return "", cleanup, nil
+	}
+	files, err := moduleFiles(m.userAppPath)
+	if err != nil || len(files) == 0 {
+		return "", cleanup, err
+	}
+
+	dir, err := os.MkdirTemp("", "go-easy-instrumentation-")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, filepath.Base(file)), contents, 0644)
+		}
+		if err != nil {
+			cleanup()
+			return "", func() {}, err
+		}
+	}
+	modFile := filepath.Join(dir, "go.mod")
+	if err := getModules(m.userAppPath, modFile, modules); err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return modFile, cleanup, nil
+}
+
+// changeAtPosition returns the change that generated the line at pos, a position formatted as "file:line:column".
+// If more than one change generated that line, the one that generated the fewest lines is returned.
+func changeAtPosition(pos string, ranges map[string][]lineRange) *change {
+	path, line, ok := parsePosition(pos)
+	if !ok {
+		return nil
+	}
+
+	var found *lineRange
+	for i, r := range ranges[path] {
+		if line < r.start || line > r.end {
+			continue
+		}
+		if found == nil || r.end-r.start < found.end-found.start {
+			found = &ranges[path][i]
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	return found.change
+}
+
+// parsePosition parses the file and line of a position formatted as "file:line" or "file:line:column".
+func parsePosition(pos string) (string, int, bool) {
+	parts := strings.Split(pos, ":")
+	if len(parts) >= 3 {
+		_, colErr := strconv.Atoi(parts[len(parts)-1])
+		_, lineErr := strconv.Atoi(parts[len(parts)-2])
+		if colErr == nil && lineErr == nil {
+			parts = parts[:len(parts)-1]
+		}
+	}
+	if len(parts) < 2 {
+		return "", 0, false
+	}
+
+	line, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.Join(parts[:len(parts)-1], ":"), line, true
+}
+
+// failedChanges returns the keys of the changes that caused verification errors.
+func failedChanges(verificationErrors []*verificationError) map[string]bool {
+	keys := map[string]bool{}
+	for _, e := range verificationErrors {
+		if e.change != nil {
+			keys[e.change.key()] = true
+		}
+	}
+	return keys
+}
@@ -0,0 +1,169 @@
+package instrumentation
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parsePosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		pos      string
+		wantPath string
+		wantLine int
+		wantOk   bool
+	}{
+		{name: "line and column", pos: "/app/main.go:12:3", wantPath: "/app/main.go", wantLine: 12, wantOk: true},
+		{name: "line", pos: "/app/main.go:12", wantPath: "/app/main.go", wantLine: 12, wantOk: true},
+		{name: "windows path", pos: "C:/app/main.go:7:1", wantPath: "C:/app/main.go", wantLine: 7, wantOk: true},
+		{name: "no position", pos: "-", wantOk: false},
+		{name: "empty", pos: "", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, line, ok := parsePosition(tt.pos)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.wantPath, path)
+			assert.Equal(t, tt.wantLine, line)
+		})
+	}
+}
+
+func Test_changeAtPosition(t *testing.T) {
+	outer := &change{rule: ruleTraceFunction}
+	inner := &change{rule: ruleExternalSegment}
+	ranges := map[string][]lineRange{
+		"/app/main.go": {
+			{start: 10, end: 20, change: outer},
+			{start: 12, end: 12, change: inner},
+		},
+	}
+
+	tests := []struct {
+		name string
+		pos  string
+		want *change
+	}{
+		{name: "smallest range wins", pos: "/app/main.go:12:5", want: inner},
+		{name: "enclosing range", pos: "/app/main.go:15:1", want: outer},
+		{name: "outside of ranges", pos: "/app/main.go:30:1", want: nil},
+		{name: "other file", pos: "/app/other.go:12:1", want: nil},
+		{name: "unparseable position", pos: "-", want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, changeAtPosition(tt.pos, ranges))
+		})
+	}
+}
+
+func Test_failedChanges(t *testing.T) {
+	c := &change{rule: ruleWrapHandler}
+	errs := []*verificationError{
+		{pos: "main.go:1:1", msg: "caused by a change", change: c},
+		{pos: "main.go:2:1", msg: "not caused by a change"},
+	}
+	assert.Equal(t, map[string]bool{c.key(): true}, failedChanges(errs))
+}
+
+func Test_ChangeDropped(t *testing.T) {
+	defer panicRecovery(t)
+	code := `package main
+
+func main() {
+	println("hello")
+}
+`
+	manager := newTestingInstrumentationManager(t, code)
+	decl := manager.GetDecoratorPackage().Syntax[0].Decls[0].(*dst.FuncDecl)
+
+	manager.RecordChange(ruleAgent, decl, decl.Body.List[0])
+	if assert.Len(t, manager.changes, 1) {
+		assert.Equal(t, 3, manager.changes[0].pos.Line)
+		assert.False(t, manager.ChangeDropped(ruleAgent, decl))
+
+		manager.DropChanges(map[string]bool{manager.changes[0].key(): true})
+		assert.True(t, manager.ChangeDropped(ruleAgent, decl))
+		assert.False(t, manager.ChangeDropped(ruleTransaction, decl), "changes of other rules should not be dropped")
+		assert.False(t, manager.ChangeDropped(ruleAgent, decl.Body.List[0]), "changes at other positions should not be dropped")
+	}
+}
+
+func Test_VerifyPackages(t *testing.T) {
+	defer panicRecovery(t)
+	stubGetModules(t)
+	code := `package main
+
+func main() {
+	println("hello")
+}
+`
+	testAppDir := "tmp"
+	pkgs, err := createTestAppPackage(testAppDir, "app.go", code)
+	defer cleanupTestApp(t, testAppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+	manager.SetPackage(testAppPackage)
+
+	verificationErrors, err := manager.VerifyPackages(defaultPackageName)
+	assert.NoError(t, err)
+	assert.Empty(t, verificationErrors, "the application should compile before it is changed")
+
+	// inject a statement that does not compile
+	decl := manager.GetDecoratorPackage().Syntax[0].Decls[0].(*dst.FuncDecl)
+	broken := &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: dst.NewIdent("undefinedFunction"),
+		},
+	}
+	decl.Body.List = append([]dst.Stmt{broken}, decl.Body.List...)
+	manager.RecordChange(ruleTransaction, decl.Body.List[1], broken)
+
+	verificationErrors, err = manager.VerifyPackages(defaultPackageName)
+	assert.NoError(t, err)
+	if assert.Len(t, verificationErrors, 1) {
+		verificationErr := verificationErrors[0]
+		assert.Contains(t, verificationErr.msg, "undefinedFunction")
+		if assert.NotNil(t, verificationErr.change, "the error should be mapped to the change that caused it") {
+			assert.Equal(t, ruleTransaction, verificationErr.change.rule)
+			assert.Equal(t, 4, verificationErr.change.pos.Line)
+		}
+	}
+}
+
+func Test_VerifyPackages_modules(t *testing.T) {
+	defer panicRecovery(t)
+	requests := stubGetModules(t)
+	code := `package main
+
+func main() {
+	println("hello")
+}
+`
+	testAppDir := "tmp"
+	pkgs, err := createTestAppPackage(testAppDir, "app.go", code)
+	defer cleanupTestApp(t, testAppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewInstrumentationManager(pkgs, defaultAppName, defaultAgentVariableName, filepath.Join(testAppDir, defaultDiffFileName), testAppDir, defaultPropagation, defaultTarget)
+	manager.SetPackage(testAppPackage)
+	manager.AddImport(newrelicAgentImport)
+
+	_, err = manager.VerifyPackages(defaultPackageName)
+	assert.NoError(t, err)
+	if assert.Len(t, *requests, 1) {
+		request := (*requests)[0]
+		assert.Equal(t, []string{newrelicAgentImport}, request.imports)
+		assert.True(t, strings.HasPrefix(request.modFile, os.TempDir()), "the modules should be added to a copy of go.mod, not to the go.mod of the application")
+		_, err := os.Stat(request.modFile)
+		assert.True(t, os.IsNotExist(err), "the copy of go.mod should be removed")
+	}
+}